@@ -189,6 +189,39 @@ app.post('/register', async function(req, res) {
 });
 
 
+// Register a manager, clerk, supplier or admin; the caller must be the CA registrar or an admin
+app.post('/staff', async function(req, res) {
+	var username = req.body.username;
+	var password = req.body.password;
+	var role = req.body.role;
+	logger.debug('End point : /staff');
+	logger.debug('User name : ' + username);
+	logger.debug('Role      : ' + role);
+	if (!username) {
+		res.json(getErrorMessage('\'username\''));
+		return;
+	}
+	if (!password) {
+		res.json(getErrorMessage('\'password\''));
+		return;
+	}
+	if (!role || role === 'customer') {
+		res.json(getErrorMessage('\'role\''));
+		return;
+	}
+	let response = await helper.registerStaff(req.username, username, req.orgname, password, {
+		role: role,
+		storeID: req.body.storeID,
+		supplierID: req.body.supplierID
+	});
+	if (response && typeof response !== 'string') {
+		res.json(response);
+	} else {
+		res.json({success: false, message: response});
+	}
+});
+
+
 // Create Channel
 app.post('/channels', async function(req, res) {
 	logger.info('<<<<<<<<<<<<<<<<< C R E A T E  C H A N N E L >>>>>>>>>>>>>>>>>');
@@ -304,7 +337,7 @@ app.post('/channels/:channelName/chaincodes', async function(req, res) {
 		return;
 	}
 
-	let message = await instantiate.instantiateChaincode(peers, channelName, chaincodeName, chaincodeVersion, chaincodeType, fcn, args, req.username, req.orgname);
+	let message = await instantiate.instantiateChaincode(peers, channelName, chaincodeName, chaincodeVersion, chaincodeType, fcn, args, req.body.collectionsConfig, req.username, req.orgname);
 	res.send(message);
 });
 // Invoke transaction on chaincode on target peers
@@ -336,7 +369,7 @@ app.post('/channels/:channelName/chaincodes/:chaincodeName', async function(req,
 		return;
 	}
 
-	let message = await invoke.invokeChaincode(peers, channelName, chaincodeName, fcn, args, req.username, req.orgname);
+	let message = await invoke.invokeChaincode(peers, channelName, chaincodeName, fcn, args, req.body.transient, req.username, req.orgname);
 	res.send(message);
 });
 // Query on chaincode on target peers
@@ -30,6 +30,32 @@ var clients = {};
 var channels = {};
 var caClients = {};
 
+// Certificate attributes read by the chaincodes (common/authz): role, plus storeID
+// for managers and clerks and supplierID for suppliers. Self-registered users are customers.
+var ROLES = ['admin', 'manager', 'clerk', 'customer', 'supplier'];
+
+var roleAttrs = function(attrs) {
+	attrs = attrs || {};
+	var role = attrs.role || 'customer';
+	if (ROLES.indexOf(role) < 0) {
+		throw new Error('unknown role ' + role);
+	}
+	if ((role === 'manager' || role === 'clerk') && !attrs.storeID) {
+		throw new Error('a ' + role + ' needs a storeID');
+	}
+	if (role === 'supplier' && !attrs.supplierID) {
+		throw new Error('a supplier needs a supplierID');
+	}
+	var list = [{name: 'role', value: role, ecert: true}];
+	if (attrs.storeID) {
+		list.push({name: 'storeID', value: attrs.storeID, ecert: true});
+	}
+	if (attrs.supplierID) {
+		list.push({name: 'supplierID', value: attrs.supplierID, ecert: true});
+	}
+	return list;
+};
+
 var sleep = async function (sleep_time_ms) {
 	return new Promise(resolve => setTimeout(resolve, sleep_time_ms));
 }
@@ -71,7 +97,7 @@ async function getClientForOrg (userorg, username) {
 	return client;
 }
 
-var getRegisteredUser = async function(username, userOrg, password, isJson) {
+var getRegisteredUser = async function(username, userOrg, password, isJson, attrs) {
 	try {
 		var client = await getClientForOrg(userOrg);
 		logger.debug('Successfully initialized the credential stores');
@@ -91,7 +117,7 @@ var getRegisteredUser = async function(username, userOrg, password, isJson) {
 				enrollmentID: username,
 				affiliation: userOrg.toLowerCase() + '.department1',
 				enrollmentSecret: password,
-                attrs:[{name:"type",value:"user",ecert:true}]
+				attrs: roleAttrs(attrs)
 			}, adminUserObj);
 			logger.debug('Successfully got the secret for user %s',username);
 			user = await client.setUserContext({username:username, password:secret});
@@ -198,11 +224,11 @@ var changeRegisteredUser = async function(username, userOrg, password, isJson) {
             let adminUserObj = await client.setUserContext({username: admins[0].username, password: admins[0].secret});
             let caClient = client.getCertificateAuthority();
             let identityService=caClient.newIdentityService();
+            // only the secret changes; the role attributes stay as registered
             let secret = await identityService.update(username,{
                 enrollmentID: username,
                 affiliation: userOrg.toLowerCase() + '.department1',
-                enrollmentSecret: password,
-                attrs:[{name:"type",value:"user2",ecert:true}]
+                enrollmentSecret: password
             }, adminUserObj);
             logger.debug('Successfully got the secret for user %s',username);
             user = await client.setUserContext({username:username, password:secret});
@@ -220,7 +246,7 @@ var changeRegisteredUser = async function(username, userOrg, password, isJson) {
                 enrollmentID: username,
                 affiliation: userOrg.toLowerCase() + '.department1',
                 enrollmentSecret: password,
-                attrs:[{name:"type",value:"user",ecert:true}]
+                attrs: roleAttrs()
             }, adminUserObj);
             logger.debug('Successfully got the secret for user %s',username);
             user = await client.setUserContext({username:username, password:secret});
@@ -248,6 +274,40 @@ var changeRegisteredUser = async function(username, userOrg, password, isJson) {
 };
 
 
+// Register a staff member or supplier with role/storeID/supplierID attributes.
+// Only the CA registrar from config.json (to create the first admin) or a user registered
+// with role=admin may do this.
+var registerStaff = async function(registrar, username, userOrg, password, attrs) {
+	try {
+		var client = await getClientForOrg(userOrg);
+		var admins = hfc.getConfigSetting('admins');
+		let adminUserObj = await client.setUserContext({username: admins[0].username, password: admins[0].secret});
+		let caClient = client.getCertificateAuthority();
+		if (registrar !== admins[0].username) {
+			let identity = await caClient.newIdentityService().getOne(registrar, adminUserObj);
+			let registrarAttrs = (identity && identity.result && identity.result.attrs) || [];
+			let isAdmin = registrarAttrs.some(function(a) { return a.name === 'role' && a.value === 'admin'; });
+			if (!isAdmin) {
+				throw new Error(registrar + ' is not an admin');
+			}
+		}
+		await caClient.register({
+			enrollmentID: username,
+			affiliation: userOrg.toLowerCase() + '.department1',
+			enrollmentSecret: password,
+			attrs: roleAttrs(attrs)
+		}, adminUserObj);
+		logger.debug('Successfully registered %s with role %s', username, attrs.role);
+		return {
+			success: true,
+			message: username + ' registered as ' + attrs.role,
+		};
+	} catch(error) {
+		logger.error('Failed to register staff %s with error: %s', username, error.toString());
+		return 'failed '+error.toString();
+	}
+};
+
 var setupChaincodeDeploy = function() {
 	process.env.GOPATH = path.join(__dirname, hfc.getConfigSetting('CC_SRC_PATH'));
 };
@@ -264,3 +324,4 @@ exports.setupChaincodeDeploy = setupChaincodeDeploy;
 exports.getRegisteredUser = getRegisteredUser;
 exports.loginUser = loginUser;
 exports.changeRegisteredUser = changeRegisteredUser;
+exports.registerStaff = registerStaff;
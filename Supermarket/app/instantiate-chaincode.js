@@ -21,7 +21,7 @@ var hfc = require('fabric-client');
 var helper = require('./helper.js');
 var logger = helper.getLogger('instantiate-chaincode');
 
-var instantiateChaincode = async function(peers, channelName, chaincodeName, chaincodeVersion, functionName, chaincodeType, args, username, org_name) {
+var instantiateChaincode = async function(peers, channelName, chaincodeName, chaincodeVersion, functionName, chaincodeType, args, collectionsConfig, username, org_name) {
 	logger.debug('\n\n============ Instantiate chaincode on channel ' + channelName +
 		' ============\n');
 	var error_message = null;
@@ -55,6 +55,9 @@ var instantiateChaincode = async function(peers, channelName, chaincodeName, cha
 
 		if (functionName)
 			request.fcn = functionName;
+		// private data collections, e.g. artifacts/src/github.com/users/collections_config.json
+		if (collectionsConfig)
+			request['collections-config'] = collectionsConfig;
 
 		let results = await channel.sendInstantiateProposal(request, 60000); //instantiate takes much longer
 
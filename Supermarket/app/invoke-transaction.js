@@ -17,11 +17,12 @@
 var path = require('path');
 var fs = require('fs');
 var util = require('util');
+var crypto = require('crypto');
 var hfc = require('fabric-client');
 var helper = require('./helper.js');
 var logger = helper.getLogger('invoke-chaincode');
 
-var invokeChaincode = async function(peerNames, channelName, chaincodeName, fcn, args, username, org_name) {
+var invokeChaincode = async function(peerNames, channelName, chaincodeName, fcn, args, transient, username, org_name) {
 	logger.debug(util.format('\n============ invoke transaction on channel %s ============\n', channelName));
 	var error_message = null;
 	var tx_id_string = null;
@@ -48,6 +49,21 @@ var invokeChaincode = async function(peerNames, channelName, chaincodeName, fcn,
 			chainId: channelName,
 			txId: tx_id
 		};
+		// secrets such as passwords go through the transient map so that
+		// they are never written into the transaction or the block
+		if (transient) {
+			request.transientMap = {};
+			for (let key in transient) {
+				request.transientMap[key] = Buffer.from(String(transient[key]));
+			}
+		}
+		// a random salt for password hashes; every endorser gets the same one,
+		// so their write sets match, and it never reaches the ledger
+		let needsSalt = (transient && transient.password) || fcn === 'migratePasswords';
+		if (needsSalt && !(transient && transient.salt)) {
+			request.transientMap = request.transientMap || {};
+			request.transientMap.salt = Buffer.from(crypto.randomBytes(16).toString('hex'));
+		}
 
 		let results = await channel.sendTransactionProposal(request);
 
@@ -9,29 +9,46 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/common/authz"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/events"
+	"github.com/common/history"
+	"github.com/common/ledger"
+	"github.com/common/schema"
+	"github.com/common/shelflife"
+	"github.com/common/txtime"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"strconv"
-	"time"
 )
 
 var logger = shim.NewLogger("Category")
 
 // 每类商品 category struct
 type Record struct {
-	ID        string `json:ID`   // ID
-	Name      string `json:Name` // full name
-	StoreID   string `json:StoreID`
-	StoreName string `json:StoreName`
-	BarCode   string `json:BarCode`   //
-	MeaUnit   string `json:MeaUnit`   // MeasurementUnit
-	UnitPrice string `json:UnitPrice` // unit-price
-	ShelfLife string `json:ShelfLife` // Quality guarantee period; shelf-life
-	Stock	  string `json:Stock`     //Stock remains
-	//Supplier  string		 	`json:Supplier`
-	//Place     string        	`json:Place`     	// place of production
-	CreateTime string        `json:CreateTime` // 创建时间
-	History    []HistoryItem `json:History`    //
+	ID        string          `json:"ID"`   // ID
+	Name      string          `json:"Name"` // full name
+	StoreID   string          `json:"StoreID"`
+	StoreName string          `json:"StoreName"` // 查询时从StoreChaincode取得, 不再保存
+	BarCode   string          `json:"BarCode"`   //
+	MeaUnit   string          `json:"MeaUnit"`   // MeasurementUnit
+	UnitPrice decimal.Decimal `json:"UnitPrice"` // unit-price, 精确到分
+	ShelfLife string          `json:"ShelfLife"` // Quality guarantee period; shelf-life, ISO-8601, 例如 P30D、P18M
+	Stock     decimal.Decimal `json:"Stock"`     //Stock remains, 存储的是已合并的库存, 查询时加上未合并的流水
+	//Supplier  string		 	`json:"Supplier"`
+	//Place     string        	`json:"Place"`     	// place of production
+	CreateTime string        `json:"CreateTime"` // 创建时间
+	History    []HistoryItem `json:"History"`    //
+	Version    int64         `json:"Version"`    // 版本, 每次写入加一, 见change
+}
+
+// 结账计价用的价格, 见getPrice
+type Price struct {
+	ID        string          `json:"ID"`
+	Name      string          `json:"Name"`
+	StoreID   string          `json:"StoreID"`
+	UnitPrice decimal.Decimal `json:"UnitPrice"`
 }
 
 // 历史item结构
@@ -42,16 +59,36 @@ type HistoryItem struct {
 
 // 前缀
 const Record_Prefix = "Cate_"
-const Stock_Prefix = "Stock_"
 
 // composite keys
 const IndexName = "storeID~CateID"
 const CommIndexName = "storeID~CommID"
 
-// chaincode response结构
-type chaincodeRet struct {
-	Code int    // 0 success otherwise 1
-	Des  string //description
+// 权限矩阵; 写操作还要检查提交者能否操作该店铺
+var permissions = authz.Matrix{
+	"insert":               authz.Managers,
+	"queryByID":            authz.Everyone,
+	"queryHistory":         authz.Everyone,
+	"query":                authz.Everyone,
+	"queryByStore":         authz.Everyone,
+	"search":               authz.Everyone,
+	"change":               authz.Managers,
+	"delete":               authz.Managers,
+	"insertStock":          authz.Managers,
+	"changeStock":          authz.Staff,
+	"moveStock":            authz.Staff,
+	"getStock":             authz.Everyone,
+	"getShelfLife":         authz.Everyone,
+	"getPrice":             authz.Everyone,
+	"queryStockEntries":    authz.Staff,
+	"compactStock":         authz.Managers,
+	"migrate":              {authz.Admin},
+	"querySchema":          authz.Everyone,
+	"exists":               authz.Everyone,
+	"queryDeleted":         authz.Managers,
+	"setDeletePolicy":      {authz.Admin},
+	"setIdempotencyWindow": {authz.Admin},
+	"purgeIdempotencyKeys": {authz.Admin},
 }
 
 // 根据ID取出记录
@@ -68,9 +105,9 @@ func (a *CategoryChaincode) getRecord(stub shim.ChaincodeStubInterface, key stri
 	return record, true
 }
 
-// 保存记录
+// 保存记录, 版本加一
 func (a *CategoryChaincode) putRecord(stub shim.ChaincodeStubInterface, key string, record Record) ([]byte, bool) {
-
+	record.Version++
 	byte, err := json.Marshal(record)
 	if err != nil {
 		return nil, false
@@ -80,6 +117,11 @@ func (a *CategoryChaincode) putRecord(stub shim.ChaincodeStubInterface, key stri
 	if err != nil {
 		return nil, false
 	}
+	// 记录提交者, 见queryHistory
+	err = history.Stamp(stub)
+	if err != nil {
+		return nil, false
+	}
 	return byte, true
 }
 
@@ -88,10 +130,8 @@ type CategoryChaincode struct {
 }
 
 // response message format
-func getRetByte(code int, des string) []byte {
-	var r chaincodeRet
-	r.Code = code
-	r.Des = des
+func getRetByte(code int, des string, details ...errcode.Detail) []byte {
+	r := errcode.NewRet(code, des, details...)
 
 	b, err := json.Marshal(r)
 
@@ -103,10 +143,8 @@ func getRetByte(code int, des string) []byte {
 }
 
 // response message format
-func getRetString(code int, des string) string {
-	var r chaincodeRet
-	r.Code = code
-	r.Des = des
+func getRetString(code int, des string, details ...errcode.Detail) string {
+	r := errcode.NewRet(code, des, details...)
 
 	b, err := json.Marshal(r)
 
@@ -118,6 +156,11 @@ func getRetString(code int, des string) string {
 	return string(b[:])
 }
 
+// 按错误的错误码返回, 保留被调用链码的Details
+func getRetError(des string, err error) string {
+	return getRetString(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...)
+}
+
 func (t *CategoryChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### Category Chaincode Init ###########")
 	//val, ok, err := cid.GetAttributeValue(stub, "type")
@@ -130,17 +173,42 @@ func (t *CategoryChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 
 // Transaction makes payment of X units from A to B
 func (t *CategoryChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	resp := ledger.DispatchOnce(stub, t.dispatch)
+	if resp.Status != shim.OK {
+		// 错误返回带上交易ID
+		resp.Message = errcode.Stamp(resp.Message, stub.GetTxID())
+	}
+	return resp
+}
+
+// 按函数名分发
+func (t *CategoryChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### chaincode Invoke ###########")
 
 	function, args := stub.GetFunctionAndParameters()
 	logger.Info("%s%s", "CategoryChaincode function=", function)
 	logger.Info("%s%s", "CategoryChaincode args=", args)
+	// 权限检查
+	_, err := permissions.Authorize(stub, function)
+	if err != nil {
+		res := getRetError("CategoryChaincode ", err)
+		return shim.Error(res)
+	}
 	if function == "insert" {
 		// 插入信息
 		return t.insert(stub, args)
+	} else if function == "queryHistory" {
+		// 变更历史
+		return t.queryHistory(stub, args)
 	} else if function == "queryByID" {
 		// 根据编号查询
 		return t.queryByID(stub, args)
+	} else if function == "queryByStore" {
+		// 按店铺分页查询
+		return t.queryByStore(stub, args)
+	} else if function == "search" {
+		// 按名称、条码、价格查找
+		return t.search(stub, args)
 	} else if function == "query" {
 		// 根据完整key查询
 		return t.query(stub, args)
@@ -156,10 +224,49 @@ func (t *CategoryChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 	} else if function == "changeStock" {
 		// 修改库存
 		return t.changeStock(stub, args)
-	}
-
-	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", args[0])
-	res := getRetString(1, "Unknown action")
+	} else if function == "moveStock" {
+		// 记录库存流水
+		return t.moveStock(stub, args)
+	} else if function == "getPrice" {
+		// 查询单价
+		return t.getPrice(stub, args)
+	} else if function == "getShelfLife" {
+		// 查询保质期
+		return t.getShelfLife(stub, args)
+	} else if function == "getStock" {
+		// 查询当前库存
+		return t.getStock(stub, args)
+	} else if function == "queryStockEntries" {
+		// 查询库存流水
+		return t.queryStockEntries(stub, args)
+	} else if function == "compactStock" {
+		// 合并旧流水
+		return t.compactStock(stub, args)
+	} else if function == "migrate" {
+		// 将旧的浮点数值改写为规范的定点小数
+		return t.migrate(stub, args)
+	} else if function == "querySchema" {
+		// 查询记录的JSON Schema
+		return t.querySchema(stub, args)
+	} else if function == "exists" {
+		// 类别是否存在
+		return t.exists(stub, args)
+	} else if function == "queryDeleted" {
+		// 查询软删除的类别
+		return t.queryDeleted(stub, args)
+	} else if function == "setDeletePolicy" {
+		// 设置删除策略
+		return t.setDeletePolicy(stub, args)
+	} else if function == "setIdempotencyWindow" {
+		// 设置幂等key的保存时间
+		return ledger.SetIdempotencyWindow(stub, args)
+	} else if function == "purgeIdempotencyKeys" {
+		// 删除已失效的幂等key
+		return ledger.PurgeIdempotencyKeys(stub, args)
+	}
+
+	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", function)
+	res := getRetString(errcode.Validation, "Unknown action: "+function, errcode.Field("function", "unknown"))
 	return shim.Error(res)
 }
 
@@ -167,35 +274,71 @@ func (t *CategoryChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 // args: 0 - {Record Object}
 func (a *CategoryChaincode) insert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke insert args!=1")
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
 	var record Record
-	err := json.Unmarshal([]byte(args[0]), &record)
+	err := recordSchema.Decode(args[0], &record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+	err = authz.CheckStore(stub, record.StoreID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+
+	err = checkStore(stub, record.StoreID)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insert unmarshal failed")
+		res := getRetError("Chaincode Invoke insert failed : ", err)
 		return shim.Error(res)
 	}
+	// 店铺名称查询时从StoreChaincode取得
+	record.StoreName = ""
 
 	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + record.ID, record.StoreID})
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insert: CreateCompositeKey failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert: CreateCompositeKey failed")
 		return shim.Error(res)
 	}
 	//根据ID 查找是否ID已存在
 	_, existbl := a.getRecord(stub, CateStoreKey)
 	if existbl {
-		res := getRetString(1, "Chaincode Invoke insert failed : the recordNo has exist ")
+		res := getRetString(errcode.AlreadyExists, "Chaincode Invoke insert failed : the recordNo has exist ")
+		return shim.Error(res)
+	}
+	shelfLife, err := shelflife.Parse(record.ShelfLife)
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert failed : "+err.Error())
 		return shim.Error(res)
 	}
-	//13位时间戳
-	record.CreateTime = strconv.FormatInt(time.Now().Unix(), 10)
-	record.Stock = "0"
+	record.ShelfLife = shelfLife.String()
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	//13位时间戳(毫秒)
+	record.CreateTime = txtime.Format(now)
+	record.UnitPrice = record.UnitPrice.RoundCents()
+	record.Stock = decimal.Zero
+	record.Version = 0
 	// 保存记录
 	_, bl := a.putRecord(stub, CateStoreKey, record)
 	if !bl {
-		res := getRetString(1, "Chaincode Invoke insert put record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert put record failed")
+		return shim.Error(res)
+	}
+	err = putStoreIndex(stub, record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert put store index failed : ", err)
+		return shim.Error(res)
+	}
+	err = events.Emit(stub, events.CategoryCreated, categoryEvent(record))
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert set event failed")
 		return shim.Error(res)
 	}
 
@@ -204,67 +347,77 @@ func (a *CategoryChaincode) insert(stub shim.ChaincodeStubInterface, args []stri
 }
 
 // 根据商品category ID查找记录
-//  0 - Record_No ;
+//
+//	0 - Record_No ;
 func (a *CategoryChaincode) queryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "CategoryChaincode queryByRecordNo args!=1")
+		res := getRetString(errcode.Validation, "CategoryChaincode queryByID args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 	// 取得所有索引
 	recordsIterator, err := stub.GetStateByPartialCompositeKey(IndexName, []string{Record_Prefix + args[0]})
 	if err != nil {
-		res := getRetString(1, "IndexChaincode queryByID get record error")
+		res := getRetString(errcode.Internal, "CategoryChaincode queryByID get records error")
 		return shim.Error(res)
 	}
 	defer recordsIterator.Close()
 	// 索引列表
 	var recordList = []Record{}
+	names := storeNames{}
 	for recordsIterator.HasNext() {
 		var record Record
 		kv, _ := recordsIterator.Next()
 		// kv.Value为内容
 		err = json.Unmarshal(kv.Value, &record)
 		if err != nil {
-			res := getRetString(1, "WorkflowChaincode queryByID unmarshal failed")
+			res := getRetString(errcode.Internal, "CategoryChaincode queryByID unmarshal failed")
 			return shim.Error(res)
 		}
 		// 取得ID与查询ID相同的加入列表
 		if record.ID == args[0] {
+			stock, _, err := a.currentStock(stub, record)
+			if err != nil {
+				res := getRetString(errcode.Internal, "CategoryChaincode queryByID get stock failed")
+				return shim.Error(res)
+			}
+			record.Stock = stock
+			record.StoreName = names.get(stub, record.StoreID)
 			recordList = append(recordList, record)
 		}
 	}
 
 	b, err := json.Marshal(recordList)
 	if err != nil {
-		res := getRetString(1, "IndexChaincode Marshal queryByRecordNo recordList error")
+		res := getRetString(errcode.Internal, "CategoryChaincode Marshal queryByID recordList error")
 		return shim.Error(res)
 	}
 	return shim.Success(b)
 }
 
 // 根据组合key查找记录
-//  0 - Category ID, 1 - Store ID ;
+//
+//	0 - Category ID, 1 - Store ID ;
 func (a *CategoryChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 2 {
-		res := getRetString(1, "CategoryChaincode queryByRecordNo args!=1")
+		res := getRetString(errcode.Validation, "CategoryChaincode query args!=2", errcode.Args("want 2"))
 		return shim.Error(res)
 	}
 	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + args[0], args[1]})
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insert: CreateCompositeKey failed")
+		res := getRetString(errcode.Internal, "CategoryChaincode query CreateCompositeKey failed")
 		return shim.Error(res)
 	}
 	// 取得该记录
 	record, bl := a.getRecord(stub, CateStoreKey)
 	if !bl {
-		res := getRetString(1, "CategoryChaincode queryByRecordNo get record error")
+		res := getRetString(errcode.NotFound, "CategoryChaincode query get record error")
 		return shim.Error(res)
 	}
 
 	// 取得历史: 通过fabric api取得该商品的变更历史
 	resultsIterator, err := stub.GetHistoryForKey(CateStoreKey)
 	if err != nil {
-		res := getRetString(1, "CategoryChaincode queryByRecordNo GetHistoryForKey error")
+		res := getRetString(errcode.Internal, "CategoryChaincode query GetHistoryForKey error")
 		return shim.Error(res)
 	}
 	defer resultsIterator.Close()
@@ -274,7 +427,7 @@ func (a *CategoryChaincode) query(stub shim.ChaincodeStubInterface, args []strin
 	for resultsIterator.HasNext() {
 		historyData, err := resultsIterator.Next()
 		if err != nil {
-			res := getRetString(1, "CategoryChaincode queryByRecordNo resultsIterator.Next() error")
+			res := getRetString(errcode.Internal, "CategoryChaincode query resultsIterator.Next() error")
 			return shim.Error(res)
 		}
 
@@ -293,45 +446,108 @@ func (a *CategoryChaincode) query(stub shim.ChaincodeStubInterface, args []strin
 	// 将历史做为记录的一个属性 一同返回
 	record.History = history
 
+	stock, _, err := a.currentStock(stub, record)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode query get stock failed")
+		return shim.Error(res)
+	}
+	record.Stock = stock
+	record.StoreName = storeNames{}.get(stub, record.StoreID)
+
 	b, err := json.Marshal(record)
 	if err != nil {
-		res := getRetString(1, "CategoryChaincode Marshal queryByRecordNo recordList error")
+		res := getRetString(errcode.Internal, "CategoryChaincode Marshal query recordList error")
 		return shim.Error(res)
 	}
 	return shim.Success(b)
 }
 
-// 修改记录
-// args: 0 - {Record Object}
+// 修改记录, JSON merge patch: 只需提交要修改的字段, 库存、创建时间等只读字段不能修改
+// ID与StoreID用于定位记录; Version为查询时读到的版本, 记录已被他人修改时返回412
+// args: 0 - {"ID": ..., "StoreID": ..., "Version": ..., 要修改的字段}
 func (a *CategoryChaincode) change(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke change args!=1")
+		res := getRetString(errcode.Validation, "Chaincode Invoke change args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
-	var record Record
-	err := json.Unmarshal([]byte(args[0]), &record)
+	var target struct {
+		ID      string `json:"ID"`
+		StoreID string `json:"StoreID"`
+	}
+	err := json.Unmarshal([]byte(args[0]), &target)
+	if err != nil || target.ID == "" || target.StoreID == "" {
+		res := getRetString(errcode.Validation, "Chaincode Invoke change failed : ID and StoreID are required",
+			errcode.Field("ID", "is required"), errcode.Field("StoreID", "is required"))
+		return shim.Error(res)
+	}
+	expected, err := schema.ExpectedVersion(args[0])
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke change unmarshal failed")
+		res := getRetError("Chaincode Invoke change failed : ", err)
 		return shim.Error(res)
 	}
-	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + record.ID, record.StoreID})
+	err = authz.CheckStore(stub, target.StoreID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
+		return shim.Error(res)
+	}
+	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + target.ID, target.StoreID})
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insert: CreateCompositeKey failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke change: CreateCompositeKey failed")
 		return shim.Error(res)
 	}
 
 	//根据ID 查找是否ID已存在
-	_, existbl := a.getRecord(stub, CateStoreKey)
+	old, existbl := a.getRecord(stub, CateStoreKey)
 	if !existbl {
-		res := getRetString(1, "Chaincode Invoke change failed : change without existed record")
+		res := getRetString(errcode.NotFound, "Chaincode Invoke change failed : change without existed record")
+		return shim.Error(res)
+	}
+	err = schema.CheckVersion(expected, old.Version)
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
+		return shim.Error(res)
+	}
+	err = checkStore(stub, old.StoreID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
 		return shim.Error(res)
 	}
+	var record Record
+	err = recordSchema.Merge(old, args[0], &record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
+		return shim.Error(res)
+	}
+	shelfLife, err := shelflife.Parse(record.ShelfLife)
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke change failed : "+err.Error())
+		return shim.Error(res)
+	}
+	record.ShelfLife = shelfLife.String()
+	record.UnitPrice = record.UnitPrice.RoundCents()
 
 	// 保存记录
 	_, bl := a.putRecord(stub, CateStoreKey, record)
 	if !bl {
-		res := getRetString(1, "Chaincode Invoke change put record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke change put record failed")
+		return shim.Error(res)
+	}
+	var evs events.List
+	err = evs.Add(events.CategoryChanged, categoryEvent(record))
+	if err == nil && record.UnitPrice.Cmp(old.UnitPrice) != 0 {
+		err = evs.Add(events.PriceChanged, events.PriceChange{
+			CateID:  record.ID,
+			StoreID: record.StoreID,
+			From:    old.UnitPrice.String(),
+			To:      record.UnitPrice.String(),
+		})
+	}
+	if err == nil {
+		err = evs.Emit(stub)
+	}
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke change set event failed")
 		return shim.Error(res)
 	}
 
@@ -339,127 +555,275 @@ func (a *CategoryChaincode) change(stub shim.ChaincodeStubInterface, args []stri
 	return shim.Success(res)
 }
 
-// 删除记录
+// 删除记录, 仍有商品引用时按删除策略处理, 见refs.go
 // args: 0 - ID, 1 - Store ID
 func (a *CategoryChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 2 {
-		res := getRetString(1, "Chaincode Invoke delete args!=1")
+		res := getRetString(errcode.Validation, "Chaincode Invoke delete args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	err := authz.CheckStore(stub, args[1])
+	if err != nil {
+		res := getRetError("Chaincode Invoke delete failed : ", err)
 		return shim.Error(res)
 	}
 
 	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + args[0], args[1]})
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insert: CreateCompositeKey failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete: CreateCompositeKey failed")
 		return shim.Error(res)
 	}
 
 	//根据ID 查找是否ID已存在
 	record, existbl := a.getRecord(stub, CateStoreKey)
 	if !existbl {
-		res := getRetString(1, "Chaincode Invoke delete failed : delete without existed record ")
+		res := getRetString(errcode.NotFound, "Chaincode Invoke delete failed : delete without existed record ")
+		return shim.Error(res)
+	}
+	err = a.deleteRefs(stub, record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke delete failed : ", err)
 		return shim.Error(res)
 	}
 
 	err = stub.DelState(CateStoreKey)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke delete delete record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete delete record failed")
+		return shim.Error(res)
+	}
+	err = history.Stamp(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete stamp history failed")
+		return shim.Error(res)
+	}
+	err = stub.DelState(storeIndexKey(record.StoreID, record.ID))
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete delete store index failed")
+		return shim.Error(res)
+	}
+	err = events.Emit(stub, events.CategoryDeleted, categoryEvent(record))
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete set event failed")
 		return shim.Error(res)
 	}
 
 	b, err := json.Marshal(record)
 	if err != nil {
-		res := getRetString(1, "CategoryChaincode Marshal delete recordList error")
+		res := getRetString(errcode.Internal, "CategoryChaincode Marshal delete recordList error")
 		return shim.Error(res)
 	}
 	return shim.Success(b)
 }
 
-// insert stock
-// args: 0 - ID, 1 - Store ID, 2 - quantity
-func (a *CategoryChaincode) insertStock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 3 {
-		res := getRetString(1, "Chaincode Invoke insertStock args!=1")
+// 查询单价, 供结账计价
+// 只读类别记录这一个key, 不读历史和库存流水, 并发结账与库存变动不会与之冲突
+// args: 0 - Category ID, 1 - Store ID
+func (a *CategoryChaincode) getPrice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "CategoryChaincode getPrice args!=2", errcode.Args("want 2"))
 		return shim.Error(res)
 	}
-
-	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Stock_Prefix + args[0], args[1]})
+	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + args[0], args[1]})
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insertStock: CreateCompositeKey failed")
+		res := getRetString(errcode.Internal, "CategoryChaincode getPrice: CreateCompositeKey failed")
 		return shim.Error(res)
 	}
-
-	//查找是否key已存在
-	_, err = stub.GetState(CateStoreKey)
-	if err == nil {
-		res := getRetString(1, "Chaincode Invoke insertStock failed : stock has existed ")
+	record, existbl := a.getRecord(stub, CateStoreKey)
+	if !existbl {
+		res := getRetString(errcode.NotFound, "CategoryChaincode getPrice failed : category "+args[0]+" does not exist in store "+args[1])
 		return shim.Error(res)
 	}
-
-	err = stub.PutState(CateStoreKey, []byte(args[2]))
+	b, err := json.Marshal(Price{ID: record.ID, Name: record.Name, StoreID: record.StoreID, UnitPrice: record.UnitPrice})
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insertStock failed")
+		res := getRetString(errcode.Internal, "CategoryChaincode Marshal getPrice error")
 		return shim.Error(res)
 	}
+	return shim.Success(b)
+}
 
-	res := getRetByte(0, "invoke insertStock success")
-	return shim.Success(res)
+// 查询保质期, 返回规范化的ISO-8601字符串, 不限保质期时为空
+// args: 0 - Category ID, 1 - Store ID
+func (a *CategoryChaincode) getShelfLife(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "CategoryChaincode getShelfLife args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + args[0], args[1]})
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode getShelfLife: CreateCompositeKey failed")
+		return shim.Error(res)
+	}
+	record, existbl := a.getRecord(stub, CateStoreKey)
+	if !existbl {
+		res := getRetString(errcode.NotFound, "CategoryChaincode getShelfLife failed : category "+args[0]+" does not exist in store "+args[1])
+		return shim.Error(res)
+	}
+	shelfLife, err := shelflife.Parse(record.ShelfLife)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode getShelfLife failed : "+err.Error())
+		return shim.Error(res)
+	}
+	return shim.Success([]byte(shelfLife.String()))
 }
 
-// change stock
-// args: 0 - Category ID, 1 - Store ID, 2 - quantity, 3 - "add" or "reduce"
-func (a *CategoryChaincode) changeStock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 4 {
-		res := getRetString(1, "Chaincode Invoke changeStock args!=1")
+// insert stock, 以一条调整流水记录初始库存
+// args: 0 - ID, 1 - Store ID, 2 - quantity
+func (a *CategoryChaincode) insertStock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insertStock args!=3", errcode.Args("want 3"))
 		return shim.Error(res)
 	}
 
 	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + args[0], args[1]})
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke changeStock: CreateCompositeKey failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke insertStock: CreateCompositeKey failed")
 		return shim.Error(res)
 	}
-
-	//根据ID 查找是否ID已存在
 	record, existbl := a.getRecord(stub, CateStoreKey)
 	if !existbl {
-		res := getRetString(1, "Chaincode Invoke changeStock failed : change without existed record")
+		res := getRetString(errcode.NotFound, "Chaincode Invoke insertStock failed : record does not exist")
 		return shim.Error(res)
 	}
 
-	stockFloat, err := strconv.ParseFloat(string(record.Stock), 32)
+	//查找是否已有库存
+	stock, entries, err := a.currentStock(stub, record)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke changeStock failed : cannot parse stock to float")
+		res := getRetError("Chaincode Invoke insertStock failed : ", err)
 		return shim.Error(res)
 	}
-	quantityFloat, err := strconv.ParseFloat(args[2], 32)
-	if err != nil {
-		res := getRetString(1, "Chaincode Invoke changeStock failed : cannot parse quantity from string to float")
+	if !stock.IsZero() || entries != 0 {
+		res := getRetString(errcode.AlreadyExists, "Chaincode Invoke insertStock failed : stock has existed ")
+		return shim.Error(res)
+	}
+
+	return a.moveStock(stub, []string{args[0], args[1], MoveAdjustment, args[2], "init"})
+}
+
+// change stock, 兼容旧接口: add 记为进货流水, reduce 记为销售流水;
+// 只能由GoodsChaincode调用, 直接调整库存用moveStock的adjustment
+// args: 0 - Category ID, 1 - Store ID, 2 - quantity, 3 - "add" or "reduce", 4 - reference(可选)
+func (a *CategoryChaincode) changeStock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 && len(args) != 5 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke changeStock args should be 4 or 5", errcode.Args("want 4 or 5"))
+		return shim.Error(res)
+	}
+	if ledger.TopLevel(stub) {
+		res := getRetString(errcode.Forbidden, "Chaincode Invoke changeStock failed : only GoodsChaincode can change stock")
 		return shim.Error(res)
 	}
+
+	var moveType string
 	if args[3] == "add" {
-		stockFloat = stockFloat + quantityFloat
+		moveType = MoveReceipt
 	} else if args[3] == "reduce" {
-		stockFloat = stockFloat - quantityFloat
+		moveType = MoveSale
 	} else {
-		res := getRetString(1, "Chaincode Invoke changeStock failed : args[3] should be add or reduce")
+		res := getRetString(errcode.Validation, "Chaincode Invoke changeStock failed : args[3] should be add or reduce")
 		return shim.Error(res)
 	}
 
-	record.Stock = strconv.FormatFloat(stockFloat, 'f', -1, 32)
+	moveArgs := []string{args[0], args[1], moveType, args[2]}
+	if len(args) == 5 {
+		moveArgs = append(moveArgs, args[4])
+	}
+	return a.moveStock(stub, moveArgs)
+}
 
-	// 保存记录
-	_, bl := a.putRecord(stub, CateStoreKey, record)
-	if !bl {
-		res := getRetString(1, "Chaincode Invoke changeStock put record failed")
+// 迁移旧数据: 旧记录中的UnitPrice/Stock及流水数量是strconv.FormatFloat产生的字符串,
+// 这里按decimal.NormalizeLegacy兼容解析后改写为规范格式, 价格按分舍入; 迁移前这类记录无法按严格格式读取;
+// 同时清除记录中保存的StoreName副本, 规范化ShelfLife, 并补写店铺索引
+// args: 无
+func (a *CategoryChaincode) migrate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke migrate args!=0", errcode.Args("want 0"))
+		return shim.Error(res)
+	}
+
+	recordsIterator, err := stub.GetStateByPartialCompositeKey(IndexName, []string{})
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke migrate get records error")
 		return shim.Error(res)
 	}
+	defer recordsIterator.Close()
+	count := 0
+	for recordsIterator.HasNext() {
+		kv, err := recordsIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate iterator error")
+			return shim.Error(res)
+		}
+		var record Record
+		b, err := decimal.NormalizeLegacy(kv.Value, "UnitPrice", "Stock")
+		if err == nil {
+			err = json.Unmarshal(b, &record)
+		}
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate unmarshal failed: "+kv.Key)
+			return shim.Error(res)
+		}
+		record.UnitPrice = record.UnitPrice.RoundCents()
+		record.StoreName = ""
+		if shelfLife, err := shelflife.Parse(record.ShelfLife); err == nil {
+			record.ShelfLife = shelfLife.String()
+		}
+		_, bl := a.putRecord(stub, kv.Key, record)
+		if !bl {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate put record failed")
+			return shim.Error(res)
+		}
+		err = putStoreIndex(stub, record)
+		if err != nil {
+			res := getRetError("Chaincode Invoke migrate put store index failed : ", err)
+			return shim.Error(res)
+		}
+		count++
+	}
 
-	res := getRetByte(0, "invoke changeStock success")
+	entriesIterator, err := stub.GetStateByPartialCompositeKey(StockIndexName, []string{})
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke migrate get stock entries error")
+		return shim.Error(res)
+	}
+	defer entriesIterator.Close()
+	for entriesIterator.HasNext() {
+		kv, err := entriesIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate iterator error")
+			return shim.Error(res)
+		}
+		var entry StockEntry
+		b, err := decimal.NormalizeLegacy(kv.Value, "Quantity")
+		if err == nil {
+			err = json.Unmarshal(b, &entry)
+		}
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate unmarshal failed: "+kv.Key)
+			return shim.Error(res)
+		}
+		b, err = json.Marshal(entry)
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate marshal failed")
+			return shim.Error(res)
+		}
+		err = stub.PutState(kv.Key, b)
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate put stock entry failed")
+			return shim.Error(res)
+		}
+		count++
+	}
+
+	res := getRetByte(0, "invoke migrate success: "+strconv.Itoa(count)+" records")
 	return shim.Success(res)
 }
 
 func main() {
-	err := shim.Start(new(CategoryChaincode))
+	err := recordSchema.Sync(Record{})
+	if err != nil {
+		logger.Errorf("Error starting Category chaincode: %s", err)
+		return
+	}
+	err = shim.Start(new(CategoryChaincode))
 	if err != nil {
 		logger.Errorf("Error starting Category chaincode: %s", err)
 	}
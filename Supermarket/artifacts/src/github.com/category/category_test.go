@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"github.com/common/errcode"
+	"github.com/common/ledger/ledgertest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 两个节点背书同一提案, 写集和事件必须逐字节相同
+func TestInsertEndorsementsMatch(t *testing.T) {
+	p := ledgertest.Proposal{
+		TxID:    "tx1",
+		Creator: ledgertest.Creator("Org1MSP", "bob", map[string]string{"role": "manager", "storeID": "S1"}),
+		Time:    time.Unix(1500000000, 123456789),
+		Args:    []string{"insert", `{"ID":"C1","Name":"Apple","StoreID":"S1","UnitPrice":"3.456","ShelfLife":"P30D"}`},
+	}
+	endorse := func() *ledgertest.Stub {
+		stub := ledgertest.NewStub("category", new(CategoryChaincode))
+		stub.Peers[StoreChaincodeName] = func(args []string) pb.Response {
+			return shim.Success(nil)
+		}
+		resp := stub.Invoke(p)
+		if resp.Status != shim.OK {
+			t.Fatalf("insert: %s", resp.Message)
+		}
+		return stub
+	}
+	a := endorse()
+	// 节点的本地时间不同
+	time.Sleep(5 * time.Millisecond)
+	b := endorse()
+
+	if len(a.Writes) == 0 || !reflect.DeepEqual(a.Writes, b.Writes) {
+		t.Errorf("write sets differ:\n%q\n%q", a.Writes, b.Writes)
+	}
+	// 创建时间取自提案, 精确到毫秒
+	found := false
+	for _, v := range a.Writes {
+		found = found || bytes.Contains(v, []byte(`"CreateTime":"1500000000123"`))
+	}
+	if !found {
+		t.Errorf("CreateTime should come from the proposal timestamp: %q", a.Writes)
+	}
+	if len(a.Events) != 1 || !reflect.DeepEqual(a.Events, b.Events) {
+		t.Errorf("events differ:\n%q\n%q", a.Events, b.Events)
+	}
+}
+
+// 修改带上读到的版本(插入后为1); 版本过期时返回412, 只读字段不被补丁覆盖
+func TestChangeVersion(t *testing.T) {
+	stub := ledgertest.NewStub("category", new(CategoryChaincode))
+	stub.Peers[StoreChaincodeName] = func(args []string) pb.Response {
+		return shim.Success(nil)
+	}
+	manager := ledgertest.Creator("Org1MSP", "bob", map[string]string{"role": "manager", "storeID": "S1"})
+	call := func(txID string, args ...string) pb.Response {
+		return stub.Invoke(ledgertest.Proposal{TxID: txID, Creator: manager, Time: time.Unix(1500000000, 0), Args: args})
+	}
+	resp := call("tx0", "insert", `{"ID":"C1","Name":"Apple","StoreID":"S1","UnitPrice":"3.5"}`)
+	if resp.Status != shim.OK {
+		t.Fatalf("insert: %s", resp.Message)
+	}
+
+	cases := []struct {
+		name  string
+		patch string
+		code  int
+	}{
+		{"read-only fields", `{"ID":"C1","StoreID":"S1","Version":1,"Name":"Plum","Stock":"99","CreateTime":"1"}`, errcode.Validation},
+		{"current version", `{"ID":"C1","StoreID":"S1","Version":1,"Name":"Pear","Stock":"0","CreateTime":"1500000000000"}`, errcode.OK},
+		{"stale version", `{"ID":"C1","StoreID":"S1","Version":1,"Name":"Plum"}`, errcode.Conflict},
+		{"missing version", `{"ID":"C1","StoreID":"S1","Name":"Plum"}`, errcode.Validation},
+		{"next version", `{"ID":"C1","StoreID":"S1","Version":2,"UnitPrice":"4"}`, errcode.OK},
+		{"unknown record", `{"ID":"C2","StoreID":"S1","Version":0}`, errcode.NotFound},
+	}
+	for i, c := range cases {
+		resp := call("tx"+strconv.Itoa(i+1), "change", c.patch)
+		code := errcode.OK
+		if resp.Status != shim.OK {
+			code = errcode.FromResponse(resp.Message).Code
+		}
+		if code != c.code {
+			t.Errorf("%s: code = %d, want %d: %s", c.name, code, c.code, resp.Message)
+		}
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + "C1", "S1"})
+	record, _ := new(CategoryChaincode).getRecord(stub, key)
+	if record.Version != 3 || record.Name != "Pear" || record.UnitPrice.String() != "4" ||
+		!record.Stock.IsZero() || record.CreateTime != "1500000000000" {
+		t.Errorf("record = %+v", record)
+	}
+}
+
+// insert中的只读字段由链码维护, 客户端提交的值不被保存
+func TestInsertIgnoresReadOnly(t *testing.T) {
+	stub := ledgertest.NewStub("category", new(CategoryChaincode))
+	stub.Peers[StoreChaincodeName] = func(args []string) pb.Response {
+		return shim.Success(nil)
+	}
+	resp := stub.Invoke(ledgertest.Proposal{
+		TxID:    "tx1",
+		Creator: ledgertest.Creator("Org1MSP", "bob", map[string]string{"role": "manager", "storeID": "S1"}),
+		Time:    time.Unix(1500000000, 0),
+		Args: []string{"insert", `{"ID":"C1","Name":"Apple","StoreID":"S1","UnitPrice":"3.5",` +
+			`"StoreName":"Fake","Stock":"99","CreateTime":"1","Version":9,"History":[{"TxId":"forged","Record":{}}]}`},
+	})
+	if resp.Status != shim.OK {
+		t.Fatalf("insert: %s", resp.Message)
+	}
+	for key, value := range stub.Writes {
+		for _, forged := range []string{"Fake", "forged", `"CreateTime":"1"`, `"Version":9`} {
+			if bytes.Contains(value, []byte(forged)) {
+				t.Errorf("%s should not store %s: %s", key, forged, value)
+			}
+		}
+	}
+	key, _ := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + "C1", "S1"})
+	record, _ := new(CategoryChaincode).getRecord(stub, key)
+	if len(record.History) != 0 || !record.Stock.IsZero() || record.Version != 1 {
+		t.Errorf("record = %+v", record)
+	}
+}
+
+// 结账计价只读类别记录一个key, 不做范围查询, 并发结账不会因幻读冲突
+func TestGetPriceReadSet(t *testing.T) {
+	stub := ledgertest.NewStub("category", new(CategoryChaincode))
+	stub.Peers[StoreChaincodeName] = func(args []string) pb.Response {
+		return shim.Success(nil)
+	}
+	manager := ledgertest.Creator("Org1MSP", "bob", map[string]string{"role": "manager", "storeID": "S1"})
+	call := func(txID string, args ...string) pb.Response {
+		return stub.Invoke(ledgertest.Proposal{TxID: txID, Creator: manager, Time: time.Unix(1500000000, 0), Args: args})
+	}
+	for i, args := range [][]string{
+		{"insert", `{"ID":"C1","Name":"Apple","StoreID":"S1","UnitPrice":"3.5"}`},
+		{"moveStock", "C1", "S1", "receipt", "10", "PO1"},
+	} {
+		if resp := call("setup"+strconv.Itoa(i), args...); resp.Status != shim.OK {
+			t.Fatalf("%s: %s", args[0], resp.Message)
+		}
+	}
+
+	resp := call("tx1", "getPrice", "C1", "S1")
+	if resp.Status != shim.OK {
+		t.Fatalf("getPrice: %s", resp.Message)
+	}
+	if string(resp.Payload) != `{"ID":"C1","Name":"Apple","StoreID":"S1","UnitPrice":"3.5"}` {
+		t.Errorf("payload = %s", resp.Payload)
+	}
+	key, _ := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + "C1", "S1"})
+	if _, ok := stub.Reads[key]; len(stub.Reads) != 1 || !ok || len(stub.Scans) != 0 {
+		t.Errorf("reads = %q, scans = %q, want only %q", stub.Reads, stub.Scans, key)
+	}
+
+	if resp := call("tx2", "getPrice", "C2", "S1"); resp.Status == shim.OK || errcode.FromResponse(resp.Message).Code != errcode.NotFound {
+		t.Errorf("unknown category: %s", resp.Message)
+	}
+}
+
+// changeStock只能由GoodsChaincode调用, 不能绕过商品入库和售出直接改库存
+func TestChangeStockCallers(t *testing.T) {
+	stub := ledgertest.NewStub("category", new(CategoryChaincode))
+	stub.Peers[StoreChaincodeName] = func(args []string) pb.Response {
+		return shim.Success(nil)
+	}
+	clerk := ledgertest.Creator("Org1MSP", "carol", map[string]string{"role": "clerk", "storeID": "S1"})
+	manager := ledgertest.Creator("Org1MSP", "bob", map[string]string{"role": "manager", "storeID": "S1"})
+	if resp := stub.Invoke(ledgertest.Proposal{TxID: "setup", Creator: manager, Time: time.Unix(1500000000, 0),
+		Args: []string{"insert", `{"ID":"C1","Name":"Apple","StoreID":"S1","UnitPrice":"3.5"}`}}); resp.Status != shim.OK {
+		t.Fatalf("insert: %s", resp.Message)
+	}
+	cases := []struct {
+		name   string
+		caller []string
+		code   int
+	}{
+		{"called directly", nil, errcode.Forbidden},
+		{"called by goods", []string{"insert", `{"Category":"C1","StoreID":"S1"}`}, errcode.OK},
+	}
+	for i, c := range cases {
+		resp := stub.Invoke(ledgertest.Proposal{TxID: "tx" + strconv.Itoa(i), Creator: clerk, Time: time.Unix(1500000000, 0),
+			Args: []string{"changeStock", "C1", "S1", "1", "add", "G1"}, Caller: c.caller})
+		code := errcode.OK
+		if resp.Status != shim.OK {
+			code = errcode.FromResponse(resp.Message).Code
+		}
+		if code != c.code {
+			t.Errorf("%s: code %d, want %d: %s", c.name, code, c.code, resp.Message)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/common/decimal"
+	"github.com/common/events"
+)
+
+// 类别事件的数据
+func categoryEvent(record Record) events.Category {
+	return events.Category{
+		ID:        record.ID,
+		StoreID:   record.StoreID,
+		Name:      record.Name,
+		BarCode:   record.BarCode,
+		UnitPrice: record.UnitPrice.String(),
+		ShelfLife: record.ShelfLife,
+	}
+}
+
+// 库存变动事件的数据
+func stockEvent(cateID, storeID, moveType string, delta decimal.Decimal, reference, peer string) events.StockMovement {
+	return events.StockMovement{
+		CateID:    cateID,
+		StoreID:   storeID,
+		Type:      moveType,
+		Quantity:  delta.String(),
+		Reference: reference,
+		Peer:      peer,
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/common/errcode"
+	"github.com/common/ledger"
+	"github.com/common/paging"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 查询类别的变更历史, 包括提交者和每次修改的字段
+//
+//	0 - Category ID, 1 - Store ID, 2 - page size(可选), 3 - bookmark(可选, 上一页返回的交易ID)
+func (a *CategoryChaincode) queryHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 || len(args) > 4 {
+		res := getRetString(errcode.Validation, "CategoryChaincode queryHistory args should be 2 to 4", errcode.Args("want 2 to 4"))
+		return shim.Error(res)
+	}
+	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + args[0], args[1]})
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode queryHistory: CreateCompositeKey failed")
+		return shim.Error(res)
+	}
+	size, bookmark, err := paging.Args(args[2:])
+	if err != nil {
+		res := getRetString(errcode.Validation, "CategoryChaincode queryHistory failed : "+err.Error())
+		return shim.Error(res)
+	}
+	b, err := ledger.KeyHistory(stub, CateStoreKey, size, bookmark)
+	if err != nil {
+		res := getRetError("CategoryChaincode queryHistory error: ", err)
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
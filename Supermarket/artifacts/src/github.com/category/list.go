@@ -0,0 +1,98 @@
+/*
+按店铺列出类别
+类别记录的composite key为 storeID~CateID(实际是Cate_<ID>在前, 店铺在后), 不能按店铺查询,
+因此另建普通key索引 CateStore_<StoreID>~<Category ID>, 按范围分页扫描
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/errcode"
+	"github.com/common/paging"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 店铺索引前缀, 值为空
+const StoreIndex_Prefix = "CateStore_"
+
+// 店铺索引key
+func storeIndexKey(storeID, cateID string) string {
+	return paging.Key(StoreIndex_Prefix, storeID, cateID)
+}
+
+// 写入店铺索引
+func putStoreIndex(stub shim.ChaincodeStubInterface, record Record) error {
+	err := paging.Check(record.StoreID, record.ID)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(storeIndexKey(record.StoreID, record.ID), []byte{0x00})
+}
+
+// 分页列出店铺的类别, 按类别ID排序
+//
+//	0 - Store ID, 1 - page size(可选), 2 - bookmark(可选)
+func (a *CategoryChaincode) queryByStore(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		res := getRetString(errcode.Validation, "CategoryChaincode queryByStore args should be 1 to 3", errcode.Args("want 1 to 3"))
+		return shim.Error(res)
+	}
+	size, bookmark, err := paging.Args(args[1:])
+	if err != nil {
+		res := getRetString(errcode.Validation, "CategoryChaincode queryByStore failed : "+err.Error())
+		return shim.Error(res)
+	}
+
+	prefix := paging.Key(StoreIndex_Prefix, args[0], "")
+	start, end := paging.Range(prefix, bookmark)
+	indexIterator, err := stub.GetStateByRange(start, end)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode queryByStore get index error")
+		return shim.Error(res)
+	}
+	defer indexIterator.Close()
+
+	var recordList = []Record{}
+	page := paging.Page{}
+	storeName := storeNames{}.get(stub, args[0])
+	for indexIterator.HasNext() {
+		kv, err := indexIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "CategoryChaincode queryByStore iterator error")
+			return shim.Error(res)
+		}
+		if len(recordList) == size {
+			page.Bookmark = kv.Key
+			break
+		}
+		CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + paging.LastField(kv.Key), args[0]})
+		if err != nil {
+			res := getRetString(errcode.Internal, "CategoryChaincode queryByStore: CreateCompositeKey failed")
+			return shim.Error(res)
+		}
+		record, bl := a.getRecord(stub, CateStoreKey)
+		if !bl {
+			res := getRetString(errcode.Internal, "CategoryChaincode queryByStore get record error: "+kv.Key)
+			return shim.Error(res)
+		}
+		stock, _, err := a.currentStock(stub, record)
+		if err != nil {
+			res := getRetString(errcode.Internal, "CategoryChaincode queryByStore get stock failed")
+			return shim.Error(res)
+		}
+		record.Stock = stock
+		record.StoreName = storeName
+		recordList = append(recordList, record)
+	}
+	page.Records = recordList
+	page.Count = len(recordList)
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode Marshal queryByStore page error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
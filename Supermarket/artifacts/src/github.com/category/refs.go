@@ -0,0 +1,182 @@
+/*
+引用完整性, 见common/refint
+CommodityChaincode中仍在店内的商品引用所在店铺的类别. 删除类别时按删除策略(setDeletePolicy)处理:
+  restrict 仍有商品时拒绝删除, 错误的Details列出这些商品
+  cascade  类别移到软删除记录(queryDeleted可查), 这些商品改为deleted
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/refint"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 被调用的chaincode名称
+const CommodityChaincodeName = "commodity"
+
+// 软删除的类别: ID, StoreID, 删除交易ID
+const DeletedIndexName = "CateID~storeID~txID"
+
+// 软删除的类别
+type DeletedRecord struct {
+	Record
+	DeletedBy   string `json:"DeletedBy"` // 操作人enrollment ID
+	DeletedTxID string `json:"DeletedTxID"`
+	DeletedTime string `json:"DeletedTime"`
+	Commodities int    `json:"Commodities"` // 一同软删除的商品数
+}
+
+// 删除类别前处理引用: restrict时仍有商品则返回错误; cascade时软删除这些商品并保存软删除的类别
+func (a *CategoryChaincode) deleteRefs(stub shim.ChaincodeStubInterface, record Record) error {
+	policy, err := refint.Policy(stub)
+	if err != nil {
+		return err
+	}
+	if policy == refint.Cascade {
+		return a.softDelete(stub, record)
+	}
+
+	resp := invoke(stub, CommodityChaincodeName, "queryRefs", record.ID, record.StoreID)
+	if resp.Status != shim.OK {
+		return errcode.FromResponse(resp.Message)
+	}
+	var refs refint.Refs
+	err = json.Unmarshal(resp.Payload, &refs)
+	if err != nil {
+		return err
+	}
+	if refs.Count > 0 {
+		return refint.Blocked("category "+record.ID+" in store "+record.StoreID, refs)
+	}
+	return nil
+}
+
+// 软删除类别及引用它的商品
+func (a *CategoryChaincode) softDelete(stub shim.ChaincodeStubInterface, record Record) error {
+	resp := invoke(stub, CommodityChaincodeName, "cascadeDelete", record.ID, record.StoreID)
+	if resp.Status != shim.OK {
+		return errcode.FromResponse(resp.Message)
+	}
+	var refs refint.Refs
+	err := json.Unmarshal(resp.Payload, &refs)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	deleted := DeletedRecord{
+		Record:      record,
+		DeletedTxID: stub.GetTxID(),
+		DeletedTime: txtime.Format(now),
+		Commodities: refs.Count,
+	}
+	deleted.StoreName = ""
+	deleted.History = nil
+	if id, err := authz.GetIdentity(stub); err == nil {
+		deleted.DeletedBy = id.ID
+	}
+	key, err := stub.CreateCompositeKey(DeletedIndexName, []string{record.ID, record.StoreID, stub.GetTxID()})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(deleted)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, b)
+}
+
+// 设置删除策略
+// args: 0 - restrict或cascade
+func (a *CategoryChaincode) setDeletePolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setDeletePolicy args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	err := refint.SetPolicy(stub, args[0])
+	if err != nil {
+		res := getRetError("Chaincode Invoke setDeletePolicy failed : ", err)
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke setDeletePolicy success")
+	return shim.Success(res)
+}
+
+// 查询软删除的类别
+//
+//	0 - Category ID, 1 - Store ID
+func (a *CategoryChaincode) queryDeleted(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "CategoryChaincode queryDeleted args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	err := authz.CheckStore(stub, args[1])
+	if err != nil {
+		res := getRetError("CategoryChaincode queryDeleted: ", err)
+		return shim.Error(res)
+	}
+	deletedIterator, err := stub.GetStateByPartialCompositeKey(DeletedIndexName, []string{args[0], args[1]})
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode queryDeleted get records error")
+		return shim.Error(res)
+	}
+	defer deletedIterator.Close()
+
+	var recordList = []DeletedRecord{}
+	for deletedIterator.HasNext() {
+		kv, err := deletedIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "CategoryChaincode queryDeleted iterator error")
+			return shim.Error(res)
+		}
+		var record DeletedRecord
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			res := getRetString(errcode.Internal, "CategoryChaincode queryDeleted unmarshal failed")
+			return shim.Error(res)
+		}
+		recordList = append(recordList, record)
+	}
+
+	b, err := json.Marshal(recordList)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode Marshal queryDeleted recordList error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 类别是否存在, 供其他链码确认引用; 不存在时返回404
+// args: 0 - Category ID, 1 - Store ID(可选, 为空时任一店铺存在即可)
+func (a *CategoryChaincode) exists(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		res := getRetString(errcode.Validation, "CategoryChaincode exists args should be 1 or 2", errcode.Args("want 1 or 2"))
+		return shim.Error(res)
+	}
+	attrs := []string{Record_Prefix + args[0]}
+	what := "category " + args[0]
+	if len(args) == 2 && args[1] != "" {
+		attrs = append(attrs, args[1])
+		what += " in store " + args[1]
+	}
+	recordsIterator, err := stub.GetStateByPartialCompositeKey(IndexName, attrs)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode exists get record error")
+		return shim.Error(res)
+	}
+	defer recordsIterator.Close()
+	if !recordsIterator.HasNext() {
+		res := getRetString(errcode.NotFound, "CategoryChaincode exists: no "+what)
+		return shim.Error(res)
+	}
+	return shim.Success(getRetByte(0, what+" exists"))
+}
@@ -0,0 +1,43 @@
+/*
+类别记录的JSON Schema
+insert与change(merge patch)按它校验, querySchema发布同一份schema; 修改Record时同时修改这里, 否则链码无法启动.
+*/
+
+package main
+
+import (
+	"github.com/common/errcode"
+	"github.com/common/schema"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var recordSchema = schema.Schema{
+	ID:          "supermarket/category.json",
+	Title:       "Category",
+	Description: "每个店铺的一类商品",
+	Properties: []schema.Property{
+		{Name: "ID", Type: schema.String, Required: true, Immutable: true, MaxLength: schema.IDMaxLength, Pattern: schema.IDPattern},
+		{Name: "Name", Type: schema.String, Required: true, MaxLength: schema.NameMaxLength},
+		{Name: "StoreID", Type: schema.String, Required: true, Immutable: true, MaxLength: schema.IDMaxLength, Pattern: schema.IDPattern},
+		{Name: "StoreName", Type: schema.String, ReadOnly: true, Description: "查询时从StoreChaincode取得"},
+		{Name: "BarCode", Type: schema.String, MaxLength: 32, Pattern: `^[0-9A-Za-z-]+$`},
+		{Name: "MeaUnit", Type: schema.String, MaxLength: 16, Description: "计量单位"},
+		{Name: "UnitPrice", Type: schema.Decimal, Required: true, NonNegative: true, Description: "单价, 保存时四舍五入到分"},
+		{Name: "ShelfLife", Type: schema.String, MaxLength: 16, Pattern: `^([0-9]+|[Pp]([0-9]+[YyMmWwDd])+)$`, Description: "保质期, ISO-8601时长或天数, 空为不限"},
+		{Name: "Stock", Type: schema.Decimal, ReadOnly: true, Description: "由库存流水维护"},
+		{Name: "CreateTime", Type: schema.String, ReadOnly: true},
+		{Name: "History", Type: schema.Array, ReadOnly: true},
+		{Name: "Version", Type: schema.Integer, ReadOnly: true, NonNegative: true, Description: "版本, 每次写入加一; change时提交查询读到的版本"},
+	},
+}
+
+// 发布类别记录的JSON Schema
+func (a *CategoryChaincode) querySchema(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	b, err := recordSchema.JSON()
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode Marshal querySchema error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
@@ -0,0 +1,140 @@
+/*
+按名称片段、条码、价格范围查找类别(需要CouchDB状态数据库)
+索引定义见 META-INF/statedb/couchdb/indexes
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/paging"
+	"github.com/common/richquery"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+)
+
+// 查找条件, 不接受其他字段
+type SearchFilter struct {
+	StoreID  string           `json:"StoreID"`
+	Name     string           `json:"Name"` // 名称片段, 不区分大小写
+	BarCode  string           `json:"BarCode"`
+	MinPrice *decimal.Decimal `json:"MinPrice"`
+	MaxPrice *decimal.Decimal `json:"MaxPrice"`
+}
+
+// 构造selector; 价格是字符串保存的定点小数, CouchDB无法按数值比较, 由链码过滤
+func (f SearchFilter) selector() (richquery.Selector, error) {
+	if f.StoreID == "" && f.Name == "" && f.BarCode == "" {
+		return nil, errors.New("one of StoreID, Name or BarCode is required")
+	}
+	s := richquery.Selector{}
+	// 类别记录有MeaUnit字段, 库存流水等其他记录没有
+	s.Exists("MeaUnit")
+	s.Eq("StoreID", f.StoreID)
+	s.Eq("BarCode", f.BarCode)
+	err := s.Contains("Name", f.Name)
+	return s, err
+}
+
+// 价格是否在范围内
+func (f SearchFilter) match(record Record) bool {
+	if f.MinPrice != nil && record.UnitPrice.Cmp(*f.MinPrice) < 0 {
+		return false
+	}
+	if f.MaxPrice != nil && record.UnitPrice.Cmp(*f.MaxPrice) > 0 {
+		return false
+	}
+	return true
+}
+
+// 查找类别
+//
+//	0 - {SearchFilter Object}, 1 - page size(可选), 2 - bookmark(可选)
+func (a *CategoryChaincode) search(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		res := getRetString(errcode.Validation, "CategoryChaincode search args should be 1 to 3", errcode.Args("want 1 to 3"))
+		return shim.Error(res)
+	}
+	var filter SearchFilter
+	err := richquery.Decode(args[0], &filter)
+	if err != nil {
+		res := getRetString(errcode.Validation, "CategoryChaincode search unmarshal failed : "+err.Error())
+		return shim.Error(res)
+	}
+	selector, err := filter.selector()
+	if err != nil {
+		res := getRetString(errcode.Validation, "CategoryChaincode search failed : "+err.Error())
+		return shim.Error(res)
+	}
+	size, bookmark, err := paging.Args(args[1:])
+	skip := 0
+	if err == nil {
+		skip, err = richquery.Offset(bookmark)
+	}
+	if err != nil {
+		res := getRetString(errcode.Validation, "CategoryChaincode search failed : "+err.Error())
+		return shim.Error(res)
+	}
+	limit := size * richquery.ScanFactor
+	query, err := selector.Query(skip, limit)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode search build query failed")
+		return shim.Error(res)
+	}
+
+	resultsIterator, err := stub.GetQueryResult(query)
+	if err != nil {
+		res := getRetError("CategoryChaincode search query error: ", err)
+		return shim.Error(res)
+	}
+	defer resultsIterator.Close()
+
+	var recordList = []Record{}
+	page := paging.Page{}
+	names := storeNames{}
+	scanned := 0
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "CategoryChaincode search iterator error")
+			return shim.Error(res)
+		}
+		var record Record
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			res := getRetString(errcode.Internal, "CategoryChaincode search unmarshal failed: "+kv.Key)
+			return shim.Error(res)
+		}
+		if filter.match(record) {
+			if len(recordList) == size {
+				break
+			}
+			stock, _, err := a.currentStock(stub, record)
+			if err != nil {
+				res := getRetString(errcode.Internal, "CategoryChaincode search get stock failed")
+				return shim.Error(res)
+			}
+			record.Stock = stock
+			record.StoreName = names.get(stub, record.StoreID)
+			recordList = append(recordList, record)
+		}
+		scanned++
+	}
+	// 页满或CouchDB返回了limit条时可能还有下一页
+	if (len(recordList) == size || scanned == limit) && skip+scanned < richquery.MaxOffset {
+		page.Bookmark = strconv.Itoa(skip + scanned)
+	}
+	page.Records = recordList
+	page.Count = len(recordList)
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode Marshal search page error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
@@ -0,0 +1,360 @@
+/*
+库存流水
+库存不再是一个可修改的计数, 每次变动以交易ID为key写入一条流水,
+同一类别的并发销售不再写同一个key, 不会产生MVCC冲突.
+当前库存 = 类别记录中已合并的Stock + 所有未合并流水之和
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/events"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+)
+
+// 库存流水类型
+const (
+	MoveReceipt    = "receipt"    // 进货
+	MoveSale       = "sale"       // 销售
+	MoveReturn     = "return"     // 退货
+	MoveAdjustment = "adjustment" // 盘点调整, quantity可为负数
+	MoveTransfer   = "transfer"   // 调货
+)
+
+// composite key: 每个交易每个reference一条流水
+const StockIndexName = "storeID~CateID~txID~ref"
+
+// 库存流水
+type StockEntry struct {
+	CateID    string          `json:"CateID"`
+	StoreID   string          `json:"StoreID"`
+	TxID      string          `json:"TxID"`
+	Type      string          `json:"Type"`
+	Quantity  decimal.Decimal `json:"Quantity"`  // 带符号的变动量
+	Reference string          `json:"Reference"` // 商品ID、单据号等
+	Peer      string          `json:"Peer"`      // 调货的对方商店
+	Time      string          `json:"Time"`
+}
+
+// 库存汇总
+type StockSummary struct {
+	CateID  string          `json:"CateID"`
+	StoreID string          `json:"StoreID"`
+	Stock   decimal.Decimal `json:"Stock"`
+	Entries int             `json:"Entries"` // 未合并的流水数
+}
+
+// 交易时间(unix毫秒), 所有背书节点一致
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
+// 写入一条流水
+func (a *CategoryChaincode) putStockEntry(stub shim.ChaincodeStubInterface, entry StockEntry) error {
+	key, err := stub.CreateCompositeKey(StockIndexName, []string{entry.StoreID, entry.CateID, entry.TxID, entry.Reference})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, b)
+}
+
+// 汇总某商店某类别的未合并流水
+// before > 0 时只统计Time早于before(unix毫秒)的流水, 同时返回这些流水的key
+func (a *CategoryChaincode) sumStockEntries(stub shim.ChaincodeStubInterface, cateID, storeID string, before int64) (decimal.Decimal, []string, error) {
+	entriesIterator, err := stub.GetStateByPartialCompositeKey(StockIndexName, []string{storeID, cateID})
+	if err != nil {
+		return decimal.Zero, nil, err
+	}
+	defer entriesIterator.Close()
+
+	var sum decimal.Decimal
+	var keys []string
+	for entriesIterator.HasNext() {
+		kv, err := entriesIterator.Next()
+		if err != nil {
+			return decimal.Zero, nil, err
+		}
+		var entry StockEntry
+		err = json.Unmarshal(kv.Value, &entry)
+		if err != nil {
+			return decimal.Zero, nil, err
+		}
+		if before > 0 {
+			t, err := txtime.Parse(entry.Time)
+			if err != nil || t >= before {
+				continue
+			}
+		}
+		sum, err = sum.Add(entry.Quantity)
+		if err != nil {
+			return decimal.Zero, nil, err
+		}
+		keys = append(keys, kv.Key)
+	}
+	return sum, keys, nil
+}
+
+// 当前库存
+// 类别记录中的Stock为已合并部分, 旧记录中为空时视为0
+func (a *CategoryChaincode) currentStock(stub shim.ChaincodeStubInterface, record Record) (decimal.Decimal, int, error) {
+	sum, keys, err := a.sumStockEntries(stub, record.ID, record.StoreID, 0)
+	if err != nil {
+		return decimal.Zero, 0, err
+	}
+	stock, err := record.Stock.Add(sum)
+	return stock, len(keys), err
+}
+
+// 记录一次库存变动
+// 只读取类别记录确认其存在, 不修改它; 不检查库存是否为负, 避免并发销售读同一批流水而冲突
+// args: 0 - Category ID, 1 - Store ID, 2 - type, 3 - quantity, 4 - reference(可选), 5 - target Store ID(调货时)
+func (a *CategoryChaincode) moveStock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 4 || len(args) > 6 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke moveStock args should be 4 to 6", errcode.Args("want 4 to 6"))
+		return shim.Error(res)
+	}
+	var reference, target string
+	if len(args) > 4 {
+		reference = args[4]
+	}
+	if len(args) > 5 {
+		target = args[5]
+	}
+	err := authz.CheckStore(stub, args[1])
+	if err != nil {
+		res := getRetError("Chaincode Invoke moveStock failed : ", err)
+		return shim.Error(res)
+	}
+
+	quantity, err := decimal.Parse(args[3])
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke moveStock failed : cannot parse quantity to decimal")
+		return shim.Error(res)
+	}
+
+	var delta decimal.Decimal
+	switch args[2] {
+	case MoveReceipt, MoveReturn:
+		delta = quantity
+	case MoveSale:
+		delta = quantity.Neg()
+	case MoveAdjustment:
+		// 调整量自带符号
+		delta = quantity
+	case MoveTransfer:
+		if target == "" || target == args[1] {
+			res := getRetString(errcode.Validation, "Chaincode Invoke moveStock failed : transfer needs another target store")
+			return shim.Error(res)
+		}
+		delta = quantity.Neg()
+	default:
+		res := getRetString(errcode.Validation, "Chaincode Invoke moveStock failed : unknown movement type "+args[2])
+		return shim.Error(res)
+	}
+	if args[2] != MoveAdjustment && quantity.Sign() <= 0 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke moveStock failed : quantity should be positive")
+		return shim.Error(res)
+	}
+
+	var evs events.List
+	err = a.recordMovement(stub, args[0], args[1], args[2], delta, reference, target)
+	if err == nil {
+		err = evs.Add(events.StockMoved, stockEvent(args[0], args[1], args[2], delta, reference, target))
+	}
+	if err != nil {
+		res := getRetError("Chaincode Invoke moveStock failed : ", err)
+		return shim.Error(res)
+	}
+	if args[2] == MoveTransfer {
+		// 调入方记录相反的一条
+		err = a.recordMovement(stub, args[0], target, args[2], quantity, reference, args[1])
+		if err == nil {
+			err = evs.Add(events.StockMoved, stockEvent(args[0], target, args[2], quantity, reference, args[1]))
+		}
+		if err != nil {
+			res := getRetError("Chaincode Invoke moveStock failed : ", err)
+			return shim.Error(res)
+		}
+	}
+	err = evs.Emit(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke moveStock set event failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke moveStock success")
+	return shim.Success(res)
+}
+
+// 确认类别存在后写入流水
+func (a *CategoryChaincode) recordMovement(stub shim.ChaincodeStubInterface, cateID, storeID, moveType string, delta decimal.Decimal, reference, peer string) error {
+	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + cateID, storeID})
+	if err != nil {
+		return err
+	}
+	_, existbl := a.getRecord(stub, CateStoreKey)
+	if !existbl {
+		return errcode.New(errcode.NotFound, "category "+cateID+" does not exist in store "+storeID)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	entry := StockEntry{
+		CateID:    cateID,
+		StoreID:   storeID,
+		TxID:      stub.GetTxID(),
+		Type:      moveType,
+		Quantity:  delta,
+		Reference: reference,
+		Peer:      peer,
+		Time:      txtime.Format(now),
+	}
+	return a.putStockEntry(stub, entry)
+}
+
+// 查询当前库存
+// args: 0 - Category ID, 1 - Store ID
+func (a *CategoryChaincode) getStock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke getStock args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+
+	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + args[0], args[1]})
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke getStock: CreateCompositeKey failed")
+		return shim.Error(res)
+	}
+	record, existbl := a.getRecord(stub, CateStoreKey)
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke getStock failed : record does not exist")
+		return shim.Error(res)
+	}
+
+	stock, entries, err := a.currentStock(stub, record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke getStock failed : ", err)
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(StockSummary{CateID: args[0], StoreID: args[1], Stock: stock, Entries: entries})
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode Marshal getStock error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 查询库存流水
+// args: 0 - Category ID, 1 - Store ID
+func (a *CategoryChaincode) queryStockEntries(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke queryStockEntries args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+
+	entriesIterator, err := stub.GetStateByPartialCompositeKey(StockIndexName, []string{args[1], args[0]})
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke queryStockEntries get entries error")
+		return shim.Error(res)
+	}
+	defer entriesIterator.Close()
+
+	var entryList = []StockEntry{}
+	for entriesIterator.HasNext() {
+		kv, err := entriesIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke queryStockEntries iterator error")
+			return shim.Error(res)
+		}
+		var entry StockEntry
+		err = json.Unmarshal(kv.Value, &entry)
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke queryStockEntries unmarshal failed")
+			return shim.Error(res)
+		}
+		entryList = append(entryList, entry)
+	}
+
+	b, err := json.Marshal(entryList)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CategoryChaincode Marshal queryStockEntries error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 合并旧流水: 将Time早于before的流水累加到类别记录的Stock中并删除这些流水
+// 删除的流水仍可通过区块历史审计; 合并会修改类别记录, 建议定期在低峰期执行
+// args: 0 - Category ID, 1 - Store ID, 2 - before (unix毫秒, 兼容unix秒)
+func (a *CategoryChaincode) compactStock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke compactStock args!=3", errcode.Args("want 3"))
+		return shim.Error(res)
+	}
+	before, err := txtime.Parse(args[2])
+	if err != nil || before <= 0 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke compactStock failed : before should be a unix timestamp")
+		return shim.Error(res)
+	}
+	err = authz.CheckStore(stub, args[1])
+	if err != nil {
+		res := getRetError("Chaincode Invoke compactStock failed : ", err)
+		return shim.Error(res)
+	}
+
+	CateStoreKey, err := stub.CreateCompositeKey(IndexName, []string{Record_Prefix + args[0], args[1]})
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke compactStock: CreateCompositeKey failed")
+		return shim.Error(res)
+	}
+	record, existbl := a.getRecord(stub, CateStoreKey)
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke compactStock failed : record does not exist")
+		return shim.Error(res)
+	}
+
+	sum, keys, err := a.sumStockEntries(stub, args[0], args[1], before)
+	if err != nil {
+		res := getRetError("Chaincode Invoke compactStock failed : ", err)
+		return shim.Error(res)
+	}
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke compactStock delete entry failed")
+			return shim.Error(res)
+		}
+	}
+
+	record.Stock, err = record.Stock.Add(sum)
+	if err != nil {
+		res := getRetError("Chaincode Invoke compactStock failed : ", err)
+		return shim.Error(res)
+	}
+	_, bl := a.putRecord(stub, CateStoreKey, record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke compactStock put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke compactStock success: "+strconv.Itoa(len(keys))+" entries folded")
+	return shim.Success(res)
+}
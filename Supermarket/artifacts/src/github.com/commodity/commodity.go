@@ -1,7 +1,7 @@
 /*
 商品记录
 每类商品有编号，用于记录价格、剩余量等信息
-每个商品有单独编号，用于记录进货时间等信息
+每个商品有单独编号(由登记交易的交易ID生成)，用于记录进货时间等信息
 */
 
 package main
@@ -9,25 +9,40 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/events"
+	"github.com/common/history"
+	"github.com/common/ledger"
+	"github.com/common/schema"
+	"github.com/common/sequence"
+	"github.com/common/shelflife"
+	"github.com/common/txtime"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"strconv"
-	"time"
+	"unicode/utf8"
 )
 
 var logger = shim.NewLogger("Commodity")
 
 // 每个商品 commodity struct
 type Record struct {
-	ID         string `json:ID`        // ID
-	Name       string `json:Name`      // full name
-	Category   string `json:Category` // category id
-	StoreID    string `json:StoreID`
-	StoreName  string `json:StoreName`
-	Supplier   string `json:Supplier`
-	Place      string `json:Place`      // place of production
-	Date       string `json:Date`       //date of production
-	CreateTime string `json:CreateTime` // 创建时间
+	ID          string            `json:"ID"`       // ID
+	Name        string            `json:"Name"`     // full name
+	Category    string            `json:"Category"` // category id
+	StoreID     string            `json:"StoreID"`
+	StoreName   string            `json:"StoreName"`        // 查询时从StoreChaincode取得, 不再保存
+	Supplier    string            `json:"Supplier"`         // 供应商ID, 见SupplierChaincode
+	Place       string            `json:"Place"`            // place of production
+	Date        string            `json:"Date"`             //date of production, YYYY-MM-DD
+	Lot         string            `json:"Lot"`              // 生产批号, 可选
+	BestBefore  string            `json:"BestBefore"`       // 保质到期日, 由生产日期和类别保质期计算, 不限保质期时为空
+	CreateTime  string            `json:"CreateTime"`       // 创建时间
+	State       string            `json:"State"`            // 商品状态, 见lifecycle.go
+	Transitions []StateTransition `json:"Transitions"`      // 状态变更记录
+	Recall      *RecallMark       `json:"Recall,omitempty"` // 被召回时的标记, 召回的商品不能卖出
+	Version     int64             `json:"Version"`          // 版本, 每次写入加一, 见change
 }
 
 // 历史item结构
@@ -42,10 +57,42 @@ const Record_Prefix = "Comm_"
 // composite keys
 const IndexName = "storeID~CommID"
 
-// chaincode response结构
-type chaincodeRet struct {
-	Code int    // 0 success otherwise 1
-	Des  string //description
+// 权限矩阵; 写操作还要检查提交者能否操作商品所在店铺
+var permissions = authz.Matrix{
+	"insert":               authz.Staff,
+	"query":                authz.Everyone,
+	"queryHistory":         authz.Staff,
+	"change":               authz.Staff,
+	"sell":                 authz.Staff,
+	"delete":               authz.Managers,
+	"queryExpiring":        authz.Staff,
+	"queryByStore":         authz.Staff,
+	"search":               authz.Staff,
+	"queryByCategory":      authz.Staff,
+	"queryByStoreCategory": authz.Staff,
+	"setState":             authz.Staff,
+	"setState.disposed":    authz.Managers,
+	"recall":               {authz.Admin},
+	"setRecallStatus":      {authz.Admin},
+	"queryRecall":          authz.Staff,
+	"migrate":              {authz.Admin},
+	"querySchema":          authz.Everyone,
+	"exists":               authz.Everyone,
+	"queryRefs":            authz.Staff,
+	"cascadeDelete":        authz.Managers,
+	"setIdempotencyWindow": {authz.Admin},
+	"purgeIdempotencyKeys": {authz.Admin},
+}
+
+// 商品事件的数据
+func commodityEvent(record Record, reference string) events.Commodity {
+	return events.Commodity{
+		ID:        record.ID,
+		Category:  record.Category,
+		StoreID:   record.StoreID,
+		Supplier:  record.Supplier,
+		Reference: reference,
+	}
 }
 
 // 根据ID取出记录
@@ -62,9 +109,9 @@ func (a *CommodityChaincode) getRecord(stub shim.ChaincodeStubInterface, key str
 	return record, true
 }
 
-// 保存记录
+// 保存记录, 版本加一
 func (a *CommodityChaincode) putRecord(stub shim.ChaincodeStubInterface, key string, record Record) ([]byte, bool) {
-
+	record.Version++
 	byte, err := json.Marshal(record)
 	if err != nil {
 		return nil, false
@@ -74,6 +121,11 @@ func (a *CommodityChaincode) putRecord(stub shim.ChaincodeStubInterface, key str
 	if err != nil {
 		return nil, false
 	}
+	// 记录提交者, 见queryHistory
+	err = history.Stamp(stub)
+	if err != nil {
+		return nil, false
+	}
 	return byte, true
 }
 
@@ -82,10 +134,8 @@ type CommodityChaincode struct {
 }
 
 // response message format
-func getRetByte(code int, des string) []byte {
-	var r chaincodeRet
-	r.Code = code
-	r.Des = des
+func getRetByte(code int, des string, details ...errcode.Detail) []byte {
+	r := errcode.NewRet(code, des, details...)
 
 	b, err := json.Marshal(r)
 
@@ -97,10 +147,8 @@ func getRetByte(code int, des string) []byte {
 }
 
 // response message format
-func getRetString(code int, des string) string {
-	var r chaincodeRet
-	r.Code = code
-	r.Des = des
+func getRetString(code int, des string, details ...errcode.Detail) string {
+	r := errcode.NewRet(code, des, details...)
 
 	b, err := json.Marshal(r)
 
@@ -112,6 +160,11 @@ func getRetString(code int, des string) string {
 	return string(b[:])
 }
 
+// 按错误的错误码返回, 保留被调用链码的Details
+func getRetError(des string, err error) string {
+	return getRetString(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...)
+}
+
 func (t *CommodityChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### Commodity Chaincode Init ###########")
 	//val, ok, err := cid.GetAttributeValue(stub, "type")
@@ -124,112 +177,307 @@ func (t *CommodityChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response
 
 // Transaction makes payment of X units from A to B
 func (t *CommodityChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	resp := ledger.DispatchOnce(stub, t.dispatch)
+	if resp.Status != shim.OK {
+		// 错误返回带上交易ID
+		resp.Message = errcode.Stamp(resp.Message, stub.GetTxID())
+	}
+	return resp
+}
+
+// 按函数名分发
+func (t *CommodityChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### chaincode Invoke ###########")
 
 	function, args := stub.GetFunctionAndParameters()
 	logger.Info("%s%s", "CommodityChaincode function=", function)
 	logger.Info("%s%s", "CommodityChaincode args=", args)
+	// 权限检查
+	_, err := permissions.Authorize(stub, function)
+	if err != nil {
+		res := getRetError("CommodityChaincode ", err)
+		return shim.Error(res)
+	}
 	if function == "insert" {
 		// 插入信息
 		return t.insert(stub, args)
+	} else if function == "queryHistory" {
+		// 变更历史
+		return t.queryHistory(stub, args)
 	} else if function == "query" {
 		// 根据编号查询
 		return t.queryByID(stub, args)
+	} else if function == "change" {
+		// 修改登记信息
+		return t.change(stub, args)
+	} else if function == "sell" {
+		// 卖出
+		return t.sell(stub, args)
 	} else if function == "delete" {
 		// 删除记录
 		return t.delete(stub, args)
+	} else if function == "search" {
+		// 按供应商、产地、生产日期等查找
+		return t.search(stub, args)
+	} else if function == "queryByStore" {
+		// 按店铺分页查询
+		return t.queryByStore(stub, args)
+	} else if function == "queryByCategory" {
+		// 按类别分页查询
+		return t.queryByCategory(stub, args)
+	} else if function == "queryByStoreCategory" {
+		// 按店铺和类别分页查询
+		return t.queryByStoreCategory(stub, args)
+	} else if function == "queryExpiring" {
+		// 查询即将到期的商品
+		return t.queryExpiring(stub, args)
+	} else if function == "setState" {
+		// 修改商品状态
+		return t.setState(stub, args)
+	} else if function == "recall" {
+		// 召回商品
+		return t.recall(stub, args)
+	} else if function == "setRecallStatus" {
+		// 召回进度
+		return t.setRecallStatus(stub, args)
+	} else if function == "queryRecall" {
+		// 召回报告
+		return t.queryRecall(stub, args)
+	} else if function == "migrate" {
+		// 清除旧记录中的StoreName副本
+		return t.migrate(stub, args)
+	} else if function == "querySchema" {
+		// 查询记录的JSON Schema
+		return t.querySchema(stub, args)
+	} else if function == "exists" {
+		// 商品是否存在
+		return t.exists(stub, args)
+	} else if function == "queryRefs" {
+		// 仍引用类别的商品
+		return t.queryRefs(stub, args)
+	} else if function == "cascadeDelete" {
+		// 随类别软删除
+		return t.cascadeDelete(stub, args)
+	} else if function == "setIdempotencyWindow" {
+		// 设置幂等key的保存时间
+		return ledger.SetIdempotencyWindow(stub, args)
+	} else if function == "purgeIdempotencyKeys" {
+		// 删除已失效的幂等key
+		return ledger.PurgeIdempotencyKeys(stub, args)
 	}
 
-	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", args[0])
-	res := getRetString(1, "Unknown action")
+	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", function)
+	res := getRetString(errcode.Validation, "Unknown action: "+function, errcode.Field("function", "unknown"))
 	return shim.Error(res)
 }
 
-// 加入新记录
-// args: 0 - {Record Object}
+// 加入新记录, ID由交易ID生成, 返回登记的记录
+// 只能由GoodsChaincode.insert、PurchaseOrderChaincode.receive调用, 入库与库存流水在同一交易中
+// args: 0 - {Record Object}, 1 - 本交易登记的第几件(可选, 从0开始; 一个交易登记多件时由调用方递增)
 func (a *CommodityChaincode) insert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke insert args!=1")
+	if len(args) != 1 && len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert args should be 1 or 2", errcode.Args("want 1 or 2"))
 		return shim.Error(res)
 	}
+	if ledger.TopLevel(stub) {
+		res := getRetString(errcode.Forbidden, "Chaincode Invoke insert failed : only GoodsChaincode.insert and PurchaseOrderChaincode.receive can insert")
+		return shim.Error(res)
+	}
+	n := 0
+	if len(args) == 2 {
+		var err error
+		n, err = strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			res := getRetString(errcode.Validation, "Chaincode Invoke insert failed : index should be a non-negative integer", errcode.Field("index", "should be a non-negative integer"))
+			return shim.Error(res)
+		}
+	}
 
 	var record Record
-	err := json.Unmarshal([]byte(args[0]), &record)
+	err := recordSchema.Decode(args[0], &record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+	record.ID = sequence.ID(stub.GetTxID(), n)
+	err = authz.CheckStore(stub, record.StoreID)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insert unmarshal failed")
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+
+	err = checkStore(stub, record.StoreID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+	// 店铺名称查询时从StoreChaincode取得
+	record.StoreName = ""
+	// 类别必须在同一店铺存在
+	err = checkCategory(stub, record.Category, record.StoreID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+	err = checkSupplier(stub, record.Supplier, record.Category)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+	record.BestBefore, err = bestBefore(stub, record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
 		return shim.Error(res)
 	}
 
 	//根据ID 查找是否ID已存在
 	_, existbl := a.getRecord(stub, Record_Prefix+record.ID)
 	if existbl {
-		res := getRetString(1, "Chaincode Invoke insert failed : the recordNo has exist ")
+		res := getRetString(errcode.AlreadyExists, "Chaincode Invoke insert failed : the recordNo has exist ")
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	//13位时间戳(毫秒)
+	record.CreateTime = txtime.Format(now)
+	record.Recall = nil
+	record.Version = 0
+	received, err := newTransition(stub, "", StateReceived, "")
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert failed :get time stamp failed ")
 		return shim.Error(res)
 	}
-	//13位时间戳
-	record.CreateTime = strconv.FormatInt(time.Now().Unix(), 10)
+	record.State = StateReceived
+	record.Transitions = []StateTransition{received}
 
 	// 保存记录
-	_, bl := a.putRecord(stub, Record_Prefix+record.ID, record)
+	b, bl := a.putRecord(stub, Record_Prefix+record.ID, record)
 	if !bl {
-		res := getRetString(1, "Chaincode Invoke insert put record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert put record failed")
+		return shim.Error(res)
+	}
+	if record.BestBefore != "" {
+		err = stub.PutState(expiryKey(record.StoreID, record.BestBefore, record.ID), []byte{0x00})
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke insert put expiry index failed")
+			return shim.Error(res)
+		}
+	}
+	err = putListIndex(stub, record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert put list index failed : ", err)
 		return shim.Error(res)
 	}
 
-	res := getRetByte(0, "invoke insert success")
-	return shim.Success(res)
+	err = events.Emit(stub, events.CommodityReceived, commodityEvent(record, ""))
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert set event failed")
+		return shim.Error(res)
+	}
+
+	return shim.Success(b)
 }
 
 // 根据ID查找记录
-//  0 - Commodity ID
+//
+//	0 - Commodity ID
 func (a *CommodityChaincode) queryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "CommodityChaincode queryByRecordNo args!=1")
+		res := getRetString(errcode.Validation, "CommodityChaincode queryByID args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
 	// 取得该记录
 	record, bl := a.getRecord(stub, Record_Prefix+args[0])
 	if !bl {
-		res := getRetString(1, "CommodityChaincode queryByRecordNo get record error")
+		res := getRetString(errcode.NotFound, "CommodityChaincode queryByID get record error")
 		return shim.Error(res)
 	}
+	record.StoreName = storeNames{}.get(stub, record.StoreID)
 
 	b, err := json.Marshal(record)
 	if err != nil {
-		res := getRetString(1, "CommodityChaincode Marshal queryByRecordNo recordList error")
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal queryByID recordList error")
 		return shim.Error(res)
 	}
 	return shim.Success(b)
 }
 
-// TODO unused
-// 修改记录
-// args: 0 - {Record Object}
+// 修改登记信息(名称、产地、生产日期、批号), JSON merge patch: 只需提交要修改的字段
+// 类别、店铺、供应商不能修改, 登记错误时delete后重新登记; 生产日期变化时重新计算保质到期日
+// Version为查询时读到的版本, 记录已被他人修改时返回412
+// args: 0 - {"ID": ..., "Version": ..., 要修改的字段}
 func (a *CommodityChaincode) change(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke change args!=1")
+		res := getRetString(errcode.Validation, "Chaincode Invoke change args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
-	var record Record
-	err := json.Unmarshal([]byte(args[0]), &record)
+	var target struct {
+		ID string `json:"ID"`
+	}
+	err := json.Unmarshal([]byte(args[0]), &target)
+	if err != nil || target.ID == "" {
+		res := getRetString(errcode.Validation, "Chaincode Invoke change failed : ID is required", errcode.Field("ID", "is required"))
+		return shim.Error(res)
+	}
+	expected, err := schema.ExpectedVersion(args[0])
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke change unmarshal failed")
+		res := getRetError("Chaincode Invoke change failed : ", err)
 		return shim.Error(res)
 	}
 
 	//根据ID 查找是否ID已存在
-	_, existbl := a.getRecord(stub, Record_Prefix+record.ID)
+	old, existbl := a.getRecord(stub, Record_Prefix+target.ID)
 	if !existbl {
-		res := getRetString(1, "Chaincode Invoke change failed : change without existed record")
+		res := getRetString(errcode.NotFound, "Chaincode Invoke change failed : change without existed record")
+		return shim.Error(res)
+	}
+	err = authz.CheckStore(stub, old.StoreID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
+		return shim.Error(res)
+	}
+	err = schema.CheckVersion(expected, old.Version)
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
+		return shim.Error(res)
+	}
+	var record Record
+	err = recordSchema.Merge(old, args[0], &record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
 		return shim.Error(res)
 	}
 
+	if record.Date != old.Date {
+		record.BestBefore, err = bestBefore(stub, record)
+		if err != nil {
+			res := getRetError("Chaincode Invoke change failed : ", err)
+			return shim.Error(res)
+		}
+		// 在售的商品才有到期索引
+		if record.BestBefore != old.BestBefore && saleable[record.state()] {
+			if old.BestBefore != "" {
+				err = stub.DelState(expiryKey(old.StoreID, old.BestBefore, old.ID))
+			}
+			if err == nil && record.BestBefore != "" {
+				err = stub.PutState(expiryKey(record.StoreID, record.BestBefore, record.ID), []byte{0x00})
+			}
+			if err != nil {
+				res := getRetString(errcode.Internal, "Chaincode Invoke change put expiry index failed")
+				return shim.Error(res)
+			}
+		}
+	}
+
 	// 保存记录
 	_, bl := a.putRecord(stub, Record_Prefix+record.ID, record)
 	if !bl {
-		res := getRetString(1, "Chaincode Invoke change put record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke change put record failed")
 		return shim.Error(res)
 	}
 
@@ -237,37 +485,167 @@ func (a *CommodityChaincode) change(stub shim.ChaincodeStubInterface, args []str
 	return shim.Success(res)
 }
 
-// 删除记录
+// 删除记录, 只用于更正登记错误; 报废、过期等用setState, 记录保留
 // args: 0 - ID
 func (a *CommodityChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke delete args!=1")
+		res := getRetString(errcode.Validation, "Chaincode Invoke delete args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
 	//根据ID 查找是否ID已存在
 	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
 	if !existbl {
-		res := getRetString(1, "Chaincode Invoke delete failed : delete without existed record ")
+		res := getRetString(errcode.NotFound, "Chaincode Invoke delete failed : delete without existed record ")
+		return shim.Error(res)
+	}
+	err := authz.CheckStore(stub, record.StoreID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke delete failed : ", err)
 		return shim.Error(res)
 	}
 
-	err := stub.DelState(Record_Prefix + args[0])
+	err = stub.DelState(Record_Prefix + args[0])
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete delete record failed")
+		return shim.Error(res)
+	}
+	err = history.Stamp(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete stamp history failed")
+		return shim.Error(res)
+	}
+	if record.BestBefore != "" && saleable[record.state()] {
+		err = stub.DelState(expiryKey(record.StoreID, record.BestBefore, record.ID))
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke delete delete expiry index failed")
+			return shim.Error(res)
+		}
+	}
+	err = delListIndex(stub, record)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke delete delete record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete delete list index failed")
 		return shim.Error(res)
 	}
 
 	b, err := json.Marshal(record)
 	if err != nil {
-		res := getRetString(1, "CommodityChaincode Marshal record error")
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal record error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 卖出商品, 拒绝已召回或已过期的商品; 卖出的商品保留记录, 状态为sold
+// args: 0 - ID
+// 返回卖出后的记录
+func (a *CommodityChaincode) sell(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke sell args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke sell failed : sell without existed record ")
+		return shim.Error(res)
+	}
+	err := authz.CheckStore(stub, record.StoreID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke sell failed : ", err)
+		return shim.Error(res)
+	}
+	if record.Recall != nil {
+		res := getRetString(errcode.BusinessRule, "Chaincode Invoke sell failed : commodity "+record.ID+" is recalled by "+record.Recall.ID)
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke sell failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	if shelflife.Expired(record.BestBefore, now) {
+		res := getRetString(errcode.BusinessRule, "Chaincode Invoke sell failed : commodity "+record.ID+" expired on "+record.BestBefore)
+		return shim.Error(res)
+	}
+
+	record.StoreName = ""
+	err = moveState(stub, &record, StateSold, "")
+	if err != nil {
+		res := getRetError("Chaincode Invoke sell failed : ", err)
+		return shim.Error(res)
+	}
+	b, bl := a.putRecord(stub, Record_Prefix+record.ID, record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke sell put record failed")
+		return shim.Error(res)
+	}
+	err = events.Emit(stub, events.CommoditySold, commodityEvent(record, ""))
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke sell set event failed")
 		return shim.Error(res)
 	}
 	return shim.Success(b)
 }
 
+// 迁移旧数据: 清除记录中保存的StoreName副本, 店铺名称统一由StoreChaincode提供; 没有状态的记录设为received, 并补写列表索引
+// args: 无
+func (a *CommodityChaincode) migrate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke migrate args!=0", errcode.Args("want 0"))
+		return shim.Error(res)
+	}
+
+	recordsIterator, err := stub.GetStateByRange(Record_Prefix, Record_Prefix+string(utf8.MaxRune))
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke migrate get records error")
+		return shim.Error(res)
+	}
+	defer recordsIterator.Close()
+	count := 0
+	for recordsIterator.HasNext() {
+		kv, err := recordsIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate iterator error")
+			return shim.Error(res)
+		}
+		var record Record
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate unmarshal failed: "+kv.Key)
+			return shim.Error(res)
+		}
+		err = putListIndex(stub, record)
+		if err != nil {
+			res := getRetError("Chaincode Invoke migrate put list index failed : ", err)
+			return shim.Error(res)
+		}
+		if record.StoreName == "" && record.State != "" {
+			continue
+		}
+		record.StoreName = ""
+		if record.State == "" {
+			record.State = StateReceived
+		}
+		_, bl := a.putRecord(stub, kv.Key, record)
+		if !bl {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate put record failed")
+			return shim.Error(res)
+		}
+		count++
+	}
+
+	res := getRetByte(0, "invoke migrate success: "+strconv.Itoa(count)+" records")
+	return shim.Success(res)
+}
+
 func main() {
-	err := shim.Start(new(CommodityChaincode))
+	err := recordSchema.Sync(Record{})
+	if err != nil {
+		logger.Errorf("Error starting Commodity chaincode: %s", err)
+		return
+	}
+	err = shim.Start(new(CommodityChaincode))
 	if err != nil {
 		logger.Errorf("Error starting Commodity chaincode: %s", err)
 	}
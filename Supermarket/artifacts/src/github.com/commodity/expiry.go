@@ -0,0 +1,126 @@
+/*
+保质期
+登记商品时由生产日期(Date)和类别保质期(CategoryChaincode.getShelfLife)计算保质到期日(BestBefore),
+并写入按店铺、到期日排序的索引, 查询即将到期的商品只扫描索引中的一段, 不扫描整个店铺
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/shelflife"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 被调用的chaincode名称
+const CategoryChaincodeName = "category"
+
+// 到期索引: Expiry_<StoreID>~<BestBefore>~<Commodity ID>, 值为空
+// 组合键不支持范围查询, 因此使用普通key; StoreID不能包含"~"
+const ExpiryIndex_Prefix = "Expiry_"
+
+// 查询的最大天数
+const MaxExpiringDays = 366
+
+func expiryKey(storeID, bestBefore, id string) string {
+	return ExpiryIndex_Prefix + storeID + "~" + bestBefore + "~" + id
+}
+
+// 交易时间(unix毫秒), 所有背书节点一致
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
+// 计算保质到期日; 类别不限保质期时为空
+func bestBefore(stub shim.ChaincodeStubInterface, record Record) (string, error) {
+	if strings.Contains(record.StoreID, "~") {
+		return "", errcode.New(errcode.Validation, "StoreID should not contain ~", errcode.Field("StoreID", "should not contain ~"))
+	}
+	resp := invoke(stub, CategoryChaincodeName, "getShelfLife", record.Category, record.StoreID)
+	if resp.Status != shim.OK {
+		return "", errcode.FromResponse(resp.Message)
+	}
+	d, err := shelflife.Parse(string(resp.Payload))
+	if err != nil {
+		return "", err
+	}
+	if d.IsZero() {
+		return "", nil
+	}
+	if record.Date == "" {
+		return "", errcode.New(errcode.Validation, "Date of production is required for goods with a shelf life", errcode.Field("Date", "is required for goods with a shelf life"))
+	}
+	return shelflife.BestBefore(record.Date, d)
+}
+
+// 查询店铺中N天内到期(含已过期)的商品, 按到期日排序
+// args: 0 - Store ID, 1 - days
+func (a *CommodityChaincode) queryExpiring(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "CommodityChaincode queryExpiring args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	days, err := strconv.Atoi(args[1])
+	if err != nil || days < 0 || days > MaxExpiringDays {
+		res := getRetString(errcode.Validation, "CommodityChaincode queryExpiring failed : days should be 0 to "+strconv.Itoa(MaxExpiringDays))
+		return shim.Error(res)
+	}
+	err = authz.CheckStore(stub, args[0])
+	if err != nil {
+		res := getRetError("CommodityChaincode queryExpiring: ", err)
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode queryExpiring failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	until := shelflife.DateOf(now + int64(days)*txtime.Day)
+
+	prefix := ExpiryIndex_Prefix + args[0] + "~"
+	indexIterator, err := stub.GetStateByRange(prefix, prefix+until+"~"+string(utf8.MaxRune))
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode queryExpiring get index error")
+		return shim.Error(res)
+	}
+	defer indexIterator.Close()
+
+	var recordList = []Record{}
+	names := storeNames{}
+	for indexIterator.HasNext() {
+		kv, err := indexIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "CommodityChaincode queryExpiring iterator error")
+			return shim.Error(res)
+		}
+		parts := strings.SplitN(strings.TrimPrefix(kv.Key, prefix), "~", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		record, bl := a.getRecord(stub, Record_Prefix+parts[1])
+		if !bl {
+			res := getRetString(errcode.Internal, "CommodityChaincode queryExpiring get record error: "+parts[1])
+			return shim.Error(res)
+		}
+		record.StoreName = names.get(stub, record.StoreID)
+		recordList = append(recordList, record)
+	}
+
+	b, err := json.Marshal(recordList)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal queryExpiring recordList error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
@@ -0,0 +1,206 @@
+/*
+商品状态
+每件商品从登记(received)开始, 只能按下表变更状态, 每次变更记录交易ID和交易时间;
+卖出、报废等状态的商品仍保留记录, 可按ID查询, 用于追溯、退货和召回
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/shelflife"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 商品状态
+const (
+	StateReceived = "received" // 已登记(收货)
+	StateOnShelf  = "on-shelf" // 已上架
+	StateReserved = "reserved" // 已预留
+	StateSold     = "sold"
+	StateReturned = "returned" // 顾客退货
+	StateDamaged  = "damaged"
+	StateExpired  = "expired"
+	StateRecalled = "recalled"
+	StateDisposed = "disposed" // 已报废处理, 终止状态
+	StateDeleted  = "deleted"  // 类别按cascade策略删除时软删除, 终止状态, 见refs.go
+)
+
+// 合法的状态变更
+var transitions = map[string][]string{
+	StateReceived: {StateOnShelf, StateReserved, StateSold, StateDamaged, StateExpired, StateRecalled, StateDisposed, StateDeleted},
+	StateOnShelf:  {StateReserved, StateSold, StateDamaged, StateExpired, StateRecalled, StateDeleted},
+	StateReserved: {StateOnShelf, StateSold, StateDamaged, StateExpired, StateRecalled, StateDeleted},
+	StateSold:     {StateReturned},
+	StateReturned: {StateOnShelf, StateDamaged, StateExpired, StateRecalled, StateDisposed, StateDeleted},
+	StateDamaged:  {StateDisposed, StateRecalled, StateDeleted},
+	StateExpired:  {StateDisposed, StateRecalled, StateDeleted},
+	StateRecalled: {StateDisposed, StateDeleted},
+	StateDisposed: {},
+	StateDeleted:  {},
+}
+
+// 这些状态的商品仍在店内可售, 保留到期索引
+var saleable = map[string]bool{
+	StateReceived: true,
+	StateOnShelf:  true,
+	StateReserved: true,
+	StateReturned: true,
+}
+
+// 状态变更记录
+type StateTransition struct {
+	From  string `json:"From"`
+	To    string `json:"To"`
+	By    string `json:"By"` // 操作人enrollment ID
+	TxID  string `json:"TxID"`
+	Time  string `json:"Time"`
+	Notes string `json:"Notes"`
+}
+
+// 商品当前状态, 旧记录没有状态时视为received
+func (r *Record) state() string {
+	if r.State == "" {
+		return StateReceived
+	}
+	return r.State
+}
+
+// 最近一次卖出的交易, 未卖出时为nil
+func (r *Record) lastSale() *StateTransition {
+	for i := len(r.Transitions) - 1; i >= 0; i-- {
+		if r.Transitions[i].To == StateSold {
+			return &r.Transitions[i]
+		}
+	}
+	return nil
+}
+
+// 是否可以从from变更为to
+func canMove(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// 状态变更记录, 时间为交易时间
+func newTransition(stub shim.ChaincodeStubInterface, from, to, notes string) (StateTransition, error) {
+	now, err := txTime(stub)
+	if err != nil {
+		return StateTransition{}, err
+	}
+	by := ""
+	if id, err := authz.GetIdentity(stub); err == nil {
+		by = id.ID
+	}
+	return StateTransition{
+		From:  from,
+		To:    to,
+		By:    by,
+		TxID:  stub.GetTxID(),
+		Time:  txtime.Format(now),
+		Notes: notes,
+	}, nil
+}
+
+// 变更状态, 同时维护到期索引; 不保存记录
+func moveState(stub shim.ChaincodeStubInterface, record *Record, to string, notes string) error {
+	from := record.state()
+	if !canMove(from, to) {
+		return errcode.New(errcode.Conflict, "cannot move commodity "+record.ID+" from "+from+" to "+to)
+	}
+	t, err := newTransition(stub, from, to, notes)
+	if err != nil {
+		return err
+	}
+	record.Transitions = append(record.Transitions, t)
+	record.State = to
+
+	if record.BestBefore != "" && saleable[from] != saleable[to] {
+		key := expiryKey(record.StoreID, record.BestBefore, record.ID)
+		if saleable[to] {
+			err = stub.PutState(key, []byte{0x00})
+		} else {
+			err = stub.DelState(key)
+		}
+	}
+	return err
+}
+
+// 修改商品状态; 卖出用sell, 召回用recall
+// args: 0 - ID, 1 - state, 2 - notes(可选)
+func (a *CommodityChaincode) setState(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setState args should be 2 or 3", errcode.Args("want 2 or 3"))
+		return shim.Error(res)
+	}
+	var notes string
+	if len(args) == 3 {
+		notes = args[2]
+	}
+	to := args[1]
+	if to == StateSold || to == StateRecalled || to == StateDeleted {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setState failed : use sell, recall or CategoryChaincode.delete to move a commodity to "+to)
+		return shim.Error(res)
+	}
+	if _, ok := transitions[to]; !ok {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setState failed : unknown state "+to)
+		return shim.Error(res)
+	}
+
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke setState failed : the commodity does not exist")
+		return shim.Error(res)
+	}
+	err := authz.CheckStore(stub, record.StoreID)
+	if err == nil && to == StateDisposed {
+		_, err = permissions.Authorize(stub, "setState."+StateDisposed)
+	}
+	if err != nil {
+		res := getRetError("Chaincode Invoke setState failed : ", err)
+		return shim.Error(res)
+	}
+	if record.Recall != nil && saleable[to] {
+		res := getRetString(errcode.BusinessRule, "Chaincode Invoke setState failed : commodity "+record.ID+" is recalled by "+record.Recall.ID)
+		return shim.Error(res)
+	}
+	// 退回货架时不能是已过期的商品
+	if to == StateOnShelf && record.BestBefore != "" {
+		now, err := txTime(stub)
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke setState failed :get time stamp failed ")
+			return shim.Error(res)
+		}
+		if shelflife.Expired(record.BestBefore, now) {
+			res := getRetString(errcode.BusinessRule, "Chaincode Invoke setState failed : commodity "+record.ID+" expired on "+record.BestBefore)
+			return shim.Error(res)
+		}
+	}
+
+	err = moveState(stub, &record, to, notes)
+	if err != nil {
+		res := getRetError("Chaincode Invoke setState failed : ", err)
+		return shim.Error(res)
+	}
+	record.StoreName = ""
+	_, bl := a.putRecord(stub, Record_Prefix+record.ID, record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke setState put record failed")
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal record error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
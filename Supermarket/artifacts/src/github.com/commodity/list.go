@@ -0,0 +1,163 @@
+/*
+商品列表
+商品记录的key为 Comm_<ID>, 另建两个普通key索引, 按范围分页扫描:
+  CommStore_<StoreID>~<Category>~<ID>  按店铺、店铺加类别
+  CommCate_<Category>~<StoreID>~<ID>   按类别(跨店铺)
+卖出等状态的商品仍保留记录, 也在列表中
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/paging"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strings"
+)
+
+// 索引前缀, 值为空
+const (
+	StoreIndex_Prefix    = "CommStore_"
+	CategoryIndex_Prefix = "CommCate_"
+)
+
+// 商品的两个索引key
+func listIndexKeys(record Record) []string {
+	return []string{
+		paging.Key(StoreIndex_Prefix, record.StoreID, record.Category, record.ID),
+		paging.Key(CategoryIndex_Prefix, record.Category, record.StoreID, record.ID),
+	}
+}
+
+// 写入索引
+func putListIndex(stub shim.ChaincodeStubInterface, record Record) error {
+	err := paging.Check(record.StoreID, record.Category, record.ID)
+	if err != nil {
+		return err
+	}
+	for _, key := range listIndexKeys(record) {
+		err = stub.PutState(key, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 删除索引
+func delListIndex(stub shim.ChaincodeStubInterface, record Record) error {
+	for _, key := range listIndexKeys(record) {
+		err := stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 分页列出店铺的商品, 按类别、ID排序
+//
+//	0 - Store ID, 1 - page size(可选), 2 - bookmark(可选)
+func (a *CommodityChaincode) queryByStore(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		res := getRetString(errcode.Validation, "CommodityChaincode queryByStore args should be 1 to 3", errcode.Args("want 1 to 3"))
+		return shim.Error(res)
+	}
+	err := authz.CheckStore(stub, args[0])
+	if err != nil {
+		res := getRetError("CommodityChaincode queryByStore: ", err)
+		return shim.Error(res)
+	}
+	return a.queryPage(stub, "queryByStore", paging.Key(StoreIndex_Prefix, args[0], ""), 0, args[1:])
+}
+
+// 分页列出店铺中某类别的商品, 按ID排序
+//
+//	0 - Store ID, 1 - Category ID, 2 - page size(可选), 3 - bookmark(可选)
+func (a *CommodityChaincode) queryByStoreCategory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 || len(args) > 4 {
+		res := getRetString(errcode.Validation, "CommodityChaincode queryByStoreCategory args should be 2 to 4", errcode.Args("want 2 to 4"))
+		return shim.Error(res)
+	}
+	err := authz.CheckStore(stub, args[0])
+	if err != nil {
+		res := getRetError("CommodityChaincode queryByStoreCategory: ", err)
+		return shim.Error(res)
+	}
+	return a.queryPage(stub, "queryByStoreCategory", paging.Key(StoreIndex_Prefix, args[0], args[1], ""), 0, args[2:])
+}
+
+// 分页列出某类别在各店铺的商品, 按店铺、ID排序; 只列出提交者可以操作的店铺
+//
+//	0 - Category ID, 1 - page size(可选), 2 - bookmark(可选)
+func (a *CommodityChaincode) queryByCategory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		res := getRetString(errcode.Validation, "CommodityChaincode queryByCategory args should be 1 to 3", errcode.Args("want 1 to 3"))
+		return shim.Error(res)
+	}
+	return a.queryPage(stub, "queryByCategory", paging.Key(CategoryIndex_Prefix, args[0], ""), 1, args[1:])
+}
+
+// 按索引前缀分页, storeField为索引key中店铺字段的位置(从前缀后开始计数)
+func (a *CommodityChaincode) queryPage(stub shim.ChaincodeStubInterface, fn string, prefix string, storeField int, pageArgs []string) pb.Response {
+	size, bookmark, err := paging.Args(pageArgs)
+	if err != nil {
+		res := getRetString(errcode.Validation, "CommodityChaincode "+fn+" failed : "+err.Error())
+		return shim.Error(res)
+	}
+	id, err := authz.GetIdentity(stub)
+	if err != nil {
+		res := getRetError("CommodityChaincode "+fn+": ", err)
+		return shim.Error(res)
+	}
+	indexPrefix := StoreIndex_Prefix
+	if strings.HasPrefix(prefix, CategoryIndex_Prefix) {
+		indexPrefix = CategoryIndex_Prefix
+	}
+
+	start, end := paging.Range(prefix, bookmark)
+	indexIterator, err := stub.GetStateByRange(start, end)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode "+fn+" get index error")
+		return shim.Error(res)
+	}
+	defer indexIterator.Close()
+
+	var recordList = []Record{}
+	page := paging.Page{}
+	names := storeNames{}
+	for indexIterator.HasNext() {
+		kv, err := indexIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "CommodityChaincode "+fn+" iterator error")
+			return shim.Error(res)
+		}
+		fields := strings.Split(strings.TrimPrefix(kv.Key, indexPrefix), paging.Separator)
+		if len(fields) != 3 || !id.CanAccessStore(fields[storeField]) {
+			continue
+		}
+		if len(recordList) == size {
+			page.Bookmark = kv.Key
+			break
+		}
+		record, bl := a.getRecord(stub, Record_Prefix+fields[2])
+		if !bl {
+			res := getRetString(errcode.Internal, "CommodityChaincode "+fn+" get record error: "+fields[2])
+			return shim.Error(res)
+		}
+		record.StoreName = names.get(stub, record.StoreID)
+		recordList = append(recordList, record)
+	}
+	page.Records = recordList
+	page.Count = len(recordList)
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal "+fn+" page error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
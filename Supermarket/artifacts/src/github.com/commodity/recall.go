@@ -0,0 +1,479 @@
+/*
+商品召回
+供应商报告问题后, 按供应商、产地、批号、生产日期范围和类别选出受影响的商品, 标记为召回(召回的商品不能卖出),
+并按店铺列出受影响的商品及其是否已经卖出. 召回状态:
+  open -> in-progress -> closed, open 也可以直接 closed; 关闭后商品仍保持召回标记
+受影响的商品用CouchDB富查询选出(需要CouchDB状态数据库), 索引定义见 META-INF/statedb/couchdb/indexes
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/history"
+	"github.com/common/richquery"
+	"github.com/common/schema"
+	"github.com/common/shelflife"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strings"
+)
+
+// 发起召回时每次向CouchDB取的商品数, 与peer的queryLimit默认值一致, 取满时继续取下一批
+const RecallQueryLimit = richquery.MaxOffset
+
+// 召回状态
+const (
+	RecallOpen       = "open"
+	RecallInProgress = "in-progress"
+	RecallClosed     = "closed"
+)
+
+// 前缀
+const Recall_Prefix = "Recall_"
+
+// composite keys, 召回涉及的商品
+const RecallIndexName = "recallID~storeID~CommID"
+
+// 选择召回商品的条件; Supplier、Place、Lot至少一项, 其余条件用于缩小范围
+type RecallCriteria struct {
+	Supplier string `json:"Supplier"`
+	Place    string `json:"Place"`
+	Lot      string `json:"Lot"`
+	Category string `json:"Category"`
+	DateFrom string `json:"DateFrom"` // 生产日期范围, 含首尾, YYYY-MM-DD
+	DateTo   string `json:"DateTo"`
+}
+
+// 召回请求
+type RecallRequest struct {
+	Criteria  RecallCriteria `json:"Criteria"`
+	Reason    string         `json:"Reason"`
+	Reference string         `json:"Reference"` // 外部编号, 例如供应商的通知或监管部门的文号
+}
+
+// 商品上的召回标记
+type RecallMark struct {
+	ID        string `json:"ID"`
+	Reason    string `json:"Reason"`
+	Reference string `json:"Reference"`
+	Time      string `json:"Time"`
+}
+
+// 召回状态变更记录
+type RecallTransition struct {
+	From  string `json:"From"`
+	To    string `json:"To"`
+	By    string `json:"By"`
+	TxID  string `json:"TxID"`
+	Time  string `json:"Time"`
+	Notes string `json:"Notes"`
+}
+
+// 召回
+type Recall struct {
+	ID          string             `json:"ID"`
+	Criteria    RecallCriteria     `json:"Criteria"`
+	Reason      string             `json:"Reason"`
+	Reference   string             `json:"Reference"`
+	Status      string             `json:"Status"`
+	Units       int                `json:"Units"` // 涉及的商品数
+	Sold        int                `json:"Sold"`  // 其中召回前已卖出的数量
+	Transitions []RecallTransition `json:"Transitions"`
+	CreateTime  string             `json:"CreateTime"`
+}
+
+// 召回报告中的一件商品
+type RecallUnit struct {
+	ID       string `json:"ID"`
+	Name     string `json:"Name"`
+	Category string `json:"Category"`
+	Lot      string `json:"Lot"`
+	Date     string `json:"Date"`
+	Sold     bool   `json:"Sold"`
+	SoldTime string `json:"SoldTime"`
+}
+
+// 召回报告中的一个店铺
+type RecallStore struct {
+	StoreID   string       `json:"StoreID"`
+	StoreName string       `json:"StoreName"`
+	Sold      int          `json:"Sold"`
+	Unsold    int          `json:"Unsold"`
+	Units     []RecallUnit `json:"Units"`
+}
+
+// 召回报告
+type RecallReport struct {
+	Recall Recall        `json:"Recall"`
+	Stores []RecallStore `json:"Stores"`
+}
+
+// 检查并规范化召回条件
+func (c *RecallCriteria) check() error {
+	if c.Supplier == "" && c.Place == "" && c.Lot == "" {
+		return errors.New("one of Supplier, Place or Lot is required")
+	}
+	for _, d := range []*string{&c.DateFrom, &c.DateTo} {
+		if *d == "" {
+			continue
+		}
+		t, err := shelflife.ParseDate(*d)
+		if err != nil {
+			return err
+		}
+		*d = t.Format(shelflife.DateLayout)
+	}
+	if c.DateFrom != "" && c.DateTo != "" && c.DateFrom > c.DateTo {
+		return errors.New("DateFrom is after DateTo")
+	}
+	return nil
+}
+
+// 构造selector, 使用 META-INF/statedb/couchdb/indexes 中的索引;
+// 生产日期允许YYYY/MM/DD等写法, 不是YYYY-MM-DD的日期无法在CouchDB中比较, 一并取出后由match判断
+func (c *RecallCriteria) selector() richquery.Selector {
+	s := richquery.Selector{}
+	// 商品记录有Supplier字段, 召回等其他记录没有
+	s.Exists("Supplier")
+	s.Eq("Supplier", c.Supplier)
+	s.Eq("Place", c.Place)
+	s.Eq("Lot", c.Lot)
+	s.Eq("Category", c.Category)
+	if c.DateFrom != "" || c.DateTo != "" {
+		inRange, other := richquery.Selector{}, richquery.Selector{}
+		inRange.Between("Date", c.DateFrom, c.DateTo)
+		other.NotMatch("Date", `^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+		s.Or(inRange, other)
+	}
+	return s
+}
+
+// 商品是否符合召回条件; 指定日期范围时, 无法识别生产日期的商品也视为符合
+func (c *RecallCriteria) match(record Record) bool {
+	if c.Supplier != "" && record.Supplier != c.Supplier {
+		return false
+	}
+	if c.Place != "" && record.Place != c.Place {
+		return false
+	}
+	if c.Lot != "" && record.Lot != c.Lot {
+		return false
+	}
+	if c.Category != "" && record.Category != c.Category {
+		return false
+	}
+	if c.DateFrom == "" && c.DateTo == "" {
+		return true
+	}
+	t, err := shelflife.ParseDate(record.Date)
+	if err != nil {
+		return true
+	}
+	date := t.Format(shelflife.DateLayout)
+	if c.DateFrom != "" && date < c.DateFrom {
+		return false
+	}
+	if c.DateTo != "" && date > c.DateTo {
+		return false
+	}
+	return true
+}
+
+// 取出召回
+func (a *CommodityChaincode) getRecall(stub shim.ChaincodeStubInterface, id string) (Recall, bool) {
+	var recall Recall
+	b, err := stub.GetState(Recall_Prefix + id)
+	if b == nil {
+		return recall, false
+	}
+	err = json.Unmarshal(b, &recall)
+	if err != nil {
+		return recall, false
+	}
+	return recall, true
+}
+
+// 保存召回
+func (a *CommodityChaincode) putRecall(stub shim.ChaincodeStubInterface, recall Recall) bool {
+	b, err := json.Marshal(recall)
+	if err != nil {
+		return false
+	}
+	return stub.PutState(Recall_Prefix+recall.ID, b) == nil && history.Stamp(stub) == nil
+}
+
+// 记录召回状态变更
+func recallTransition(stub shim.ChaincodeStubInterface, recall *Recall, to string, now int64, notes string) {
+	by := ""
+	if id, err := authz.GetIdentity(stub); err == nil {
+		by = id.ID
+	}
+	recall.Transitions = append(recall.Transitions, RecallTransition{
+		From:  recall.Status,
+		To:    to,
+		By:    by,
+		TxID:  stub.GetTxID(),
+		Time:  txtime.Format(now),
+		Notes: notes,
+	})
+	recall.Status = to
+}
+
+// 发起召回: 标记所有符合条件的商品(包括已卖出的), 召回编号为交易ID
+// args: 0 - {RecallRequest Object}
+func (a *CommodityChaincode) recall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke recall args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	var req RecallRequest
+	err := schema.Strict(args[0], &req)
+	if err != nil {
+		res := getRetError("Chaincode Invoke recall failed : ", err)
+		return shim.Error(res)
+	}
+	if req.Reason == "" {
+		res := getRetString(errcode.Validation, "Chaincode Invoke recall failed : Reason is required")
+		return shim.Error(res)
+	}
+	err = req.Criteria.check()
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke recall failed : "+err.Error())
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke recall failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+
+	recall := Recall{
+		ID:          stub.GetTxID(),
+		Criteria:    req.Criteria,
+		Reason:      req.Reason,
+		Reference:   req.Reference,
+		Transitions: []RecallTransition{},
+		CreateTime:  txtime.Format(now),
+	}
+	mark := &RecallMark{ID: recall.ID, Reason: req.Reason, Reference: req.Reference, Time: recall.CreateTime}
+
+	// 按条件查询商品, 不扫描全部记录; 本交易的写入不影响查询结果, 按skip分批取完
+	selector := req.Criteria.selector()
+	for skip := 0; ; {
+		n, err := a.recallBatch(stub, selector, skip, &recall, mark)
+		if err != nil {
+			res := getRetError("Chaincode Invoke recall failed : ", err)
+			return shim.Error(res)
+		}
+		if n < RecallQueryLimit {
+			break
+		}
+		skip += n
+	}
+
+	recallTransition(stub, &recall, RecallOpen, now, req.Reason)
+	if !a.putRecall(stub, recall) {
+		res := getRetString(errcode.Internal, "Chaincode Invoke recall put recall failed")
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(recall)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal recall error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 标记一批符合条件的商品, 返回CouchDB返回的条数
+func (a *CommodityChaincode) recallBatch(stub shim.ChaincodeStubInterface, selector richquery.Selector, skip int, recall *Recall, mark *RecallMark) (int, error) {
+	query, err := selector.Query(skip, RecallQueryLimit)
+	if err != nil {
+		return 0, errcode.New(errcode.Internal, "build query failed")
+	}
+	resultsIterator, err := stub.GetQueryResult(query)
+	if err != nil {
+		return 0, errcode.New(errcode.Internal, "query records error: "+err.Error())
+	}
+	defer resultsIterator.Close()
+	n := 0
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return n, errcode.New(errcode.Internal, "iterator error")
+		}
+		n++
+		if !strings.HasPrefix(kv.Key, Record_Prefix) {
+			continue
+		}
+		var record Record
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			return n, errcode.New(errcode.Internal, "unmarshal failed: "+kv.Key)
+		}
+		if !recall.Criteria.match(record) {
+			continue
+		}
+
+		// 已被其他召回标记的商品保留原标记, 但仍列入本次召回;
+		// 店内的商品变为recalled, 已卖出的商品保持sold, 退货后再召回
+		if record.Recall == nil {
+			record.Recall = mark
+			if canMove(record.state(), StateRecalled) {
+				err = moveState(stub, &record, StateRecalled, recall.Reason)
+				if err != nil {
+					return n, err
+				}
+			}
+			_, bl := a.putRecord(stub, kv.Key, record)
+			if !bl {
+				return n, errcode.New(errcode.Internal, "put record failed")
+			}
+		}
+		key, err := stub.CreateCompositeKey(RecallIndexName, []string{recall.ID, record.StoreID, record.ID})
+		if err != nil {
+			return n, errcode.New(errcode.Internal, "create index failed")
+		}
+		err = stub.PutState(key, []byte{0x00})
+		if err != nil {
+			return n, errcode.New(errcode.Internal, "put index failed")
+		}
+		recall.Units++
+		if record.state() == StateSold {
+			recall.Sold++
+		}
+	}
+	return n, nil
+}
+
+// 修改召回状态
+// args: 0 - Recall ID, 1 - status(in-progress/closed), 2 - notes(可选)
+func (a *CommodityChaincode) setRecallStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setRecallStatus args should be 2 or 3", errcode.Args("want 2 or 3"))
+		return shim.Error(res)
+	}
+	var notes string
+	if len(args) == 3 {
+		notes = args[2]
+	}
+	recall, existbl := a.getRecall(stub, args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke setRecallStatus failed : the recall does not exist")
+		return shim.Error(res)
+	}
+
+	to := args[1]
+	legal := (recall.Status == RecallOpen && (to == RecallInProgress || to == RecallClosed)) ||
+		(recall.Status == RecallInProgress && to == RecallClosed)
+	if !legal {
+		res := getRetString(errcode.Conflict, "Chaincode Invoke setRecallStatus failed : cannot move a recall from "+recall.Status+" to "+to)
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke setRecallStatus failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	recallTransition(stub, &recall, to, now, notes)
+	if !a.putRecall(stub, recall) {
+		res := getRetString(errcode.Internal, "Chaincode Invoke setRecallStatus put recall failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke setRecallStatus success")
+	return shim.Success(res)
+}
+
+// 召回报告: 按店铺列出涉及的商品及是否已卖出; 只列出提交者可以操作的店铺
+// args: 0 - Recall ID, 1 - Store ID(可选)
+func (a *CommodityChaincode) queryRecall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		res := getRetString(errcode.Validation, "CommodityChaincode queryRecall args should be 1 or 2", errcode.Args("want 1 or 2"))
+		return shim.Error(res)
+	}
+	recall, existbl := a.getRecall(stub, args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "CommodityChaincode queryRecall get recall error")
+		return shim.Error(res)
+	}
+	id, err := authz.GetIdentity(stub)
+	if err == nil && len(args) == 2 {
+		err = authz.CheckStore(stub, args[1])
+	}
+	if err != nil {
+		res := getRetError("CommodityChaincode queryRecall: ", err)
+		return shim.Error(res)
+	}
+
+	indexIterator, err := stub.GetStateByPartialCompositeKey(RecallIndexName, args)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode queryRecall get index error")
+		return shim.Error(res)
+	}
+	defer indexIterator.Close()
+
+	report := RecallReport{Recall: recall, Stores: []RecallStore{}}
+	names := storeNames{}
+	for indexIterator.HasNext() {
+		kv, err := indexIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "CommodityChaincode queryRecall iterator error")
+			return shim.Error(res)
+		}
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attrs) != 3 {
+			res := getRetString(errcode.Internal, "CommodityChaincode queryRecall split index key error")
+			return shim.Error(res)
+		}
+		if !id.CanAccessStore(attrs[1]) {
+			continue
+		}
+		record, bl := a.getRecord(stub, Record_Prefix+attrs[2])
+		if !bl {
+			// 召回后被删除(报废)的商品
+			record = Record{ID: attrs[2], StoreID: attrs[1]}
+		}
+
+		// 索引按店铺排序, 同一店铺的商品相邻
+		n := len(report.Stores)
+		if n == 0 || report.Stores[n-1].StoreID != attrs[1] {
+			report.Stores = append(report.Stores, RecallStore{
+				StoreID:   attrs[1],
+				StoreName: names.get(stub, attrs[1]),
+				Units:     []RecallUnit{},
+			})
+			n++
+		}
+		store := &report.Stores[n-1]
+		unit := RecallUnit{
+			ID:       record.ID,
+			Name:     record.Name,
+			Category: record.Category,
+			Lot:      record.Lot,
+			Date:     record.Date,
+			Sold:     record.state() == StateSold,
+		}
+		if sale := record.lastSale(); unit.Sold && sale != nil {
+			unit.SoldTime = sale.Time
+		}
+		if unit.Sold {
+			store.Sold++
+		} else {
+			store.Unsold++
+		}
+		store.Units = append(store.Units, unit)
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal queryRecall report error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+// 召回条件转换为CouchDB查询, 非YYYY-MM-DD写法的日期一并取出
+func TestRecallSelector(t *testing.T) {
+	cases := []struct {
+		name     string
+		criteria RecallCriteria
+		query    string
+	}{
+		{"supplier", RecallCriteria{Supplier: "SP1"},
+			`{"selector":{"Supplier":"SP1"},"limit":10000,"skip":0}`},
+		{"place and category", RecallCriteria{Place: "Shandong", Category: "Apple"},
+			`{"selector":{"Category":"Apple","Place":"Shandong","Supplier":{"$exists":true}},"limit":10000,"skip":0}`},
+		{"lot with dates", RecallCriteria{Lot: "L1", DateFrom: "2018-01-01", DateTo: "2018-01-31"},
+			`{"selector":{"$or":[{"Date":{"$gte":"2018-01-01","$lte":"2018-01-31"}},{"Date":{"$not":{"$regex":"^[0-9]{4}-[0-9]{2}-[0-9]{2}$"}}}],"Lot":"L1","Supplier":{"$exists":true}},"limit":10000,"skip":0}`},
+	}
+	for _, c := range cases {
+		query, err := c.criteria.selector().Query(0, RecallQueryLimit)
+		if err != nil || query != c.query {
+			t.Errorf("%s: query = %s, %v\nwant %s", c.name, query, err, c.query)
+		}
+	}
+}
+
+// 日期写法不同的商品由match按日期判断
+func TestRecallMatch(t *testing.T) {
+	criteria := RecallCriteria{Supplier: "SP1", DateFrom: "2018/01/01", DateTo: "20180131"}
+	if err := criteria.check(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		record Record
+		match  bool
+	}{
+		{Record{Supplier: "SP1", Date: "2018-01-15"}, true},
+		{Record{Supplier: "SP1", Date: "2018/01/15"}, true},
+		{Record{Supplier: "SP1", Date: "20180215"}, false},
+		{Record{Supplier: "SP1", Date: "unknown"}, true},
+		{Record{Supplier: "SP2", Date: "2018-01-15"}, false},
+	}
+	for _, c := range cases {
+		if got := criteria.match(c.record); got != c.match {
+			t.Errorf("match(%+v) = %v, want %v", c.record, got, c.match)
+		}
+	}
+}
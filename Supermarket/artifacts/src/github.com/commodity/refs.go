@@ -0,0 +1,173 @@
+/*
+引用完整性, 见common/refint
+商品引用所在店铺的类别: 登记时确认类别在同一店铺存在; 删除类别时CategoryChaincode调用queryRefs列出仍在店内的商品,
+按cascade策略删除时调用cascadeDelete把这些商品改为deleted(软删除). 已卖出、已报废的商品只作为历史, 不阻止删除.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/ledger"
+	"github.com/common/paging"
+	"github.com/common/refint"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"strings"
+)
+
+// 这些状态的商品不再引用类别
+var unreferenced = map[string]bool{
+	StateSold:     true,
+	StateDisposed: true,
+	StateDeleted:  true,
+}
+
+// 确认类别在店铺中存在
+func checkCategory(stub shim.ChaincodeStubInterface, categoryID, storeID string) error {
+	resp := invoke(stub, CategoryChaincodeName, "exists", categoryID, storeID)
+	if resp.Status == shim.OK {
+		return nil
+	}
+	err := errcode.FromResponse(resp.Message)
+	if errcode.Code(err) != errcode.NotFound {
+		return err
+	}
+	return refint.Missing("Category", "category "+categoryID+" in store "+storeID)
+}
+
+// 逐个处理店铺中某类别仍引用类别的商品, fn返回false时停止
+func (a *CommodityChaincode) eachRef(stub shim.ChaincodeStubInterface, categoryID, storeID string, fn func(record Record) (bool, error)) error {
+	prefix := paging.Key(StoreIndex_Prefix, storeID, categoryID, "")
+	start, end := paging.Range(prefix, "")
+	indexIterator, err := stub.GetStateByRange(start, end)
+	if err != nil {
+		return err
+	}
+	defer indexIterator.Close()
+	for indexIterator.HasNext() {
+		kv, err := indexIterator.Next()
+		if err != nil {
+			return err
+		}
+		id := strings.TrimPrefix(kv.Key, prefix)
+		record, bl := a.getRecord(stub, Record_Prefix+id)
+		if !bl {
+			return errcode.New(errcode.Internal, "get record error: "+id)
+		}
+		if unreferenced[record.state()] {
+			continue
+		}
+		more, err := fn(record)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// 列出店铺中仍引用类别的商品
+// args: 0 - Category ID, 1 - Store ID
+func (a *CommodityChaincode) queryRefs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "CommodityChaincode queryRefs args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	err := authz.CheckStore(stub, args[1])
+	if err != nil {
+		res := getRetError("CommodityChaincode queryRefs: ", err)
+		return shim.Error(res)
+	}
+
+	refs := refint.Refs{Refs: []refint.Ref{}}
+	err = a.eachRef(stub, args[0], args[1], func(record Record) (bool, error) {
+		refs.Count++
+		if len(refs.Refs) < refint.MaxReported {
+			refs.Refs = append(refs.Refs, refint.Ref{Kind: "commodity", ID: record.ID, State: record.state()})
+		}
+		return true, nil
+	})
+	if err != nil {
+		res := getRetError("CommodityChaincode queryRefs failed : ", err)
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(refs)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal queryRefs error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 类别按cascade策略删除时, 把店铺中仍引用它的商品改为deleted; 只能由CategoryChaincode.delete调用
+// args: 0 - Category ID, 1 - Store ID
+func (a *CommodityChaincode) cascadeDelete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke cascadeDelete args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	if ledger.TopLevel(stub) {
+		res := getRetString(errcode.Forbidden, "Chaincode Invoke cascadeDelete failed : only CategoryChaincode.delete can cascade")
+		return shim.Error(res)
+	}
+	err := authz.CheckStore(stub, args[1])
+	if err != nil {
+		res := getRetError("Chaincode Invoke cascadeDelete failed : ", err)
+		return shim.Error(res)
+	}
+
+	refs := refint.Refs{Refs: []refint.Ref{}}
+	err = a.eachRef(stub, args[0], args[1], func(record Record) (bool, error) {
+		refs.Count++
+		if refs.Count > refint.MaxCascade {
+			return false, errcode.New(errcode.BusinessRule, "more than "+strconv.Itoa(refint.MaxCascade)+" commodities reference the category, dispose some of them first")
+		}
+		err := moveState(stub, &record, StateDeleted, "category "+args[0]+" deleted")
+		if err != nil {
+			return false, err
+		}
+		record.StoreName = ""
+		_, bl := a.putRecord(stub, Record_Prefix+record.ID, record)
+		if !bl {
+			return false, errcode.New(errcode.Internal, "put record error: "+record.ID)
+		}
+		if len(refs.Refs) < refint.MaxReported {
+			refs.Refs = append(refs.Refs, refint.Ref{Kind: "commodity", ID: record.ID, State: StateDeleted})
+		}
+		return true, nil
+	})
+	if err != nil {
+		res := getRetError("Chaincode Invoke cascadeDelete failed : ", err)
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(refs)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal cascadeDelete error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 商品是否存在, 供其他链码(如IndexChaincode)确认引用; 不存在时返回404
+// args: 0 - Commodity ID
+func (a *CommodityChaincode) exists(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "CommodityChaincode exists args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	b, err := stub.GetState(Record_Prefix + args[0])
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode exists get record error")
+		return shim.Error(res)
+	}
+	if b == nil {
+		res := getRetString(errcode.NotFound, "CommodityChaincode exists: no commodity "+args[0])
+		return shim.Error(res)
+	}
+	return shim.Success(getRetByte(0, "commodity "+args[0]+" exists"))
+}
@@ -0,0 +1,46 @@
+/*
+商品记录的JSON Schema
+insert与change(merge patch)按它校验, querySchema发布同一份schema; 修改Record时同时修改这里, 否则链码无法启动.
+*/
+
+package main
+
+import (
+	"github.com/common/errcode"
+	"github.com/common/schema"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var recordSchema = schema.Schema{
+	ID:          "supermarket/commodity.json",
+	Title:       "Commodity",
+	Description: "一件商品, 属于某个店铺的某个类别",
+	Properties: []schema.Property{
+		{Name: "ID", Type: schema.String, ReadOnly: true, Description: "由交易ID生成, insert时忽略"},
+		{Name: "Name", Type: schema.String, MaxLength: schema.NameMaxLength},
+		{Name: "Category", Type: schema.String, Required: true, Immutable: true, MaxLength: schema.IDMaxLength, Pattern: schema.IDPattern, Description: "类别ID, 见CategoryChaincode"},
+		{Name: "StoreID", Type: schema.String, Required: true, Immutable: true, MaxLength: schema.IDMaxLength, Pattern: schema.IDPattern},
+		{Name: "StoreName", Type: schema.String, ReadOnly: true, Description: "查询时从StoreChaincode取得"},
+		{Name: "Supplier", Type: schema.String, Required: true, Immutable: true, MaxLength: schema.IDMaxLength, Pattern: schema.IDPattern, Description: "供应商ID, 见SupplierChaincode"},
+		{Name: "Place", Type: schema.String, MaxLength: schema.TextMaxLength, Description: "产地"},
+		{Name: "Date", Type: schema.String, Pattern: `^[0-9]{4}[-/.]?[0-9]{2}[-/.]?[0-9]{2}$`, Description: "生产日期, YYYY-MM-DD"},
+		{Name: "Lot", Type: schema.String, MaxLength: schema.IDMaxLength, Pattern: schema.IDPattern, Description: "生产批号"},
+		{Name: "BestBefore", Type: schema.String, ReadOnly: true, Description: "由生产日期和类别保质期计算"},
+		{Name: "CreateTime", Type: schema.String, ReadOnly: true},
+		{Name: "State", Type: schema.String, ReadOnly: true, Description: "商品状态, 由setState维护"},
+		{Name: "Transitions", Type: schema.Array, ReadOnly: true},
+		{Name: "Recall", Type: schema.Object, ReadOnly: true},
+		{Name: "Version", Type: schema.Integer, ReadOnly: true, NonNegative: true, Description: "版本, 每次写入加一; change时提交查询读到的版本"},
+	},
+}
+
+// 发布商品记录的JSON Schema
+func (a *CommodityChaincode) querySchema(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	b, err := recordSchema.JSON()
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal querySchema error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
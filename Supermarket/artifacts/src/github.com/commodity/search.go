@@ -0,0 +1,154 @@
+/*
+按供应商、产地、生产日期等查找商品(需要CouchDB状态数据库)
+索引定义见 META-INF/statedb/couchdb/indexes
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/paging"
+	"github.com/common/richquery"
+	"github.com/common/shelflife"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+)
+
+// 查找条件, 不接受其他字段
+type SearchFilter struct {
+	StoreID  string `json:"StoreID"`
+	Category string `json:"Category"`
+	Supplier string `json:"Supplier"`
+	Place    string `json:"Place"`
+	Lot      string `json:"Lot"`
+	State    string `json:"State"`
+	DateFrom string `json:"DateFrom"` // 生产日期范围, 含首尾, YYYY-MM-DD
+	DateTo   string `json:"DateTo"`
+}
+
+// 构造selector
+func (f SearchFilter) selector() (richquery.Selector, error) {
+	if f.StoreID == "" && f.Category == "" && f.Supplier == "" && f.Place == "" && f.Lot == "" &&
+		f.DateFrom == "" && f.DateTo == "" {
+		return nil, errors.New("one of StoreID, Category, Supplier, Place, Lot or a date range is required")
+	}
+	if _, ok := transitions[f.State]; f.State != "" && !ok {
+		return nil, errors.New("unknown state " + f.State)
+	}
+	for _, d := range []*string{&f.DateFrom, &f.DateTo} {
+		if *d == "" {
+			continue
+		}
+		t, err := shelflife.ParseDate(*d)
+		if err != nil {
+			return nil, err
+		}
+		*d = t.Format(shelflife.DateLayout)
+	}
+
+	s := richquery.Selector{}
+	// 商品记录有Supplier字段, 召回等其他记录没有
+	s.Exists("Supplier")
+	s.Eq("StoreID", f.StoreID)
+	s.Eq("Category", f.Category)
+	s.Eq("Supplier", f.Supplier)
+	s.Eq("Place", f.Place)
+	s.Eq("Lot", f.Lot)
+	s.Eq("State", f.State)
+	s.Between("Date", f.DateFrom, f.DateTo)
+	return s, nil
+}
+
+// 查找商品; 不指定店铺时只返回提交者可以操作的店铺的商品
+//
+//	0 - {SearchFilter Object}, 1 - page size(可选), 2 - bookmark(可选)
+func (a *CommodityChaincode) search(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		res := getRetString(errcode.Validation, "CommodityChaincode search args should be 1 to 3", errcode.Args("want 1 to 3"))
+		return shim.Error(res)
+	}
+	var filter SearchFilter
+	err := richquery.Decode(args[0], &filter)
+	if err != nil {
+		res := getRetString(errcode.Validation, "CommodityChaincode search unmarshal failed : "+err.Error())
+		return shim.Error(res)
+	}
+	selector, err := filter.selector()
+	if err != nil {
+		res := getRetString(errcode.Validation, "CommodityChaincode search failed : "+err.Error())
+		return shim.Error(res)
+	}
+	id, err := authz.GetIdentity(stub)
+	if err == nil && filter.StoreID != "" {
+		err = authz.CheckStore(stub, filter.StoreID)
+	}
+	if err != nil {
+		res := getRetError("CommodityChaincode search: ", err)
+		return shim.Error(res)
+	}
+	size, bookmark, err := paging.Args(args[1:])
+	skip := 0
+	if err == nil {
+		skip, err = richquery.Offset(bookmark)
+	}
+	if err != nil {
+		res := getRetString(errcode.Validation, "CommodityChaincode search failed : "+err.Error())
+		return shim.Error(res)
+	}
+	limit := size * richquery.ScanFactor
+	query, err := selector.Query(skip, limit)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode search build query failed")
+		return shim.Error(res)
+	}
+
+	resultsIterator, err := stub.GetQueryResult(query)
+	if err != nil {
+		res := getRetError("CommodityChaincode search query error: ", err)
+		return shim.Error(res)
+	}
+	defer resultsIterator.Close()
+
+	var recordList = []Record{}
+	page := paging.Page{}
+	names := storeNames{}
+	scanned := 0
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "CommodityChaincode search iterator error")
+			return shim.Error(res)
+		}
+		var record Record
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			res := getRetString(errcode.Internal, "CommodityChaincode search unmarshal failed: "+kv.Key)
+			return shim.Error(res)
+		}
+		if id.CanAccessStore(record.StoreID) {
+			if len(recordList) == size {
+				break
+			}
+			record.StoreName = names.get(stub, record.StoreID)
+			recordList = append(recordList, record)
+		}
+		scanned++
+	}
+	// 页满或CouchDB返回了limit条时可能还有下一页
+	if (len(recordList) == size || scanned == limit) && skip+scanned < richquery.MaxOffset {
+		page.Bookmark = strconv.Itoa(skip + scanned)
+	}
+	page.Records = recordList
+	page.Count = len(recordList)
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CommodityChaincode Marshal search page error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
@@ -0,0 +1,59 @@
+/*
+店铺
+店铺由StoreChaincode登记, 商品记录只保存StoreID:
+写入前确认店铺存在且未关闭, 查询时取得当前的店铺名称, 店铺改名后不会留下过期的StoreName
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/errcode"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 被调用的chaincode名称
+const StoreChaincodeName = "store"
+
+// 店铺记录中用到的字段
+type storeRef struct {
+	ID     string `json:"ID"`
+	Name   string `json:"Name"`
+	Status string `json:"Status"`
+}
+
+// 调用同一channel上的其他chaincode
+func invoke(stub shim.ChaincodeStubInterface, chaincodeName string, args ...string) pb.Response {
+	ccArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		ccArgs[i] = []byte(arg)
+	}
+	return stub.InvokeChaincode(chaincodeName, ccArgs, "")
+}
+
+// 确认店铺存在且未关闭
+func checkStore(stub shim.ChaincodeStubInterface, storeID string) error {
+	resp := invoke(stub, StoreChaincodeName, "check", storeID)
+	if resp.Status != shim.OK {
+		return errcode.FromResponse(resp.Message)
+	}
+	return nil
+}
+
+// 一次查询内按StoreID缓存店铺名称
+type storeNames map[string]string
+
+// 当前店铺名称, 店铺不存在时为空
+func (n storeNames) get(stub shim.ChaincodeStubInterface, storeID string) string {
+	if name, ok := n[storeID]; ok {
+		return name
+	}
+	var ref storeRef
+	resp := invoke(stub, StoreChaincodeName, "queryByID", storeID)
+	if resp.Status == shim.OK {
+		json.Unmarshal(resp.Payload, &ref)
+	}
+	n[storeID] = ref.Name
+	return ref.Name
+}
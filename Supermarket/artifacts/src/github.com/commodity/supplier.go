@@ -0,0 +1,27 @@
+/*
+供应商
+供应商由SupplierChaincode登记, 商品记录中的Supplier为供应商ID;
+登记商品前确认供应商在合作中、核准供应该类别且食品经营许可证在有效期内
+*/
+
+package main
+
+import (
+	"github.com/common/errcode"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// 被调用的chaincode名称
+const SupplierChaincodeName = "supplier"
+
+// 确认供应商可以供应该类别的商品
+func checkSupplier(stub shim.ChaincodeStubInterface, supplierID, category string) error {
+	if supplierID == "" {
+		return errcode.New(errcode.Validation, "Supplier is required", errcode.Field("Supplier", "is required"))
+	}
+	resp := invoke(stub, SupplierChaincodeName, "check", supplierID, category)
+	if resp.Status != shim.OK {
+		return errcode.FromResponse(resp.Message)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+/*
+权限控制
+角色取自交易提交者证书中的属性(由Fabric CA写入ecert)与其所属MSP:
+  - role属性: admin / manager / clerk / customer / supplier
+  - 旧版注册的顾客只有 type=user 属性, 视为customer
+  - 其他证书(peer、cryptogen生成的用户、CA bootstrap admin、未带属性注册的用户等)没有角色, 一律拒绝;
+    管理员也必须由CA注册时写入 role=admin
+角色由应用注册用户时写入, 见app/helper.js. 角色只在RoleMSPs列出的MSP中有效,
+其他MSP(例如orderer组织或新加入通道的组织)的CA签发的同名属性不被接受; 网络的组织不同时修改RoleMSPs.
+店长与店员通过storeID属性(多个用逗号分隔)限定可操作的店铺, 供应商通过supplierID属性标识.
+每个链码定义自己的权限矩阵(函数 -> 允许的角色), 在Invoke入口检查; 店铺、本人等与数据相关的限制在各函数中检查.
+本包只依赖标准库, 自行解析creator, 因此各链码(包括vendor了fabric的index)都可以使用.
+*/
+
+package authz
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 角色
+type Role string
+
+const (
+	Admin    Role = "admin"    // 总部管理员, 可操作所有店铺
+	Manager  Role = "manager"  // 店长, 限定店铺
+	Clerk    Role = "clerk"    // 店员, 限定店铺
+	Customer Role = "customer" // 顾客, 只能操作本人数据
+	Supplier Role = "supplier" // 供应商
+)
+
+// 常用角色组合
+var (
+	Managers = []Role{Admin, Manager}
+	Staff    = []Role{Admin, Manager, Clerk}
+	Everyone = []Role{Admin, Manager, Clerk, Customer, Supplier}
+)
+
+// 证书属性名
+const (
+	RoleAttribute       = "role"
+	LegacyTypeAttribute = "type"
+	StoreAttribute      = "storeID"
+	SupplierAttribute   = "supplierID"
+)
+
+// 各角色可以由哪些MSP的CA签发, 与 artifacts/channel/configtx.yaml 中的组织一致
+var RoleMSPs = map[Role][]string{
+	Admin:    {"Org1MSP", "Org2MSP"},
+	Manager:  {"Org1MSP", "Org2MSP"},
+	Clerk:    {"Org1MSP", "Org2MSP"},
+	Customer: {"Org1MSP", "Org2MSP"},
+	Supplier: {"Org1MSP", "Org2MSP"},
+}
+
+// 旧版注册时写入的type属性值
+const legacyCustomerType = "user"
+
+// 拒绝时的错误码
+const (
+	CodeUnauthenticated = 401 // 无法识别提交者身份
+	CodeForbidden       = 403 // 身份有效但无权限
+)
+
+// 权限错误
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func forbidden(format string, a ...interface{}) error {
+	return &Error{Code: CodeForbidden, Message: "forbidden: " + fmt.Sprintf(format, a...)}
+}
+
+func unauthenticated(format string, a ...interface{}) error {
+	return &Error{Code: CodeUnauthenticated, Message: "unauthenticated: " + fmt.Sprintf(format, a...)}
+}
+
+// 只需要shim.ChaincodeStubInterface中的GetCreator
+type Stub interface {
+	GetCreator() ([]byte, error)
+}
+
+// 交易提交者
+type Identity struct {
+	MSPID      string
+	ID         string // 证书CN, 即CA的enrollment ID, 顾客的enrollment ID与用户ID一致
+	Subject    string // 例如 "CN=alice,OU=client,O=Org1"
+	Role       Role
+	Stores     []string
+	SupplierID string
+	Attrs      map[string]string
+}
+
+// 是否具有其中一个角色
+func (id *Identity) HasRole(roles ...Role) bool {
+	for _, r := range roles {
+		if id.Role == r {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否可以操作该店铺: 管理员可操作所有店铺, 店长、店员只能操作证书中的店铺
+func (id *Identity) CanAccessStore(storeID string) bool {
+	if id.Role == Admin {
+		return true
+	}
+	if id.Role != Manager && id.Role != Clerk {
+		return false
+	}
+	for _, s := range id.Stores {
+		if s == storeID {
+			return true
+		}
+	}
+	return false
+}
+
+// 权限矩阵: 函数名 -> 允许的角色; 未列出的函数一律拒绝
+type Matrix map[string][]Role
+
+// 检查提交者是否可以调用function
+func (m Matrix) Authorize(stub Stub, function string) (*Identity, error) {
+	id, err := GetIdentity(stub)
+	if err != nil {
+		return nil, err
+	}
+	roles, ok := m[function]
+	if !ok {
+		return id, forbidden("function %s is not open to any role", function)
+	}
+	if !id.HasRole(roles...) {
+		return id, forbidden("role %q of %s@%s may not call %s", id.Role, id.ID, id.MSPID, function)
+	}
+	return id, nil
+}
+
+// 检查提交者是否可以操作该店铺
+func CheckStore(stub Stub, storeID string) error {
+	id, err := GetIdentity(stub)
+	if err != nil {
+		return err
+	}
+	if !id.CanAccessStore(storeID) {
+		return forbidden("%s@%s may not operate on store %s", id.ID, id.MSPID, storeID)
+	}
+	return nil
+}
+
+// 检查顾客只操作本人数据, 其他角色由权限矩阵决定
+func CheckSelf(stub Stub, userID string) error {
+	id, err := GetIdentity(stub)
+	if err != nil {
+		return err
+	}
+	if id.Role == Customer && id.ID != userID {
+		return forbidden("customer %s may not access user %s", id.ID, userID)
+	}
+	return nil
+}
+
+// 检查供应商只操作本公司的数据, 其他角色由权限矩阵决定
+func CheckSupplier(stub Stub, supplierID string) error {
+	id, err := GetIdentity(stub)
+	if err != nil {
+		return err
+	}
+	if id.Role == Supplier && id.SupplierID != supplierID {
+		return forbidden("supplier %s may not access supplier %s", id.SupplierID, supplierID)
+	}
+	return nil
+}
+
+// 解析交易提交者
+func GetIdentity(stub Stub) (*Identity, error) {
+	creator, err := stub.GetCreator()
+	if err != nil {
+		return nil, unauthenticated("get creator failed: %v", err)
+	}
+	mspID, idBytes, err := parseSerializedIdentity(creator)
+	if err != nil {
+		return nil, unauthenticated("%v", err)
+	}
+	block, _ := pem.Decode(idBytes)
+	if block == nil {
+		return nil, unauthenticated("creator is not a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, unauthenticated("parse certificate failed: %v", err)
+	}
+	attrs, err := certAttributes(cert)
+	if err != nil {
+		return nil, unauthenticated("%v", err)
+	}
+
+	id := &Identity{
+		MSPID:      mspID,
+		ID:         cert.Subject.CommonName,
+		Subject:    cert.Subject.String(),
+		Attrs:      attrs,
+		SupplierID: attrs[SupplierAttribute],
+	}
+	if stores := attrs[StoreAttribute]; stores != "" {
+		for _, s := range strings.Split(stores, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				id.Stores = append(id.Stores, s)
+			}
+		}
+	}
+	if role, ok := attrs[RoleAttribute]; ok {
+		if !knownRole(Role(role)) {
+			return nil, forbidden("%s@%s has unknown role attribute %q", id.ID, mspID, role)
+		}
+		id.Role = Role(role)
+	} else if typ, ok := attrs[LegacyTypeAttribute]; ok {
+		if typ != legacyCustomerType {
+			return nil, forbidden("%s@%s has type attribute %q, which is not a role; register it with a role attribute", id.ID, mspID, typ)
+		}
+		id.Role = Customer
+	} else {
+		return nil, forbidden("%s@%s has no role attribute", id.ID, mspID)
+	}
+	if !trusted(id.Role, mspID) {
+		return nil, forbidden("%s@%s: role %q is not accepted from MSP %s", id.ID, mspID, id.Role, mspID)
+	}
+	return id, nil
+}
+
+// 角色是否可以由该MSP签发
+func trusted(r Role, mspID string) bool {
+	for _, m := range RoleMSPs[r] {
+		if m == mspID {
+			return true
+		}
+	}
+	return false
+}
+
+func knownRole(r Role) bool {
+	for _, known := range Everyone {
+		if r == known {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析msp.SerializedIdentity: 1 - mspid (string), 2 - id_bytes (bytes)
+func parseSerializedIdentity(b []byte) (string, []byte, error) {
+	var mspID string
+	var idBytes []byte
+	for len(b) > 0 {
+		tag, n := uvarint(b)
+		if n <= 0 {
+			return "", nil, errors.New("malformed creator")
+		}
+		b = b[n:]
+		field, wire := tag>>3, tag&7
+		if wire != 2 {
+			return "", nil, errors.New("malformed creator: unexpected wire type")
+		}
+		l, n := uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return "", nil, errors.New("malformed creator: bad length")
+		}
+		value := b[n : n+int(l)]
+		b = b[n+int(l):]
+		switch field {
+		case 1:
+			mspID = string(value)
+		case 2:
+			idBytes = value
+		}
+	}
+	if mspID == "" || len(idBytes) == 0 {
+		return "", nil, errors.New("creator without MSP ID or certificate")
+	}
+	return mspID, idBytes, nil
+}
+
+func uvarint(b []byte) (uint64, int) {
+	var x uint64
+	var s uint
+	for i, c := range b {
+		if i == 10 {
+			return 0, -1
+		}
+		if c < 0x80 {
+			return x | uint64(c)<<s, i + 1
+		}
+		x |= uint64(c&0x7f) << s
+		s += 7
+	}
+	return 0, 0
+}
+
+// Fabric CA把属性以JSON写在该扩展中: {"attrs":{"name":"value"}}
+var attrOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+func certAttributes(cert *x509.Certificate) (map[string]string, error) {
+	attrs := map[string]string{}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(attrOID) {
+			continue
+		}
+		var v struct {
+			Attrs map[string]string `json:"attrs"`
+		}
+		if err := json.Unmarshal(ext.Value, &v); err != nil {
+			return nil, errors.New("malformed certificate attributes")
+		}
+		for k, val := range v.Attrs {
+			attrs[k] = val
+		}
+	}
+	return attrs, nil
+}
@@ -0,0 +1,119 @@
+package authz
+
+import (
+	"github.com/common/ledger/ledgertest"
+	"testing"
+)
+
+type fakeStub struct {
+	creator []byte
+}
+
+func (s fakeStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+// 提交者证书带Fabric CA属性扩展, 见ledgertest.Creator
+func creator(t *testing.T, mspID, cn string, attrs map[string]string) fakeStub {
+	return fakeStub{creator: ledgertest.Creator(mspID, cn, attrs)}
+}
+
+func TestGetIdentity(t *testing.T) {
+	cases := []struct {
+		name  string
+		attrs map[string]string
+		role  Role
+		code  int
+	}{
+		{"admin attribute", map[string]string{"role": "admin"}, Admin, 0},
+		{"manager with stores", map[string]string{"role": "manager", "storeID": "S1, S2"}, Manager, 0},
+		{"legacy customer", map[string]string{"type": "user"}, Customer, 0},
+		{"role wins over type", map[string]string{"role": "clerk", "type": "user"}, Clerk, 0},
+		{"no attributes", nil, "", CodeForbidden},
+		{"unrelated attributes", map[string]string{"hf.EnrollmentID": "peer0"}, "", CodeForbidden},
+		{"unknown type", map[string]string{"type": "user2"}, "", CodeForbidden},
+		{"unknown role", map[string]string{"role": "root"}, "", CodeForbidden},
+	}
+	for _, c := range cases {
+		id, err := GetIdentity(creator(t, "Org1MSP", "alice", c.attrs))
+		if c.code != 0 {
+			if e, ok := err.(*Error); !ok || e.Code != c.code {
+				t.Errorf("%s: error = %v, want code %d", c.name, err, c.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", c.name, err)
+			continue
+		}
+		if id.Role != c.role || id.ID != "alice" || id.MSPID != "Org1MSP" {
+			t.Errorf("%s: identity = %+v", c.name, id)
+		}
+	}
+}
+
+// 角色只在RoleMSPs中的MSP有效
+func TestRoleMSP(t *testing.T) {
+	cases := []struct {
+		name  string
+		mspID string
+		attrs map[string]string
+		code  int
+	}{
+		{"admin of Org1", "Org1MSP", map[string]string{"role": "admin"}, 0},
+		{"customer of Org2", "Org2MSP", map[string]string{"role": "customer"}, 0},
+		{"legacy customer of Org2", "Org2MSP", map[string]string{"type": "user"}, 0},
+		{"admin of the orderer", "OrdererMSP", map[string]string{"role": "admin"}, CodeForbidden},
+		{"manager of another org", "Org3MSP", map[string]string{"role": "manager", "storeID": "S1"}, CodeForbidden},
+		{"legacy customer of another org", "Org3MSP", map[string]string{"type": "user"}, CodeForbidden},
+		{"MSP ID differs in case", "org1msp", map[string]string{"role": "admin"}, CodeForbidden},
+	}
+	for _, c := range cases {
+		_, err := GetIdentity(creator(t, c.mspID, "alice", c.attrs))
+		code := 0
+		if e, ok := err.(*Error); ok {
+			code = e.Code
+		} else if err != nil {
+			code = -1
+		}
+		if code != c.code {
+			t.Errorf("%s: error = %v, want code %d", c.name, err, c.code)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	m := Matrix{"insert": Managers, "query": Everyone}
+	manager := creator(t, "Org1MSP", "bob", map[string]string{"role": "manager", "storeID": "S1,S2"})
+	clerk := creator(t, "Org1MSP", "carol", map[string]string{"role": "clerk", "storeID": "S1"})
+	peer := creator(t, "Org1MSP", "peer0", nil)
+
+	if _, err := m.Authorize(manager, "insert"); err != nil {
+		t.Errorf("manager insert: %v", err)
+	}
+	if _, err := m.Authorize(clerk, "insert"); err == nil {
+		t.Error("clerk insert should be forbidden")
+	}
+	if _, err := m.Authorize(clerk, "delete"); err == nil {
+		t.Error("unlisted function should be forbidden")
+	}
+	if _, err := m.Authorize(peer, "query"); err == nil {
+		t.Error("certificate without role should be forbidden")
+	}
+	if err := CheckStore(manager, "S2"); err != nil {
+		t.Errorf("manager store S2: %v", err)
+	}
+	if err := CheckStore(clerk, "S2"); err == nil {
+		t.Error("clerk of S1 should not access S2")
+	}
+}
+
+func TestMalformedCreator(t *testing.T) {
+	for _, b := range [][]byte{nil, {0x0a}, {0x0a, 0x05, 'O'}, {0x0a, 0x01, 'O', 0x12, 0x01, 'x'}} {
+		if _, err := GetIdentity(fakeStub{creator: b}); err == nil {
+			t.Errorf("creator %x should be rejected", b)
+		} else if e, ok := err.(*Error); !ok || e.Code != CodeUnauthenticated {
+			t.Errorf("creator %x: error = %v, want unauthenticated", b, err)
+		}
+	}
+}
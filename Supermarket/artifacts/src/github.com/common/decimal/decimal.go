@@ -0,0 +1,397 @@
+/*
+定点小数
+金额与计量数量统一使用Decimal, 内部以 10^-Scale 为单位的int64保存,
+运算结果精确, 需要舍入时必须显式给出舍入方式; 绝对值不超过Max, 超出时运算返回ErrRange.
+JSON编码为规范化的字符串, 例如 "3.5"、"-0.25"、"12", 与原有字符串字段兼容.
+JSON解码是严格的, 旧账本上的数值只在迁移时经NormalizeLegacy兼容解析.
+*/
+
+package decimal
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// 小数位数
+const Scale = 6
+
+// 金额按分(0.01元)舍入
+const CentPlaces = 2
+
+// 10^Scale
+const unit = 1000000
+
+// 绝对值上限(以10^-Scale为单位), 即 10^12; 两个合法值相加不会溢出int64
+const maxUnits = 1000000000000000000
+
+// 指数的绝对值上限, 超出时值必然越界或舍入为0
+const maxExp = 18 + Scale
+
+// 字符串的最大长度, 防止超长输入占用背书节点
+const maxLen = 64
+
+// 舍入方式
+type RoundingMode int
+
+const (
+	HalfUp   RoundingMode = iota // 四舍五入, .5远离0
+	HalfEven                     // 银行家舍入, .5取偶
+	Down                         // 向0截断
+	Up                           // 远离0进位
+)
+
+var ErrFormat = errors.New("decimal: invalid format")
+var ErrRange = errors.New("decimal: value out of range")
+
+// 定点小数, 零值为0
+type Decimal struct {
+	units int64
+}
+
+var Zero = Decimal{}
+
+// 最大值
+var Max = Decimal{units: maxUnits}
+
+// 整数, n的绝对值不超过10^12, 用于常量与计数
+func FromInt(n int64) Decimal {
+	return Decimal{units: n * unit}
+}
+
+// 严格解析: 可选的负号, 整数部分, 至多Scale位小数; 不接受正号、指数、省略整数部分与首尾空白,
+// 这些写法只在ParseLegacy中兼容
+func Parse(s string) (Decimal, error) {
+	if !canonical(s) {
+		return Zero, ErrFormat
+	}
+	d, exact, err := parse(s, HalfUp)
+	if err != nil {
+		return Zero, err
+	}
+	if !exact {
+		return Zero, ErrFormat
+	}
+	return d, nil
+}
+
+// 解析旧账本上的数值: 兼容strconv.FormatFloat产生的多余小数位与指数形式,
+// 超出Scale的部分按mode舍入; 空字符串视为0
+func ParseLegacy(s string, mode RoundingMode) (Decimal, error) {
+	if strings.TrimSpace(s) == "" {
+		return Zero, nil
+	}
+	d, _, err := parse(s, mode)
+	return d, err
+}
+
+func MustParse(s string) Decimal {
+	d, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// 是否为 -?[0-9]+(\.[0-9]+)? 形式
+func canonical(s string) bool {
+	if len(s) > maxLen {
+		return false
+	}
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+	}
+	intPart, fracPart, dot := s, "", false
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart, dot = s[:i], s[i+1:], true
+	}
+	if intPart == "" || (dot && fracPart == "") {
+		return false
+	}
+	for _, c := range intPart + fracPart {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// 解析十进制字符串(可带指数), 返回是否无需舍入
+func parse(s string, mode RoundingMode) (Decimal, bool, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || len(s) > maxLen {
+		return Zero, false, ErrFormat
+	}
+	mantissa, exp := s, 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return Zero, false, ErrFormat
+		}
+		if e > maxExp || e < -maxExp {
+			return Zero, false, ErrRange
+		}
+		mantissa, exp = s[:i], e
+	}
+
+	neg := false
+	if mantissa != "" && (mantissa[0] == '-' || mantissa[0] == '+') {
+		neg = mantissa[0] == '-'
+		mantissa = mantissa[1:]
+	}
+	intPart, fracPart := mantissa, ""
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		intPart, fracPart = mantissa[:i], mantissa[i+1:]
+	}
+	if intPart == "" && fracPart == "" {
+		return Zero, false, ErrFormat
+	}
+	digits := intPart + fracPart
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return Zero, false, ErrFormat
+		}
+	}
+
+	// value = digits * 10^(exp - len(fracPart)), 以10^-Scale为单位
+	n, _ := new(big.Int).SetString("0"+digits, 10)
+	if neg {
+		n.Neg(n)
+	}
+	shift := exp - len(fracPart) + Scale
+	exact := true
+	if shift >= 0 {
+		n.Mul(n, pow10(shift))
+	} else {
+		var rem *big.Int
+		n, rem = divRound(n, pow10(-shift), mode)
+		exact = rem.Sign() == 0
+	}
+	d, err := fit(n)
+	return d, exact, err
+}
+
+// 检查范围
+func fit(n *big.Int) (Decimal, error) {
+	if !n.IsInt64() {
+		return Zero, ErrRange
+	}
+	return checked(n.Int64())
+}
+
+func checked(units int64) (Decimal, error) {
+	if units > maxUnits || units < -maxUnits {
+		return Zero, ErrRange
+	}
+	return Decimal{units: units}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// 按mode做整数除法, 返回商和余数
+func divRound(n, d *big.Int, mode RoundingMode) (*big.Int, *big.Int) {
+	q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+	if r.Sign() == 0 {
+		return q, r
+	}
+	sign := int64(n.Sign() * d.Sign())
+	twice := new(big.Int).Abs(r)
+	twice.Lsh(twice, 1)
+	cmp := twice.Cmp(new(big.Int).Abs(d))
+
+	var away bool
+	switch mode {
+	case HalfUp:
+		away = cmp >= 0
+	case HalfEven:
+		away = cmp > 0 || (cmp == 0 && q.Bit(0) == 1)
+	case Down:
+		away = false
+	case Up:
+		away = true
+	}
+	if away {
+		q.Add(q, big.NewInt(sign))
+	}
+	return q, r
+}
+
+func (d Decimal) Add(o Decimal) (Decimal, error) {
+	return checked(d.units + o.units)
+}
+
+func (d Decimal) Sub(o Decimal) (Decimal, error) {
+	return checked(d.units - o.units)
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{units: -d.units}
+}
+
+// 乘以整数, 结果精确
+func (d Decimal) MulInt(n int64) (Decimal, error) {
+	return fit(new(big.Int).Mul(big.NewInt(d.units), big.NewInt(n)))
+}
+
+// 乘法, 超出Scale的部分按mode舍入
+func (d Decimal) Mul(o Decimal, mode RoundingMode) (Decimal, error) {
+	n := new(big.Int).Mul(big.NewInt(d.units), big.NewInt(o.units))
+	q, _ := divRound(n, big.NewInt(unit), mode)
+	return fit(q)
+}
+
+// 按百分比取值, 例如 Percent(5) 为5%
+func (d Decimal) Percent(p Decimal, mode RoundingMode) (Decimal, error) {
+	n := new(big.Int).Mul(big.NewInt(d.units), big.NewInt(p.units))
+	q, _ := divRound(n, big.NewInt(unit*100), mode)
+	return fit(q)
+}
+
+// 按比例取值 d*n/m, 例如退货按实付金额与原价的比例退款; m为0时返回0
+func (d Decimal) Prorate(n, m Decimal, mode RoundingMode) (Decimal, error) {
+	if m.units == 0 {
+		return Zero, nil
+	}
+	x := new(big.Int).Mul(big.NewInt(d.units), big.NewInt(n.units))
+	q, _ := divRound(x, big.NewInt(m.units), mode)
+	return fit(q)
+}
+
+// 保留places位小数; 合法值舍入后不会越界
+func (d Decimal) Round(places int, mode RoundingMode) Decimal {
+	if places >= Scale {
+		return d
+	}
+	if places < 0 {
+		places = 0
+	}
+	step := pow10(Scale - places)
+	q, _ := divRound(big.NewInt(d.units), step, mode)
+	return Decimal{units: q.Mul(q, step).Int64()}
+}
+
+// 按分舍入(四舍五入)
+func (d Decimal) RoundCents() Decimal {
+	return d.Round(CentPlaces, HalfUp)
+}
+
+func (d Decimal) Cmp(o Decimal) int {
+	if d.units < o.units {
+		return -1
+	}
+	if d.units > o.units {
+		return 1
+	}
+	return 0
+}
+
+func (d Decimal) Sign() int {
+	return d.Cmp(Zero)
+}
+
+func (d Decimal) IsZero() bool {
+	return d.units == 0
+}
+
+// 是否为整数
+func (d Decimal) IsInteger() bool {
+	return d.units%unit == 0
+}
+
+// 整数部分(向0截断)
+func (d Decimal) IntPart() int64 {
+	return d.units / unit
+}
+
+// 规范化字符串: 去掉末尾的0, 整数不带小数点
+func (d Decimal) String() string {
+	s := d.StringFixed(Scale)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// 固定places位小数的字符串, 用于显示, 例如 StringFixed(2) 为 "3.50"
+func (d Decimal) StringFixed(places int) string {
+	r := d.Round(places, HalfUp)
+	u := r.units
+	neg := u < 0
+	if neg {
+		u = -u
+	}
+	intPart := strconv.FormatInt(u/unit, 10)
+	frac := strconv.FormatInt(u%unit+unit, 10)[1:]
+	s := intPart
+	if places > 0 {
+		if places > Scale {
+			places = Scale
+		}
+		s += "." + frac[:places]
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// 接受字符串与数字, 按Parse严格解析
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	var s string
+	if len(b) > 0 && b[0] == '"' {
+		err := json.Unmarshal(b, &s)
+		if err != nil {
+			return err
+		}
+	} else if string(b) == "null" {
+		*d = Zero
+		return nil
+	} else {
+		s = string(b)
+	}
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// 迁移旧账本记录: 把JSON对象中fields字段的旧数值(strconv.FormatFloat产生的字符串或数字)
+// 按ParseLegacy四舍五入后改写为规范字符串, 其余字段原样保留
+func NormalizeLegacy(b []byte, fields ...string) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	err := json.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		raw, ok := doc[f]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		s := string(raw)
+		if len(raw) > 0 && raw[0] == '"' {
+			err = json.Unmarshal(raw, &s)
+			if err != nil {
+				return nil, err
+			}
+		}
+		v, err := ParseLegacy(s, HalfUp)
+		if err != nil {
+			return nil, errors.New("decimal: field " + f + ": " + err.Error())
+		}
+		doc[f], err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,214 @@
+package decimal
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+		err  error
+	}{
+		{"3.5", "3.5", nil},
+		{"-0.25", "-0.25", nil},
+		{"12.000000", "12", nil},
+		{"0.5", "0.5", nil},
+		{"+12", "", ErrFormat},
+		{".5", "", ErrFormat},
+		{"-.5", "", ErrFormat},
+		{"12.", "", ErrFormat},
+		{"1.5e2", "", ErrFormat},
+		{"25e-2", "", ErrFormat},
+		{"1E3", "", ErrFormat},
+		{" 3.5", "", ErrFormat},
+		{"3.5 ", "", ErrFormat},
+		{"3.5\n", "", ErrFormat},
+		{"--1", "", ErrFormat},
+		{"0.0000001", "", ErrFormat},
+		{"1e-7", "", ErrFormat},
+		{"", "", ErrFormat},
+		{"abc", "", ErrFormat},
+		{"1.2.3", "", ErrFormat},
+		{"-", "", ErrFormat},
+		{"1e", "", ErrFormat},
+		{"1000000000000", "1000000000000", nil},
+		{"1000000000000.000001", "", ErrRange},
+		{"-1000000000001", "", ErrRange},
+		{"1e12", "", ErrFormat},
+		{"1e13", "", ErrFormat},
+		{strings.Repeat("1", 80), "", ErrFormat},
+	}
+	for _, c := range cases {
+		d, err := Parse(c.in)
+		if err != c.err {
+			t.Errorf("Parse(%q) error = %v, want %v", c.in, err, c.err)
+			continue
+		}
+		if err == nil && d.String() != c.want {
+			t.Errorf("Parse(%q) = %s, want %s", c.in, d, c.want)
+		}
+	}
+}
+
+func TestParseLegacy(t *testing.T) {
+	cases := []struct {
+		in   string
+		mode RoundingMode
+		want string
+	}{
+		{"0.30000000000000004", HalfUp, "0.3"},
+		{"1e+06", HalfUp, "1000000"},
+		{"2.0000005", HalfUp, "2.000001"},
+		{"2.0000005", HalfEven, "2"},
+		{"2.0000015", HalfEven, "2.000002"},
+		{"-2.0000005", HalfUp, "-2.000001"},
+		{"2.0000009", Down, "2"},
+		{"2.0000001", Up, "2.000001"},
+		{"", HalfUp, "0"},
+		{"+12", HalfUp, "12"},
+		{".5", HalfUp, "0.5"},
+		{" 3.5 ", HalfUp, "3.5"},
+		{"1.5e2", HalfUp, "150"},
+		{"25e-2", HalfUp, "0.25"},
+		{"1e12", HalfUp, "1000000000000"},
+	}
+	for _, c := range cases {
+		d, err := ParseLegacy(c.in, c.mode)
+		if err != nil {
+			t.Errorf("ParseLegacy(%q) error = %v", c.in, err)
+			continue
+		}
+		if d.String() != c.want {
+			t.Errorf("ParseLegacy(%q, %d) = %s, want %s", c.in, c.mode, d, c.want)
+		}
+	}
+
+	for _, in := range []string{"1e13", "1e999999999", "1e-999999999", "0.1e25"} {
+		if _, err := ParseLegacy(in, HalfUp); err != ErrRange {
+			t.Errorf("ParseLegacy(%q) error = %v, want %v", in, err, ErrRange)
+		}
+	}
+}
+
+func TestRound(t *testing.T) {
+	cases := []struct {
+		in     string
+		places int
+		mode   RoundingMode
+		want   string
+	}{
+		{"2.345", 2, HalfUp, "2.35"},
+		{"2.345", 2, HalfEven, "2.34"},
+		{"2.355", 2, HalfEven, "2.36"},
+		{"-2.345", 2, HalfUp, "-2.35"},
+		{"2.349", 2, Down, "2.34"},
+		{"2.341", 2, Up, "2.35"},
+		{"2.5", 0, HalfUp, "3"},
+		{"2.5", -1, HalfEven, "2"},
+		{"1000000000000", 0, Up, "1000000000000"},
+	}
+	for _, c := range cases {
+		d := MustParse(c.in).Round(c.places, c.mode)
+		if d.String() != c.want {
+			t.Errorf("Round(%s, %d, %d) = %s, want %s", c.in, c.places, c.mode, d, c.want)
+		}
+	}
+	if s := MustParse("3.5").StringFixed(2); s != "3.50" {
+		t.Errorf("StringFixed = %s, want 3.50", s)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	a, b := MustParse("19.99"), MustParse("3")
+	check := func(name string, d Decimal, err error, want string) {
+		t.Helper()
+		if err != nil {
+			t.Errorf("%s error = %v", name, err)
+		} else if d.String() != want {
+			t.Errorf("%s = %s, want %s", name, d, want)
+		}
+	}
+	d, err := a.Add(b)
+	check("Add", d, err, "22.99")
+	d, err = a.Sub(b)
+	check("Sub", d, err, "16.99")
+	d, err = a.MulInt(3)
+	check("MulInt", d, err, "59.97")
+	d, err = a.Mul(MustParse("0.5"), HalfUp)
+	check("Mul", d, err, "9.995")
+	d, err = a.Percent(MustParse("5"), HalfUp)
+	check("Percent", d, err, "0.9995")
+	d, err = MustParse("10").Prorate(MustParse("90"), MustParse("100"), HalfUp)
+	check("Prorate", d, err, "9")
+	d, err = MustParse("10").Prorate(MustParse("1"), Zero, HalfUp)
+	check("Prorate by zero", d, err, "0")
+}
+
+func TestOverflow(t *testing.T) {
+	big := MustParse("900000000000")
+	cases := []struct {
+		name string
+		op   func() (Decimal, error)
+	}{
+		{"Add", func() (Decimal, error) { return big.Add(big) }},
+		{"Sub", func() (Decimal, error) { return big.Neg().Sub(big) }},
+		{"MulInt", func() (Decimal, error) { return big.MulInt(1 << 40) }},
+		{"Mul", func() (Decimal, error) { return big.Mul(big, HalfUp) }},
+		{"Percent", func() (Decimal, error) { return big.Percent(MustParse("1000"), HalfUp) }},
+		{"Prorate", func() (Decimal, error) { return big.Prorate(big, MustParse("0.000001"), HalfUp) }},
+	}
+	for _, c := range cases {
+		if _, err := c.op(); err != ErrRange {
+			t.Errorf("%s error = %v, want ErrRange", c.name, err)
+		}
+	}
+	if d, err := Max.Add(Zero); err != nil || d.Cmp(Max) != 0 {
+		t.Errorf("Max.Add(0) = %s, %v", d, err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Price Decimal `json:"Price"`
+	}
+	for in, want := range map[string]string{
+		`{"Price":"3.50"}`: "3.5",
+		`{"Price":3.5}`:    "3.5",
+		`{"Price":null}`:   "0",
+	} {
+		v.Price = MustParse("1")
+		if err := json.Unmarshal([]byte(in), &v); err != nil {
+			t.Errorf("Unmarshal(%s) error = %v", in, err)
+		} else if v.Price.String() != want {
+			t.Errorf("Unmarshal(%s) = %s, want %s", in, v.Price, want)
+		}
+	}
+	for _, in := range []string{`{"Price":"3.1234567"}`, `{"Price":"1e999999999"}`, `{"Price":"0.30000000000000004"}`} {
+		if err := json.Unmarshal([]byte(in), &v); err == nil {
+			t.Errorf("Unmarshal(%s) should fail", in)
+		}
+	}
+	v.Price = MustParse("-3.50")
+	b, err := json.Marshal(v)
+	if err != nil || string(b) != `{"Price":"-3.5"}` {
+		t.Errorf("Marshal = %s, %v", b, err)
+	}
+}
+
+func TestNormalizeLegacy(t *testing.T) {
+	in := `{"ID":"c1","UnitPrice":"3.4999999999999996","Stock":1e+06,"Name":"x"}`
+	b, err := NormalizeLegacy([]byte(in), "UnitPrice", "Stock", "Missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"ID":"c1","Name":"x","Stock":"1000000","UnitPrice":"3.5"}`
+	if string(b) != want {
+		t.Errorf("NormalizeLegacy = %s, want %s", b, want)
+	}
+	if _, err := NormalizeLegacy([]byte(`{"Stock":"x"}`), "Stock"); err == nil {
+		t.Error("NormalizeLegacy should reject malformed numbers")
+	}
+}
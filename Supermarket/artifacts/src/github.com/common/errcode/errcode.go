@@ -0,0 +1,158 @@
+/*
+错误码
+各链码的返回统一为 {"Code": 0, "Des": "..."}; 失败时Code为下列稳定的错误码, 客户端按Code分支, 不必解析Des:
+  400 validation      参数或字段不合法
+  401 unauthenticated 无法识别提交者身份(与authz一致)
+  403 forbidden       无权限(与authz一致)
+  404 not-found       记录不存在
+  409 already-exists  记录已存在
+  412 conflict        与记录的当前状态或版本冲突
+  422 business-rule   违反业务规则, 例如商品已召回、优惠券已核销
+  500 internal        账本读写、序列化等内部错误
+失败时还带有Error(错误码名称)、Details(按字段的错误)和TxID, 成功时没有这些字段.
+调用其他链码失败时用FromResponse保留被调用链码的错误码与Details.
+本包只依赖标准库与authz.
+*/
+
+package errcode
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/common/authz"
+)
+
+// 错误码
+const (
+	OK              = 0
+	Validation      = 400
+	Unauthenticated = authz.CodeUnauthenticated
+	Forbidden       = authz.CodeForbidden
+	NotFound        = 404
+	AlreadyExists   = 409
+	Conflict        = 412
+	BusinessRule    = 422
+	Internal        = 500
+)
+
+var names = map[int]string{
+	Validation:      "validation",
+	Unauthenticated: "unauthenticated",
+	Forbidden:       "forbidden",
+	NotFound:        "not-found",
+	AlreadyExists:   "already-exists",
+	Conflict:        "conflict",
+	BusinessRule:    "business-rule",
+	Internal:        "internal",
+}
+
+// 错误码名称, 不在目录中的错误码为空
+func Name(code int) string {
+	return names[code]
+}
+
+// 一个字段的错误
+type Detail struct {
+	Field  string `json:"Field"`  // 字段名, 参数个数等不属于某个字段的错误为"args"
+	Reason string `json:"Reason"` // 例如 "is required"
+}
+
+// 链码返回
+type Ret struct {
+	Code    int      `json:"Code"`
+	Des     string   `json:"Des"`
+	Error   string   `json:"Error,omitempty"`
+	Details []Detail `json:"Details,omitempty"`
+	TxID    string   `json:"TxID,omitempty"`
+}
+
+// 生成返回; 不在目录中的非0错误码按内部错误处理
+func NewRet(code int, des string, details ...Detail) Ret {
+	r := Ret{Code: code, Des: des, Details: details}
+	if code != OK {
+		if Name(code) == "" {
+			r.Code = Internal
+		}
+		r.Error = Name(r.Code)
+	}
+	return r
+}
+
+// 在错误返回中加上交易ID; 不是错误返回时原样返回
+func Stamp(message, txID string) string {
+	var r Ret
+	if json.Unmarshal([]byte(message), &r) != nil || r.Code == OK {
+		return message
+	}
+	r.TxID = txID
+	b, err := json.Marshal(r)
+	if err != nil {
+		return message
+	}
+	return string(b)
+}
+
+// 带错误码的错误
+type Error struct {
+	Code    int
+	Message string
+	Details []Detail
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// 生成错误
+func New(code int, message string, details ...Detail) *Error {
+	return &Error{Code: code, Message: message, Details: details}
+}
+
+// 生成错误, 格式同fmt.Sprintf
+func Errorf(code int, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// 字段错误
+func Field(field, reason string) Detail {
+	return Detail{Field: field, Reason: reason}
+}
+
+// 参数个数错误
+func Args(reason string) Detail {
+	return Detail{Field: "args", Reason: reason}
+}
+
+// 错误的错误码; 权限错误取authz的错误码, 其他错误为内部错误
+func Code(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return OK
+	case *Error:
+		return e.Code
+	case *authz.Error:
+		return e.Code
+	}
+	return Internal
+}
+
+// 错误的Details
+func DetailsOf(err error) []Detail {
+	if e, ok := err.(*Error); ok {
+		return e.Details
+	}
+	return nil
+}
+
+// 被调用链码返回的错误, 保留其错误码与Details; 旧版的返回按内部错误处理
+func FromResponse(message string) *Error {
+	var r Ret
+	if json.Unmarshal([]byte(message), &r) != nil || r.Code == OK {
+		return &Error{Code: Internal, Message: message}
+	}
+	code := r.Code
+	if Name(code) == "" {
+		code = Internal
+	}
+	return &Error{Code: code, Message: r.Des, Details: r.Details}
+}
@@ -0,0 +1,236 @@
+/*
+链码事件
+Fabric 1.x每个交易只保留最后一次SetEvent, 并且只有最外层被调用的链码设置的事件会随交易提交,
+因此每次调用把本次的所有业务事件合成一批, 以固定的事件名Name发出;
+由goods、sales、purchaseorder等调用其他链码完成的业务, 由最外层链码发出相应的事件.
+结账时累计消费引起的会员升级发生在被调用的usercc中, 由sales根据usercc change返回的等级变化发出VIPChanged.
+LoginFailed只在登录作为交易提交时发出.
+
+事件目录(Type, 数据结构, 版本):
+  CategoryCreated   Category       1
+  CategoryChanged   Category       1
+  CategoryDeleted   Category       1
+  PriceChanged      PriceChange    1
+  StockMoved        StockMovement  1
+  CommodityReceived Commodity      1
+  CommoditySold     Commodity      1
+  UserRegistered    User           1
+  VIPChanged        VIPChange      1
+  LoginFailed       LoginFailure   1
+数据结构增加字段不改变版本, 删除或改变字段含义时版本加一.
+下游用Decode解析批次, 再用Event.Decode取得对应的数据结构. 本包只依赖标准库.
+*/
+
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// 事件名, 链码事件监听按此名称过滤
+const Name = "SupermarketEvents"
+
+// 批次格式版本
+const BatchVersion = 1
+
+// 事件类型
+const (
+	CategoryCreated   = "CategoryCreated"
+	CategoryChanged   = "CategoryChanged"
+	CategoryDeleted   = "CategoryDeleted"
+	PriceChanged      = "PriceChanged"
+	StockMoved        = "StockMoved"
+	CommodityReceived = "CommodityReceived"
+	CommoditySold     = "CommoditySold"
+	UserRegistered    = "UserRegistered"
+	VIPChanged        = "VIPChanged"
+	LoginFailed       = "LoginFailed"
+)
+
+// 各类型的当前版本
+var Versions = map[string]int{
+	CategoryCreated:   1,
+	CategoryChanged:   1,
+	CategoryDeleted:   1,
+	PriceChanged:      1,
+	StockMoved:        1,
+	CommodityReceived: 1,
+	CommoditySold:     1,
+	UserRegistered:    1,
+	VIPChanged:        1,
+	LoginFailed:       1,
+}
+
+// 类别新建、修改、删除
+type Category struct {
+	ID        string `json:"ID"`
+	StoreID   string `json:"StoreID"`
+	Name      string `json:"Name"`
+	BarCode   string `json:"BarCode"`
+	UnitPrice string `json:"UnitPrice"` // 定点小数字符串
+	ShelfLife string `json:"ShelfLife"`
+}
+
+// 价格变化
+type PriceChange struct {
+	CateID  string `json:"CateID"`
+	StoreID string `json:"StoreID"`
+	From    string `json:"From"`
+	To      string `json:"To"`
+}
+
+// 库存变动, Quantity为带符号的定点小数字符串
+type StockMovement struct {
+	CateID    string `json:"CateID"`
+	StoreID   string `json:"StoreID"`
+	Type      string `json:"Type"` // receipt, sale, return, adjustment, transfer
+	Quantity  string `json:"Quantity"`
+	Reference string `json:"Reference"`
+	Peer      string `json:"Peer"` // 调货的对方商店
+}
+
+// 商品入库、售出
+type Commodity struct {
+	ID        string `json:"ID"`
+	Category  string `json:"Category"`
+	StoreID   string `json:"StoreID"`
+	Supplier  string `json:"Supplier"`
+	Reference string `json:"Reference"` // 采购单号、销售单号等, 可为空
+}
+
+// 用户注册
+type User struct {
+	ID  string `json:"ID"`
+	VIP string `json:"VIP"`
+}
+
+// 会员等级变化
+type VIPChange struct {
+	UserID string `json:"UserID"`
+	From   string `json:"From"`
+	To     string `json:"To"`
+	Reason string `json:"Reason"`
+	Cost   string `json:"Cost"` // 评定所依据的消费
+}
+
+// 登录失败
+type LoginFailure struct {
+	ID     string `json:"ID"`
+	Reason string `json:"Reason"` // unknown-user, bad-password
+}
+
+// 一个事件
+type Event struct {
+	Type    string          `json:"Type"`
+	Version int             `json:"Version"`
+	Data    json.RawMessage `json:"Data"`
+}
+
+// 一个交易的事件
+type Batch struct {
+	Version int     `json:"Version"`
+	TxID    string  `json:"TxID"`
+	Events  []Event `json:"Events"`
+}
+
+// 发出事件所需的stub方法
+type Stub interface {
+	GetTxID() string
+	SetEvent(name string, payload []byte) error
+}
+
+// 生成事件, data为目录中对应的数据结构
+func New(typ string, data interface{}) (Event, error) {
+	version, ok := Versions[typ]
+	if !ok {
+		return Event{}, errors.New("events: unknown event type " + typ)
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Type: typ, Version: version, Data: b}, nil
+}
+
+// 事件列表, 便于在一次调用中逐个加入
+type List []Event
+
+// 加入一个事件
+func (l *List) Add(typ string, data interface{}) error {
+	e, err := New(typ, data)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, e)
+	return nil
+}
+
+// 发出本次调用的事件; 一次调用只应调用一次, 没有事件时不发出
+func (l List) Emit(stub Stub) error {
+	if len(l) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(Batch{Version: BatchVersion, TxID: stub.GetTxID(), Events: l})
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(Name, b)
+}
+
+// 发出单个事件
+func Emit(stub Stub, typ string, data interface{}) error {
+	var l List
+	err := l.Add(typ, data)
+	if err != nil {
+		return err
+	}
+	return l.Emit(stub)
+}
+
+// 解析事件批次
+func Decode(payload []byte) (*Batch, error) {
+	var b Batch
+	err := json.Unmarshal(payload, &b)
+	if err != nil {
+		return nil, err
+	}
+	if b.Version != BatchVersion {
+		return nil, fmt.Errorf("events: unsupported batch version %d", b.Version)
+	}
+	return &b, nil
+}
+
+// 按类型解析事件数据, 返回目录中对应数据结构的指针; 未知类型或较新的版本返回错误
+func (e Event) Decode() (interface{}, error) {
+	version, ok := Versions[e.Type]
+	if !ok {
+		return nil, errors.New("events: unknown event type " + e.Type)
+	}
+	if e.Version > version {
+		return nil, fmt.Errorf("events: %s version %d is newer than %d", e.Type, e.Version, version)
+	}
+	var v interface{}
+	switch e.Type {
+	case CategoryCreated, CategoryChanged, CategoryDeleted:
+		v = &Category{}
+	case PriceChanged:
+		v = &PriceChange{}
+	case StockMoved:
+		v = &StockMovement{}
+	case CommodityReceived, CommoditySold:
+		v = &Commodity{}
+	case UserRegistered:
+		v = &User{}
+	case VIPChanged:
+		v = &VIPChange{}
+	case LoginFailed:
+		v = &LoginFailure{}
+	}
+	err := json.Unmarshal(e.Data, v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,221 @@
+/*
+变更历史
+Fabric的GetHistoryForKey只返回交易ID、时间、是否删除和当时的值, 不包含提交者.
+每次写入或删除记录时调用Stamp, 在本链码中按交易ID保存提交者(MSP ID与证书subject);
+查询时由Query遍历GetHistoryForKey的结果并分页, 补上提交者并计算相邻版本之间按字段的差异.
+本包只依赖标准库、authz、paging与txtime, 因此各链码(包括vendor了fabric的index)都可以使用;
+GetHistoryForKey的结果类型来自fabric, 由适配器(common/ledger, index自己的ledger.go)转为Modification.
+*/
+
+package history
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/paging"
+	"github.com/common/txtime"
+	"sort"
+)
+
+// 保存提交者的composite key: txID
+const SubmitterIndexName = "history~txID"
+
+// 链码中用到的stub方法
+type Stub interface {
+	authz.Stub
+	GetTxID() string
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+	CreateCompositeKey(objectType string, attributes []string) (string, error)
+}
+
+// 查询历史用到的账本访问
+type Ledger interface {
+	Stub
+	// 按GetHistoryForKey的顺序(旧的在前)对每次修改调用fn, fn返回false时停止
+	History(key string, fn func(m Modification) (bool, error)) error
+}
+
+// 交易提交者
+type Submitter struct {
+	MSPID   string `json:"MSPID"`
+	Subject string `json:"Subject"` // 证书subject, 例如 "CN=alice,OU=client,O=Org1"
+}
+
+// GetHistoryForKey返回的一次修改
+type Modification struct {
+	TxID     string
+	Seconds  int64
+	Nanos    int32
+	IsDelete bool
+	Value    []byte
+}
+
+// 满足txtime.Timestamp
+func (m Modification) GetSeconds() int64 { return m.Seconds }
+func (m Modification) GetNanos() int32   { return m.Nanos }
+
+// 一个字段的变化, 新增字段没有Old, 删除字段没有New
+type Change struct {
+	Field string          `json:"Field"`
+	Old   json.RawMessage `json:"Old,omitempty"`
+	New   json.RawMessage `json:"New,omitempty"`
+}
+
+// 一条历史
+type Entry struct {
+	TxID      string          `json:"TxID"`
+	Time      string          `json:"Time"`      // 交易时间, unix毫秒
+	Submitter *Submitter      `json:"Submitter"` // 本功能上线前的交易没有记录提交者, 为null
+	IsDelete  bool            `json:"IsDelete"`
+	Value     json.RawMessage `json:"Value"`   // 删除时为null
+	Changes   []Change        `json:"Changes"` // 与上一版本相比变化的字段
+}
+
+func submitterKey(stub Stub, txID string) (string, error) {
+	return stub.CreateCompositeKey(SubmitterIndexName, []string{txID})
+}
+
+// 记录本交易的提交者; 同一交易多次调用只保存一份
+func Stamp(stub Stub) error {
+	id, err := authz.GetIdentity(stub)
+	if err != nil {
+		return err
+	}
+	key, err := submitterKey(stub, stub.GetTxID())
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(Submitter{MSPID: id.MSPID, Subject: id.Subject})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, b)
+}
+
+// 取得交易的提交者, 没有记录时为nil
+func GetSubmitter(stub Stub, txID string) (*Submitter, error) {
+	key, err := submitterKey(stub, txID)
+	if err != nil {
+		return nil, err
+	}
+	b, err := stub.GetState(key)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	var s Submitter
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// 查询key的变更历史(旧的在前), 返回paging.Page的JSON, redact中的字段从值和差异中去掉;
+// 每页size条, bookmark为上一页返回的交易ID, 为空时从第一次修改开始.
+// 差异要与上一版本比较, 因此书签之前的修改也要遍历, 只是不查询提交者
+func Query(stub Ledger, key string, size int, bookmark string, redact ...string) ([]byte, error) {
+	page := paging.Page{}
+	entries := []Entry{}
+	var prev map[string]json.RawMessage
+	skip := bookmark != ""
+	err := stub.History(key, func(m Modification) (bool, error) {
+		if skip && m.TxID == bookmark {
+			skip = false
+		}
+		if !skip && len(entries) == size {
+			page.Bookmark = m.TxID
+			return false, nil
+		}
+		cur, err := fields(m, redact)
+		if err != nil {
+			return false, err
+		}
+		if !skip {
+			e, err := newEntry(stub, m, prev, cur)
+			if err != nil {
+				return false, err
+			}
+			entries = append(entries, e)
+		}
+		prev = cur
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	page.Records = entries
+	page.Count = len(entries)
+	return json.Marshal(page)
+}
+
+// 修改后的字段, 删除时为nil
+func fields(m Modification, redact []string) (map[string]json.RawMessage, error) {
+	if m.IsDelete || m.Value == nil {
+		return nil, nil
+	}
+	var cur map[string]json.RawMessage
+	err := json.Unmarshal(m.Value, &cur)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range redact {
+		delete(cur, f)
+	}
+	return cur, nil
+}
+
+func newEntry(stub Stub, m Modification, prev, cur map[string]json.RawMessage) (Entry, error) {
+	e := Entry{
+		TxID:     m.TxID,
+		Time:     txtime.Format(txtime.Of(m)),
+		IsDelete: m.IsDelete,
+		Changes:  Diff(prev, cur),
+	}
+	s, err := GetSubmitter(stub, m.TxID)
+	if err != nil {
+		return e, err
+	}
+	e.Submitter = s
+	if cur != nil {
+		e.Value, err = json.Marshal(cur)
+	}
+	return e, err
+}
+
+// 两个版本之间按顶层字段比较, 结果按字段名排序
+func Diff(old, cur map[string]json.RawMessage) []Change {
+	changes := []Change{}
+	fields := map[string]bool{}
+	for f := range old {
+		fields[f] = true
+	}
+	for f := range cur {
+		fields[f] = true
+	}
+	names := make([]string, 0, len(fields))
+	for f := range fields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	for _, f := range names {
+		o, inOld := old[f]
+		n, inCur := cur[f]
+		if inOld && inCur && equal(o, n) {
+			continue
+		}
+		changes = append(changes, Change{Field: f, Old: o, New: n})
+	}
+	return changes
+}
+
+// 比较两个JSON值, 忽略空白
+func equal(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
@@ -0,0 +1,90 @@
+package history
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type fakeLedger struct {
+	state map[string][]byte
+	mods  []Modification
+}
+
+func (l fakeLedger) GetCreator() ([]byte, error)         { return nil, nil }
+func (l fakeLedger) GetTxID() string                     { return "" }
+func (l fakeLedger) GetState(key string) ([]byte, error) { return l.state[key], nil }
+func (l fakeLedger) PutState(key string, value []byte) error {
+	l.state[key] = value
+	return nil
+}
+func (l fakeLedger) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return objectType + "\x00" + strings.Join(attributes, "\x00"), nil
+}
+
+func (l fakeLedger) History(key string, fn func(m Modification) (bool, error)) error {
+	for _, m := range l.mods {
+		more, err := fn(m)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+type page struct {
+	Records  []Entry
+	Count    int
+	Bookmark string
+}
+
+func TestQuery(t *testing.T) {
+	l := fakeLedger{state: map[string][]byte{}, mods: []Modification{
+		{TxID: "t1", Seconds: 1, Value: []byte(`{"Name":"a","Password":"x"}`)},
+		{TxID: "t2", Seconds: 2, Value: []byte(`{"Name":"b","Password":"y"}`)},
+		{TxID: "t3", Seconds: 3, IsDelete: true},
+	}}
+	l.state["history~txID\x00t2"] = []byte(`{"MSPID":"Org1MSP","Subject":"CN=alice"}`)
+
+	cases := []struct {
+		size     int
+		bookmark string
+		txIDs    string
+		next     string
+	}{
+		{20, "", "t1,t2,t3", ""},
+		{2, "", "t1,t2", "t3"},
+		{1, "t2", "t2", "t3"},
+		{2, "t3", "t3", ""},
+		{2, "unknown", "", ""},
+	}
+	for _, c := range cases {
+		b, err := Query(l, "k", c.size, c.bookmark, "Password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p page
+		if err := json.Unmarshal(b, &p); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range p.Records {
+			ids = append(ids, e.TxID)
+		}
+		if strings.Join(ids, ",") != c.txIDs || p.Count != len(ids) || p.Bookmark != c.next {
+			t.Errorf("Query(%d, %q) = %s", c.size, c.bookmark, b)
+		}
+	}
+
+	// 书签之后的第一条仍与书签之前的版本比较, 且不含被去掉的字段
+	b, _ := Query(l, "k", 1, "t2", "Password")
+	var p page
+	json.Unmarshal(b, &p)
+	e := p.Records[0]
+	if len(e.Changes) != 1 || e.Changes[0].Field != "Name" || string(e.Changes[0].Old) != `"a"` {
+		t.Errorf("changes = %+v", e.Changes)
+	}
+	if string(e.Value) != `{"Name":"b"}` || e.Submitter == nil || e.Submitter.MSPID != "Org1MSP" {
+		t.Errorf("entry = %s", b)
+	}
+}
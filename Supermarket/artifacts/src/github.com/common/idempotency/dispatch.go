@@ -0,0 +1,223 @@
+/*
+按幂等key分发与清理
+各链码的Invoke通过DispatchOnce分发, setIdempotencyWindow与purgeIdempotencyKeys由SetWindowFunc与PurgeFunc实现.
+fabric的类型(pb.Response、时间戳、迭代器)由适配器转换: common/ledger用于GOPATH中的链码, index vendor了fabric, 由index/ledger.go适配.
+*/
+
+package idempotency
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/common/errcode"
+	"strconv"
+)
+
+// 状态码, 与shim.OK、shim.ERROR相同
+const (
+	StatusOK    = 200
+	StatusError = 500
+)
+
+// 链码的返回, 与pb.Response的字段相同
+type Response struct {
+	Status  int32
+	Message string
+	Payload []byte
+}
+
+// 分发与清理用到的账本访问, 由适配器实现
+type Ledger interface {
+	Stub
+	DelState(key string) error
+	GetArgs() [][]byte
+	GetFunctionAndParameters() (string, []string)
+	// 提案(SignedProposal.ProposalBytes)
+	ProposalBytes() ([]byte, error)
+	// 交易时间, unix毫秒
+	Time() (int64, error)
+	// 按key的顺序遍历composite key, fn返回false时停止
+	Scan(objectType string, attributes []string, fn func(key string, value []byte) (bool, error)) error
+}
+
+// 错误返回, 格式与各链码的getRetString相同
+func failure(des string, err error) Response {
+	b, _ := json.Marshal(errcode.NewRet(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...))
+	return Response{Status: StatusError, Message: string(b)}
+}
+
+func success(des string) Response {
+	b, _ := json.Marshal(errcode.NewRet(errcode.OK, des))
+	return Response{Status: StatusOK, Payload: b}
+}
+
+// 带幂等key时: key已用过则返回当时的结果, 否则执行dispatch并保存结果
+func DispatchOnce(stub Ledger, dispatch func() Response) Response {
+	key, err := Key(stub)
+	if err != nil {
+		return failure("idempotency key: ", err)
+	}
+	if key == "" || !TopLevel(stub) {
+		return dispatch()
+	}
+	function, args := stub.GetFunctionAndParameters()
+	req, err := NewRequest(stub, key, function, args)
+	if err != nil {
+		return failure("idempotency key: ", err)
+	}
+	now, err := stub.Time()
+	if err != nil {
+		return failure("idempotency key: get time stamp failed: ", errcode.New(errcode.Internal, err.Error()))
+	}
+	prev, err := Lookup(stub, req, now)
+	if err != nil {
+		return failure("idempotency key: ", err)
+	}
+	if prev != nil {
+		return Response{Status: prev.Status, Message: prev.Message, Payload: prev.Payload}
+	}
+
+	resp := dispatch()
+	if resp.Status == StatusOK {
+		err = Save(stub, req, now, resp.Status, resp.Message, resp.Payload)
+		if err != nil {
+			return failure("idempotency key: save result failed: ", errcode.New(errcode.Internal, err.Error()))
+		}
+	}
+	return resp
+}
+
+// 是否由客户端直接调用: 提案中的参数与本次调用的参数相同; 被其他链码调用时不同
+func TopLevel(stub Ledger) bool {
+	b, err := stub.ProposalBytes()
+	if err != nil {
+		return false
+	}
+	in, ok := proposalArgs(b)
+	args := stub.GetArgs()
+	if !ok || len(in) != len(args) {
+		return false
+	}
+	for i := range in {
+		if string(in[i]) != string(args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// 提案中调用的参数, 逐层取protobuf字段:
+// Proposal.payload(2) -> ChaincodeProposalPayload.input(1) -> ChaincodeInvocationSpec.chaincode_spec(1)
+// -> ChaincodeSpec.input(3) -> ChaincodeInput.args(1)
+func proposalArgs(b []byte) ([][]byte, bool) {
+	for _, num := range []uint64{2, 1, 1, 3} {
+		values, ok := fields(b, num)
+		if !ok || len(values) == 0 {
+			return nil, false
+		}
+		b = values[len(values)-1]
+	}
+	return fields(b, 1)
+}
+
+// 消息中编号为num的length-delimited字段
+func fields(b []byte, num uint64) ([][]byte, bool) {
+	var values [][]byte
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, false
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			_, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, false
+			}
+			b = b[n:]
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return nil, false
+			}
+			b = b[size:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, false
+			}
+			if tag>>3 == num {
+				values = append(values, b[n:n+int(l)])
+			}
+			b = b[n+int(l):]
+		default:
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// 删除最多limit条已失效的结果, 返回删除的条数
+func Purge(stub Ledger, limit int) (int, error) {
+	now, err := stub.Time()
+	if err != nil {
+		return 0, err
+	}
+	window, err := Window(stub)
+	if err != nil {
+		return 0, err
+	}
+	var expired []string
+	err = stub.Scan(IndexName, []string{}, func(key string, value []byte) (bool, error) {
+		var e Entry
+		if json.Unmarshal(value, &e) != nil || e.Expired(now, window) {
+			expired = append(expired, key)
+		}
+		return len(expired) < limit, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range expired {
+		err = stub.DelState(key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// setIdempotencyWindow: 设置幂等key的保存时间
+// args: 0 - 秒
+func SetWindowFunc(stub Ledger, args []string) Response {
+	if len(args) != 1 {
+		return failure("Chaincode Invoke setIdempotencyWindow ", errcode.New(errcode.Validation, "args!=1", errcode.Args("want 1")))
+	}
+	err := SetWindow(stub, args[0])
+	if err != nil {
+		return failure("Chaincode Invoke setIdempotencyWindow failed : ", err)
+	}
+	return success("invoke setIdempotencyWindow success")
+}
+
+// purgeIdempotencyKeys: 删除已失效的幂等key
+// args: 0 - 最多删除的条数
+func PurgeFunc(stub Ledger, args []string) Response {
+	if len(args) != 1 {
+		return failure("Chaincode Invoke purgeIdempotencyKeys ", errcode.New(errcode.Validation, "args!=1", errcode.Args("want 1")))
+	}
+	limit, err := strconv.Atoi(args[0])
+	if err != nil || limit <= 0 {
+		return failure("Chaincode Invoke purgeIdempotencyKeys failed : ", errcode.New(errcode.Validation,
+			"limit should be a positive integer", errcode.Field("limit", "should be a positive integer")))
+	}
+	count, err := Purge(stub, limit)
+	if err != nil {
+		return failure("Chaincode Invoke purgeIdempotencyKeys failed : ", errcode.New(errcode.Internal, err.Error()))
+	}
+	return success("invoke purgeIdempotencyKeys success: " + strconv.Itoa(count) + " keys")
+}
@@ -0,0 +1,43 @@
+package idempotency
+
+import (
+	"reflect"
+	"testing"
+)
+
+// 按protobuf编码一个length-delimited字段
+func field(num byte, value []byte) []byte {
+	return append([]byte{num<<3 | 2, byte(len(value))}, value...)
+}
+
+func TestProposalArgs(t *testing.T) {
+	input := append(field(1, []byte("add")), field(1, []byte("1"))...)
+	spec := append([]byte{0x08, 0x01}, field(3, input)...) // type = GOLANG
+	payload := field(1, field(1, spec))
+	proposal := append(field(1, []byte("header")), field(2, payload)...)
+
+	cases := []struct {
+		name string
+		b    []byte
+		args []string
+		ok   bool
+	}{
+		{"proposal", proposal, []string{"add", "1"}, true},
+		{"empty input", field(2, field(1, field(1, field(3, nil)))), nil, true},
+		{"no payload", field(1, []byte("header")), nil, false},
+		{"truncated length", append(field(1, []byte("h")), 0x12, 0x7f), nil, false},
+		{"truncated varint", []byte{0x08, 0x80}, nil, false},
+		{"unsupported wire type", []byte{0x0b}, nil, false},
+		{"empty", nil, nil, false},
+	}
+	for _, c := range cases {
+		in, ok := proposalArgs(c.b)
+		var args []string
+		for _, a := range in {
+			args = append(args, string(a))
+		}
+		if ok != c.ok || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%s: proposalArgs = %q, %v, want %q, %v", c.name, args, ok, c.args, c.ok)
+		}
+	}
+}
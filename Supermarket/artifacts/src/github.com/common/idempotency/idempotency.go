@@ -0,0 +1,204 @@
+/*
+幂等key
+客户端超时后重试时, 在transient map的"idempotency-key"中带上同一个key(例如UUID), 任何修改账本的函数都可以使用:
+第一次调用成功后, 链码按key保存本次的结果(状态、消息、payload); 再次提交同一key时直接返回保存的结果, 不再执行,
+因此重试不会重复增加库存或消费. 失败的调用不会提交, 不保存结果, 重试时重新执行.
+同一key只能用于同一提交者的同一请求(函数与参数相同), 否则返回412.
+key在保存时间窗口(默认24小时, 可由setIdempotencyWindow配置)过后失效, 可以再次使用; purgeIdempotencyKeys删除失效的记录.
+被其他链码调用时transient与外层相同, 只有客户端直接调用的链码记录key.
+查询不会提交, 带key也没有影响. 重放不会再次发出链码事件.
+本包只依赖标准库、authz、errcode与txtime.
+*/
+
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/txtime"
+	"regexp"
+	"strconv"
+)
+
+// transient map中的key名
+const TransientKey = "idempotency-key"
+
+// 保存结果的composite key: key
+const IndexName = "idempotency~key"
+
+// 时间窗口配置的key
+const ConfigKey = "IdempotencyConfig"
+
+// 默认与最长的保存时间(秒)
+const (
+	DefaultWindow = 24 * 60 * 60
+	MaxWindow     = 366 * 24 * 60 * 60
+)
+
+var keyRe = regexp.MustCompile(`^[0-9A-Za-z_.:-]{8,128}$`)
+
+// 所需的stub方法
+type Stub interface {
+	authz.Stub
+	GetTransient() (map[string][]byte, error)
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+	CreateCompositeKey(objectType string, attributes []string) (string, error)
+	GetTxID() string
+}
+
+// 时间窗口配置
+type Config struct {
+	Window int64 `json:"Window"` // 秒
+}
+
+// 一次调用的结果
+type Entry struct {
+	Key       string `json:"Key"`
+	Submitter string `json:"Submitter"` // MSP ID与证书subject的摘要
+	Request   string `json:"Request"`   // 函数与参数的摘要
+	TxID      string `json:"TxID"`
+	Time      string `json:"Time"` // unix毫秒
+	Status    int32  `json:"Status"`
+	Message   string `json:"Message"`
+	Payload   []byte `json:"Payload"`
+}
+
+// 本次调用的key, 没有时为空
+func Key(stub Stub) (string, error) {
+	m, err := stub.GetTransient()
+	if err != nil {
+		return "", errcode.New(errcode.Internal, "get transient failed")
+	}
+	b, ok := m[TransientKey]
+	if !ok {
+		return "", nil
+	}
+	key := string(b)
+	if !keyRe.MatchString(key) {
+		return "", errcode.New(errcode.Validation, "idempotency key should be 8 to 128 letters, digits or _.:-",
+			errcode.Field(TransientKey, "should be 8 to 128 letters, digits or _.:-"))
+	}
+	return key, nil
+}
+
+func digest(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(strconv.Itoa(len(p))))
+		h.Write([]byte{':'})
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 一次带key的请求
+type Request struct {
+	Key       string
+	Submitter string
+	Digest    string
+}
+
+// 生成请求, 摘要包括提交者、函数与参数
+func NewRequest(stub Stub, key, function string, args []string) (*Request, error) {
+	id, err := authz.GetIdentity(stub)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{
+		Key:       key,
+		Submitter: digest(id.MSPID, id.Subject),
+		Digest:    digest(append([]string{function}, args...)...),
+	}, nil
+}
+
+// 保存时间窗口(毫秒)
+func Window(stub Stub) (int64, error) {
+	b, err := stub.GetState(ConfigKey)
+	if err != nil {
+		return 0, err
+	}
+	if b == nil {
+		return DefaultWindow * txtime.Second, nil
+	}
+	var c Config
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return 0, err
+	}
+	return c.Window * txtime.Second, nil
+}
+
+// 设置保存时间窗口
+func SetWindow(stub Stub, seconds string) error {
+	n, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil || n <= 0 || n > MaxWindow {
+		return errcode.New(errcode.Validation, "window should be 1 to "+strconv.Itoa(MaxWindow)+" seconds",
+			errcode.Field("Window", "should be 1 to "+strconv.Itoa(MaxWindow)+" seconds"))
+	}
+	b, err := json.Marshal(Config{Window: n})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(ConfigKey, b)
+}
+
+// 保存的结果在now时是否已失效
+func (e Entry) Expired(now, window int64) bool {
+	t, err := txtime.Parse(e.Time)
+	return err != nil || now >= t+window
+}
+
+// 查找key已保存的结果; 没有或已失效时为nil, key用于其他请求时返回errcode.Conflict
+func Lookup(stub Stub, req *Request, now int64) (*Entry, error) {
+	k, err := stub.CreateCompositeKey(IndexName, []string{req.Key})
+	if err != nil {
+		return nil, err
+	}
+	b, err := stub.GetState(k)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	var e Entry
+	err = json.Unmarshal(b, &e)
+	if err != nil {
+		return nil, err
+	}
+	window, err := Window(stub)
+	if err != nil {
+		return nil, err
+	}
+	if e.Expired(now, window) {
+		return nil, nil
+	}
+	if e.Submitter != req.Submitter || e.Request != req.Digest {
+		return nil, errcode.New(errcode.Conflict, "idempotency key "+req.Key+" has been used for another request in transaction "+e.TxID,
+			errcode.Field(TransientKey, "has been used for another request"))
+	}
+	return &e, nil
+}
+
+// 保存本次调用的结果
+func Save(stub Stub, req *Request, now int64, status int32, message string, payload []byte) error {
+	k, err := stub.CreateCompositeKey(IndexName, []string{req.Key})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(Entry{
+		Key:       req.Key,
+		Submitter: req.Submitter,
+		Request:   req.Digest,
+		TxID:      stub.GetTxID(),
+		Time:      txtime.Format(now),
+		Status:    status,
+		Message:   message,
+		Payload:   payload,
+	})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(k, b)
+}
@@ -0,0 +1,137 @@
+/*
+账本适配
+common下的其他包只依赖标准库, 需要遍历账本或fabric的类型时通过小接口回调; 本包把shim.ChaincodeStubInterface适配为这些接口,
+并提供各链码直接调用的函数, 各链码不再各自复制遍历与分发的代码.
+本包依赖GOPATH中的fabric, index vendor了自己的fabric, 类型不同, 不能使用本包, 由index/ledger.go做同样的适配.
+*/
+
+package ledger
+
+import (
+	"github.com/common/history"
+	"github.com/common/idempotency"
+	"github.com/common/sequence"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 适配common各包的账本接口
+type Stub struct {
+	shim.ChaincodeStubInterface
+}
+
+// 满足history.Ledger
+func (s Stub) History(key string, fn func(m history.Modification) (bool, error)) error {
+	resultsIterator, err := s.GetHistoryForKey(key)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		m, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		more, err := fn(history.Modification{
+			TxID:     m.TxId,
+			Seconds:  m.GetTimestamp().GetSeconds(),
+			Nanos:    m.GetTimestamp().GetNanos(),
+			IsDelete: m.IsDelete,
+			Value:    m.Value,
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// 满足idempotency.Ledger与sequence.Ledger
+func (s Stub) ProposalBytes() ([]byte, error) {
+	sp, err := s.GetSignedProposal()
+	if err != nil || sp == nil {
+		return nil, err
+	}
+	return sp.ProposalBytes, nil
+}
+
+// 交易时间(unix毫秒), 所有背书节点一致
+func (s Stub) Time() (int64, error) {
+	ts, err := s.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
+// 按key的顺序遍历composite key, fn返回false时停止
+func (s Stub) Scan(objectType string, attributes []string, fn func(key string, value []byte) (bool, error)) error {
+	resultsIterator, err := s.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		more, err := fn(kv.Key, kv.Value)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func response(r idempotency.Response) pb.Response {
+	return pb.Response{Status: r.Status, Message: r.Message, Payload: r.Payload}
+}
+
+// 取得key的变更历史的一页, 见history.Query
+func KeyHistory(stub shim.ChaincodeStubInterface, key string, size int, bookmark string, redact ...string) ([]byte, error) {
+	return history.Query(Stub{stub}, key, size, bookmark, redact...)
+}
+
+// 按幂等key分发, 见idempotency.DispatchOnce
+func DispatchOnce(stub shim.ChaincodeStubInterface, dispatch func(stub shim.ChaincodeStubInterface) pb.Response) pb.Response {
+	return response(idempotency.DispatchOnce(Stub{stub}, func() idempotency.Response {
+		r := dispatch(stub)
+		return idempotency.Response{Status: r.Status, Message: r.Message, Payload: r.Payload}
+	}))
+}
+
+// 是否由客户端直接调用, 见idempotency.TopLevel
+func TopLevel(stub shim.ChaincodeStubInterface) bool {
+	return idempotency.TopLevel(Stub{stub})
+}
+
+// 设置幂等key的保存时间
+// args: 0 - 秒
+func SetIdempotencyWindow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return response(idempotency.SetWindowFunc(Stub{stub}, args))
+}
+
+// 删除已失效的幂等key
+// args: 0 - 最多删除的条数
+func PurgeIdempotencyKeys(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return response(idempotency.PurgeFunc(Stub{stub}, args))
+}
+
+// 写入待编号记录, 见sequence.Enqueue
+func EnqueueNumber(stub shim.ChaincodeStubInterface, kind, storeID string, t int64, docID string) error {
+	return sequence.Enqueue(Stub{stub}, kind, storeID, t, docID)
+}
+
+// 为店铺的待编号单据连续编号, 见sequence.Assign
+func AssignNumbers(stub shim.ChaincodeStubInterface, kind, storeID string, limit int, setNumber func(docID, number string) error) (sequence.Assignment, error) {
+	return sequence.Assign(Stub{stub}, kind, storeID, limit, setNumber)
+}
+
+// 编号对应的单据ID, 没有时为空
+func NumberedDocument(stub shim.ChaincodeStubInterface, number string) (string, error) {
+	return sequence.Lookup(Stub{stub}, number)
+}
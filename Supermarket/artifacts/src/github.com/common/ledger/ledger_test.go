@@ -0,0 +1,147 @@
+package ledger
+
+import (
+	"github.com/common/errcode"
+	"github.com/common/idempotency"
+	"github.com/common/ledger/ledgertest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 每次add把计数器加一并返回计数, fail总是失败
+type counter struct {
+	calls int
+}
+
+func (c *counter) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (c *counter) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	return DispatchOnce(stub, func(stub shim.ChaincodeStubInterface) pb.Response {
+		function, args := stub.GetFunctionAndParameters()
+		switch function {
+		case "add":
+			c.calls++
+			n := []byte(strconv.Itoa(c.calls))
+			stub.PutState("counter", n)
+			return shim.Success(n)
+		case "setIdempotencyWindow":
+			return SetIdempotencyWindow(stub, args)
+		case "purgeIdempotencyKeys":
+			return PurgeIdempotencyKeys(stub, args)
+		}
+		return shim.Error("fail")
+	})
+}
+
+var t0 = time.Unix(1500000000, 0)
+
+var (
+	alice = ledgertest.Creator("Org1MSP", "alice", map[string]string{"role": "clerk", "storeID": "S1"})
+	bob   = ledgertest.Creator("Org1MSP", "bob", map[string]string{"role": "clerk", "storeID": "S1"})
+)
+
+func proposal(txID, key string, creator []byte, at time.Duration, args ...string) ledgertest.Proposal {
+	p := ledgertest.Proposal{TxID: txID, Creator: creator, Time: t0.Add(at), Args: args}
+	if key != "" {
+		p.Transient = map[string][]byte{idempotency.TransientKey: []byte(key)}
+	}
+	return p
+}
+
+// 按顺序执行, 后面的步骤依赖前面保存的结果
+func TestDispatchOnce(t *testing.T) {
+	stub := ledgertest.NewStub("counter", &counter{})
+	cases := []struct {
+		name    string
+		p       ledgertest.Proposal
+		code    int
+		payload string
+	}{
+		{"first call", proposal("tx1", "key-0001", alice, 0, "add", "1"), errcode.OK, "1"},
+		{"replay", proposal("tx2", "key-0001", alice, time.Hour, "add", "1"), errcode.OK, "1"},
+		{"other arguments", proposal("tx3", "key-0001", alice, time.Hour, "add", "2"), errcode.Conflict, ""},
+		{"other submitter", proposal("tx4", "key-0001", bob, time.Hour, "add", "1"), errcode.Conflict, ""},
+		{"without key", proposal("tx5", "", alice, time.Hour, "add", "1"), errcode.OK, "2"},
+		{"invalid key", proposal("tx6", "short", alice, time.Hour, "add", "1"), errcode.Validation, ""},
+		{"failure is not saved", proposal("tx7", "key-0002", alice, time.Hour, "fail"), errcode.Internal, ""},
+		{"retry after failure", proposal("tx8", "key-0002", alice, time.Hour, "add"), errcode.OK, "3"},
+		{"replay after retry", proposal("tx9", "key-0002", alice, 2*time.Hour, "add"), errcode.OK, "3"},
+		{"expired key", proposal("tx10", "key-0001", alice, 25*time.Hour, "add", "1"), errcode.OK, "4"},
+		{"replay of the new result", proposal("tx11", "key-0001", alice, 26*time.Hour, "add", "1"), errcode.OK, "4"},
+	}
+	for _, c := range cases {
+		resp := stub.Invoke(c.p)
+		code := errcode.OK
+		if resp.Status != shim.OK {
+			code = errcode.FromResponse(resp.Message).Code
+		}
+		if code != c.code || (code == errcode.OK && string(resp.Payload) != c.payload) {
+			t.Errorf("%s: code %d payload %q, want %d %q: %s", c.name, code, resp.Payload, c.code, c.payload, resp.Message)
+		}
+	}
+}
+
+// 被其他链码调用时不记录key, 每次都执行
+func TestDispatchOnceNested(t *testing.T) {
+	stub := ledgertest.NewStub("counter", &counter{})
+	for i, want := range []string{"1", "2"} {
+		p := proposal("tx"+strconv.Itoa(i), "key-0001", alice, 0, "add")
+		p.Caller = []string{"checkout", "{}"}
+		resp := stub.Invoke(p)
+		if string(resp.Payload) != want {
+			t.Errorf("call %d: payload %q, want %q", i, resp.Payload, want)
+		}
+	}
+	if len(stub.Writes) != 1 {
+		t.Errorf("nested call should not save the key: %q", stub.Writes)
+	}
+}
+
+func TestPurgeIdempotencyKeys(t *testing.T) {
+	stub := ledgertest.NewStub("counter", &counter{})
+	// 三个key, 分别在0、10、20小时时保存
+	for i := 0; i < 3; i++ {
+		p := proposal("tx"+strconv.Itoa(i), "key-000"+strconv.Itoa(i), alice, time.Duration(i)*10*time.Hour, "add")
+		if resp := stub.Invoke(p); resp.Status != shim.OK {
+			t.Fatal(resp.Message)
+		}
+	}
+	admin := ledgertest.Creator("Org1MSP", "root", map[string]string{"role": "admin"})
+	cases := []struct {
+		name string
+		at   time.Duration
+		args []string
+		code int
+		left int // 剩下的key
+	}{
+		{"nothing expired", 23 * time.Hour, []string{"purgeIdempotencyKeys", "10"}, errcode.OK, 3},
+		{"default window", 26 * time.Hour, []string{"purgeIdempotencyKeys", "10"}, errcode.OK, 2},
+		{"shorter window", 26 * time.Hour, []string{"setIdempotencyWindow", "3600"}, errcode.OK, 2},
+		{"limit", 26 * time.Hour, []string{"purgeIdempotencyKeys", "1"}, errcode.OK, 1},
+		{"rest", 26 * time.Hour, []string{"purgeIdempotencyKeys", "1"}, errcode.OK, 0},
+		{"empty", 26 * time.Hour, []string{"purgeIdempotencyKeys", "1"}, errcode.OK, 0},
+		{"invalid limit", 26 * time.Hour, []string{"purgeIdempotencyKeys", "0"}, errcode.Validation, 0},
+		{"invalid window", 26 * time.Hour, []string{"setIdempotencyWindow", "-1"}, errcode.Validation, 0},
+		{"wrong arguments", 26 * time.Hour, []string{"purgeIdempotencyKeys"}, errcode.Validation, 0},
+	}
+	for i, c := range cases {
+		resp := stub.Invoke(proposal("purge"+strconv.Itoa(i), "", admin, c.at, c.args...))
+		code := errcode.OK
+		if resp.Status != shim.OK {
+			code = errcode.FromResponse(resp.Message).Code
+		}
+		left := 0
+		Stub{stub}.Scan(idempotency.IndexName, []string{}, func(key string, value []byte) (bool, error) {
+			left++
+			return true, nil
+		})
+		if code != c.code || left != c.left {
+			t.Errorf("%s: code %d, %d keys left, want %d, %d: %s", c.name, code, left, c.code, c.left, resp.Message)
+		}
+	}
+}
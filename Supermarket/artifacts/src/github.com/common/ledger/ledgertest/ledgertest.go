@@ -0,0 +1,355 @@
+/*
+链码测试
+shim.MockStub没有提交者证书、transient、提案, 也不记录写集和事件, 被调用的链码也要是MockStub.
+Stub在MockStub之上补齐这些: 用同一Proposal在两个Stub上各执行一次即模拟两个节点的背书, 比较Writes可检查写集是否一致;
+被调用的链码由Peers中的函数代替. 与节点一样, 失败的调用不提交, 其写入被撤销.
+Endorse只背书不提交, 之后Commit按背书时的读集做MVCC检查, 用来模拟基于同一状态并发背书的两笔交易.
+private data与节点一样在提交时才写入, 调用中读不到本次调用的写入.
+只用于测试.
+*/
+
+package ledgertest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+	"time"
+)
+
+// Fabric CA把属性放在证书的这个扩展中, 见authz
+var attrOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// 一次提案
+type Proposal struct {
+	TxID      string
+	Creator   []byte // 见Creator
+	Time      time.Time
+	Args      []string // 函数名与参数
+	Caller    []string // 被其他链码调用时客户端提案中的参数, 为空时为Args
+	Transient map[string][]byte
+}
+
+// 链码事件
+type Event struct {
+	Name    string
+	Payload []byte
+}
+
+// 代替被调用的链码, args为函数名与参数
+type Peer func(args []string) pb.Response
+
+// 背书的结果
+type Endorsement struct {
+	TxID     string
+	Response pb.Response
+	Reads    map[string][]byte // 读集: 读到的值, 不存在时为nil
+	Writes   map[string][]byte
+	Private  map[string]map[string][]byte // private data的写集
+}
+
+// 模拟背书节点上的一个链码
+type Stub struct {
+	*shim.MockStub
+	Reads  map[string][]byte // 最近一次Invoke的读集, 不含本次调用写过的key
+	Scans  []string          // 最近一次Invoke的范围查询与历史查询, 提交时节点对范围查询检查幻读
+	Writes map[string][]byte // 最近一次Invoke的写集, 删除的key值为nil
+	Events []Event           // 最近一次Invoke发出的事件
+	Peers  map[string]Peer   // 按链码名称
+
+	Private       map[string]map[string][]byte // 已提交的private data, 按collection
+	PrivateWrites map[string]map[string][]byte // 最近一次Invoke写入的private data, 删除的key值为nil
+
+	cc   shim.Chaincode
+	p    Proposal
+	args [][]byte
+	undo map[string][]byte // 本次调用写入的key原来的值
+}
+
+func NewStub(name string, cc shim.Chaincode) *Stub {
+	return &Stub{MockStub: shim.NewMockStub(name, cc), Peers: map[string]Peer{}, Private: map[string]map[string][]byte{}, cc: cc}
+}
+
+// 以提案p调用链码, 成功时提交
+func (s *Stub) Invoke(p Proposal) pb.Response {
+	resp := s.run(p)
+	if resp.Status != shim.OK {
+		s.rollback()
+	} else {
+		s.commitPrivate(s.PrivateWrites)
+	}
+	return resp
+}
+
+// 以提案p背书, 不论成败都不提交
+func (s *Stub) Endorse(p Proposal) Endorsement {
+	resp := s.run(p)
+	s.rollback()
+	return Endorsement{TxID: p.TxID, Response: resp, Reads: s.Reads, Writes: s.Writes, Private: s.PrivateWrites}
+}
+
+// 提交背书的写集. 与节点的MVCC检查一样, 读集中的key在背书后被其他交易修改时交易无效, 返回false.
+// 只比较值, 不检查范围查询的幻读
+func (s *Stub) Commit(e Endorsement) bool {
+	if e.Response.Status != shim.OK {
+		return false
+	}
+	for key, value := range e.Reads {
+		if !bytes.Equal(s.MockStub.State[key], value) {
+			return false
+		}
+	}
+	s.TxID = e.TxID
+	defer func() { s.TxID = "" }()
+	for key, value := range e.Writes {
+		if value == nil {
+			s.MockStub.DelState(key)
+		} else {
+			s.MockStub.PutState(key, value)
+		}
+	}
+	s.commitPrivate(e.Private)
+	return true
+}
+
+func (s *Stub) commitPrivate(writes map[string]map[string][]byte) {
+	for collection, kvs := range writes {
+		if s.Private[collection] == nil {
+			s.Private[collection] = map[string][]byte{}
+		}
+		for key, value := range kvs {
+			if value == nil {
+				delete(s.Private[collection], key)
+			} else {
+				s.Private[collection][key] = value
+			}
+		}
+	}
+}
+
+func (s *Stub) run(p Proposal) pb.Response {
+	s.p = p
+	s.args = make([][]byte, len(p.Args))
+	for i, a := range p.Args {
+		s.args[i] = []byte(a)
+	}
+	s.Reads = map[string][]byte{}
+	s.Scans = nil
+	s.Writes = map[string][]byte{}
+	s.PrivateWrites = map[string]map[string][]byte{}
+	s.Events = nil
+	s.undo = map[string][]byte{}
+	s.TxID = p.TxID
+	defer func() { s.TxID = "" }()
+	return s.cc.Invoke(s)
+}
+
+// 撤销本次调用的写入
+func (s *Stub) rollback() {
+	s.TxID = "rollback"
+	defer func() { s.TxID = "" }()
+	for key, value := range s.undo {
+		if value == nil {
+			s.MockStub.DelState(key)
+		} else {
+			s.MockStub.PutState(key, value)
+		}
+	}
+}
+
+// 直接写入账本, 不经过链码, 用于准备状态
+func (s *Stub) Put(key string, value []byte) {
+	s.TxID = "setup"
+	s.MockStub.PutState(key, value)
+	s.TxID = ""
+}
+
+func (s *Stub) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *Stub) GetStringArgs() []string {
+	return s.p.Args
+}
+
+func (s *Stub) GetFunctionAndParameters() (string, []string) {
+	if len(s.p.Args) == 0 {
+		return "", []string{}
+	}
+	return s.p.Args[0], s.p.Args[1:]
+}
+
+func (s *Stub) GetCreator() ([]byte, error) {
+	return s.p.Creator, nil
+}
+
+func (s *Stub) GetTransient() (map[string][]byte, error) {
+	return s.p.Transient, nil
+}
+
+func (s *Stub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.p.Time.Unix(), Nanos: int32(s.p.Time.Nanosecond())}, nil
+}
+
+// 提案中只有调用的参数, 足够判断是否由客户端直接调用
+func (s *Stub) GetSignedProposal() (*pb.SignedProposal, error) {
+	args := s.args
+	if s.p.Caller != nil {
+		args = make([][]byte, len(s.p.Caller))
+		for i, a := range s.p.Caller {
+			args[i] = []byte(a)
+		}
+	}
+	cis, err := proto.Marshal(&pb.ChaincodeInvocationSpec{
+		ChaincodeSpec: &pb.ChaincodeSpec{
+			ChaincodeId: &pb.ChaincodeID{Name: s.Name},
+			Input:       &pb.ChaincodeInput{Args: args},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := proto.Marshal(&pb.ChaincodeProposalPayload{Input: cis, TransientMap: s.p.Transient})
+	if err != nil {
+		return nil, err
+	}
+	prop, err := proto.Marshal(&pb.Proposal{Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SignedProposal{ProposalBytes: prop}, nil
+}
+
+func (s *Stub) GetState(key string) ([]byte, error) {
+	value, err := s.MockStub.GetState(key)
+	_, written := s.undo[key]
+	_, read := s.Reads[key]
+	if err == nil && s.Reads != nil && !written && !read {
+		s.Reads[key] = value
+	}
+	return value, err
+}
+
+func (s *Stub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	s.Scans = append(s.Scans, "range "+startKey+" "+endKey)
+	return s.MockStub.GetStateByRange(startKey, endKey)
+}
+
+func (s *Stub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	key, err := s.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	s.Scans = append(s.Scans, "range "+key)
+	return s.MockStub.GetStateByPartialCompositeKey(objectType, attributes)
+}
+
+func (s *Stub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	s.Scans = append(s.Scans, "history "+key)
+	return s.MockStub.GetHistoryForKey(key)
+}
+
+func (s *Stub) GetPrivateData(collection, key string) ([]byte, error) {
+	return s.Private[collection][key], nil
+}
+
+func (s *Stub) PutPrivateData(collection string, key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	s.writePrivate(collection, key, value)
+	return nil
+}
+
+func (s *Stub) DelPrivateData(collection, key string) error {
+	s.writePrivate(collection, key, nil)
+	return nil
+}
+
+func (s *Stub) writePrivate(collection, key string, value []byte) {
+	if s.PrivateWrites[collection] == nil {
+		s.PrivateWrites[collection] = map[string][]byte{}
+	}
+	s.PrivateWrites[collection][key] = value
+}
+
+func (s *Stub) PutState(key string, value []byte) error {
+	s.write(key, value)
+	return s.MockStub.PutState(key, value)
+}
+
+func (s *Stub) DelState(key string) error {
+	s.write(key, nil)
+	return s.MockStub.DelState(key)
+}
+
+func (s *Stub) write(key string, value []byte) {
+	if _, ok := s.undo[key]; !ok {
+		s.undo[key] = s.MockStub.State[key]
+	}
+	s.Writes[key] = value
+}
+
+func (s *Stub) SetEvent(name string, payload []byte) error {
+	s.Events = append(s.Events, Event{Name: name, Payload: payload})
+	return nil
+}
+
+// 被调用的链码不在Peers中时返回错误
+func (s *Stub) InvokeChaincode(chaincodeName string, args [][]byte, channel string) pb.Response {
+	peer, ok := s.Peers[chaincodeName]
+	if !ok {
+		return shim.Error("ledgertest: chaincode " + chaincodeName + " not mocked")
+	}
+	strs := make([]string, len(args))
+	for i, a := range args {
+		strs[i] = string(a)
+	}
+	return peer(strs)
+}
+
+// 序列化的提交者身份(msp.SerializedIdentity), 证书中带Fabric CA属性, attrs为nil时不带
+func Creator(mspID, cn string, attrs map[string]string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(1<<32, 0),
+	}
+	if attrs != nil {
+		v, _ := json.Marshal(map[string]interface{}{"attrs": attrs})
+		tmpl.ExtraExtensions = []pkix.Extension{{Id: attrOID, Value: v}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	var b []byte
+	b = append(b, 0x0a, byte(len(mspID)))
+	b = append(b, mspID...)
+	b = append(b, 0x12)
+	for l := len(cert); ; l >>= 7 {
+		if l < 0x80 {
+			b = append(b, byte(l))
+			break
+		}
+		b = append(b, byte(l&0x7f|0x80))
+	}
+	return append(b, cert...)
+}
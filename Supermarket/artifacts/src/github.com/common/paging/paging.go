@@ -0,0 +1,81 @@
+/*
+分页
+Fabric 1.1/1.2没有分页查询的API, 列表用普通key的二级索引按范围扫描:
+每页多取一条, 多取的那条的key作为下一页的书签(bookmark), 下一页从书签开始扫描.
+索引key形如 <前缀><字段1>~<字段2>~..., 因此字段中不能包含"~".
+本包只依赖标准库, 各链码(包括vendor了fabric的index)都可以使用.
+*/
+
+package paging
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 每页条数
+const (
+	DefaultSize = 20
+	MaxSize     = 200
+)
+
+// 索引key中字段的分隔符
+const Separator = "~"
+
+var ErrSize = errors.New("paging: page size should be 1 to " + strconv.Itoa(MaxSize))
+var ErrSeparator = errors.New("paging: IDs should not contain " + Separator)
+
+// 一页结果; Bookmark为空表示没有下一页
+type Page struct {
+	Records  interface{} `json:"Records"`
+	Count    int         `json:"Count"`
+	Bookmark string      `json:"Bookmark"`
+}
+
+// 索引key
+func Key(prefix string, fields ...string) string {
+	return prefix + strings.Join(fields, Separator)
+}
+
+// 检查索引字段中没有分隔符
+func Check(fields ...string) error {
+	for _, f := range fields {
+		if strings.Contains(f, Separator) {
+			return ErrSeparator
+		}
+	}
+	return nil
+}
+
+// 索引key中最后一个字段, 通常为记录ID
+func LastField(key string) string {
+	return key[strings.LastIndex(key, Separator)+1:]
+}
+
+// 解析可选的分页参数: args[0] - page size, args[1] - bookmark
+func Args(args []string) (int, string, error) {
+	size := DefaultSize
+	bookmark := ""
+	if len(args) > 0 && args[0] != "" {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 || n > MaxSize {
+			return 0, "", ErrSize
+		}
+		size = n
+	}
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	return size, bookmark, nil
+}
+
+// 以prefix开头的key的扫描范围; 书签必须以prefix开头, 否则从头开始
+func Range(prefix, bookmark string) (string, string) {
+	start := prefix
+	if strings.HasPrefix(bookmark, prefix) {
+		start = bookmark
+	}
+	return start, prefix + string(utf8.MaxRune)
+}
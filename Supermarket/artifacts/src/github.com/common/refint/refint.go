@@ -0,0 +1,112 @@
+/*
+引用完整性
+写入时确认被引用的记录存在(必要时调用其他链码读取), 例如商品的类别必须在同一店铺存在, 索引必须指向存在的记录.
+删除被引用的记录时按删除策略处理:
+  restrict 默认; 仍有引用时拒绝删除(412), 错误的Details逐条列出阻止删除的引用
+  cascade  被删除的记录与引用它的记录都改为软删除状态, 记录保留, 不能再使用
+策略由各链码的setDeletePolicy配置. 本包只依赖标准库与errcode.
+*/
+
+package refint
+
+import (
+	"encoding/json"
+	"github.com/common/errcode"
+	"strconv"
+)
+
+// 删除策略
+const (
+	Restrict = "restrict"
+	Cascade  = "cascade"
+)
+
+// 删除策略配置的key
+const ConfigKey = "DeletePolicyConfig"
+
+// 错误中最多列出的引用数
+const MaxReported = 50
+
+// 一次级联软删除最多的记录数, 超过时拒绝, 应先处理部分记录
+const MaxCascade = 1000
+
+// 所需的stub方法
+type Stub interface {
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+}
+
+// 删除策略配置
+type Config struct {
+	Policy string `json:"Policy"`
+}
+
+// 一条引用
+type Ref struct {
+	Kind  string `json:"Kind"` // 引用方的记录类型, 例如 commodity
+	ID    string `json:"ID"`
+	State string `json:"State"` // 引用方的状态, 可为空
+}
+
+// 引用方的查询结果
+type Refs struct {
+	Count int   `json:"Count"` // 引用总数
+	Refs  []Ref `json:"Refs"`  // 最多MaxReported条
+}
+
+// 当前的删除策略
+func Policy(stub Stub) (string, error) {
+	b, err := stub.GetState(ConfigKey)
+	if err != nil {
+		return "", err
+	}
+	if b == nil {
+		return Restrict, nil
+	}
+	var c Config
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return "", err
+	}
+	return c.Policy, nil
+}
+
+// 设置删除策略
+func SetPolicy(stub Stub, policy string) error {
+	if policy != Restrict && policy != Cascade {
+		return errcode.New(errcode.Validation, "delete policy should be "+Restrict+" or "+Cascade,
+			errcode.Field("Policy", "should be "+Restrict+" or "+Cascade))
+	}
+	b, err := json.Marshal(Config{Policy: policy})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(ConfigKey, b)
+}
+
+// 引用的错误详情, Field为 <类型>/<ID>
+func (r Ref) Detail() errcode.Detail {
+	reason := "references it"
+	if r.State != "" {
+		reason += " (state " + r.State + ")"
+	}
+	return errcode.Field(r.Kind+"/"+r.ID, reason)
+}
+
+// 仍被引用, 不能删除; what为被删除的记录, 例如 "category C1 in store S1"
+func Blocked(what string, refs Refs) error {
+	details := make([]errcode.Detail, 0, len(refs.Refs))
+	for _, r := range refs.Refs {
+		details = append(details, r.Detail())
+	}
+	message := what + " is still referenced by " + strconv.Itoa(refs.Count) + " records"
+	if refs.Count > len(refs.Refs) {
+		message += ", the first " + strconv.Itoa(len(refs.Refs)) + " are listed"
+	}
+	return errcode.New(errcode.Conflict, message, details...)
+}
+
+// 被引用的记录不存在
+func Missing(field, what string) error {
+	return errcode.New(errcode.NotFound, what+" does not exist", errcode.Field(field, what+" does not exist"))
+}
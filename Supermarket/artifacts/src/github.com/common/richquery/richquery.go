@@ -0,0 +1,123 @@
+/*
+CouchDB富查询
+查询条件由各链码的白名单结构解析后在链码内构造, 不接受客户端直接提交的selector;
+字符串值经json.Marshal写入, 名称片段经regexp.QuoteMeta转义, 因此不能注入操作符或正则.
+Fabric 1.1/1.2的GetQueryResult没有分页, 这里用skip/limit分页, 书签为下一页的skip;
+链码还可以对结果做CouchDB无法完成的过滤(例如按定点小数比较价格), skip按CouchDB返回的条数计算.
+对应的索引定义放在各链码的 META-INF/statedb/couchdb/indexes 中, 随链码安装.
+本包只依赖标准库.
+*/
+
+package richquery
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 限制
+const (
+	MaxOffset   = 10000 // 与peer的queryLimit默认值一致
+	MaxFragment = 64    // 名称片段的最大长度
+	ScanFactor  = 5     // 每页最多向CouchDB取 size*ScanFactor 条再在链码内过滤
+)
+
+var ErrBookmark = errors.New("richquery: invalid bookmark")
+var ErrFragment = errors.New("richquery: name fragment should be 1 to " + strconv.Itoa(MaxFragment) + " characters")
+
+// 查询条件, 字段名 -> 值或操作符
+type Selector map[string]interface{}
+
+// CouchDB查询
+type Query struct {
+	Selector Selector `json:"selector"`
+	Limit    int      `json:"limit"`
+	Skip     int      `json:"skip"`
+}
+
+// 解析客户端提交的过滤条件, 拒绝未知字段
+func Decode(s string, filter interface{}) error {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(filter)
+	if err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("richquery: unexpected data after filter")
+	}
+	return nil
+}
+
+// 书签为下一页的skip, 空书签从头开始
+func Offset(bookmark string) (int, error) {
+	if bookmark == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(bookmark)
+	if err != nil || n < 0 || n > MaxOffset {
+		return 0, ErrBookmark
+	}
+	return n, nil
+}
+
+// 字段等于value; value为空时不加条件
+func (s Selector) Eq(field, value string) {
+	if value != "" {
+		s[field] = value
+	}
+}
+
+// 字段存在, 用于区分同一链码中不同类型的记录
+func (s Selector) Exists(field string) {
+	s[field] = map[string]interface{}{"$exists": true}
+}
+
+// 字段在[from, to]之间(字符串比较), 空值表示不限
+func (s Selector) Between(field, from, to string) {
+	cond := map[string]interface{}{}
+	if from != "" {
+		cond["$gte"] = from
+	}
+	if to != "" {
+		cond["$lte"] = to
+	}
+	if len(cond) > 0 {
+		s[field] = cond
+	}
+}
+
+// 满足任一条件
+func (s Selector) Or(conds ...Selector) {
+	s["$or"] = conds
+}
+
+// 字段不匹配正则pattern, pattern由链码给出, 不来自客户端
+func (s Selector) NotMatch(field, pattern string) {
+	s[field] = map[string]interface{}{"$not": map[string]interface{}{"$regex": pattern}}
+}
+
+// 字段包含fragment, 不区分大小写
+func (s Selector) Contains(field, fragment string) error {
+	if fragment == "" {
+		return nil
+	}
+	if len([]rune(fragment)) > MaxFragment {
+		return ErrFragment
+	}
+	s[field] = map[string]interface{}{"$regex": "(?i)" + regexp.QuoteMeta(fragment)}
+	return nil
+}
+
+// 生成查询字符串
+func (s Selector) Query(skip, limit int) (string, error) {
+	b, err := json.Marshal(Query{Selector: s, Limit: limit, Skip: skip})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
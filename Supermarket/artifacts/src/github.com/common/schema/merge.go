@@ -0,0 +1,168 @@
+/*
+部分修改与版本
+修改记录时客户端只提交要修改的字段, 格式为JSON merge patch(RFC 7386): 出现的字段替换当前值, null删除该字段.
+只读字段由链码维护, 补丁中带有与当前值不同的只读字段时返回错误, 不会静默丢弃, 原样带回当前值(例如ID)可以;
+Version除外, 它是客户端读到的版本. Immutable字段(ID等)不能修改.
+每条记录带有版本(Version), 每次写入加一; 修改时补丁中的Version为客户端读到的版本, 与账本不一致时返回412,
+客户端应重新查询后再修改, 不会静默覆盖他人的修改.
+*/
+
+package schema
+
+import (
+	"encoding/json"
+	"github.com/common/errcode"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 版本字段名
+const VersionField = "Version"
+
+// 按补丁修改current并解析到v; 补丁中的字段与Decode一样校验, 错误为errcode.Validation
+func (s Schema) Merge(current interface{}, patch string, v interface{}) error {
+	fields, err := object(patch)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	err = json.Unmarshal(b, &doc)
+	if err != nil {
+		return err
+	}
+
+	details := []errcode.Detail{}
+	known := map[string]bool{}
+	for _, p := range s.Properties {
+		known[p.Name] = true
+		raw, ok := fields[p.Name]
+		if !ok {
+			continue
+		}
+		if p.ReadOnly {
+			if p.Name != VersionField && !sameJSON(raw, doc[p.Name]) {
+				details = append(details, errcode.Field(p.Name, "is read-only"))
+			}
+			continue
+		}
+		if p.Immutable {
+			if !sameJSON(raw, doc[p.Name]) {
+				details = append(details, errcode.Field(p.Name, "cannot be changed"))
+			}
+			continue
+		}
+		if string(raw) == "null" {
+			if p.Required {
+				details = append(details, errcode.Field(p.Name, "is required"))
+			} else {
+				delete(doc, p.Name)
+			}
+			continue
+		}
+		if reason := p.check(raw); reason != "" {
+			details = append(details, errcode.Field(p.Name, reason))
+			continue
+		}
+		doc[p.Name] = mergeValue(doc[p.Name], raw)
+	}
+	for name := range fields {
+		if !known[name] {
+			details = append(details, errcode.Field(name, "is not a known field"))
+		}
+	}
+	if len(details) > 0 {
+		sort.Slice(details, func(i, j int) bool { return details[i].Field < details[j].Field })
+		return errcode.New(errcode.Validation, s.Title+" patch is invalid: "+details[0].Field+" "+details[0].Reason, details...)
+	}
+
+	b, err = json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return errcode.New(errcode.Validation, s.Title+" patch is invalid: "+err.Error())
+	}
+	return nil
+}
+
+// RFC 7386: 对象逐个字段合并, null删除字段, 其他值直接替换
+func mergeValue(target, patch json.RawMessage) json.RawMessage {
+	var p map[string]json.RawMessage
+	if json.Unmarshal(patch, &p) != nil || p == nil {
+		return patch
+	}
+	var t map[string]json.RawMessage
+	if json.Unmarshal(target, &t) != nil || t == nil {
+		t = map[string]json.RawMessage{}
+	}
+	for k, raw := range p {
+		if string(raw) == "null" {
+			delete(t, k)
+		} else {
+			t[k] = mergeValue(t[k], raw)
+		}
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return patch
+	}
+	return b
+}
+
+// 两个JSON值是否相同; 没有值与空字符串视为相同
+func sameJSON(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if len(a) > 0 {
+		json.Unmarshal(a, &x)
+	}
+	if len(b) > 0 {
+		json.Unmarshal(b, &y)
+	}
+	if x == nil {
+		x = ""
+	}
+	if y == nil {
+		y = ""
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// 补丁中客户端读到的版本, 数字或数字字符串; 没有时报错
+func ExpectedVersion(patch string) (int64, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(patch), &fields) != nil {
+		return 0, errcode.New(errcode.Validation, "patch should be a JSON object")
+	}
+	raw, ok := fields[VersionField]
+	if !ok || string(raw) == "null" {
+		return 0, errcode.New(errcode.Validation, "Version is required: query the record and send the Version you read",
+			errcode.Field(VersionField, "is required"))
+	}
+	s := string(raw)
+	if raw[0] == '"' {
+		json.Unmarshal(raw, &s)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errcode.New(errcode.Validation, "Version should be a non-negative integer",
+			errcode.Field(VersionField, "should be a non-negative integer"))
+	}
+	return n, nil
+}
+
+// 客户端读到的版本与账本上的版本不一致时返回errcode.Conflict
+func CheckVersion(expected, current int64) error {
+	if expected == current {
+		return nil
+	}
+	return errcode.New(errcode.Conflict,
+		"the record has been changed by someone else: expected version "+strconv.FormatInt(expected, 10)+", current version "+strconv.FormatInt(current, 10),
+		errcode.Field(VersionField, "expected "+strconv.FormatInt(expected, 10)+", current "+strconv.FormatInt(current, 10)))
+}
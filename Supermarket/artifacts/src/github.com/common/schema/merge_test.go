@@ -0,0 +1,141 @@
+package schema
+
+import (
+	"encoding/json"
+	"github.com/common/errcode"
+	"reflect"
+	"testing"
+)
+
+type item struct {
+	ID      string                 `json:"ID"`
+	Name    string                 `json:"Name"`
+	Note    string                 `json:"Note,omitempty"`
+	Price   string                 `json:"Price"`
+	Stock   string                 `json:"Stock"`
+	Attrs   map[string]interface{} `json:"Attrs,omitempty"`
+	Version int64                  `json:"Version"`
+}
+
+var itemSchema = Schema{
+	ID:    "test/item.json",
+	Title: "Item",
+	Properties: []Property{
+		{Name: "ID", Type: String, Required: true, Immutable: true},
+		{Name: "Name", Type: String, Required: true, MaxLength: 8},
+		{Name: "Note", Type: String},
+		{Name: "Price", Type: Decimal, Required: true, NonNegative: true},
+		{Name: "Stock", Type: Decimal, ReadOnly: true},
+		{Name: "Attrs", Type: Object},
+		{Name: VersionField, Type: Integer, ReadOnly: true},
+	},
+}
+
+func TestMerge(t *testing.T) {
+	current := item{ID: "A", Name: "apple", Note: "red", Price: "3.5", Stock: "10",
+		Attrs: map[string]interface{}{"color": "red", "size": "m"}, Version: 4}
+	cases := []struct {
+		name   string
+		patch  string
+		want   item
+		fields []string // 校验失败时Details中的字段
+	}{
+		{"replace a field", `{"Name":"pear"}`,
+			item{ID: "A", Name: "pear", Note: "red", Price: "3.5", Stock: "10", Attrs: current.Attrs, Version: 4}, nil},
+		{"null removes an optional field", `{"Note":null}`,
+			item{ID: "A", Name: "apple", Price: "3.5", Stock: "10", Attrs: current.Attrs, Version: 4}, nil},
+		{"objects merge recursively", `{"Attrs":{"size":null,"origin":"CN"}}`,
+			item{ID: "A", Name: "apple", Note: "red", Price: "3.5", Stock: "10",
+				Attrs: map[string]interface{}{"color": "red", "origin": "CN"}, Version: 4}, nil},
+		{"version is not merged", `{"Version":9,"Price":"4"}`,
+			item{ID: "A", Name: "apple", Note: "red", Price: "4", Stock: "10", Attrs: current.Attrs, Version: 4}, nil},
+		{"same read-only value", `{"Stock":"10","Price":"4"}`,
+			item{ID: "A", Name: "apple", Note: "red", Price: "4", Stock: "10", Attrs: current.Attrs, Version: 4}, nil},
+		{"read-only fields", `{"Stock":"0","Version":9,"Price":"4"}`, item{}, []string{"Stock"}},
+		{"same immutable value", `{"ID":"A"}`, current, nil},
+		{"empty patch", `{}`, current, nil},
+		{"immutable field", `{"ID":"B"}`, item{}, []string{"ID"}},
+		{"null on required field", `{"Name":null}`, item{}, []string{"Name"}},
+		{"invalid values", `{"Name":"watermelon","Price":"-1"}`, item{}, []string{"Name", "Price"}},
+		{"unknown field", `{"Colour":"red"}`, item{}, []string{"Colour"}},
+		{"duplicated key", `{"Name":"a","Name":"b"}`, item{}, []string{}},
+		{"not an object", `["Name"]`, item{}, []string{}},
+	}
+	for _, c := range cases {
+		var got item
+		err := itemSchema.Merge(current, c.patch, &got)
+		if c.fields != nil {
+			if errcode.Code(err) != errcode.Validation {
+				t.Errorf("%s: error = %v, want validation", c.name, err)
+				continue
+			}
+			fields := []string{}
+			for _, d := range errcode.DetailsOf(err) {
+				fields = append(fields, d.Field)
+			}
+			if !reflect.DeepEqual(fields, c.fields) {
+				t.Errorf("%s: details = %v, want %v", c.name, fields, c.fields)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			g, _ := json.Marshal(got)
+			t.Errorf("%s: got %s", c.name, g)
+		}
+	}
+}
+
+func TestExpectedVersion(t *testing.T) {
+	cases := []struct {
+		patch string
+		want  int64
+		ok    bool
+	}{
+		{`{"Version":3}`, 3, true},
+		{`{"Version":"3"}`, 3, true},
+		{`{"Version":0,"Name":"x"}`, 0, true},
+		{`{"Name":"x"}`, 0, false},
+		{`{"Version":null}`, 0, false},
+		{`{"Version":-1}`, 0, false},
+		{`{"Version":"x"}`, 0, false},
+		{`{"Version":1.5}`, 0, false},
+		{`[1]`, 0, false},
+	}
+	for _, c := range cases {
+		n, err := ExpectedVersion(c.patch)
+		if !c.ok {
+			if errcode.Code(err) != errcode.Validation {
+				t.Errorf("ExpectedVersion(%s) error = %v, want validation", c.patch, err)
+			}
+			continue
+		}
+		if err != nil || n != c.want {
+			t.Errorf("ExpectedVersion(%s) = %d, %v, want %d", c.patch, n, err, c.want)
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	cases := []struct {
+		expected, current int64
+		code              int
+	}{
+		{4, 4, errcode.OK},
+		{3, 4, errcode.Conflict},
+		{5, 4, errcode.Conflict},
+	}
+	for _, c := range cases {
+		err := CheckVersion(c.expected, c.current)
+		if errcode.Code(err) != c.code {
+			t.Errorf("CheckVersion(%d, %d) = %v, want code %d", c.expected, c.current, err, c.code)
+		}
+	}
+	details := errcode.DetailsOf(CheckVersion(3, 4))
+	if len(details) != 1 || details[0].Field != VersionField {
+		t.Errorf("details = %v", details)
+	}
+}
@@ -0,0 +1,401 @@
+/*
+记录的JSON Schema与写入校验
+每种记录在链码中声明一个Schema, 写入时按它校验客户端提交的JSON, 查询时由querySchema发布同一份JSON Schema(draft-07),
+因此发布的schema与链码的校验始终一致; 链码启动时用Sync确认Schema与Go结构体的json字段一一对应.
+写入的JSON必须是规范的: 合法的UTF-8, 只有一个JSON值, 没有重复的key, 字段名大小写与结构体完全一致;
+未知字段报错. 只读字段(StoreName、CreateTime等)由链码维护, 旧客户端提交的值被忽略, 因此线上格式不变.
+金额等定点小数与整数兼容字符串与数字两种写法; 修改记录用Merge(JSON merge patch, RFC 7386), 见merge.go.
+本包只依赖标准库与errcode.
+*/
+
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/common/errcode"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 字段类型
+type Type string
+
+const (
+	String  Type = "string"
+	Decimal Type = "decimal" // 定点小数, 字符串或数字
+	Integer Type = "integer" // 整数, 字符串或数字
+	Array   Type = "array"
+	Object  Type = "object"
+)
+
+// 常用格式
+const (
+	IDPattern     = `^[^~\s]+$` // 不能包含索引分隔符与空白
+	IDMaxLength   = 64
+	NameMaxLength = 128
+	TextMaxLength = 256
+)
+
+// 定点小数的写法
+const (
+	decimalPattern  = `^-?[0-9]+(\.[0-9]+)?$`
+	unsignedPattern = `^[0-9]+(\.[0-9]+)?$`
+)
+
+var decimalRe = regexp.MustCompile(decimalPattern)
+var integerRe = regexp.MustCompile(`^-?[0-9]+$`)
+
+// 一个字段
+type Property struct {
+	Name        string
+	Type        Type
+	Description string
+	Required    bool     // 不能为空
+	ReadOnly    bool     // 由链码维护, 写入时忽略
+	Immutable   bool     // 只能在创建时设置, 修改时须与当前值相同
+	Deprecated  bool     // 已废弃, 只能为空
+	MaxLength   int      // 0为不限
+	Pattern     string   // 非空字符串须匹配, 语法同时兼容Go与ECMA-262
+	Enum        []string // 非空字符串须为其中之一
+	NonNegative bool     // 定点小数、整数不能为负
+}
+
+// 一种记录
+type Schema struct {
+	ID          string // 例如 "supermarket/category.json"
+	Title       string
+	Description string
+	Properties  []Property
+}
+
+var ErrCanonical = errors.New("schema: JSON should be a single object with valid UTF-8 and no duplicated keys")
+
+// 按Schema校验input并解析到v, 只读字段不解析; 错误为errcode.Validation, Details列出每个字段的错误
+func (s Schema) Decode(input string, v interface{}) error {
+	fields, err := object(input)
+	if err != nil {
+		return err
+	}
+	details := s.check(fields)
+	if len(details) > 0 {
+		return errcode.New(errcode.Validation, s.Title+" is invalid: "+details[0].Field+" "+details[0].Reason, details...)
+	}
+	for _, p := range s.Properties {
+		if p.ReadOnly {
+			delete(fields, p.Name)
+		}
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return errcode.New(errcode.Validation, s.Title+" is invalid: "+err.Error())
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return errcode.New(errcode.Validation, s.Title+" is invalid: "+err.Error())
+	}
+	return nil
+}
+
+// 没有声明Schema的输入: 规范的JSON, 拒绝未知字段
+func Strict(input string, v interface{}) error {
+	err := Canonical(input)
+	if err != nil {
+		return errcode.New(errcode.Validation, err.Error())
+	}
+	dec := json.NewDecoder(strings.NewReader(input))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(v)
+	if err != nil {
+		return errcode.New(errcode.Validation, "invalid JSON: "+err.Error())
+	}
+	return nil
+}
+
+// 检查JSON是否规范: 合法的UTF-8, 只有一个值, 各层对象没有重复的key
+func Canonical(input string) error {
+	if !utf8.ValidString(input) {
+		return ErrCanonical
+	}
+	dec := json.NewDecoder(strings.NewReader(input))
+	err := walk(dec)
+	if err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return ErrCanonical
+	}
+	return nil
+}
+
+// 读取一个值, 检查其中的对象没有重复的key
+func walk(dec *json.Decoder) error {
+	t, err := dec.Token()
+	if err != nil {
+		return ErrCanonical
+	}
+	switch t {
+	case json.Delim('{'):
+		keys := map[string]bool{}
+		for dec.More() {
+			k, err := dec.Token()
+			if err != nil {
+				return ErrCanonical
+			}
+			key := k.(string)
+			if keys[key] {
+				return errors.New("schema: duplicated key " + key)
+			}
+			keys[key] = true
+			err = walk(dec)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for dec.More() {
+			err = walk(dec)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	if err != nil {
+		return ErrCanonical
+	}
+	return nil
+}
+
+// 解析顶层对象
+func object(input string) (map[string]json.RawMessage, error) {
+	err := Canonical(input)
+	if err != nil {
+		return nil, errcode.New(errcode.Validation, err.Error())
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal([]byte(input), &fields)
+	if err != nil || fields == nil {
+		return nil, errcode.New(errcode.Validation, "schema: JSON should be an object")
+	}
+	return fields, nil
+}
+
+// 逐个字段校验, 结果按字段名排序
+func (s Schema) check(fields map[string]json.RawMessage) []errcode.Detail {
+	details := []errcode.Detail{}
+	known := map[string]bool{}
+	for _, p := range s.Properties {
+		known[p.Name] = true
+		raw, ok := fields[p.Name]
+		if !ok || string(raw) == "null" {
+			if p.Required && !p.ReadOnly {
+				details = append(details, errcode.Field(p.Name, "is required"))
+			}
+			continue
+		}
+		if p.ReadOnly {
+			continue
+		}
+		if reason := p.check(raw); reason != "" {
+			details = append(details, errcode.Field(p.Name, reason))
+		}
+	}
+	for name := range fields {
+		if !known[name] {
+			details = append(details, errcode.Field(name, "is not a known field"))
+		}
+	}
+	sort.Slice(details, func(i, j int) bool { return details[i].Field < details[j].Field })
+	return details
+}
+
+// 校验一个字段的值, 返回错误原因
+func (p Property) check(raw json.RawMessage) string {
+	switch p.Type {
+	case Array:
+		if raw[0] != '[' {
+			return "should be an array"
+		}
+		return ""
+	case Object:
+		if raw[0] != '{' {
+			return "should be an object"
+		}
+		return ""
+	case Decimal, Integer:
+		s := string(raw)
+		if raw[0] == '"' {
+			json.Unmarshal(raw, &s)
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			if p.Required {
+				return "is required"
+			}
+			return ""
+		}
+		if p.Type == Integer && !integerRe.MatchString(s) {
+			return "should be an integer"
+		}
+		if !decimalRe.MatchString(s) {
+			return "should be a decimal number"
+		}
+		if p.NonNegative && strings.HasPrefix(s, "-") {
+			return "should not be negative"
+		}
+		return ""
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return "should be a string"
+	}
+	if s == "" {
+		if p.Required {
+			return "is required"
+		}
+		return ""
+	}
+	if p.Deprecated {
+		return "is deprecated and should be empty"
+	}
+	if p.MaxLength > 0 && utf8.RuneCountInString(s) > p.MaxLength {
+		return "should be at most " + strconv.Itoa(p.MaxLength) + " characters"
+	}
+	if p.Pattern != "" && !regexp.MustCompile(p.Pattern).MatchString(s) {
+		return "should match " + p.Pattern
+	}
+	if len(p.Enum) > 0 {
+		for _, e := range p.Enum {
+			if s == e {
+				return ""
+			}
+		}
+		return "should be one of " + strings.Join(p.Enum, ", ")
+	}
+	return ""
+}
+
+// 发布的JSON Schema
+func (s Schema) JSON() ([]byte, error) {
+	props := map[string]interface{}{}
+	required := []string{}
+	for _, p := range s.Properties {
+		props[p.Name] = p.json()
+		if p.Required && !p.ReadOnly {
+			required = append(required, p.Name)
+		}
+	}
+	doc := map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"$id":                  s.ID,
+		"title":                s.Title,
+		"description":          s.Description,
+		"type":                 "object",
+		"properties":           props,
+		"required":             required,
+		"additionalProperties": false,
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (p Property) json() map[string]interface{} {
+	m := map[string]interface{}{}
+	if p.Description != "" {
+		m["description"] = p.Description
+	}
+	if p.ReadOnly {
+		m["readOnly"] = true
+	}
+	if p.Deprecated {
+		m["deprecated"] = true
+	}
+	switch p.Type {
+	case Array, Object:
+		m["type"] = string(p.Type)
+		return m
+	case Decimal:
+		m["type"] = []string{"string", "number"}
+		if p.NonNegative {
+			m["pattern"] = unsignedPattern
+			m["minimum"] = 0
+		} else {
+			m["pattern"] = decimalPattern
+		}
+		return m
+	case Integer:
+		m["type"] = []string{"string", "integer"}
+		if p.NonNegative {
+			m["pattern"] = "^[0-9]+$"
+			m["minimum"] = 0
+		} else {
+			m["pattern"] = integerRe.String()
+		}
+		return m
+	}
+	m["type"] = "string"
+	if p.Required && !p.ReadOnly {
+		m["minLength"] = 1
+	}
+	if p.Deprecated {
+		m["maxLength"] = 0
+	} else if p.MaxLength > 0 {
+		m["maxLength"] = p.MaxLength
+	}
+	if p.Pattern != "" {
+		m["pattern"] = p.Pattern
+	}
+	if len(p.Enum) > 0 {
+		m["enum"] = p.Enum
+	}
+	return m
+}
+
+// 确认Schema的字段与结构体的json字段一一对应
+func (s Schema) Sync(v interface{}) error {
+	t := reflect.TypeOf(v)
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("json")
+		if !ok {
+			return errors.New("schema: field " + f.Name + " of " + t.Name() + " has no json tag")
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "-" {
+			continue
+		}
+		fields[name] = true
+	}
+	for _, p := range s.Properties {
+		if !fields[p.Name] {
+			return errors.New("schema: " + s.Title + " declares " + p.Name + " which " + t.Name() + " does not have")
+		}
+		delete(fields, p.Name)
+	}
+	if len(fields) > 0 {
+		missing := make([]string, 0, len(fields))
+		for name := range fields {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return errors.New("schema: " + t.Name() + " fields " + strings.Join(missing, ", ") + " are missing from " + s.Title)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package schema
+
+import (
+	"github.com/common/errcode"
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		want   item
+		fields []string // 校验失败时Details中的字段
+	}{
+		{"valid", `{"ID":"A","Name":"apple","Price":"3.5"}`, item{ID: "A", Name: "apple", Price: "3.5"}, nil},
+		{"read-only fields are not decoded", `{"ID":"A","Name":"apple","Price":"3.5","Stock":"99","Version":7}`,
+			item{ID: "A", Name: "apple", Price: "3.5"}, nil},
+		{"missing required fields", `{"ID":"A"}`, item{}, []string{"Name", "Price"}},
+		{"unknown field", `{"ID":"A","Name":"apple","Price":"1","Colour":"red"}`, item{}, []string{"Colour"}},
+		{"duplicated key", `{"ID":"A","ID":"B","Name":"apple","Price":"1"}`, item{}, []string{}},
+	}
+	for _, c := range cases {
+		var got item
+		err := itemSchema.Decode(c.input, &got)
+		if c.fields != nil {
+			if errcode.Code(err) != errcode.Validation {
+				t.Errorf("%s: error = %v, want validation", c.name, err)
+				continue
+			}
+			fields := []string{}
+			for _, d := range errcode.DetailsOf(err) {
+				fields = append(fields, d.Field)
+			}
+			if !reflect.DeepEqual(fields, c.fields) {
+				t.Errorf("%s: details = %v, want %v", c.name, fields, c.fields)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
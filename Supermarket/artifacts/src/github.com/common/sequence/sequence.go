@@ -0,0 +1,231 @@
+/*
+账本分配的ID与单据编号
+ID: 交易ID是客户端的nonce与证书的SHA-256(64位十六进制), 背书节点会重新计算并拒绝不一致的提案,
+因此所有背书节点一致, 不会重复也无法猜测;
+采购单、小票、退货单以交易ID为ID, 一个交易登记多件商品时商品ID为交易ID加序号(见ID).
+编号: 税务要求每个店铺的小票、采购单、退货单各自连续编号, 不能有空号.
+在创建单据的交易中读写计数器会使交易失败(背书后被MVCC作废)时编号已被其他交易读到,
+并且所有结账争用同一个计数器key. 因此与库存流水一样分两步:
+ 1. 创建单据时只写入一条待编号记录(kind, 店铺, 交易时间, 单据ID), 不读计数器;
+ 2. assignNumbers按交易时间、单据ID的顺序为已提交的待编号单据连续编号, 更新计数器并删除待编号记录.
+只有提交了的单据才有待编号记录, 因此编号连续; 编号交易失败时待编号记录仍在, 重新执行即可.
+计数器只由编号交易读写, 不影响结账; 两个编号交易并发时其中一个因MVCC失败, 不会重复编号.
+本包只依赖标准库与txtime, 账本的扫描由适配器(common/ledger)完成.
+*/
+
+package sequence
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/common/txtime"
+	"strconv"
+)
+
+// 单据类型
+const (
+	Receipt       = "receipt"
+	PurchaseOrder = "purchase-order"
+	Return        = "return"
+)
+
+// 各类单据编号的前缀
+var Prefixes = map[string]string{
+	Receipt:       "R",
+	PurchaseOrder: "PO",
+	Return:        "RT",
+}
+
+// composite keys
+const (
+	PendingIndexName = "kind~storeID~time~docID" // 待编号的单据, 值为单据ID
+	CounterIndexName = "kind~storeID"            // 计数器
+	NumberIndexName  = "number~docID"            // 编号到单据ID
+)
+
+// 一次编号最多的单据数
+const (
+	DefaultBatch = 100
+	MaxBatch     = 1000
+)
+
+// 商品ID中交易ID的长度, 使ID不超过64个字符.
+// 交易ID是SHA-256, 前32位十六进制为128位, 即使有2^32个交易, 两个前缀相同的概率也只有约2^-65;
+// 万一相同, 写入前的存在检查会使后一个交易返回409, 不会覆盖已有记录
+const idTxIDLength = 32
+
+var ErrKind = errors.New("sequence: unknown document kind")
+
+// 编号用到的账本访问, 由适配器实现
+type Ledger interface {
+	GetTxID() string
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+	DelState(key string) error
+	CreateCompositeKey(objectType string, attributes []string) (string, error)
+	// 交易时间, unix毫秒
+	Time() (int64, error)
+	// 按key的顺序遍历composite key, fn返回false时停止
+	Scan(objectType string, attributes []string, fn func(key string, value []byte) (bool, error)) error
+}
+
+// 计数器: 店铺某类单据已分配的最后一个编号
+type Counter struct {
+	Kind    string `json:"Kind"`
+	StoreID string `json:"StoreID"`
+	Last    int64  `json:"Last"`
+	TxID    string `json:"TxID"` // 最近一次编号的交易
+	Time    string `json:"Time"`
+}
+
+// 一次编号的结果
+type Assignment struct {
+	Kind    string   `json:"Kind"`
+	StoreID string   `json:"StoreID"`
+	First   string   `json:"First"` // 本次第一个编号, 没有待编号单据时为空
+	Last    string   `json:"Last"`
+	Count   int      `json:"Count"`
+	Pending bool     `json:"Pending"` // 是否还有待编号单据
+	Docs    []string `json:"Docs"`    // 按编号顺序的单据ID
+}
+
+// 一个交易中第n件(从0开始)记录的ID
+func ID(txID string, n int) string {
+	if len(txID) > idTxIDLength {
+		txID = txID[:idTxIDLength]
+	}
+	return txID + "-" + strconv.Itoa(n)
+}
+
+// 检查单据类型
+func Check(kind string) error {
+	if _, ok := Prefixes[kind]; !ok {
+		return ErrKind
+	}
+	return nil
+}
+
+// 编号: <StoreID>-<前缀><8位序号>, 例如 S001-R00000042
+func Format(kind, storeID string, n int64) string {
+	return fmt.Sprintf("%s-%s%08d", storeID, Prefixes[kind], n)
+}
+
+// 解析计数器, 没有时从0开始
+func ParseCounter(kind, storeID string, b []byte) (Counter, error) {
+	c := Counter{Kind: kind, StoreID: storeID}
+	if b == nil {
+		return c, nil
+	}
+	err := json.Unmarshal(b, &c)
+	return c, err
+}
+
+// 分配下一个编号
+func (c *Counter) Next() string {
+	c.Last++
+	return Format(c.Kind, c.StoreID, c.Last)
+}
+
+// 解析编号数量参数, 空为默认值
+func Batch(s string) (int, error) {
+	if s == "" {
+		return DefaultBatch, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > MaxBatch {
+		return 0, errors.New("sequence: batch size should be 1 to " + strconv.Itoa(MaxBatch))
+	}
+	return n, nil
+}
+
+// 创建单据时写入待编号记录, t为交易时间
+func Enqueue(stub Ledger, kind, storeID string, t int64, docID string) error {
+	key, err := stub.CreateCompositeKey(PendingIndexName, []string{kind, storeID, txtime.Format(t), docID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte(docID))
+}
+
+// 按交易时间顺序为店铺的待编号单据连续编号, 最多limit个; setNumber把编号写入单据
+func Assign(stub Ledger, kind, storeID string, limit int, setNumber func(docID, number string) error) (Assignment, error) {
+	result := Assignment{Kind: kind, StoreID: storeID, Docs: []string{}}
+	counterKey, err := stub.CreateCompositeKey(CounterIndexName, []string{kind, storeID})
+	if err != nil {
+		return result, err
+	}
+	b, err := stub.GetState(counterKey)
+	if err != nil {
+		return result, err
+	}
+	counter, err := ParseCounter(kind, storeID, b)
+	if err != nil {
+		return result, err
+	}
+
+	// 先取出本次编号的单据, 遍历结束后再写入
+	var keys, docs []string
+	err = stub.Scan(PendingIndexName, []string{kind, storeID}, func(key string, value []byte) (bool, error) {
+		if len(docs) == limit {
+			result.Pending = true
+			return false, nil
+		}
+		keys = append(keys, key)
+		docs = append(docs, string(value))
+		return true, nil
+	})
+	if err != nil {
+		return result, err
+	}
+	for i, docID := range docs {
+		number := counter.Next()
+		err = setNumber(docID, number)
+		if err != nil {
+			return result, err
+		}
+		numberKey, err := stub.CreateCompositeKey(NumberIndexName, []string{number, docID})
+		if err != nil {
+			return result, err
+		}
+		err = stub.PutState(numberKey, []byte(docID))
+		if err != nil {
+			return result, err
+		}
+		err = stub.DelState(keys[i])
+		if err != nil {
+			return result, err
+		}
+		if result.First == "" {
+			result.First = number
+		}
+		result.Last = number
+		result.Count++
+		result.Docs = append(result.Docs, docID)
+	}
+	if result.Count == 0 {
+		return result, nil
+	}
+
+	now, err := stub.Time()
+	if err != nil {
+		return result, err
+	}
+	counter.TxID = stub.GetTxID()
+	counter.Time = txtime.Format(now)
+	b, err = json.Marshal(counter)
+	if err != nil {
+		return result, err
+	}
+	return result, stub.PutState(counterKey, b)
+}
+
+// 编号对应的单据ID, 没有时为空
+func Lookup(stub Ledger, number string) (string, error) {
+	docID := ""
+	err := stub.Scan(NumberIndexName, []string{number}, func(key string, value []byte) (bool, error) {
+		docID = string(value)
+		return false, nil
+	})
+	return docID, err
+}
@@ -0,0 +1,143 @@
+package sequence
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 内存中的账本, composite key的格式与fabric相同
+type fakeLedger struct {
+	state map[string][]byte
+}
+
+func (l fakeLedger) GetTxID() string                     { return "tx" }
+func (l fakeLedger) Time() (int64, error)                { return 1500000000000, nil }
+func (l fakeLedger) GetState(key string) ([]byte, error) { return l.state[key], nil }
+func (l fakeLedger) PutState(key string, value []byte) error {
+	l.state[key] = value
+	return nil
+}
+func (l fakeLedger) DelState(key string) error {
+	delete(l.state, key)
+	return nil
+}
+func (l fakeLedger) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return "\x00" + objectType + "\x00" + strings.Join(append(attributes, ""), "\x00"), nil
+}
+func (l fakeLedger) Scan(objectType string, attributes []string, fn func(key string, value []byte) (bool, error)) error {
+	prefix, _ := l.CreateCompositeKey(objectType, attributes)
+	var keys []string
+	for k := range l.state {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		more, err := fn(k, l.state[k])
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAssign(t *testing.T) {
+	l := fakeLedger{state: map[string][]byte{}}
+	// 并发提交的单据按提交顺序写入待编号记录, 交易时间可能相同或乱序
+	pending := []struct {
+		kind, store string
+		t           int64
+		doc         string
+	}{
+		{Receipt, "S1", 3000, "c"},
+		{Receipt, "S1", 1000, "b"},
+		{Receipt, "S1", 1000, "a"},
+		{Receipt, "S2", 500, "x"},
+		{Return, "S1", 2000, "r"},
+		{Receipt, "S1", 2000, "d"},
+	}
+	for _, p := range pending {
+		if err := Enqueue(l, p.kind, p.store, p.t, p.doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	numbers := map[string]string{}
+	set := func(docID, number string) error {
+		if numbers[docID] != "" {
+			return errors.New("numbered twice: " + docID)
+		}
+		numbers[docID] = number
+		return nil
+	}
+	cases := []struct {
+		kind, store string
+		limit       int
+		docs        []string
+		first, last string
+		pending     bool
+	}{
+		{Receipt, "S1", 2, []string{"a", "b"}, "S1-R00000001", "S1-R00000002", true},
+		{Receipt, "S1", 2, []string{"d", "c"}, "S1-R00000003", "S1-R00000004", false},
+		{Receipt, "S1", 2, []string{}, "", "", false},
+		{Receipt, "S2", 10, []string{"x"}, "S2-R00000001", "S2-R00000001", false},
+		{Return, "S1", 10, []string{"r"}, "S1-RT00000001", "S1-RT00000001", false},
+	}
+	for _, c := range cases {
+		r, err := Assign(l, c.kind, c.store, c.limit, set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r.Docs, c.docs) || r.First != c.first || r.Last != c.last || r.Pending != c.pending || r.Count != len(c.docs) {
+			t.Errorf("Assign(%s, %s, %d) = %+v", c.kind, c.store, c.limit, r)
+		}
+	}
+	// 每张单据只编号一次, 可以按编号查到
+	for doc, number := range numbers {
+		if got, err := Lookup(l, number); err != nil || got != doc {
+			t.Errorf("Lookup(%s) = %q, %v, want %q", number, got, err, doc)
+		}
+	}
+	if got, _ := Lookup(l, "S1-R00000099"); got != "" {
+		t.Errorf("Lookup of an unused number = %q", got)
+	}
+	key, _ := l.CreateCompositeKey(CounterIndexName, []string{Receipt, "S1"})
+	c, _ := ParseCounter(Receipt, "S1", l.state[key])
+	if c.Last != 4 || c.TxID != "tx" {
+		t.Errorf("counter = %+v", c)
+	}
+}
+
+// 写入单据失败时返回错误, 交易不提交, 待编号记录保留
+func TestAssignFailure(t *testing.T) {
+	l := fakeLedger{state: map[string][]byte{}}
+	Enqueue(l, PurchaseOrder, "S1", 1000, "a")
+	_, err := Assign(l, PurchaseOrder, "S1", 10, func(docID, number string) error {
+		return errors.New("put failed")
+	})
+	if err == nil {
+		t.Error("Assign should fail")
+	}
+}
+
+func TestID(t *testing.T) {
+	txID := strings.Repeat("0123456789abcdef", 4)
+	cases := []struct {
+		txID string
+		n    int
+		want string
+	}{
+		{txID, 0, txID[:32] + "-0"},
+		{txID, 12, txID[:32] + "-12"},
+		{"short", 1, "short-1"},
+	}
+	for _, c := range cases {
+		if got := ID(c.txID, c.n); got != c.want {
+			t.Errorf("ID(%s, %d) = %s, want %s", c.txID, c.n, got, c.want)
+		}
+	}
+}
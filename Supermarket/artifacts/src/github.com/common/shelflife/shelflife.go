@@ -0,0 +1,129 @@
+/*
+保质期
+类别的ShelfLife可以写成ISO-8601时长(只支持日期部分, 例如 "P18M"、"P2W"、"P1Y6M")
+或天数(例如 "30"), 规范化后保存为ISO-8601字符串; 空字符串表示不限保质期.
+生产日期与保质到期日(best-before)均为UTC日期 "2006-01-02", 到期日当天仍可销售.
+*/
+
+package shelflife
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 日期格式
+const DateLayout = "2006-01-02"
+
+// 兼容的生产日期写法
+var dateLayouts = []string{DateLayout, "2006/01/02", "20060102", "2006.01.02"}
+
+var ErrFormat = errors.New("shelflife: invalid shelf life, expecting ISO-8601 like P18M or a number of days")
+var ErrDate = errors.New("shelflife: invalid date, expecting YYYY-MM-DD")
+
+// 保质期, 零值表示不限
+type Duration struct {
+	Years  int
+	Months int
+	Days   int
+}
+
+// 是否不限保质期
+func (d Duration) IsZero() bool {
+	return d.Years == 0 && d.Months == 0 && d.Days == 0
+}
+
+// 解析ISO-8601时长或天数
+func Parse(s string) (Duration, error) {
+	s = strings.TrimSpace(s)
+	var d Duration
+	if s == "" {
+		return d, nil
+	}
+	if days, err := strconv.Atoi(s); err == nil {
+		if days < 0 {
+			return d, ErrFormat
+		}
+		d.Days = days
+		return d, nil
+	}
+
+	s = strings.ToUpper(s)
+	if len(s) < 3 || s[0] != 'P' {
+		return d, ErrFormat
+	}
+	rest := s[1:]
+	for rest != "" {
+		i := strings.IndexAny(rest, "YMWD")
+		if i <= 0 {
+			return d, ErrFormat
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil || n < 0 {
+			return d, ErrFormat
+		}
+		switch rest[i] {
+		case 'Y':
+			d.Years += n
+		case 'M':
+			d.Months += n
+		case 'W':
+			d.Days += 7 * n
+		case 'D':
+			d.Days += n
+		}
+		rest = rest[i+1:]
+	}
+	return d, nil
+}
+
+// 规范化的ISO-8601字符串, 不限时为空字符串
+func (d Duration) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	s := "P"
+	if d.Years != 0 {
+		s += strconv.Itoa(d.Years) + "Y"
+	}
+	if d.Months != 0 {
+		s += strconv.Itoa(d.Months) + "M"
+	}
+	if d.Days != 0 {
+		s += strconv.Itoa(d.Days) + "D"
+	}
+	return s
+}
+
+// 解析日期, 结果为UTC零点
+func ParseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, s, time.UTC)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrDate
+}
+
+// 保质到期日: 生产日期加保质期减一天, 例如1月1日生产保质30天, 1月30日到期
+func BestBefore(production string, d Duration) (string, error) {
+	t, err := ParseDate(production)
+	if err != nil {
+		return "", err
+	}
+	return t.AddDate(d.Years, d.Months, d.Days-1).Format(DateLayout), nil
+}
+
+// unix毫秒对应的UTC日期
+func DateOf(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(DateLayout)
+}
+
+// now(unix毫秒)时是否已过期(到期日当天不算过期)
+func Expired(bestBefore string, now int64) bool {
+	return bestBefore != "" && DateOf(now) > bestBefore
+}
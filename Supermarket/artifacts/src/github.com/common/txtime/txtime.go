@@ -0,0 +1,63 @@
+/*
+交易时间
+背书时不能使用time.Now: 同一提案在各背书节点上的本地时间不同, 写集不一致会导致背书不匹配.
+写入账本的时间(创建时间、状态变更时间等)以及有效期、到期的判断都取自提案的时间戳(stub.GetTxTimestamp), 各节点一致.
+时间统一保存为unix毫秒的十进制字符串(13位); 旧记录和客户端提交的unix秒(10位)由Parse兼容.
+本包只依赖标准库.
+*/
+
+package txtime
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 毫秒为单位的时长
+const (
+	Millisecond int64 = 1
+	Second            = 1000 * Millisecond
+	Minute            = 60 * Second
+	Hour              = 60 * Minute
+	Day               = 24 * Hour
+)
+
+// 小于此值的时间按unix秒处理: 1e11秒是5138年, 1e11毫秒是1973年
+const secondsBelow = 100000000000
+
+var ErrFormat = errors.New("txtime: invalid time, expecting unix milliseconds or seconds")
+
+// 提案时间戳, 即stub.GetTxTimestamp()返回的*timestamp.Timestamp
+type Timestamp interface {
+	GetSeconds() int64
+	GetNanos() int32
+}
+
+// 时间戳对应的unix毫秒, 不足一毫秒的部分舍去
+func Of(ts Timestamp) int64 {
+	return ts.GetSeconds()*Second + int64(ts.GetNanos())/int64(time.Millisecond)
+}
+
+// 保存到账本的写法
+func Format(ms int64) string {
+	return strconv.FormatInt(ms, 10)
+}
+
+// 解析保存的时间, 兼容unix秒
+func Parse(s string) (int64, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, ErrFormat
+	}
+	if n < secondsBelow {
+		n *= Second
+	}
+	return n, nil
+}
+
+// unix毫秒对应的UTC时间
+func Time(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
@@ -0,0 +1,679 @@
+/*
+优惠券
+模板定义优惠方式(满减、折扣、指定类别满减)与最低消费, 按模板向指定用户或整个会员等级发券,
+每张券单独一个key, 核销时写入小票号; 两个结账并发核销同一张券时, 后提交的交易因MVCC冲突失效,
+因此一张券只能被核销一次. 核销只能由SalesChaincode.checkout在结账时调用, 券上记录的小票号即该结账的交易ID
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/common/authz"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/history"
+	"github.com/common/ledger"
+	"github.com/common/schema"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var logger = shim.NewLogger("Coupon")
+
+// 被调用的chaincode名称
+const UsersChaincodeName = "usercc"
+
+// 权限矩阵; 顾客只能查询本人的券
+var permissions = authz.Matrix{
+	"insertTemplate":       authz.Managers,
+	"queryTemplate":        authz.Everyone,
+	"issue":                authz.Managers,
+	"issueToVIP":           authz.Managers,
+	"redeem":               authz.Staff,
+	"queryByID":            {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"queryHistory":         {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"queryActive":          {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"exists":               authz.Everyone,
+	"setIdempotencyWindow": {authz.Admin},
+	"purgeIdempotencyKeys": {authz.Admin},
+}
+
+// 优惠方式
+const (
+	TypeFixed    = "fixed"    // 满MinSpend减Amount
+	TypePercent  = "percent"  // 满MinSpend优惠Amount%
+	TypeCategory = "category" // 指定类别消费满MinSpend减Amount
+)
+
+// 券状态
+const (
+	StatusActive   = "active"
+	StatusRedeemed = "redeemed"
+)
+
+// 券模板
+type Template struct {
+	ID         string          `json:"ID"`
+	Name       string          `json:"Name"`
+	Type       string          `json:"Type"`
+	Amount     decimal.Decimal `json:"Amount"`   // 减免金额, percent类型为百分比
+	Category   string          `json:"Category"` // category类型限定的类别
+	MinSpend   decimal.Decimal `json:"MinSpend"`
+	ValidFrom  string          `json:"ValidFrom"` // 有效期开始(unix毫秒, 兼容unix秒)
+	ValidTo    string          `json:"ValidTo"`   // 有效期结束(unix毫秒, 兼容unix秒, 不含)
+	CreateTime string          `json:"CreateTime"`
+}
+
+// 发给用户的券
+type Coupon struct {
+	ID         string `json:"ID"`
+	TemplateID string `json:"TemplateID"`
+	UserID     string `json:"UserID"`
+	Status     string `json:"Status"`
+	ValidFrom  string `json:"ValidFrom"`
+	ValidTo    string `json:"ValidTo"`
+	IssueTxID  string `json:"IssueTxID"`
+	IssueTime  string `json:"IssueTime"`
+	ReceiptNo  string `json:"ReceiptNo"` // 核销的小票
+	RedeemTime string `json:"RedeemTime"`
+}
+
+// 核销时提交的购物篮
+type Basket struct {
+	Subtotal decimal.Decimal `json:"Subtotal"`
+	Lines    []BasketLine    `json:"Lines"`
+}
+
+type BasketLine struct {
+	Category string          `json:"Category"`
+	Amount   decimal.Decimal `json:"Amount"`
+}
+
+// 核销结果
+type Redemption struct {
+	CouponID string          `json:"CouponID"`
+	Discount decimal.Decimal `json:"Discount"`
+}
+
+// 前缀
+const Template_Prefix = "CouponTpl_"
+const Record_Prefix = "Coupon_"
+
+// composite keys
+const UserIndexName = "userID~couponID"
+
+// CouponChaincode example Coupon Chaincode implementation
+type CouponChaincode struct {
+}
+
+// 根据key取出模板
+func (a *CouponChaincode) getTemplate(stub shim.ChaincodeStubInterface, key string) (Template, bool) {
+	var template Template
+	b, err := stub.GetState(key)
+	if b == nil {
+		return template, false
+	}
+	err = json.Unmarshal(b, &template)
+	if err != nil {
+		return template, false
+	}
+	return template, true
+}
+
+// 根据key取出券
+func (a *CouponChaincode) getRecord(stub shim.ChaincodeStubInterface, key string) (Coupon, bool) {
+	var record Coupon
+	b, err := stub.GetState(key)
+	if b == nil {
+		return record, false
+	}
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// 保存记录
+func (a *CouponChaincode) putState(stub shim.ChaincodeStubInterface, key string, record interface{}) ([]byte, bool) {
+
+	byte, err := json.Marshal(record)
+	if err != nil {
+		return nil, false
+	}
+
+	err = stub.PutState(key, byte)
+	if err != nil {
+		return nil, false
+	}
+	// 记录提交者, 见queryHistory
+	err = history.Stamp(stub)
+	if err != nil {
+		return nil, false
+	}
+	return byte, true
+}
+
+// response message format
+func getRetByte(code int, des string, details ...errcode.Detail) []byte {
+	r := errcode.NewRet(code, des, details...)
+
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		fmt.Println("marshal Ret failed")
+		return nil
+	}
+	return b
+}
+
+// response message format
+func getRetString(code int, des string, details ...errcode.Detail) string {
+	r := errcode.NewRet(code, des, details...)
+
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		fmt.Println("marshal Ret failed")
+		return ""
+	}
+	logger.Infof("%s", string(b[:]))
+	return string(b[:])
+}
+
+// 按错误的错误码返回, 保留被调用链码的Details
+func getRetError(des string, err error) string {
+	return getRetString(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...)
+}
+
+// 调用同一channel上的其他chaincode
+func invoke(stub shim.ChaincodeStubInterface, chaincodeName string, args ...string) pb.Response {
+	ccArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		ccArgs[i] = []byte(arg)
+	}
+	return stub.InvokeChaincode(chaincodeName, ccArgs, "")
+}
+
+// 交易时间(unix毫秒), 所有背书节点一致
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
+// 券号: 由发券交易、模板和用户确定, 各背书节点一致
+func couponID(txID, templateID, userID string) string {
+	sum := sha256.Sum256([]byte(txID + "\x00" + templateID + "\x00" + userID))
+	return hex.EncodeToString(sum[:10])
+}
+
+// 是否在有效期内
+func (c Coupon) validAt(now int64) bool {
+	from, err1 := txtime.Parse(c.ValidFrom)
+	to, err2 := txtime.Parse(c.ValidTo)
+	return err1 == nil && err2 == nil && now >= from && now < to
+}
+
+func (t *CouponChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("########### Coupon Chaincode Init ###########")
+	return shim.Success(nil)
+
+}
+
+// Transaction makes payment of X units from A to B
+func (t *CouponChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	resp := ledger.DispatchOnce(stub, t.dispatch)
+	if resp.Status != shim.OK {
+		// 错误返回带上交易ID
+		resp.Message = errcode.Stamp(resp.Message, stub.GetTxID())
+	}
+	return resp
+}
+
+// 按函数名分发
+func (t *CouponChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("########### chaincode Invoke ###########")
+
+	function, args := stub.GetFunctionAndParameters()
+	logger.Info("%s%s", "CouponChaincode function=", function)
+	logger.Info("%s%s", "CouponChaincode args=", args)
+	// 权限检查
+	_, err := permissions.Authorize(stub, function)
+	if err != nil {
+		res := getRetError("CouponChaincode ", err)
+		return shim.Error(res)
+	}
+	if function == "insertTemplate" {
+		// 新建模板
+		return t.insertTemplate(stub, args)
+	} else if function == "queryTemplate" {
+		// 查询模板
+		return t.queryTemplate(stub, args)
+	} else if function == "issue" {
+		// 向指定用户发券
+		return t.issue(stub, args)
+	} else if function == "issueToVIP" {
+		// 向会员等级发券
+		return t.issueToVIP(stub, args)
+	} else if function == "redeem" {
+		// 核销
+		return t.redeem(stub, args)
+	} else if function == "queryHistory" {
+		// 变更历史
+		return t.queryHistory(stub, args)
+	} else if function == "queryByID" {
+		// 根据券号查询
+		return t.queryByID(stub, args)
+	} else if function == "queryActive" {
+		// 查询用户可用的券
+		return t.queryActive(stub, args)
+	} else if function == "exists" {
+		// 记录是否存在
+		return t.exists(stub, args)
+	} else if function == "setIdempotencyWindow" {
+		// 设置幂等key的保存时间
+		return ledger.SetIdempotencyWindow(stub, args)
+	} else if function == "purgeIdempotencyKeys" {
+		// 删除已失效的幂等key
+		return ledger.PurgeIdempotencyKeys(stub, args)
+	}
+
+	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", function)
+	res := getRetString(errcode.Validation, "Unknown action: "+function, errcode.Field("function", "unknown"))
+	return shim.Error(res)
+}
+
+// 新建模板
+// args: 0 - {Template Object}
+func (a *CouponChaincode) insertTemplate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insertTemplate args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	var template Template
+	err := schema.Strict(args[0], &template)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insertTemplate failed : ", err)
+		return shim.Error(res)
+	}
+	if template.ID == "" {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insertTemplate failed : ID is required")
+		return shim.Error(res)
+	}
+	switch template.Type {
+	case TypeFixed:
+	case TypePercent:
+		if template.Amount.Cmp(decimal.FromInt(100)) > 0 {
+			res := getRetString(errcode.Validation, "Chaincode Invoke insertTemplate failed : percentage should not exceed 100")
+			return shim.Error(res)
+		}
+	case TypeCategory:
+		if template.Category == "" {
+			res := getRetString(errcode.Validation, "Chaincode Invoke insertTemplate failed : category coupon needs a Category")
+			return shim.Error(res)
+		}
+	default:
+		res := getRetString(errcode.Validation, "Chaincode Invoke insertTemplate failed : unknown Type "+template.Type)
+		return shim.Error(res)
+	}
+	if template.Amount.Sign() <= 0 || template.MinSpend.Sign() < 0 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insertTemplate failed : Amount should be positive and MinSpend not negative")
+		return shim.Error(res)
+	}
+	from, err1 := txtime.Parse(template.ValidFrom)
+	to, err2 := txtime.Parse(template.ValidTo)
+	if err1 != nil || err2 != nil || from >= to {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insertTemplate failed : invalid validity window")
+		return shim.Error(res)
+	}
+
+	_, existbl := a.getTemplate(stub, Template_Prefix+template.ID)
+	if existbl {
+		res := getRetString(errcode.AlreadyExists, "Chaincode Invoke insertTemplate failed : the template has exist ")
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insertTemplate failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	template.CreateTime = txtime.Format(now)
+	if template.Type != TypePercent {
+		template.Amount = template.Amount.RoundCents()
+	}
+	template.MinSpend = template.MinSpend.RoundCents()
+
+	_, bl := a.putState(stub, Template_Prefix+template.ID, template)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insertTemplate put template failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke insertTemplate success")
+	return shim.Success(res)
+}
+
+// 查询模板
+// args: 0 - Template ID
+func (a *CouponChaincode) queryTemplate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "CouponChaincode queryTemplate args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	b, err := stub.GetState(Template_Prefix + args[0])
+	if err != nil || b == nil {
+		res := getRetString(errcode.NotFound, "CouponChaincode queryTemplate get template error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 向指定用户发券
+// args: 0 - Template ID, 1 - [User ID, ...]
+func (a *CouponChaincode) issue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke issue args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	var userIDs []string
+	err := json.Unmarshal([]byte(args[1]), &userIDs)
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke issue failed : user list should be a JSON array of user IDs",
+			errcode.Field("userIDs", "should be a JSON array of user IDs"))
+		return shim.Error(res)
+	}
+	return a.issueTo(stub, args[0], userIDs)
+}
+
+// 向某一会员等级的所有用户发券
+// args: 0 - Template ID, 1 - VIP level
+func (a *CouponChaincode) issueToVIP(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke issueToVIP args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	resp := invoke(stub, UsersChaincodeName, "queryByVIP", args[1])
+	if resp.Status != shim.OK {
+		res := getRetError("Chaincode Invoke issueToVIP query users failed: ", errcode.FromResponse(resp.Message))
+		return shim.Error(res)
+	}
+	var userIDs []string
+	err := json.Unmarshal(resp.Payload, &userIDs)
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke issueToVIP failed : user list should be a JSON array of user IDs")
+		return shim.Error(res)
+	}
+	return a.issueTo(stub, args[0], userIDs)
+}
+
+func (a *CouponChaincode) issueTo(stub shim.ChaincodeStubInterface, templateID string, userIDs []string) pb.Response {
+	template, existbl := a.getTemplate(stub, Template_Prefix+templateID)
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke issue failed : template does not exist")
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke issue failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+
+	issued := []string{}
+	seen := map[string]bool{}
+	for _, userID := range userIDs {
+		if userID == "" || seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		coupon := Coupon{
+			ID:         couponID(stub.GetTxID(), template.ID, userID),
+			TemplateID: template.ID,
+			UserID:     userID,
+			Status:     StatusActive,
+			ValidFrom:  template.ValidFrom,
+			ValidTo:    template.ValidTo,
+			IssueTxID:  stub.GetTxID(),
+			IssueTime:  txtime.Format(now),
+		}
+		_, bl := a.putState(stub, Record_Prefix+coupon.ID, coupon)
+		if !bl {
+			res := getRetString(errcode.Internal, "Chaincode Invoke issue put coupon failed")
+			return shim.Error(res)
+		}
+		key, err := stub.CreateCompositeKey(UserIndexName, []string{userID, coupon.ID})
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke issue: CreateCompositeKey failed")
+			return shim.Error(res)
+		}
+		err = stub.PutState(key, []byte(coupon.ID))
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke issue put index failed")
+			return shim.Error(res)
+		}
+		issued = append(issued, coupon.ID)
+	}
+
+	b, err := json.Marshal(issued)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CouponChaincode Marshal issue list error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 核销: 检查归属、状态、有效期与最低消费, 计算优惠金额并将券标记为已用
+// 只能由SalesChaincode.checkout调用, 客户端直接调用时小票号与购物篮无从核实
+// args: 0 - Coupon ID, 1 - User ID, 2 - Receipt No, 3 - {Basket Object}
+func (a *CouponChaincode) redeem(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke redeem args!=4", errcode.Args("want 4"))
+		return shim.Error(res)
+	}
+	if ledger.TopLevel(stub) {
+		res := getRetString(errcode.Forbidden, "Chaincode Invoke redeem failed : only SalesChaincode.checkout can redeem")
+		return shim.Error(res)
+	}
+	var basket Basket
+	err := schema.Strict(args[3], &basket)
+	if err != nil {
+		res := getRetError("Chaincode Invoke redeem basket failed : ", err)
+		return shim.Error(res)
+	}
+
+	coupon, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke redeem failed : coupon does not exist")
+		return shim.Error(res)
+	}
+	if coupon.UserID != args[1] {
+		res := getRetString(errcode.BusinessRule, "Chaincode Invoke redeem failed : coupon belongs to another user")
+		return shim.Error(res)
+	}
+	if coupon.Status != StatusActive {
+		res := getRetString(errcode.BusinessRule, "Chaincode Invoke redeem failed : coupon has been redeemed by receipt "+coupon.ReceiptNo)
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke redeem failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	if !coupon.validAt(now) {
+		res := getRetString(errcode.BusinessRule, "Chaincode Invoke redeem failed : coupon is not valid now")
+		return shim.Error(res)
+	}
+	template, existbl := a.getTemplate(stub, Template_Prefix+coupon.TemplateID)
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke redeem failed : template does not exist")
+		return shim.Error(res)
+	}
+
+	// 参与计算的消费金额
+	base := basket.Subtotal
+	if template.Type == TypeCategory {
+		base = decimal.Zero
+		for _, line := range basket.Lines {
+			if line.Category == template.Category {
+				base, err = base.Add(line.Amount)
+				if err != nil {
+					res := getRetString(errcode.Validation, "Chaincode Invoke redeem failed : "+err.Error())
+					return shim.Error(res)
+				}
+			}
+		}
+	}
+	if base.Sign() <= 0 || base.Cmp(template.MinSpend) < 0 {
+		res := getRetString(errcode.BusinessRule, "Chaincode Invoke redeem failed : minimum spend not reached")
+		return shim.Error(res)
+	}
+
+	var discount decimal.Decimal
+	if template.Type == TypePercent {
+		discount, err = base.Percent(template.Amount, decimal.HalfUp)
+		if err != nil {
+			res := getRetString(errcode.Validation, "Chaincode Invoke redeem failed : "+err.Error())
+			return shim.Error(res)
+		}
+		discount = discount.RoundCents()
+	} else {
+		discount = template.Amount
+	}
+	if discount.Cmp(base) > 0 {
+		discount = base
+	}
+
+	coupon.Status = StatusRedeemed
+	coupon.ReceiptNo = args[2]
+	coupon.RedeemTime = txtime.Format(now)
+	_, bl := a.putState(stub, Record_Prefix+coupon.ID, coupon)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke redeem put coupon failed")
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(Redemption{CouponID: coupon.ID, Discount: discount})
+	if err != nil {
+		res := getRetString(errcode.Internal, "CouponChaincode Marshal redemption error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 根据券号查询
+// args: 0 - Coupon ID
+func (a *CouponChaincode) queryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "CouponChaincode queryByID args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	coupon, bl := a.getRecord(stub, Record_Prefix+args[0])
+	if !bl {
+		res := getRetString(errcode.NotFound, "CouponChaincode queryByID get coupon error")
+		return shim.Error(res)
+	}
+	err := authz.CheckSelf(stub, coupon.UserID)
+	if err != nil {
+		res := getRetError("CouponChaincode queryByID: ", err)
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(coupon)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CouponChaincode Marshal queryByID coupon error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 查询用户当前可用(未核销且在有效期内)的券
+// args: 0 - User ID
+func (a *CouponChaincode) queryActive(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "CouponChaincode queryActive args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	err := authz.CheckSelf(stub, args[0])
+	if err != nil {
+		res := getRetError("CouponChaincode queryActive: ", err)
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CouponChaincode queryActive failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+
+	indexIterator, err := stub.GetStateByPartialCompositeKey(UserIndexName, []string{args[0]})
+	if err != nil {
+		res := getRetString(errcode.Internal, "CouponChaincode queryActive get index error")
+		return shim.Error(res)
+	}
+	defer indexIterator.Close()
+
+	var couponList = []Coupon{}
+	for indexIterator.HasNext() {
+		kv, err := indexIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "CouponChaincode queryActive iterator error")
+			return shim.Error(res)
+		}
+		coupon, bl := a.getRecord(stub, Record_Prefix+string(kv.Value))
+		if !bl {
+			res := getRetString(errcode.Internal, "CouponChaincode queryActive get coupon error")
+			return shim.Error(res)
+		}
+		if coupon.Status == StatusActive && coupon.validAt(now) {
+			couponList = append(couponList, coupon)
+		}
+	}
+
+	b, err := json.Marshal(couponList)
+	if err != nil {
+		res := getRetString(errcode.Internal, "CouponChaincode Marshal queryActive couponList error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 记录是否存在, 供其他链码(如IndexChaincode)确认引用; 不存在时返回404
+// args: 0 - ID
+func (a *CouponChaincode) exists(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "CouponChaincode exists args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	var b []byte
+	var err error
+	for _, prefix := range []string{Record_Prefix, Template_Prefix} {
+		b, err = stub.GetState(prefix + args[0])
+		if err != nil {
+			res := getRetString(errcode.Internal, "CouponChaincode exists get record error")
+			return shim.Error(res)
+		}
+		if b != nil {
+			break
+		}
+	}
+	if b == nil {
+		res := getRetString(errcode.NotFound, "CouponChaincode exists: no coupon or coupon template "+args[0])
+		return shim.Error(res)
+	}
+	return shim.Success(getRetByte(0, args[0]+" exists"))
+}
+
+func main() {
+	err := shim.Start(new(CouponChaincode))
+	if err != nil {
+		logger.Errorf("Error starting Coupon chaincode: %s", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/ledger/ledgertest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	t0    = time.Unix(1500000000, 0)
+	clerk = ledgertest.Creator("Org1MSP", "alice", map[string]string{"role": "clerk", "storeID": "S1"})
+)
+
+// 满10减2的模板, 发给u1一张有效期一天的券
+func newCouponStub() *ledgertest.Stub {
+	stub := ledgertest.NewStub("coupon", new(CouponChaincode))
+	template, _ := json.Marshal(Template{ID: "T1", Name: "2 off 10", Type: TypeFixed,
+		Amount: decimal.MustParse("2"), MinSpend: decimal.MustParse("10")})
+	coupon, _ := json.Marshal(Coupon{ID: "K1", TemplateID: "T1", UserID: "u1", Status: StatusActive,
+		ValidFrom: "1500000000000", ValidTo: "1500086400000"})
+	stub.Put(Template_Prefix+"T1", template)
+	stub.Put(Record_Prefix+"K1", coupon)
+	return stub
+}
+
+// 结账时由SalesChaincode调用
+func redeemProposal(txID, userID, receiptNo, subtotal string, at time.Duration) ledgertest.Proposal {
+	return ledgertest.Proposal{
+		TxID:    txID,
+		Creator: clerk,
+		Time:    t0.Add(at),
+		Args:    []string{"redeem", "K1", userID, receiptNo, `{"Subtotal":"` + subtotal + `","Lines":[]}`},
+		Caller:  []string{"checkout", `{"StoreID":"S1"}`},
+	}
+}
+
+// 客户端直接调用
+func direct(p ledgertest.Proposal) ledgertest.Proposal {
+	p.Caller = nil
+	return p
+}
+
+func code(resp pb.Response) int {
+	if resp.Status == shim.OK {
+		return errcode.OK
+	}
+	return errcode.FromResponse(resp.Message).Code
+}
+
+// 按顺序核销, 后面的步骤依赖前面保存的结果
+func TestRedeem(t *testing.T) {
+	stub := newCouponStub()
+	cases := []struct {
+		name string
+		p    ledgertest.Proposal
+		code int
+	}{
+		{"called directly", direct(redeemProposal("tx0", "u1", "R1", "12.00", time.Hour)), errcode.Forbidden},
+		{"another user", redeemProposal("tx1", "u2", "R1", "12.00", time.Hour), errcode.BusinessRule},
+		{"minimum spend not reached", redeemProposal("tx2", "u1", "R1", "9.99", time.Hour), errcode.BusinessRule},
+		{"before valid from", redeemProposal("tx3", "u1", "R1", "12.00", -time.Hour), errcode.BusinessRule},
+		{"first redemption", redeemProposal("tx4", "u1", "R1", "12.00", time.Hour), errcode.OK},
+		{"same receipt again", redeemProposal("tx5", "u1", "R1", "12.00", time.Hour), errcode.BusinessRule},
+		{"another receipt", redeemProposal("tx6", "u1", "R2", "12.00", 2*time.Hour), errcode.BusinessRule},
+	}
+	for _, c := range cases {
+		resp := stub.Invoke(c.p)
+		if got := code(resp); got != c.code {
+			t.Errorf("%s: code %d, want %d: %s", c.name, got, c.code, resp.Message)
+		}
+	}
+
+	var coupon Coupon
+	b, _ := stub.GetState(Record_Prefix + "K1")
+	if err := json.Unmarshal(b, &coupon); err != nil {
+		t.Fatal(err)
+	}
+	if coupon.Status != StatusRedeemed || coupon.ReceiptNo != "R1" {
+		t.Errorf("coupon should be redeemed by R1: %s", b)
+	}
+}
+
+// 两个收银台基于同一状态同时核销: 背书都成功, 提交时后一笔读到的券已被修改, 被MVCC检查作废
+func TestRedeemRace(t *testing.T) {
+	stub := newCouponStub()
+	a := stub.Endorse(redeemProposal("tx1", "u1", "R1", "12.00", time.Hour))
+	b := stub.Endorse(redeemProposal("tx2", "u1", "R2", "12.00", time.Hour))
+	for _, e := range []ledgertest.Endorsement{a, b} {
+		if e.Response.Status != shim.OK {
+			t.Fatalf("%s: endorsement failed: %s", e.TxID, e.Response.Message)
+		}
+		if _, ok := e.Reads[Record_Prefix+"K1"]; !ok {
+			t.Fatalf("%s: coupon is not in the read set: %q", e.TxID, e.Reads)
+		}
+	}
+	if !stub.Commit(a) {
+		t.Fatal("first redemption should commit")
+	}
+	if stub.Commit(b) {
+		t.Fatal("second redemption should fail the MVCC check")
+	}
+
+	var coupon Coupon
+	value, _ := stub.GetState(Record_Prefix + "K1")
+	if err := json.Unmarshal(value, &coupon); err != nil {
+		t.Fatal(err)
+	}
+	if coupon.ReceiptNo != "R1" {
+		t.Errorf("coupon should be redeemed by R1 only: %s", value)
+	}
+}
+
+// 格式错误的用户列表是客户端输入错误
+func TestIssue(t *testing.T) {
+	stub := newCouponStub()
+	stub.Peers[UsersChaincodeName] = func(args []string) pb.Response {
+		if args[1] == "bad" {
+			return shim.Success([]byte(`{"u1":true}`))
+		}
+		return shim.Success([]byte(`["u1","u2"]`))
+	}
+	manager := ledgertest.Creator("Org1MSP", "bob", map[string]string{"role": "manager", "storeID": "S1"})
+	cases := []struct {
+		name   string
+		args   []string
+		code   int
+		issued int
+	}{
+		{"users", []string{"issue", "T1", `["u1","u2","u1",""]`}, errcode.OK, 2},
+		{"not a list", []string{"issue", "T1", `"u1"`}, errcode.Validation, 0},
+		{"not JSON", []string{"issue", "T1", `[u1]`}, errcode.Validation, 0},
+		{"unknown template", []string{"issue", "T9", `["u1"]`}, errcode.NotFound, 0},
+		{"VIP level", []string{"issueToVIP", "T1", "gold"}, errcode.OK, 2},
+		{"bad VIP user list", []string{"issueToVIP", "T1", "bad"}, errcode.Validation, 0},
+	}
+	for i, c := range cases {
+		resp := stub.Invoke(ledgertest.Proposal{TxID: "issue" + strconv.Itoa(i), Creator: manager, Time: t0, Args: c.args})
+		var issued []string
+		json.Unmarshal(resp.Payload, &issued)
+		if got := code(resp); got != c.code || len(issued) != c.issued {
+			t.Errorf("%s: code %d, %d issued, want %d, %d: %s", c.name, got, len(issued), c.code, c.issued, resp.Message)
+		}
+	}
+}
@@ -1,49 +1,84 @@
 /*
-商品记录
-每类商品有编号，用于记录价格、剩余量等信息
-每个商品有单独编号，用于记录进货时间等信息
+进货/卖货
+一次交易内同时完成商品记录(CommodityChaincode)与库存(CategoryChaincode)的修改，
+任何一步失败则整个交易失败
 */
 
-
-
 package main
-/*
+
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/events"
+	"github.com/common/ledger"
+	"github.com/common/txtime"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
-	"strconv"
-	"time"
 )
 
 var logger = shim.NewLogger("Goods")
 
-// 前缀
-const Cate_Prefix = "Cate_"
-const Comm_Prefix = "Comm_"
+// 被调用的chaincode名称
+const CommodityChaincodeName = "commodity"
+const CategoryChaincodeName = "category"
 
-// composite keys
-const CateIndexName = "storeID~CateID"
-const CommIndexName = "storeID~CommID"
+// 每次进货/卖货的数量
+const UnitQuantity = "1"
 
-// chaincode response结构
-type chaincodeRet struct {
-	Code int    // 0 success otherwise 1
-	Des  string //description
+// 权限矩阵; 店铺限制由被调用的chaincode检查, 进货时这里先行检查
+var permissions = authz.Matrix{
+	"purchase":             authz.Staff,
+	"sell":                 authz.Staff,
+	"setIdempotencyWindow": {authz.Admin},
+	"purgeIdempotencyKeys": {authz.Admin},
 }
 
+// 商品记录中与库存相关的字段
+type commodityRef struct {
+	ID       string `json:"ID"`
+	Category string `json:"Category"`
+	StoreID  string `json:"StoreID"`
+	Supplier string `json:"Supplier"`
+}
+
+// 被调用的chaincode发出的事件不随交易提交, 由本chaincode发出商品与库存事件
+func emitGoodsEvents(stub shim.ChaincodeStubInterface, commodityEvent, moveType string, ref commodityRef) error {
+	var evs events.List
+	err := evs.Add(commodityEvent, events.Commodity{
+		ID:       ref.ID,
+		Category: ref.Category,
+		StoreID:  ref.StoreID,
+		Supplier: ref.Supplier,
+	})
+	if err != nil {
+		return err
+	}
+	quantity := UnitQuantity
+	if moveType == "sale" {
+		quantity = "-" + UnitQuantity
+	}
+	err = evs.Add(events.StockMoved, events.StockMovement{
+		CateID:    ref.Category,
+		StoreID:   ref.StoreID,
+		Type:      moveType,
+		Quantity:  quantity,
+		Reference: ref.ID,
+	})
+	if err != nil {
+		return err
+	}
+	return evs.Emit(stub)
+}
 
 // GoodsChaincode example Goods Chaincode implementation
 type GoodsChaincode struct {
 }
 
-
 // response message format
-func getRetByte(code int, des string) []byte {
-	var r chaincodeRet
-	r.Code = code
-	r.Des = des
+func getRetByte(code int, des string, details ...errcode.Detail) []byte {
+	r := errcode.NewRet(code, des, details...)
 
 	b, err := json.Marshal(r)
 
@@ -55,10 +90,8 @@ func getRetByte(code int, des string) []byte {
 }
 
 // response message format
-func getRetString(code int, des string) string {
-	var r chaincodeRet
-	r.Code = code
-	r.Des = des
+func getRetString(code int, des string, details ...errcode.Detail) string {
+	r := errcode.NewRet(code, des, details...)
 
 	b, err := json.Marshal(r)
 
@@ -70,206 +103,163 @@ func getRetString(code int, des string) string {
 	return string(b[:])
 }
 
+// 按错误的错误码返回, 保留被调用链码的Details
+func getRetError(des string, err error) string {
+	return getRetString(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...)
+}
+
+// 调用同一channel上的其他chaincode
+// 被调用chaincode的写集与本交易一同提交
+func invoke(stub shim.ChaincodeStubInterface, chaincodeName string, args ...string) pb.Response {
+	ccArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		ccArgs[i] = []byte(arg)
+	}
+	return stub.InvokeChaincode(chaincodeName, ccArgs, "")
+}
+
+// 交易时间(unix毫秒), 所有背书节点一致
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
 func (t *GoodsChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### Goods Chaincode Init ###########")
-	//val, ok, err := cid.GetAttributeValue(stub, "type")
-	//logger.Info(val,ok,err)
-	//res := getRetByte(0, "############"+string(val)+string(err.Error()))
-	//return shim.Success(res)
 	return shim.Success(nil)
 
 }
 
 // Transaction makes payment of X units from A to B
 func (t *GoodsChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	resp := ledger.DispatchOnce(stub, t.dispatch)
+	if resp.Status != shim.OK {
+		// 错误返回带上交易ID
+		resp.Message = errcode.Stamp(resp.Message, stub.GetTxID())
+	}
+	return resp
+}
+
+// 按函数名分发
+func (t *GoodsChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### chaincode Invoke ###########")
 
 	function, args := stub.GetFunctionAndParameters()
 	logger.Info("%s%s", "GoodsChaincode function=", function)
 	logger.Info("%s%s", "GoodsChaincode args=", args)
+	// 权限检查
+	_, err := permissions.Authorize(stub, function)
+	if err != nil {
+		res := getRetError("GoodsChaincode ", err)
+		return shim.Error(res)
+	}
 	if function == "purchase" {
-		// 插入信息
+		// 进货
 		return t.purchase(stub, args)
-	} else if function == "queryByID" {
-		// 根据编号查询
-		return t.queryByID(stub, args)
-	} else if function == "change" {
-		// 更改信息
-		return t.change(stub, args)
-	} else if function == "delete" {
-		// 删除记录
-		return t.delete(stub, args)
+	} else if function == "sell" {
+		// 卖货
+		return t.sell(stub, args)
+	} else if function == "setIdempotencyWindow" {
+		// 设置幂等key的保存时间
+		return ledger.SetIdempotencyWindow(stub, args)
+	} else if function == "purgeIdempotencyKeys" {
+		// 删除已失效的幂等key
+		return ledger.PurgeIdempotencyKeys(stub, args)
 	}
 
-	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", args[0])
-	res := getRetString(1, "Unknown action")
+	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", function)
+	res := getRetString(errcode.Validation, "Unknown action: "+function, errcode.Field("function", "unknown"))
 	return shim.Error(res)
 }
 
-// 进货
-// args: 0 - channel name, 1 - store id, 2- category id, 3- {commodity object}
+// 进货: 登记商品并增加库存, 返回登记的商品记录(含生成的ID)
+// args: 0 - {Commodity Record Object}
 func (a *GoodsChaincode) purchase(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-
-		res := getRetString(1, "Chaincode Invoke insert args!=1")
+		res := getRetString(errcode.Validation, "GoodsChaincode purchase args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
-	newArgs:=[][]byte{[]byte()}
-
-	//根据ID 查找是否ID已存在
-	_, existbl := a.getRecord(stub, record.ID)
-	if existbl {
-		res := getRetString(1, "Chaincode Invoke insert failed : the recordNo has exist ")
-		return shim.Error(res)
-	}
-	//13位时间戳
-	record.CreateTime = strconv.FormatInt(time.Now().Unix(), 10)
-
-	// 保存记录
-	_, bl := a.putRecord(stub, record)
-	if !bl {
-		res := getRetString(1, "Chaincode Invoke insert put record failed")
-		return shim.Error(res)
-	}
-
-	res := getRetByte(0, "invoke insert success")
-	return shim.Success(res)
-}
-
-// 根据ID查找记录
-//  0 - Record_No ;
-func (a *GoodsChaincode) queryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
-		res := getRetString(1, "GoodsChaincode queryByRecordNo args!=1")
-		return shim.Error(res)
-	}
-	// 取得该票据
-	record, bl := a.getRecord(stub, args[0])
-	if !bl {
-		res := getRetString(1, "GoodsChaincode queryByRecordNo get record error")
-		return shim.Error(res)
-	}
-
-	// 取得背书历史: 通过fabric api取得该票据的变更历史
-	resultsIterator, err := stub.GetHistoryForKey(Record_Prefix + args[0])
+	var ref commodityRef
+	err := json.Unmarshal([]byte(args[0]), &ref)
 	if err != nil {
-		res := getRetString(1, "GoodsChaincode queryByRecordNo GetHistoryForKey error")
+		res := getRetString(errcode.Validation, "GoodsChaincode purchase unmarshal failed")
 		return shim.Error(res)
 	}
-	defer resultsIterator.Close()
-
-	var history []HistoryItem
-	var hisRecord Record
-	for resultsIterator.HasNext() {
-		historyData, err := resultsIterator.Next()
-		if err != nil {
-			res := getRetString(1, "GoodsChaincode queryByRecordNo resultsIterator.Next() error")
-			return shim.Error(res)
-		}
-
-		var hisItem HistoryItem
-		hisItem.TxId = historyData.TxId               //copy transaction id over
-		json.Unmarshal(historyData.Value, &hisRecord) //un stringify it aka JSON.parse()
-		if historyData.Value == nil {                 //record has been deleted
-			var emptyRecord Record
-			hisItem.Record = emptyRecord //copy nil marble
-		} else {
-			json.Unmarshal(historyData.Value, &hisRecord) //un stringify it aka JSON.parse()
-			hisItem.Record = hisRecord                    //copy record over
-		}
-		history = append(history, hisItem) //add this tx to the list
-	}
-	// 将背书历史做为票据的一个属性 一同返回
-	record.History = history
-
-	b, err := json.Marshal(record)
+	err = authz.CheckStore(stub, ref.StoreID)
 	if err != nil {
-		res := getRetString(1, "GoodsChaincode Marshal queryByRecordNo recordList error")
+		res := getRetError("GoodsChaincode purchase failed: ", err)
 		return shim.Error(res)
 	}
-	return shim.Success(b)
-}
 
-// 修改记录
-// args: 0 - {Record Object}
-func (a *GoodsChaincode) change(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke change args!=1")
+	// 登记商品
+	resp := invoke(stub, CommodityChaincodeName, "insert", args[0])
+	if resp.Status != shim.OK {
+		res := getRetError("GoodsChaincode purchase insert commodity failed: ", errcode.FromResponse(resp.Message))
 		return shim.Error(res)
 	}
-
-	var record Record
-	err := json.Unmarshal([]byte(args[0]), &record)
+	// 商品ID由CommodityChaincode生成, 以登记的记录为准
+	commodity := resp.Payload
+	err = json.Unmarshal(commodity, &ref)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke change unmarshal failed")
+		res := getRetString(errcode.Internal, "GoodsChaincode purchase unmarshal commodity failed")
 		return shim.Error(res)
 	}
 
-	//根据ID 查找是否ID已存在
-	_, existbl := a.getRecord(stub, record.ID)
-	if !existbl {
-		res := getRetString(1, "Chaincode Invoke change failed : change without existed record")
+	// 增加库存, 以商品ID作为流水的reference
+	resp = invoke(stub, CategoryChaincodeName, "changeStock", ref.Category, ref.StoreID, UnitQuantity, "add", ref.ID)
+	if resp.Status != shim.OK {
+		res := getRetError("GoodsChaincode purchase add stock failed: ", errcode.FromResponse(resp.Message))
 		return shim.Error(res)
 	}
-
-	timestamp, err := stub.GetTxTimestamp()
+	err = emitGoodsEvents(stub, events.CommodityReceived, "receipt", ref)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke change failed :get time stamp failed ")
-		return shim.Error(res)
-	}
-	logger.Error("%s", timestamp)
-	record.CreateTime = strconv.FormatInt(time.Now().Unix(), 10)
-
-	// 保存记录
-	_, bl := a.putRecord(stub, record)
-	if !bl {
-		res := getRetString(1, "Chaincode Invoke change put record failed")
+		res := getRetString(errcode.Internal, "GoodsChaincode purchase set event failed")
 		return shim.Error(res)
 	}
 
-	res := getRetByte(0, "invoke change success")
-	return shim.Success(res)
+	return shim.Success(commodity)
 }
 
-// 加入新记录
-// args: 0 - {Record Object}
-func (a *GoodsChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// 卖货: 商品标记为已售并减少库存
+// args: 0 - Commodity ID
+func (a *GoodsChaincode) sell(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke delete args!=1")
+		res := getRetString(errcode.Validation, "GoodsChaincode sell args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
-	var record Record
-	err := json.Unmarshal([]byte(args[0]), &record)
-	if err != nil {
-		res := getRetString(1, "Chaincode Invoke delete unmarshal failed")
+	// 售出商品, 返回卖出后的记录
+	resp := invoke(stub, CommodityChaincodeName, "sell", args[0])
+	if resp.Status != shim.OK {
+		res := getRetError("GoodsChaincode sell commodity failed: ", errcode.FromResponse(resp.Message))
 		return shim.Error(res)
 	}
 
-	//根据ID 查找是否ID已存在
-	_, existbl := a.getRecord(stub, record.ID)
-	if !existbl {
-		res := getRetString(1, "Chaincode Invoke delete failed : delete without existed record ")
+	// 类别与商店以账本上的记录为准
+	var ref commodityRef
+	err := json.Unmarshal(resp.Payload, &ref)
+	if err != nil {
+		res := getRetString(errcode.Internal, "GoodsChaincode sell unmarshal commodity failed")
 		return shim.Error(res)
 	}
 
-	timestamp, err := stub.GetTxTimestamp()
-	if err != nil {
-		res := getRetString(1, "Chaincode Invoke delete failed :get time stamp failed ")
+	// 减少库存
+	resp = invoke(stub, CategoryChaincodeName, "changeStock", ref.Category, ref.StoreID, UnitQuantity, "reduce", ref.ID)
+	if resp.Status != shim.OK {
+		res := getRetError("GoodsChaincode sell reduce stock failed: ", errcode.FromResponse(resp.Message))
 		return shim.Error(res)
 	}
-	logger.Error("%s", timestamp)
-	record.CreateTime = strconv.FormatInt(time.Now().Unix(), 10)
-
-	// 保存记录
-	err = stub.DelState(Record_Prefix + record.ID)
+	err = emitGoodsEvents(stub, events.CommoditySold, "sale", ref)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke delete delete record failed")
+		res := getRetString(errcode.Internal, "GoodsChaincode sell set event failed")
 		return shim.Error(res)
 	}
 
-	res := getRetByte(0, "invoke delete success")
+	res := getRetByte(0, "invoke sell success")
 	return shim.Success(res)
 }
 
@@ -279,4 +269,3 @@ func main() {
 		logger.Errorf("Error starting Goods chaincode: %s", err)
 	}
 }
-*/
\ No newline at end of file
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/common/errcode"
+	"github.com/common/history"
+	"github.com/common/paging"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 查询索引的变更历史, 包括提交者和删除记录
+//
+//	0 - ID, 1 - Channel, 2 - Chaincode, 3 - page size(可选), 4 - bookmark(可选, 上一页返回的交易ID)
+func (a *IndexChaincode) queryHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 || len(args) > 5 {
+		res := getRetString(errcode.Validation, "IndexChaincode queryHistory args should be 3 to 5", errcode.Args("want 3 to 5"))
+		return shim.Error(res)
+	}
+	IdChannelChaincodeKey, err := stub.CreateCompositeKey(IdChannelChaincodeKeyStruct, args[:3])
+	if err != nil {
+		res := getRetString(errcode.Internal, "IndexChaincode queryHistory: CreateCompositeKey failed")
+		return shim.Error(res)
+	}
+	size, bookmark, err := paging.Args(args[3:])
+	if err != nil {
+		res := getRetString(errcode.Validation, "IndexChaincode queryHistory failed : "+err.Error())
+		return shim.Error(res)
+	}
+	b, err := history.Query(ledgerStub{stub}, IdChannelChaincodeKey, size, bookmark)
+	if err != nil {
+		res := getRetError("IndexChaincode queryHistory error: ", err)
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
@@ -1,5 +1,6 @@
 /*
 全国索引
+记录ID所在的通道与链码; 登记时确认目标链码中存在该记录, 见refs.go
 */
 
 package main
@@ -7,30 +8,36 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/history"
+	"github.com/common/txtime"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
-	"strconv"
-	"time"
 )
 
 var logger = shim.NewLogger("Index")
 
 // 索引
 type Record struct {
-	ID         string `json:ID`         //ID
-	Channel    string `json:Channel`    //
-	Chaincode  string `json:Chaincode`  //
-	CreateTime string `json:CreateTime` //创建时间
+	ID         string `json:"ID"`         //ID
+	Channel    string `json:"Channel"`    //
+	Chaincode  string `json:"Chaincode"`  //
+	CreateTime string `json:"CreateTime"` //创建时间
 }
 
 // search表的映射名
 const IdChannelChaincodeKeyStruct = "ID~Channel~Chaincode"
 
-// chaincode response结构
-type chaincodeRet struct {
-	Code int    // 0 success otherwise 1
-	Des  string //description
+// 权限矩阵
+var permissions = authz.Matrix{
+	"insert":               authz.Managers,
+	"queryByID":            authz.Everyone,
+	"queryHistory":         authz.Everyone,
+	"delete":               authz.Managers,
+	"querySchema":          authz.Everyone,
+	"setIdempotencyWindow": {authz.Admin},
+	"purgeIdempotencyKeys": {authz.Admin},
 }
 
 // 根据票号取出票据
@@ -60,6 +67,11 @@ func (a *IndexChaincode) putRecord(stub shim.ChaincodeStubInterface, key string,
 	if err != nil {
 		return nil, false
 	}
+	// 记录提交者, 见queryHistory
+	err = history.Stamp(stub)
+	if err != nil {
+		return nil, false
+	}
 	return byte, true
 }
 
@@ -68,10 +80,8 @@ type IndexChaincode struct {
 }
 
 // response message format
-func getRetByte(code int, des string) []byte {
-	var r chaincodeRet
-	r.Code = code
-	r.Des = des
+func getRetByte(code int, des string, details ...errcode.Detail) []byte {
+	r := errcode.NewRet(code, des, details...)
 
 	b, err := json.Marshal(r)
 
@@ -83,10 +93,8 @@ func getRetByte(code int, des string) []byte {
 }
 
 // response message format
-func getRetString(code int, des string) string {
-	var r chaincodeRet
-	r.Code = code
-	r.Des = des
+func getRetString(code int, des string, details ...errcode.Detail) string {
+	r := errcode.NewRet(code, des, details...)
 
 	b, err := json.Marshal(r)
 
@@ -98,6 +106,11 @@ func getRetString(code int, des string) string {
 	return string(b[:])
 }
 
+// 按错误的错误码返回, 保留被调用链码的Details
+func getRetError(des string, err error) string {
+	return getRetString(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...)
+}
+
 func (t *IndexChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### GovernmentAffairs Init ###########")
 	return shim.Success(nil)
@@ -106,26 +119,52 @@ func (t *IndexChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 
 // Transaction makes payment of X units from A to B
 func (t *IndexChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	resp := dispatchOnce(stub, t.dispatch)
+	if resp.Status != shim.OK {
+		// 错误返回带上交易ID
+		resp.Message = errcode.Stamp(resp.Message, stub.GetTxID())
+	}
+	return resp
+}
+
+// 按函数名分发
+func (t *IndexChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### chaincode Invoke ###########")
 
 	function, args := stub.GetFunctionAndParameters()
 	logger.Info("%s%s", "IndexChaincode function=", function)
 	logger.Info("%s%s", "IndexChaincode args=", args)
-	val, ok, err := cid.GetAttributeValue(stub, "type")
-	logger.Info(val, ok, err)
+	// 权限检查
+	_, err := permissions.Authorize(stub, function)
+	if err != nil {
+		res := getRetError("IndexChaincode ", err)
+		return shim.Error(res)
+	}
 	if function == "insert" {
 		// 发布提案
 		return t.insert(stub, args)
+	} else if function == "queryHistory" {
+		// 变更历史
+		return t.queryHistory(stub, args)
 	} else if function == "queryByID" {
 		// 根据编号查询
 		return t.queryByID(stub, args)
 	} else if function == "delete" {
 		// 根据编号查询
 		return t.delete(stub, args)
+	} else if function == "querySchema" {
+		// 查询记录的JSON Schema
+		return t.querySchema(stub, args)
+	} else if function == "setIdempotencyWindow" {
+		// 设置幂等key的保存时间
+		return setIdempotencyWindow(stub, args)
+	} else if function == "purgeIdempotencyKeys" {
+		// 删除已失效的幂等key
+		return purgeIdempotencyKeys(stub, args)
 	}
 
-	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", args[0])
-	res := getRetString(1, "Unknown action: "+args[0])
+	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", function)
+	res := getRetString(errcode.Validation, "Unknown action: "+function, errcode.Field("function", "unknown"))
 	return shim.Error(res)
 }
 
@@ -133,53 +172,62 @@ func (t *IndexChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 // args: 0 - {Record Object}
 func (a *IndexChaincode) insert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke insert args!=1")
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
 	var record Record
-	err := json.Unmarshal([]byte(args[0]), &record)
+	err := recordSchema.Decode(args[0], &record)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insert unmarshal failed")
+		res := getRetError("Chaincode Invoke insert failed : ", err)
 		return shim.Error(res)
 	}
 	IdChannelChaincodeKey, err := stub.CreateCompositeKey(IdChannelChaincodeKeyStruct, []string{record.ID, record.Channel, record.Chaincode})
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insert: CreateCompositeKey failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert: CreateCompositeKey failed")
 		return shim.Error(res)
 	}
 
 	//根据ID 查找是否ID已存在
 	_, existbl := a.getRecord(stub, IdChannelChaincodeKey)
 	if existbl {
-		res := getRetString(1, "Chaincode Invoke insert failed : the index has exist ")
+		res := getRetString(errcode.AlreadyExists, "Chaincode Invoke insert failed : the index has exist ")
+		return shim.Error(res)
+	}
+	err = checkTarget(stub, record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
 		return shim.Error(res)
 	}
-	record.CreateTime = strconv.FormatInt(time.Now().Unix(), 10)
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	record.CreateTime = txtime.Format(now)
 
 	// 保存记录
 	_, bl := a.putRecord(stub, IdChannelChaincodeKey, record)
 	if !bl {
-		res := getRetString(1, "Chaincode Invoke insert put record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert put record failed")
 		return shim.Error(res)
 	}
-	val, ok, err := cid.GetAttributeValue(stub, "type")
-	logger.Info(val, ok, err)
-	res := getRetByte(0, "invoke insert success "+string(val))
+	res := getRetByte(0, "invoke insert success")
 	return shim.Success(res)
 }
 
 // 根据ID查找记录
-//  0 - Record_No ;
+//
+//	0 - Record_No ;
 func (a *IndexChaincode) queryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "IndexChaincode queryByRecordNo args!=1")
+		res := getRetString(errcode.Validation, "IndexChaincode queryByID args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 	// 取得所有索引
 	recordsIterator, err := stub.GetStateByPartialCompositeKey(IdChannelChaincodeKeyStruct, []string{args[0]})
 	if err != nil {
-		res := getRetString(1, "IndexChaincode queryByID get record error")
+		res := getRetString(errcode.Internal, "IndexChaincode queryByID get record error")
 		return shim.Error(res)
 	}
 	defer recordsIterator.Close()
@@ -191,7 +239,7 @@ func (a *IndexChaincode) queryByID(stub shim.ChaincodeStubInterface, args []stri
 		// kv.Value为内容
 		err = json.Unmarshal(kv.Value, &record)
 		if err != nil {
-			res := getRetString(1, "WorkflowChaincode queryByID unmarshal failed")
+			res := getRetString(errcode.Internal, "IndexChaincode queryByID unmarshal failed")
 			return shim.Error(res)
 		}
 		// 取得ID与查询ID相同的加入列表
@@ -202,7 +250,7 @@ func (a *IndexChaincode) queryByID(stub shim.ChaincodeStubInterface, args []stri
 
 	b, err := json.Marshal(recordList)
 	if err != nil {
-		res := getRetString(1, "IndexChaincode Marshal queryByRecordNo recordList error")
+		res := getRetString(errcode.Internal, "IndexChaincode Marshal queryByID recordList error")
 		return shim.Error(res)
 	}
 	return shim.Success(b)
@@ -212,33 +260,38 @@ func (a *IndexChaincode) queryByID(stub shim.ChaincodeStubInterface, args []stri
 // args: 0 - {Record Object}
 func (a *IndexChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke insert args!=1")
+		res := getRetString(errcode.Validation, "Chaincode Invoke delete args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
 	var record Record
-	err := json.Unmarshal([]byte(args[0]), &record)
+	err := recordSchema.Decode(args[0], &record)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke delete unmarshal failed")
+		res := getRetError("Chaincode Invoke delete failed : ", err)
 		return shim.Error(res)
 	}
 	IdChannelChaincodeKey, err := stub.CreateCompositeKey(IdChannelChaincodeKeyStruct, []string{record.ID, record.Channel, record.Chaincode})
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke delete: CreateCompositeKey failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete: CreateCompositeKey failed")
 		return shim.Error(res)
 	}
 
 	//根据ID 查找是否ID已存在
 	_, existbl := a.getRecord(stub, IdChannelChaincodeKey)
 	if !existbl {
-		res := getRetString(1, "Chaincode Invoke delete failed : delete an nonexistent record ")
+		res := getRetString(errcode.NotFound, "Chaincode Invoke delete failed : delete an nonexistent record ")
 		return shim.Error(res)
 	}
 
 	// 保存记录
 	err = stub.DelState(IdChannelChaincodeKey)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke delete record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete record failed")
+		return shim.Error(res)
+	}
+	err = history.Stamp(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete stamp history failed")
 		return shim.Error(res)
 	}
 
@@ -246,8 +299,22 @@ func (a *IndexChaincode) delete(stub shim.ChaincodeStubInterface, args []string)
 	return shim.Success(res)
 }
 
+// 交易时间(unix毫秒), 所有背书节点一致
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
 func main() {
-	err := shim.Start(new(IndexChaincode))
+	err := recordSchema.Sync(Record{})
+	if err != nil {
+		logger.Errorf("Error starting Index chaincode: %s", err)
+		return
+	}
+	err = shim.Start(new(IndexChaincode))
 	if err != nil {
 		logger.Errorf("Error starting Index chaincode: %s", err)
 	}
@@ -0,0 +1,104 @@
+/*
+账本适配
+与common/ledger相同: 把shim.ChaincodeStubInterface适配为common各包的账本接口.
+index vendor了fabric, 类型与GOPATH中的不同, 不能使用common/ledger.
+*/
+
+package main
+
+import (
+	"github.com/common/history"
+	"github.com/common/idempotency"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type ledgerStub struct {
+	shim.ChaincodeStubInterface
+}
+
+// 满足history.Ledger
+func (s ledgerStub) History(key string, fn func(m history.Modification) (bool, error)) error {
+	resultsIterator, err := s.GetHistoryForKey(key)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		m, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		more, err := fn(history.Modification{
+			TxID:     m.TxId,
+			Seconds:  m.GetTimestamp().GetSeconds(),
+			Nanos:    m.GetTimestamp().GetNanos(),
+			IsDelete: m.IsDelete,
+			Value:    m.Value,
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// 满足idempotency.Ledger
+func (s ledgerStub) ProposalBytes() ([]byte, error) {
+	sp, err := s.GetSignedProposal()
+	if err != nil || sp == nil {
+		return nil, err
+	}
+	return sp.ProposalBytes, nil
+}
+
+// 交易时间(unix毫秒)
+func (s ledgerStub) Time() (int64, error) {
+	return txTime(s)
+}
+
+// 按key的顺序遍历composite key, fn返回false时停止
+func (s ledgerStub) Scan(objectType string, attributes []string, fn func(key string, value []byte) (bool, error)) error {
+	resultsIterator, err := s.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		more, err := fn(kv.Key, kv.Value)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func response(r idempotency.Response) pb.Response {
+	return pb.Response{Status: r.Status, Message: r.Message, Payload: r.Payload}
+}
+
+// 按幂等key分发, 见idempotency.DispatchOnce
+func dispatchOnce(stub shim.ChaincodeStubInterface, dispatch func(stub shim.ChaincodeStubInterface) pb.Response) pb.Response {
+	return response(idempotency.DispatchOnce(ledgerStub{stub}, func() idempotency.Response {
+		r := dispatch(stub)
+		return idempotency.Response{Status: r.Status, Message: r.Message, Payload: r.Payload}
+	}))
+}
+
+// 设置幂等key的保存时间
+// args: 0 - 秒
+func setIdempotencyWindow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return response(idempotency.SetWindowFunc(ledgerStub{stub}, args))
+}
+
+// 删除已失效的幂等key
+// args: 0 - 最多删除的条数
+func purgeIdempotencyKeys(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return response(idempotency.PurgeFunc(ledgerStub{stub}, args))
+}
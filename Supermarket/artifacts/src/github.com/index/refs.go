@@ -0,0 +1,29 @@
+/*
+引用完整性
+索引必须指向存在的记录: 登记时调用目标通道上目标链码的exists(ID)确认, 见common/refint
+*/
+
+package main
+
+import (
+	"github.com/common/errcode"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// 确认索引指向的记录存在; 跨通道调用只读取, 不写入
+func checkTarget(stub shim.ChaincodeStubInterface, record Record) error {
+	channel := record.Channel
+	if channel == stub.GetChannelID() {
+		channel = ""
+	}
+	resp := stub.InvokeChaincode(record.Chaincode, [][]byte{[]byte("exists"), []byte(record.ID)}, channel)
+	if resp.Status == shim.OK {
+		return nil
+	}
+	err := errcode.FromResponse(resp.Message)
+	reason := "does not exist in chaincode " + record.Chaincode + " on channel " + record.Channel
+	if errcode.Code(err) != errcode.NotFound {
+		reason = "cannot be checked in chaincode " + record.Chaincode + " on channel " + record.Channel + ": " + err.Error()
+	}
+	return errcode.New(errcode.NotFound, "index target "+record.ID+" "+reason, errcode.Field("ID", reason))
+}
@@ -0,0 +1,35 @@
+/*
+索引记录的JSON Schema
+insert与delete按它校验, querySchema发布同一份schema; 修改Record时同时修改这里, 否则链码无法启动.
+*/
+
+package main
+
+import (
+	"github.com/common/errcode"
+	"github.com/common/schema"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var recordSchema = schema.Schema{
+	ID:          "supermarket/index.json",
+	Title:       "Index",
+	Description: "记录ID所在的通道与链码",
+	Properties: []schema.Property{
+		{Name: "ID", Type: schema.String, Required: true, MaxLength: schema.IDMaxLength, Pattern: schema.IDPattern},
+		{Name: "Channel", Type: schema.String, Required: true, MaxLength: 249, Pattern: `^[a-z][a-z0-9.-]*$`, Description: "通道名, 规则同Fabric"},
+		{Name: "Chaincode", Type: schema.String, Required: true, MaxLength: schema.IDMaxLength, Pattern: `^[a-zA-Z0-9]+([-_][a-zA-Z0-9]+)*$`, Description: "链码名, 规则同Fabric"},
+		{Name: "CreateTime", Type: schema.String, ReadOnly: true},
+	},
+}
+
+// 发布索引记录的JSON Schema
+func (a *IndexChaincode) querySchema(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	b, err := recordSchema.JSON()
+	if err != nil {
+		res := getRetString(errcode.Internal, "IndexChaincode Marshal querySchema error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
@@ -0,0 +1,850 @@
+/*
+采购单
+采购单列出供应商、收货店铺、各类别的订购数量与约定进价, 状态流转:
+  draft -> submitted -> approved -> partial -> received -> closed
+  draft / submitted / approved 可以取消(cancelled), submitted 可以退回 draft,
+  partial 可以提前结单(closed), 剩余数量不再收货
+按采购单收货时在同一交易内登记商品(CommodityChaincode)并增加库存(CategoryChaincode);
+收货数量超过订购数量时拒绝, 店长可以指定override强制收货
+采购单号与收货登记的商品ID由交易ID生成, 每个店铺的采购单编号见sequence.go
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/common/authz"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/events"
+	"github.com/common/history"
+	"github.com/common/ledger"
+	"github.com/common/schema"
+	"github.com/common/sequence"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+)
+
+var logger = shim.NewLogger("PurchaseOrder")
+
+// 被调用的chaincode名称
+const CommodityChaincodeName = "commodity"
+const CategoryChaincodeName = "category"
+const SupplierChaincodeName = "supplier"
+
+// 权限矩阵; 写操作还要检查提交者能否操作采购单的店铺
+var permissions = authz.Matrix{
+	"create":               authz.Staff,
+	"change":               authz.Staff,
+	"submit":               authz.Staff,
+	"reject":               authz.Managers,
+	"approve":              authz.Managers,
+	"receive":              authz.Staff,
+	"receive.override":     authz.Managers,
+	"close":                authz.Managers,
+	"cancel":               authz.Managers,
+	"queryByID":            {authz.Admin, authz.Manager, authz.Clerk, authz.Supplier},
+	"queryHistory":         {authz.Admin, authz.Manager, authz.Clerk, authz.Supplier},
+	"queryByStore":         authz.Staff,
+	"queryBySupplier":      {authz.Admin, authz.Manager, authz.Supplier},
+	"queryByNumber":        {authz.Admin, authz.Manager, authz.Clerk, authz.Supplier},
+	"assignNumbers":        authz.Managers,
+	"exists":               authz.Everyone,
+	"setIdempotencyWindow": {authz.Admin},
+	"purgeIdempotencyKeys": {authz.Admin},
+}
+
+// 采购单状态
+const (
+	StatusDraft     = "draft"
+	StatusSubmitted = "submitted"
+	StatusApproved  = "approved"
+	StatusPartial   = "partial" // 部分收货
+	StatusReceived  = "received"
+	StatusClosed    = "closed"
+	StatusCancelled = "cancelled"
+)
+
+// 采购单的一行
+type Line struct {
+	Category    string          `json:"Category"`
+	Quantity    decimal.Decimal `json:"Quantity"`              // 订购数量(件)
+	UnitCost    decimal.Decimal `json:"UnitCost"`              // 约定进价, 精确到分
+	Received    decimal.Decimal `json:"Received"`              // 已收数量
+	Commodities []string        `json:"Commodities,omitempty"` // 收货登记的商品ID
+}
+
+// 状态变更记录
+type Transition struct {
+	From  string `json:"From"`
+	To    string `json:"To"`
+	By    string `json:"By"` // 操作人enrollment ID
+	TxID  string `json:"TxID"`
+	Time  string `json:"Time"`
+	Notes string `json:"Notes"`
+}
+
+// 采购单
+type Order struct {
+	ID          string          `json:"ID"`     // 交易ID
+	Number      string          `json:"Number"` // 店铺内连续的编号, 由assignNumbers分配, 之前为空
+	SupplierID  string          `json:"SupplierID"`
+	StoreID     string          `json:"StoreID"`
+	Lines       []Line          `json:"Lines"`
+	Total       decimal.Decimal `json:"Total"` // 订购金额
+	Status      string          `json:"Status"`
+	Transitions []Transition    `json:"Transitions"`
+	CreateTime  string          `json:"CreateTime"`
+}
+
+// 收货请求: 按类别列出到货的商品, 每条商品记录为一件
+type Receiving struct {
+	Lines    []ReceivingLine `json:"Lines"`
+	Override bool            `json:"Override"` // 超量收货, 需要店长
+	Notes    string          `json:"Notes"`
+}
+
+type ReceivingLine struct {
+	Category    string      `json:"Category"`
+	Commodities []Commodity `json:"Commodities"`
+}
+
+// 登记到CommodityChaincode的商品记录, ID由CommodityChaincode生成, Category/StoreID/Supplier由采购单填写
+type Commodity struct {
+	Name     string `json:"Name"`
+	Category string `json:"Category"`
+	StoreID  string `json:"StoreID"`
+	Supplier string `json:"Supplier"`
+	Place    string `json:"Place"`
+	Date     string `json:"Date"`
+	Lot      string `json:"Lot"`
+}
+
+// 前缀
+const Record_Prefix = "PO_"
+
+// composite keys
+const StoreIndexName = "storeID~poID"
+const SupplierIndexName = "supplierID~poID"
+
+// PurchaseOrderChaincode example PurchaseOrder Chaincode implementation
+type PurchaseOrderChaincode struct {
+}
+
+// 根据key取出采购单
+func (a *PurchaseOrderChaincode) getRecord(stub shim.ChaincodeStubInterface, key string) (Order, bool) {
+	var record Order
+	b, err := stub.GetState(key)
+	if b == nil {
+		return record, false
+	}
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// 保存采购单
+func (a *PurchaseOrderChaincode) putRecord(stub shim.ChaincodeStubInterface, key string, record Order) ([]byte, bool) {
+
+	byte, err := json.Marshal(record)
+	if err != nil {
+		return nil, false
+	}
+
+	err = stub.PutState(key, byte)
+	if err != nil {
+		return nil, false
+	}
+	// 记录提交者, 见queryHistory
+	err = history.Stamp(stub)
+	if err != nil {
+		return nil, false
+	}
+	return byte, true
+}
+
+// response message format
+func getRetByte(code int, des string, details ...errcode.Detail) []byte {
+	r := errcode.NewRet(code, des, details...)
+
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		fmt.Println("marshal Ret failed")
+		return nil
+	}
+	return b
+}
+
+// response message format
+func getRetString(code int, des string, details ...errcode.Detail) string {
+	r := errcode.NewRet(code, des, details...)
+
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		fmt.Println("marshal Ret failed")
+		return ""
+	}
+	logger.Infof("%s", string(b[:]))
+	return string(b[:])
+}
+
+// 按错误的错误码返回, 保留被调用链码的Details
+func getRetError(des string, err error) string {
+	return getRetString(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...)
+}
+
+// 调用同一channel上的其他chaincode
+// 被调用chaincode的写集与本交易一同提交
+func invoke(stub shim.ChaincodeStubInterface, chaincodeName string, args ...string) pb.Response {
+	ccArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		ccArgs[i] = []byte(arg)
+	}
+	return stub.InvokeChaincode(chaincodeName, ccArgs, "")
+}
+
+// 交易时间(unix毫秒), 所有背书节点一致
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
+// 检查订购行: 类别不重复, 数量为正整数, 进价不为负; 返回订购金额
+func checkLines(lines []Line) (decimal.Decimal, error) {
+	total := decimal.Zero
+	if len(lines) == 0 {
+		return total, fmt.Errorf("empty order")
+	}
+	seen := map[string]bool{}
+	for i := range lines {
+		line := &lines[i]
+		if line.Category == "" || seen[line.Category] {
+			return total, fmt.Errorf("missing or duplicated category in line %d", i)
+		}
+		seen[line.Category] = true
+		if line.Quantity.Sign() <= 0 || !line.Quantity.IsInteger() {
+			return total, fmt.Errorf("quantity of %s should be a positive integer", line.Category)
+		}
+		if line.UnitCost.Sign() < 0 {
+			return total, fmt.Errorf("unit cost of %s should not be negative", line.Category)
+		}
+		line.UnitCost = line.UnitCost.RoundCents()
+		line.Received = decimal.Zero
+		line.Commodities = nil
+		amount, err := line.UnitCost.Mul(line.Quantity, decimal.HalfUp)
+		if err == nil {
+			total, err = total.Add(amount.RoundCents())
+		}
+		if err != nil {
+			return total, fmt.Errorf("amount of %s: %v", line.Category, err)
+		}
+	}
+	return total, nil
+}
+
+// 记录状态变更
+func (a *PurchaseOrderChaincode) transition(stub shim.ChaincodeStubInterface, order *Order, to, notes string) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	by := ""
+	if id, err := authz.GetIdentity(stub); err == nil {
+		by = id.ID
+	}
+	order.Transitions = append(order.Transitions, Transition{
+		From:  order.Status,
+		To:    to,
+		By:    by,
+		TxID:  stub.GetTxID(),
+		Time:  txtime.Format(now),
+		Notes: notes,
+	})
+	order.Status = to
+	return nil
+}
+
+func (t *PurchaseOrderChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("########### PurchaseOrder Chaincode Init ###########")
+	return shim.Success(nil)
+
+}
+
+// Transaction makes payment of X units from A to B
+func (t *PurchaseOrderChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	resp := ledger.DispatchOnce(stub, t.dispatch)
+	if resp.Status != shim.OK {
+		// 错误返回带上交易ID
+		resp.Message = errcode.Stamp(resp.Message, stub.GetTxID())
+	}
+	return resp
+}
+
+// 按函数名分发
+func (t *PurchaseOrderChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("########### chaincode Invoke ###########")
+
+	function, args := stub.GetFunctionAndParameters()
+	logger.Info("%s%s", "PurchaseOrderChaincode function=", function)
+	logger.Info("%s%s", "PurchaseOrderChaincode args=", args)
+	// 权限检查
+	_, err := permissions.Authorize(stub, function)
+	if err != nil {
+		res := getRetError("PurchaseOrderChaincode ", err)
+		return shim.Error(res)
+	}
+	if function == "create" {
+		// 新建采购单
+		return t.create(stub, args)
+	} else if function == "change" {
+		// 修改草稿
+		return t.change(stub, args)
+	} else if function == "submit" {
+		// 提交审批
+		return t.move(stub, args, "submit", []string{StatusDraft}, StatusSubmitted)
+	} else if function == "reject" {
+		// 退回草稿
+		return t.move(stub, args, "reject", []string{StatusSubmitted}, StatusDraft)
+	} else if function == "approve" {
+		// 审批
+		return t.approve(stub, args)
+	} else if function == "receive" {
+		// 收货
+		return t.receive(stub, args)
+	} else if function == "close" {
+		// 结单
+		return t.move(stub, args, "close", []string{StatusPartial, StatusReceived}, StatusClosed)
+	} else if function == "cancel" {
+		// 取消
+		return t.move(stub, args, "cancel", []string{StatusDraft, StatusSubmitted, StatusApproved}, StatusCancelled)
+	} else if function == "queryHistory" {
+		// 变更历史
+		return t.queryHistory(stub, args)
+	} else if function == "queryByID" {
+		// 根据编号查询
+		return t.queryByID(stub, args)
+	} else if function == "queryByStore" {
+		// 根据店铺查询
+		return t.queryByIndex(stub, StoreIndexName, args)
+	} else if function == "queryBySupplier" {
+		// 根据供应商查询
+		return t.queryByIndex(stub, SupplierIndexName, args)
+	} else if function == "queryByNumber" {
+		// 根据编号查询
+		return t.queryByNumber(stub, args)
+	} else if function == "assignNumbers" {
+		// 分配编号
+		return t.assignNumbers(stub, args)
+	} else if function == "exists" {
+		// 记录是否存在
+		return t.exists(stub, args)
+	} else if function == "setIdempotencyWindow" {
+		// 设置幂等key的保存时间
+		return ledger.SetIdempotencyWindow(stub, args)
+	} else if function == "purgeIdempotencyKeys" {
+		// 删除已失效的幂等key
+		return ledger.PurgeIdempotencyKeys(stub, args)
+	}
+
+	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", function)
+	res := getRetString(errcode.Validation, "Unknown action: "+function, errcode.Field("function", "unknown"))
+	return shim.Error(res)
+}
+
+// 新建采购单草稿, 采购单号为交易ID
+// args: 0 - {Order Object}, 只使用SupplierID, StoreID, Lines
+func (a *PurchaseOrderChaincode) create(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke create args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	var input Order
+	err := schema.Strict(args[0], &input)
+	if err != nil {
+		res := getRetError("Chaincode Invoke create failed : ", err)
+		return shim.Error(res)
+	}
+	if input.SupplierID == "" || input.StoreID == "" {
+		res := getRetString(errcode.Validation, "Chaincode Invoke create failed : SupplierID and StoreID are required")
+		return shim.Error(res)
+	}
+	err = authz.CheckStore(stub, input.StoreID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke create failed : ", err)
+		return shim.Error(res)
+	}
+	total, err := checkLines(input.Lines)
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke create failed : "+err.Error())
+		return shim.Error(res)
+	}
+
+	order := Order{
+		ID:         stub.GetTxID(),
+		SupplierID: input.SupplierID,
+		StoreID:    input.StoreID,
+		Lines:      input.Lines,
+		Total:      total,
+	}
+	_, existbl := a.getRecord(stub, Record_Prefix+order.ID)
+	if existbl {
+		res := getRetString(errcode.AlreadyExists, "Chaincode Invoke create failed : the order has exist ")
+		return shim.Error(res)
+	}
+	err = a.transition(stub, &order, StatusDraft, "")
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke create failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	order.CreateTime = order.Transitions[0].Time
+
+	_, bl := a.putRecord(stub, Record_Prefix+order.ID, order)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke create put record failed")
+		return shim.Error(res)
+	}
+	for _, index := range [][]string{{StoreIndexName, order.StoreID}, {SupplierIndexName, order.SupplierID}} {
+		key, err := stub.CreateCompositeKey(index[0], []string{index[1], order.ID})
+		if err == nil {
+			err = stub.PutState(key, []byte{0x00})
+		}
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke create put index failed")
+			return shim.Error(res)
+		}
+	}
+	// 编号由assignNumbers分配, 本交易不读写计数器
+	now, err := txTime(stub)
+	if err == nil {
+		err = ledger.EnqueueNumber(stub, sequence.PurchaseOrder, order.StoreID, now, order.ID)
+	}
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke create put pending number failed")
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(order)
+	if err != nil {
+		res := getRetString(errcode.Internal, "PurchaseOrderChaincode Marshal create order error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 取出采购单并检查提交者能否操作该店铺
+func (a *PurchaseOrderChaincode) loadForUpdate(stub shim.ChaincodeStubInterface, id, fn string) (Order, pb.Response, bool) {
+	order, existbl := a.getRecord(stub, Record_Prefix+id)
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke "+fn+" failed : the order does not exist")
+		return order, shim.Error(res), false
+	}
+	err := authz.CheckStore(stub, order.StoreID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke "+fn+" failed : ", err)
+		return order, shim.Error(res), false
+	}
+	return order, pb.Response{}, true
+}
+
+// 状态是否在列表中
+func statusIn(status string, statuses []string) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// 修改草稿中的订购行
+// args: 0 - ID, 1 - [Line, ...]
+func (a *PurchaseOrderChaincode) change(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke change args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	order, resp, ok := a.loadForUpdate(stub, args[0], "change")
+	if !ok {
+		return resp
+	}
+	if order.Status != StatusDraft {
+		res := getRetString(errcode.Conflict, "Chaincode Invoke change failed : only draft orders can be changed, status is "+order.Status)
+		return shim.Error(res)
+	}
+
+	var lines []Line
+	err := schema.Strict(args[1], &lines)
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
+		return shim.Error(res)
+	}
+	total, err := checkLines(lines)
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke change failed : "+err.Error())
+		return shim.Error(res)
+	}
+	order.Lines = lines
+	order.Total = total
+
+	_, bl := a.putRecord(stub, Record_Prefix+order.ID, order)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke change put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke change success")
+	return shim.Success(res)
+}
+
+// 不涉及其他数据的状态变更: submit, reject, close, cancel
+// args: 0 - ID, 1 - notes(可选)
+func (a *PurchaseOrderChaincode) move(stub shim.ChaincodeStubInterface, args []string, fn string, from []string, to string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke "+fn+" args should be 1 or 2", errcode.Args("want 1 or 2"))
+		return shim.Error(res)
+	}
+	var notes string
+	if len(args) == 2 {
+		notes = args[1]
+	}
+	order, resp, ok := a.loadForUpdate(stub, args[0], fn)
+	if !ok {
+		return resp
+	}
+	if !statusIn(order.Status, from) {
+		res := getRetString(errcode.Conflict, "Chaincode Invoke "+fn+" failed : cannot "+fn+" an order in status "+order.Status)
+		return shim.Error(res)
+	}
+
+	err := a.transition(stub, &order, to, notes)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke "+fn+" failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	_, bl := a.putRecord(stub, Record_Prefix+order.ID, order)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke "+fn+" put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke "+fn+" success")
+	return shim.Success(res)
+}
+
+// 审批: 确认供应商可以供应每个类别
+// args: 0 - ID, 1 - notes(可选)
+func (a *PurchaseOrderChaincode) approve(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke approve args should be 1 or 2", errcode.Args("want 1 or 2"))
+		return shim.Error(res)
+	}
+	order, resp, ok := a.loadForUpdate(stub, args[0], "approve")
+	if !ok {
+		return resp
+	}
+	if order.Status != StatusSubmitted {
+		res := getRetString(errcode.Conflict, "Chaincode Invoke approve failed : cannot approve an order in status "+order.Status)
+		return shim.Error(res)
+	}
+	for _, line := range order.Lines {
+		resp := invoke(stub, SupplierChaincodeName, "check", order.SupplierID, line.Category)
+		if resp.Status != shim.OK {
+			res := getRetError("Chaincode Invoke approve failed : ", errcode.FromResponse(resp.Message))
+			return shim.Error(res)
+		}
+	}
+	return a.move(stub, args, "approve", []string{StatusSubmitted}, StatusApproved)
+}
+
+// 收货: 登记商品, 按类别增加库存(流水reference为采购单号), 更新已收数量与状态
+// args: 0 - ID, 1 - {Receiving Object}
+func (a *PurchaseOrderChaincode) receive(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke receive args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	var receiving Receiving
+	err := schema.Strict(args[1], &receiving)
+	if err != nil {
+		res := getRetError("Chaincode Invoke receive failed : ", err)
+		return shim.Error(res)
+	}
+	if len(receiving.Lines) == 0 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke receive failed : nothing to receive")
+		return shim.Error(res)
+	}
+	if receiving.Override {
+		_, err = permissions.Authorize(stub, "receive.override")
+		if err != nil {
+			res := getRetError("Chaincode Invoke receive failed : ", err)
+			return shim.Error(res)
+		}
+	}
+
+	order, resp, ok := a.loadForUpdate(stub, args[0], "receive")
+	if !ok {
+		return resp
+	}
+	if order.Status != StatusApproved && order.Status != StatusPartial {
+		res := getRetString(errcode.Conflict, "Chaincode Invoke receive failed : cannot receive an order in status "+order.Status)
+		return shim.Error(res)
+	}
+
+	lineIndex := map[string]int{}
+	for i, line := range order.Lines {
+		lineIndex[line.Category] = i
+	}
+	var evs events.List
+	seen := map[string]bool{}
+	// 本交易登记的第几件商品, 商品ID由交易ID与它生成
+	n := 0
+	for _, rl := range receiving.Lines {
+		i, ok := lineIndex[rl.Category]
+		if !ok {
+			res := getRetString(errcode.Validation, "Chaincode Invoke receive failed : category "+rl.Category+" is not on the order")
+			return shim.Error(res)
+		}
+		// 每个类别一条库存流水
+		if seen[rl.Category] {
+			res := getRetString(errcode.Validation, "Chaincode Invoke receive failed : duplicated category "+rl.Category)
+			return shim.Error(res)
+		}
+		seen[rl.Category] = true
+		if len(rl.Commodities) == 0 {
+			continue
+		}
+		line := &order.Lines[i]
+		quantity := decimal.FromInt(int64(len(rl.Commodities)))
+		received, err := line.Received.Add(quantity)
+		if err != nil {
+			res := getRetString(errcode.Validation, "Chaincode Invoke receive failed : "+err.Error())
+			return shim.Error(res)
+		}
+		if received.Cmp(line.Quantity) > 0 && !receiving.Override {
+			res := getRetString(errcode.BusinessRule, "Chaincode Invoke receive failed : receiving "+quantity.String()+" of "+rl.Category+
+				" exceeds the ordered "+line.Quantity.String()+" (already received "+line.Received.String()+")")
+			return shim.Error(res)
+		}
+
+		// 登记商品
+		for _, c := range rl.Commodities {
+			c.Category = line.Category
+			c.StoreID = order.StoreID
+			c.Supplier = order.SupplierID
+			b, err := json.Marshal(c)
+			if err != nil {
+				res := getRetString(errcode.Internal, "Chaincode Invoke receive marshal commodity failed")
+				return shim.Error(res)
+			}
+			resp := invoke(stub, CommodityChaincodeName, "insert", string(b), strconv.Itoa(n))
+			if resp.Status != shim.OK {
+				res := getRetError("Chaincode Invoke receive insert commodity "+strconv.Itoa(n)+" failed: ", errcode.FromResponse(resp.Message))
+				return shim.Error(res)
+			}
+			n++
+			var inserted struct {
+				ID string `json:"ID"`
+			}
+			err = json.Unmarshal(resp.Payload, &inserted)
+			if err != nil {
+				res := getRetString(errcode.Internal, "Chaincode Invoke receive unmarshal commodity failed")
+				return shim.Error(res)
+			}
+			line.Commodities = append(line.Commodities, inserted.ID)
+			err = evs.Add(events.CommodityReceived, events.Commodity{
+				ID:        inserted.ID,
+				Category:  c.Category,
+				StoreID:   c.StoreID,
+				Supplier:  c.Supplier,
+				Reference: order.ID,
+			})
+			if err != nil {
+				res := getRetString(errcode.Internal, "Chaincode Invoke receive add event failed")
+				return shim.Error(res)
+			}
+		}
+
+		// 增加库存
+		resp := invoke(stub, CategoryChaincodeName, "moveStock", line.Category, order.StoreID, "receipt", quantity.String(), order.ID)
+		if resp.Status != shim.OK {
+			res := getRetError("Chaincode Invoke receive add stock failed: ", errcode.FromResponse(resp.Message))
+			return shim.Error(res)
+		}
+		err = evs.Add(events.StockMoved, events.StockMovement{
+			CateID:    line.Category,
+			StoreID:   order.StoreID,
+			Type:      "receipt",
+			Quantity:  quantity.String(),
+			Reference: order.ID,
+		})
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke receive add event failed")
+			return shim.Error(res)
+		}
+		line.Received = received
+	}
+
+	to := StatusReceived
+	for _, line := range order.Lines {
+		if line.Received.Cmp(line.Quantity) < 0 {
+			to = StatusPartial
+			break
+		}
+	}
+	notes := receiving.Notes
+	if receiving.Override {
+		notes = "override: " + notes
+	}
+	err = a.transition(stub, &order, to, notes)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke receive failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	_, bl := a.putRecord(stub, Record_Prefix+order.ID, order)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke receive put record failed")
+		return shim.Error(res)
+	}
+	// 被调用的chaincode发出的事件不随交易提交, 由本chaincode发出
+	err = evs.Emit(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke receive set event failed")
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(order)
+	if err != nil {
+		res := getRetString(errcode.Internal, "PurchaseOrderChaincode Marshal receive order error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 根据编号查找采购单
+//
+//	0 - Order ID
+func (a *PurchaseOrderChaincode) queryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "PurchaseOrderChaincode queryByID args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	order, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "PurchaseOrderChaincode queryByID get order error")
+		return shim.Error(res)
+	}
+
+	id, err := authz.GetIdentity(stub)
+	if err == nil {
+		if id.Role == authz.Supplier {
+			err = authz.CheckSupplier(stub, order.SupplierID)
+		} else {
+			err = authz.CheckStore(stub, order.StoreID)
+		}
+	}
+	if err != nil {
+		res := getRetError("PurchaseOrderChaincode queryByID: ", err)
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(order)
+	if err != nil {
+		res := getRetString(errcode.Internal, "PurchaseOrderChaincode Marshal queryByID order error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 根据店铺或供应商查找采购单
+//
+//	0 - Store ID or Supplier ID, 1 - status(可选)
+func (a *PurchaseOrderChaincode) queryByIndex(stub shim.ChaincodeStubInterface, indexName string, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		res := getRetString(errcode.Validation, "PurchaseOrderChaincode query args should be 1 or 2", errcode.Args("want 1 or 2"))
+		return shim.Error(res)
+	}
+	var err error
+	if indexName == StoreIndexName {
+		err = authz.CheckStore(stub, args[0])
+	} else {
+		err = authz.CheckSupplier(stub, args[0])
+	}
+	if err != nil {
+		res := getRetError("PurchaseOrderChaincode query: ", err)
+		return shim.Error(res)
+	}
+
+	indexIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{args[0]})
+	if err != nil {
+		res := getRetString(errcode.Internal, "PurchaseOrderChaincode query get index error")
+		return shim.Error(res)
+	}
+	defer indexIterator.Close()
+
+	var orderList = []Order{}
+	for indexIterator.HasNext() {
+		kv, err := indexIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "PurchaseOrderChaincode query iterator error")
+			return shim.Error(res)
+		}
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attrs) != 2 {
+			res := getRetString(errcode.Internal, "PurchaseOrderChaincode query split index key error")
+			return shim.Error(res)
+		}
+		order, bl := a.getRecord(stub, Record_Prefix+attrs[1])
+		if !bl {
+			res := getRetString(errcode.Internal, "PurchaseOrderChaincode query get order error")
+			return shim.Error(res)
+		}
+		if len(args) == 2 && order.Status != args[1] {
+			continue
+		}
+		orderList = append(orderList, order)
+	}
+
+	b, err := json.Marshal(orderList)
+	if err != nil {
+		res := getRetString(errcode.Internal, "PurchaseOrderChaincode Marshal query orderList error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 记录是否存在, 供其他链码(如IndexChaincode)确认引用; 不存在时返回404
+// args: 0 - ID
+func (a *PurchaseOrderChaincode) exists(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "PurchaseOrderChaincode exists args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	b, err := stub.GetState(Record_Prefix + args[0])
+	if err != nil {
+		res := getRetString(errcode.Internal, "PurchaseOrderChaincode exists get record error")
+		return shim.Error(res)
+	}
+	if b == nil {
+		res := getRetString(errcode.NotFound, "PurchaseOrderChaincode exists: no purchase order "+args[0])
+		return shim.Error(res)
+	}
+	return shim.Success(getRetByte(0, args[0]+" exists"))
+}
+
+func main() {
+	err := shim.Start(new(PurchaseOrderChaincode))
+	if err != nil {
+		logger.Errorf("Error starting PurchaseOrder chaincode: %s", err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+采购单编号
+采购单号为交易ID; 每个店铺的采购单另有连续的编号(Number), 由assignNumbers在采购单提交后分配, 见common/sequence
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/ledger"
+	"github.com/common/sequence"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 为店铺的采购单编号
+// args: 0 - kind(purchase-order), 1 - Store ID, 2 - 最多编号的数量(可选)
+func (a *PurchaseOrderChaincode) assignNumbers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke assignNumbers args should be 2 or 3", errcode.Args("want 2 or 3"))
+		return shim.Error(res)
+	}
+	if args[0] != sequence.PurchaseOrder {
+		res := getRetString(errcode.Validation, "Chaincode Invoke assignNumbers failed : kind should be "+sequence.PurchaseOrder, errcode.Field("kind", "should be "+sequence.PurchaseOrder))
+		return shim.Error(res)
+	}
+	limit := sequence.DefaultBatch
+	var err error
+	if len(args) == 3 {
+		limit, err = sequence.Batch(args[2])
+		if err != nil {
+			res := getRetString(errcode.Validation, "Chaincode Invoke assignNumbers failed : "+err.Error())
+			return shim.Error(res)
+		}
+	}
+	err = authz.CheckStore(stub, args[1])
+	if err != nil {
+		res := getRetError("Chaincode Invoke assignNumbers failed : ", err)
+		return shim.Error(res)
+	}
+
+	result, err := ledger.AssignNumbers(stub, args[0], args[1], limit, func(docID, number string) error {
+		order, existbl := a.getRecord(stub, Record_Prefix+docID)
+		if !existbl {
+			return errcode.New(errcode.Internal, "the order "+docID+" does not exist")
+		}
+		order.Number = number
+		_, bl := a.putRecord(stub, Record_Prefix+docID, order)
+		if !bl {
+			return errcode.New(errcode.Internal, "put order "+docID+" failed")
+		}
+		return nil
+	})
+	if err != nil {
+		res := getRetError("Chaincode Invoke assignNumbers failed : ", err)
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		res := getRetString(errcode.Internal, "PurchaseOrderChaincode Marshal assignNumbers result error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 根据编号查找采购单
+//
+//	0 - Number
+func (a *PurchaseOrderChaincode) queryByNumber(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "PurchaseOrderChaincode queryByNumber args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	docID, err := ledger.NumberedDocument(stub, args[0])
+	if err != nil {
+		res := getRetString(errcode.Internal, "PurchaseOrderChaincode queryByNumber get index error")
+		return shim.Error(res)
+	}
+	if docID == "" {
+		res := getRetString(errcode.NotFound, "PurchaseOrderChaincode queryByNumber failed : no order numbered "+args[0])
+		return shim.Error(res)
+	}
+	return a.queryByID(stub, []string{docID})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/common/errcode"
+	"github.com/common/ledger"
+	"github.com/common/paging"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 查询销售单的变更历史, 包括提交者; 权限与queryByID相同
+//
+//	0 - Receipt No, 1 - page size(可选), 2 - bookmark(可选, 上一页返回的交易ID)
+func (a *SalesChaincode) queryHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		res := getRetString(errcode.Validation, "SalesChaincode queryHistory args should be 1 to 3", errcode.Args("want 1 to 3"))
+		return shim.Error(res)
+	}
+	resp := a.queryByID(stub, args[:1])
+	if resp.Status != shim.OK {
+		return resp
+	}
+	size, bookmark, err := paging.Args(args[1:])
+	if err != nil {
+		res := getRetString(errcode.Validation, "SalesChaincode queryHistory failed : "+err.Error())
+		return shim.Error(res)
+	}
+	b, err := ledger.KeyHistory(stub, Record_Prefix+args[0], size, bookmark)
+	if err != nil {
+		res := getRetError("SalesChaincode queryHistory error: ", err)
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
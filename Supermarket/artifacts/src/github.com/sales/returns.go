@@ -0,0 +1,402 @@
+/*
+退货
+顾客凭小票退货: 逐件登记的商品改为returned(CommodityChaincode.setState), 按类别计量的商品按数量退回,
+库存按类别增加(流水类型return, reference为退货单号), 按小票实付金额与原价的比例退款, 并扣减顾客累计消费; 优惠券不退回.
+每张小票已退的数量与金额记录在Returned_<小票号>, 合计不能超过小票上的数量与实付金额;
+按类别计量退回的数量不能超过小票行中按类别计量的部分, 逐件登记的商品只能逐件退. 全部退完时退款为剩余的实付金额, 逐行舍入的误差不会留下.
+退货单号为交易ID, 店铺内连续的编号见sequence.go
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/events"
+	"github.com/common/history"
+	"github.com/common/ledger"
+	"github.com/common/schema"
+	"github.com/common/sequence"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"sort"
+)
+
+// 退货请求
+type ReturnRequest struct {
+	ReceiptNo   string         `json:"ReceiptNo"`
+	Commodities []string       `json:"Commodities"` // 逐件登记的商品ID
+	Lines       []CategoryLine `json:"Lines"`       // 按类别计量的商品
+	Reason      string         `json:"Reason"`
+}
+
+// 退货单
+type Return struct {
+	ID         string          `json:"ID"`     // 交易ID
+	Number     string          `json:"Number"` // 店铺内连续的编号, 由assignNumbers分配, 之前为空
+	ReceiptNo  string          `json:"ReceiptNo"`
+	StoreID    string          `json:"StoreID"`
+	CustomerID string          `json:"CustomerID"`
+	Lines      []ReceiptLine   `json:"Lines"` // Amount为该行退款金额
+	Total      decimal.Decimal `json:"Total"` // 退款金额
+	Reason     string          `json:"Reason"`
+	TxID       string          `json:"TxID"`
+	CreateTime string          `json:"CreateTime"`
+}
+
+// 一张小票已退的数量与金额
+type Returned struct {
+	ReceiptNo  string                     `json:"ReceiptNo"`
+	Quantities map[string]decimal.Decimal `json:"Quantities"` // 按类别
+	Weighed    map[string]decimal.Decimal `json:"Weighed"`    // 按类别计量退回的部分
+	Refunded   decimal.Decimal            `json:"Refunded"`
+	Returns    []string                   `json:"Returns"` // 退货单号
+}
+
+// 前缀
+const Return_Prefix = "Return_"
+const Returned_Prefix = "Returned_"
+
+// 根据退货单号取出退货单
+func (a *SalesChaincode) getReturn(stub shim.ChaincodeStubInterface, id string) (Return, bool) {
+	var ret Return
+	b, err := stub.GetState(Return_Prefix + id)
+	if b == nil {
+		return ret, false
+	}
+	err = json.Unmarshal(b, &ret)
+	if err != nil {
+		return ret, false
+	}
+	return ret, true
+}
+
+// 保存退货单
+func (a *SalesChaincode) putReturn(stub shim.ChaincodeStubInterface, ret Return) ([]byte, bool) {
+	b, err := json.Marshal(ret)
+	if err != nil {
+		return nil, false
+	}
+	err = stub.PutState(Return_Prefix+ret.ID, b)
+	if err != nil {
+		return nil, false
+	}
+	// 记录提交者, 见queryHistory
+	err = history.Stamp(stub)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// 小票已退的数量与金额, 没有退过时为空
+func (a *SalesChaincode) getReturned(stub shim.ChaincodeStubInterface, receiptNo string) (Returned, error) {
+	returned := Returned{ReceiptNo: receiptNo, Quantities: map[string]decimal.Decimal{}, Weighed: map[string]decimal.Decimal{}, Returns: []string{}}
+	b, err := stub.GetState(Returned_Prefix + receiptNo)
+	if err != nil || b == nil {
+		return returned, err
+	}
+	err = json.Unmarshal(b, &returned)
+	if returned.Quantities == nil {
+		returned.Quantities = map[string]decimal.Decimal{}
+	}
+	if returned.Weighed == nil {
+		returned.Weighed = map[string]decimal.Decimal{}
+	}
+	return returned, err
+}
+
+// 退货
+// args: 0 - {ReturnRequest Object}
+func (a *SalesChaincode) returnGoods(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "SalesChaincode returnGoods args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	var request ReturnRequest
+	err := schema.Strict(args[0], &request)
+	if err != nil {
+		res := getRetError("SalesChaincode returnGoods failed : ", err)
+		return shim.Error(res)
+	}
+	if request.ReceiptNo == "" {
+		res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : ReceiptNo is required", errcode.Field("ReceiptNo", "is required"))
+		return shim.Error(res)
+	}
+	if len(request.Commodities) == 0 && len(request.Lines) == 0 {
+		res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : nothing to return")
+		return shim.Error(res)
+	}
+
+	receipt, existbl := a.getRecord(stub, Record_Prefix+request.ReceiptNo)
+	if !existbl {
+		res := getRetString(errcode.NotFound, "SalesChaincode returnGoods failed : the receipt does not exist")
+		return shim.Error(res)
+	}
+	err = authz.CheckStore(stub, receipt.StoreID)
+	if err != nil {
+		res := getRetError("SalesChaincode returnGoods failed : ", err)
+		return shim.Error(res)
+	}
+	returned, err := a.getReturned(stub, receipt.ReceiptNo)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode returnGoods get returned quantities failed")
+		return shim.Error(res)
+	}
+
+	returnID := stub.GetTxID()
+	if _, ok := a.getReturn(stub, returnID); ok {
+		res := getRetString(errcode.AlreadyExists, "SalesChaincode returnGoods failed : the return has exist ")
+		return shim.Error(res)
+	}
+
+	// 小票行与商品所在的行
+	sold := map[string]ReceiptLine{}
+	lineOfCommodity := map[string]string{}
+	for _, line := range receipt.Lines {
+		sold[line.Category] = line
+		for _, id := range line.Commodities {
+			lineOfCommodity[id] = line.Category
+		}
+	}
+	lines := map[string]*ReceiptLine{}
+	lineOf := func(category string) *ReceiptLine {
+		line, ok := lines[category]
+		if !ok {
+			line = &ReceiptLine{Category: category, Name: sold[category].Name, Commodities: []string{}, UnitPrice: sold[category].UnitPrice}
+			lines[category] = line
+		}
+		return line
+	}
+
+	// 逐件商品: 改为returned, 已退过的商品CommodityChaincode会拒绝
+	seen := map[string]bool{}
+	for _, commID := range request.Commodities {
+		if seen[commID] {
+			res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : duplicate commodity "+commID)
+			return shim.Error(res)
+		}
+		seen[commID] = true
+		category, ok := lineOfCommodity[commID]
+		if !ok {
+			res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : commodity "+commID+" is not on receipt "+receipt.ReceiptNo)
+			return shim.Error(res)
+		}
+		resp := invoke(stub, CommodityChaincodeName, "setState", commID, "returned", "return "+returnID)
+		if resp.Status != shim.OK {
+			res := getRetError("SalesChaincode returnGoods return commodity "+commID+" failed: ", errcode.FromResponse(resp.Message))
+			return shim.Error(res)
+		}
+		line := lineOf(category)
+		line.Commodities = append(line.Commodities, commID)
+		line.Quantity, err = line.Quantity.Add(decimal.FromInt(1))
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : "+err.Error())
+			return shim.Error(res)
+		}
+	}
+
+	// 按类别计量: 不能超过小票行中除逐件商品以外的数量
+	for _, l := range request.Lines {
+		if l.Category == "" || l.Quantity.Sign() <= 0 {
+			res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : category line needs Category and a positive Quantity")
+			return shim.Error(res)
+		}
+		if _, ok := sold[l.Category]; !ok {
+			res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : category "+l.Category+" is not on receipt "+receipt.ReceiptNo)
+			return shim.Error(res)
+		}
+		weighed, err := sold[l.Category].Quantity.Sub(decimal.FromInt(int64(len(sold[l.Category].Commodities))))
+		var total decimal.Decimal
+		if err == nil {
+			total, err = returned.Weighed[l.Category].Add(l.Quantity)
+		}
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : "+err.Error())
+			return shim.Error(res)
+		}
+		if total.Cmp(weighed) > 0 {
+			res := getRetString(errcode.BusinessRule, "SalesChaincode returnGoods failed : returning "+l.Quantity.String()+" of "+l.Category+
+				" by quantity exceeds the "+weighed.String()+" sold by quantity (already returned "+returned.Weighed[l.Category].String()+")")
+			return shim.Error(res)
+		}
+		returned.Weighed[l.Category] = total
+		line := lineOf(l.Category)
+		line.Quantity, err = line.Quantity.Add(l.Quantity)
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : "+err.Error())
+			return shim.Error(res)
+		}
+	}
+
+	categories := make([]string, 0, len(lines))
+	for category := range lines {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	ret := Return{
+		ID:         returnID,
+		ReceiptNo:  receipt.ReceiptNo,
+		StoreID:    receipt.StoreID,
+		CustomerID: receipt.CustomerID,
+		Lines:      []ReceiptLine{},
+		Reason:     request.Reason,
+		TxID:       stub.GetTxID(),
+	}
+	var evs events.List
+	for _, category := range categories {
+		line := lines[category]
+		total, err := returned.Quantities[category].Add(line.Quantity)
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : "+err.Error())
+			return shim.Error(res)
+		}
+		if total.Cmp(sold[category].Quantity) > 0 {
+			res := getRetString(errcode.BusinessRule, "SalesChaincode returnGoods failed : returning "+line.Quantity.String()+" of "+category+
+				" exceeds the sold "+sold[category].Quantity.String()+" (already returned "+returned.Quantities[category].String()+")")
+			return shim.Error(res)
+		}
+		returned.Quantities[category] = total
+
+		// 按原价计算, 再按实付比例退款
+		amount, err := line.UnitPrice.Mul(line.Quantity, decimal.HalfUp)
+		if err == nil {
+			line.Amount, err = amount.RoundCents().Prorate(receipt.Total, receipt.Subtotal, decimal.HalfUp)
+		}
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : "+err.Error())
+			return shim.Error(res)
+		}
+		line.Amount = line.Amount.RoundCents()
+
+		// 增加库存, 以退货单号作为流水的reference
+		resp := invoke(stub, CategoryChaincodeName, "moveStock", category, receipt.StoreID, "return", line.Quantity.String(), returnID)
+		if resp.Status != shim.OK {
+			res := getRetError("SalesChaincode returnGoods add stock of "+category+" failed: ", errcode.FromResponse(resp.Message))
+			return shim.Error(res)
+		}
+		err = evs.Add(events.StockMoved, events.StockMovement{
+			CateID:    category,
+			StoreID:   receipt.StoreID,
+			Type:      "return",
+			Quantity:  line.Quantity.String(),
+			Reference: returnID,
+		})
+		if err != nil {
+			res := getRetString(errcode.Internal, "SalesChaincode returnGoods add event failed")
+			return shim.Error(res)
+		}
+
+		ret.Lines = append(ret.Lines, *line)
+		ret.Total, err = ret.Total.Add(line.Amount)
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode returnGoods failed : "+err.Error())
+			return shim.Error(res)
+		}
+	}
+	// 逐行舍入后合计可能差几分: 累计退款不超过实付金额, 全部退完时退回剩余的金额
+	left, err := receipt.Total.Sub(returned.Refunded)
+	if err == nil && (ret.Total.Cmp(left) > 0 || allReturned(receipt, returned)) {
+		ret.Total = left
+	}
+	if err == nil {
+		returned.Refunded, err = returned.Refunded.Add(ret.Total)
+	}
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode returnGoods failed : "+err.Error())
+		return shim.Error(res)
+	}
+	returned.Returns = append(returned.Returns, returnID)
+
+	// 扣减顾客累计消费
+	if receipt.CustomerID != "" && ret.Total.Sign() > 0 {
+		resp := invoke(stub, UsersChaincodeName, "refund", receipt.CustomerID, ret.Total.String())
+		if resp.Status != shim.OK {
+			res := getRetError("SalesChaincode returnGoods reduce customer cost failed: ", errcode.FromResponse(resp.Message))
+			return shim.Error(res)
+		}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode returnGoods failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	ret.CreateTime = txtime.Format(now)
+
+	b, bl := a.putReturn(stub, ret)
+	if !bl {
+		res := getRetString(errcode.Internal, "SalesChaincode returnGoods put return failed")
+		return shim.Error(res)
+	}
+	rb, err := json.Marshal(returned)
+	if err == nil {
+		err = stub.PutState(Returned_Prefix+receipt.ReceiptNo, rb)
+	}
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode returnGoods put returned quantities failed")
+		return shim.Error(res)
+	}
+	// 编号由assignNumbers分配, 本交易不读写计数器
+	err = ledger.EnqueueNumber(stub, sequence.Return, ret.StoreID, now, returnID)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode returnGoods put pending number failed")
+		return shim.Error(res)
+	}
+
+	err = evs.Emit(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode returnGoods set event failed")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 小票上的商品是否已全部退回
+func allReturned(receipt Receipt, returned Returned) bool {
+	for _, line := range receipt.Lines {
+		if returned.Quantities[line.Category].Cmp(line.Quantity) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 根据退货单号查找退货单
+//
+//	0 - Return ID
+func (a *SalesChaincode) queryReturn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "SalesChaincode queryReturn args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	ret, bl := a.getReturn(stub, args[0])
+	if !bl {
+		res := getRetString(errcode.NotFound, "SalesChaincode queryReturn get return error")
+		return shim.Error(res)
+	}
+
+	id, err := authz.GetIdentity(stub)
+	if err == nil {
+		if id.Role == authz.Customer {
+			err = authz.CheckSelf(stub, ret.CustomerID)
+		} else {
+			err = authz.CheckStore(stub, ret.StoreID)
+		}
+	}
+	if err != nil {
+		res := getRetError("SalesChaincode queryReturn: ", err)
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(ret)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode Marshal queryReturn error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/ledger/ledgertest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 结账后按顺序退货, 后面的步骤依赖前面已退的数量与金额; 全部退完后退款合计须等于小票实付金额
+func testReturns(t *testing.T, checkout string, wantTotal string, steps []returnStep) {
+	stub := ledgertest.NewStub("sales", new(SalesChaincode))
+	salesPeers(stub)
+	// 与CommodityChaincode一样, 已退回的商品不能再退
+	returned := map[string]bool{}
+	commodity := stub.Peers[CommodityChaincodeName]
+	stub.Peers[CommodityChaincodeName] = func(args []string) pb.Response {
+		if args[0] == "setState" && args[2] == "returned" {
+			if returned[args[1]] {
+				return shim.Error(`{"Code":422,"Des":"commodity has been returned"}`)
+			}
+			returned[args[1]] = true
+		}
+		return commodity(args)
+	}
+	// 顾客累计消费的扣减
+	var refunded []string
+	users := stub.Peers[UsersChaincodeName]
+	stub.Peers[UsersChaincodeName] = func(args []string) pb.Response {
+		if args[0] == "refund" {
+			refunded = append(refunded, args[2])
+		}
+		return users(args)
+	}
+	clerk := ledgertest.Creator("Org1MSP", "carol", map[string]string{"role": "clerk", "storeID": "S1"})
+	t0 := time.Unix(1500000000, 0)
+
+	resp := stub.Invoke(ledgertest.Proposal{TxID: "R1", Creator: clerk, Time: t0, Args: []string{"checkout", checkout}})
+	if resp.Status != shim.OK {
+		t.Fatalf("checkout: %s", resp.Message)
+	}
+	var receipt Receipt
+	json.Unmarshal(resp.Payload, &receipt)
+	if receipt.Total.String() != wantTotal {
+		t.Fatalf("receipt total = %s, want %s", receipt.Total, wantTotal)
+	}
+
+	sum := decimal.Zero
+	for i, s := range steps {
+		resp := stub.Invoke(ledgertest.Proposal{TxID: "ret" + strconv.Itoa(i), Creator: clerk, Time: t0.Add(time.Hour),
+			Args: []string{"returnGoods", `{"ReceiptNo":"R1",` + s.request + `}`}})
+		code := errcode.OK
+		if resp.Status != shim.OK {
+			code = errcode.FromResponse(resp.Message).Code
+		}
+		if code != s.code {
+			t.Errorf("%s: code %d, want %d: %s", s.name, code, s.code, resp.Message)
+			continue
+		}
+		if code != errcode.OK {
+			continue
+		}
+		var ret Return
+		json.Unmarshal(resp.Payload, &ret)
+		if ret.Total.String() != s.refund {
+			t.Errorf("%s: refund %s, want %s", s.name, ret.Total, s.refund)
+		}
+		sum, _ = sum.Add(ret.Total)
+	}
+
+	var r Returned
+	b, _ := stub.GetState(Returned_Prefix + "R1")
+	json.Unmarshal(b, &r)
+	if r.Refunded.String() != sum.String() || sum.Cmp(receipt.Total) != 0 {
+		t.Errorf("refunded %s (returns %s), want the receipt total %s", r.Refunded, sum, receipt.Total)
+	}
+	if receipt.CustomerID != "" && len(refunded) != len(r.Returns) {
+		t.Errorf("customer cost reduced %d times for %d returns: %v", len(refunded), len(r.Returns), refunded)
+	}
+}
+
+type returnStep struct {
+	name    string
+	request string
+	code    int
+	refund  string
+}
+
+// 逐件商品与称重混在同一类别, 小票用了会员折扣和优惠券: 3.25 x 3.5 = 11.38, 九五折0.57, 优惠券1元, 实付9.81
+func TestReturnGoods(t *testing.T) {
+	testReturns(t, `{"StoreID":"S1","CustomerID":"U1","PaymentMethod":"cash",`+
+		`"Commodities":["C1","C2"],"Lines":[{"Category":"Apple","Quantity":"1.25"}],"Coupons":["K1"]}`, "9.81",
+		[]returnStep{
+			{"nothing to return", `"Lines":[]`, errcode.Validation, ""},
+			{"commodity not on the receipt", `"Commodities":["C9"]`, errcode.Validation, ""},
+			{"category not on the receipt", `"Lines":[{"Category":"Pear","Quantity":"1"}]`, errcode.Validation, ""},
+			{"commodities returned by quantity", `"Lines":[{"Category":"Apple","Quantity":"1.5"}]`, errcode.BusinessRule, ""},
+			// 3.50 x 9.81 / 11.38
+			{"one commodity", `"Commodities":["C1"]`, errcode.OK, "3.02"},
+			{"same commodity again", `"Commodities":["C1"]`, errcode.BusinessRule, ""},
+			// 1.75 x 9.81 / 11.38
+			{"part by quantity", `"Lines":[{"Category":"Apple","Quantity":"0.5"}]`, errcode.OK, "1.51"},
+			{"more than left by quantity", `"Lines":[{"Category":"Apple","Quantity":"0.76"}]`, errcode.BusinessRule, ""},
+			// 剩余的实付金额 9.81 - 3.02 - 1.51
+			{"the rest, mixed", `"Commodities":["C2"],"Lines":[{"Category":"Apple","Quantity":"0.75"}]`, errcode.OK, "5.28"},
+			{"nothing left", `"Lines":[{"Category":"Apple","Quantity":"0.01"}]`, errcode.BusinessRule, ""},
+		})
+}
+
+// 分次退回, 逐次舍入的误差在最后一次补齐: 3 x 3.5 = 10.50, 九五折0.53, 实付9.97; 每次 3.50 x 9.97 / 10.50 = 3.32
+func TestReturnGoodsRemainder(t *testing.T) {
+	testReturns(t, `{"StoreID":"S1","CustomerID":"U1","PaymentMethod":"cash","Lines":[{"Category":"Apple","Quantity":"3"}]}`, "9.97",
+		[]returnStep{
+			{"first", `"Lines":[{"Category":"Apple","Quantity":"1"}]`, errcode.OK, "3.32"},
+			{"second", `"Lines":[{"Category":"Apple","Quantity":"1"}]`, errcode.OK, "3.32"},
+			{"last", `"Lines":[{"Category":"Apple","Quantity":"1"}]`, errcode.OK, "3.33"},
+			{"over the sold quantity", `"Lines":[{"Category":"Apple","Quantity":"1"}]`, errcode.BusinessRule, ""},
+		})
+}
@@ -0,0 +1,792 @@
+/*
+销售
+收银台一次结账: 按类别单价计价, 卖出商品, 扣减库存, 累计顾客消费, 生成不可修改的销售小票
+所有步骤在同一交易内完成, 任何一步失败则整个交易失败
+小票号为交易ID, 退货见returns.go, 店铺内连续的编号见sequence.go
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/common/authz"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/events"
+	"github.com/common/history"
+	"github.com/common/ledger"
+	"github.com/common/schema"
+	"github.com/common/sequence"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"sort"
+)
+
+var logger = shim.NewLogger("Sales")
+
+// 被调用的chaincode名称
+const CommodityChaincodeName = "commodity"
+const CategoryChaincodeName = "category"
+const UsersChaincodeName = "usercc"
+const CouponChaincodeName = "coupon"
+
+// 权限矩阵; 店员只能在本店结账、查询本店小票, 顾客只能查询本人的小票
+var permissions = authz.Matrix{
+	"checkout":             authz.Staff,
+	"queryByID":            {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"queryHistory":         {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"queryByStore":         authz.Staff,
+	"queryByCustomer":      {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"returnGoods":          authz.Staff,
+	"queryReturn":          {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"queryByNumber":        {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"assignNumbers":        authz.Managers,
+	"exists":               authz.Everyone,
+	"setIdempotencyWindow": {authz.Admin},
+	"purgeIdempotencyKeys": {authz.Admin},
+}
+
+// 支付方式
+const (
+	PayCash   = "cash"
+	PayCard   = "card"
+	PayWechat = "wechat"
+	PayAlipay = "alipay"
+)
+
+var paymentMethods = map[string]bool{PayCash: true, PayCard: true, PayWechat: true, PayAlipay: true}
+
+// 结账请求
+type Checkout struct {
+	StoreID       string         `json:"StoreID"`
+	CustomerID    string         `json:"CustomerID"` // 可为空, 非会员
+	PaymentMethod string         `json:"PaymentMethod"`
+	Commodities   []string       `json:"Commodities"` // 逐件登记的商品ID
+	Lines         []CategoryLine `json:"Lines"`       // 按类别计量的商品, 如散装称重
+	Coupons       []string       `json:"Coupons"`     // 使用的优惠券, 需要CustomerID
+}
+
+// 按类别计量的一行
+type CategoryLine struct {
+	Category string          `json:"Category"`
+	Quantity decimal.Decimal `json:"Quantity"`
+}
+
+// 小票行
+type ReceiptLine struct {
+	Category    string          `json:"Category"`
+	Name        string          `json:"Name"`
+	Commodities []string        `json:"Commodities"`
+	Quantity    decimal.Decimal `json:"Quantity"`
+	UnitPrice   decimal.Decimal `json:"UnitPrice"`
+	Amount      decimal.Decimal `json:"Amount"`
+}
+
+// 销售小票
+type Receipt struct {
+	ReceiptNo     string          `json:"ReceiptNo"` // 交易ID
+	Number        string          `json:"Number"`    // 店铺内连续的编号, 由assignNumbers分配, 之前为空
+	StoreID       string          `json:"StoreID"`
+	CustomerID    string          `json:"CustomerID"`
+	PaymentMethod string          `json:"PaymentMethod"`
+	Lines         []ReceiptLine   `json:"Lines"`
+	Subtotal      decimal.Decimal `json:"Subtotal"`
+	VIP           string          `json:"VIP"`
+	Discount      decimal.Decimal `json:"Discount"` // 会员优惠金额
+	Coupons       []Redemption    `json:"Coupons"`
+	Total         decimal.Decimal `json:"Total"` // 实付金额
+	TxID          string          `json:"TxID"`
+	CreateTime    string          `json:"CreateTime"`
+}
+
+// 被调用chaincode返回的记录中用到的字段
+type commodityRef struct {
+	ID       string `json:"ID"`
+	Category string `json:"Category"`
+	StoreID  string `json:"StoreID"`
+	Supplier string `json:"Supplier"`
+}
+
+// 优惠券核销结果
+type Redemption struct {
+	CouponID string          `json:"CouponID"`
+	Discount decimal.Decimal `json:"Discount"`
+}
+
+// 提交给优惠券核销的购物篮
+type couponBasket struct {
+	Subtotal decimal.Decimal `json:"Subtotal"`
+	Lines    []basketLine    `json:"Lines"`
+}
+
+type basketLine struct {
+	Category string          `json:"Category"`
+	Amount   decimal.Decimal `json:"Amount"`
+}
+
+type benefitsRef struct {
+	VIP      string          `json:"VIP"`
+	Discount decimal.Decimal `json:"Discount"` // 折扣百分比
+}
+
+// UsersChaincode.change的返回
+type changeRef struct {
+	VIPChange *struct {
+		UserID string          `json:"UserID"`
+		From   string          `json:"From"`
+		To     string          `json:"To"`
+		Reason string          `json:"Reason"`
+		Cost   decimal.Decimal `json:"Cost"`
+	} `json:"VIPChange"`
+}
+
+type categoryRef struct {
+	ID        string          `json:"ID"`
+	Name      string          `json:"Name"`
+	StoreID   string          `json:"StoreID"`
+	UnitPrice decimal.Decimal `json:"UnitPrice"`
+}
+
+// 前缀
+const Record_Prefix = "Receipt_"
+
+// composite keys
+const StoreIndexName = "storeID~time~receiptNo"
+const CustomerIndexName = "customerID~time~receiptNo"
+
+// 根据小票号取出小票
+func (a *SalesChaincode) getRecord(stub shim.ChaincodeStubInterface, key string) (Receipt, bool) {
+	var record Receipt
+	b, err := stub.GetState(key)
+	if b == nil {
+		return record, false
+	}
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// 保存小票
+func (a *SalesChaincode) putRecord(stub shim.ChaincodeStubInterface, key string, record Receipt) ([]byte, bool) {
+
+	byte, err := json.Marshal(record)
+	if err != nil {
+		return nil, false
+	}
+
+	err = stub.PutState(key, byte)
+	if err != nil {
+		return nil, false
+	}
+	// 记录提交者, 见queryHistory
+	err = history.Stamp(stub)
+	if err != nil {
+		return nil, false
+	}
+	return byte, true
+}
+
+// SalesChaincode example Sales Chaincode implementation
+type SalesChaincode struct {
+}
+
+// response message format
+func getRetByte(code int, des string, details ...errcode.Detail) []byte {
+	r := errcode.NewRet(code, des, details...)
+
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		fmt.Println("marshal Ret failed")
+		return nil
+	}
+	return b
+}
+
+// response message format
+func getRetString(code int, des string, details ...errcode.Detail) string {
+	r := errcode.NewRet(code, des, details...)
+
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		fmt.Println("marshal Ret failed")
+		return ""
+	}
+	logger.Infof("%s", string(b[:]))
+	return string(b[:])
+}
+
+// 按错误的错误码返回, 保留被调用链码的Details
+func getRetError(des string, err error) string {
+	return getRetString(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...)
+}
+
+// 调用同一channel上的其他chaincode
+// 被调用chaincode的写集与本交易一同提交
+func invoke(stub shim.ChaincodeStubInterface, chaincodeName string, args ...string) pb.Response {
+	ccArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		ccArgs[i] = []byte(arg)
+	}
+	return stub.InvokeChaincode(chaincodeName, ccArgs, "")
+}
+
+// 索引中的时间补齐位数, 使key按时间排序
+// 索引中的时间, 按字符串排序即按时间排序; 旧索引为12位补零的unix秒, 查询时由txtime.Parse兼容
+func timeKey(t int64) string {
+	return fmt.Sprintf("%013d", t)
+}
+
+// 交易时间(unix毫秒), 所有背书节点一致
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
+func (t *SalesChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("########### Sales Chaincode Init ###########")
+	return shim.Success(nil)
+
+}
+
+// Transaction makes payment of X units from A to B
+func (t *SalesChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	resp := ledger.DispatchOnce(stub, t.dispatch)
+	if resp.Status != shim.OK {
+		// 错误返回带上交易ID
+		resp.Message = errcode.Stamp(resp.Message, stub.GetTxID())
+	}
+	return resp
+}
+
+// 按函数名分发
+func (t *SalesChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("########### chaincode Invoke ###########")
+
+	function, args := stub.GetFunctionAndParameters()
+	logger.Info("%s%s", "SalesChaincode function=", function)
+	logger.Info("%s%s", "SalesChaincode args=", args)
+	// 权限检查
+	_, err := permissions.Authorize(stub, function)
+	if err != nil {
+		res := getRetError("SalesChaincode ", err)
+		return shim.Error(res)
+	}
+	if function == "checkout" {
+		// 结账
+		return t.checkout(stub, args)
+	} else if function == "queryHistory" {
+		// 变更历史
+		return t.queryHistory(stub, args)
+	} else if function == "queryByID" {
+		// 根据小票号查询
+		return t.queryByID(stub, args)
+	} else if function == "queryByStore" {
+		// 根据商店查询
+		return t.queryByIndex(stub, StoreIndexName, args)
+	} else if function == "queryByCustomer" {
+		// 根据顾客查询
+		return t.queryByIndex(stub, CustomerIndexName, args)
+	} else if function == "returnGoods" {
+		// 退货
+		return t.returnGoods(stub, args)
+	} else if function == "queryReturn" {
+		// 根据退货单号查询
+		return t.queryReturn(stub, args)
+	} else if function == "queryByNumber" {
+		// 根据编号查询小票或退货单
+		return t.queryByNumber(stub, args)
+	} else if function == "assignNumbers" {
+		// 分配编号
+		return t.assignNumbers(stub, args)
+	} else if function == "exists" {
+		// 记录是否存在
+		return t.exists(stub, args)
+	} else if function == "setIdempotencyWindow" {
+		// 设置幂等key的保存时间
+		return ledger.SetIdempotencyWindow(stub, args)
+	} else if function == "purgeIdempotencyKeys" {
+		// 删除已失效的幂等key
+		return ledger.PurgeIdempotencyKeys(stub, args)
+	}
+
+	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", function)
+	res := getRetString(errcode.Validation, "Unknown action: "+function, errcode.Field("function", "unknown"))
+	return shim.Error(res)
+}
+
+// 结账
+// args: 0 - {Checkout Object}
+func (a *SalesChaincode) checkout(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "SalesChaincode checkout args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	var checkout Checkout
+	err := schema.Strict(args[0], &checkout)
+	if err != nil {
+		res := getRetError("SalesChaincode checkout failed : ", err)
+		return shim.Error(res)
+	}
+	if checkout.StoreID == "" {
+		res := getRetString(errcode.Validation, "SalesChaincode checkout failed : StoreID is required")
+		return shim.Error(res)
+	}
+	err = authz.CheckStore(stub, checkout.StoreID)
+	if err != nil {
+		res := getRetError("SalesChaincode checkout failed : ", err)
+		return shim.Error(res)
+	}
+	if !paymentMethods[checkout.PaymentMethod] {
+		res := getRetString(errcode.Validation, "SalesChaincode checkout failed : unknown payment method "+checkout.PaymentMethod)
+		return shim.Error(res)
+	}
+	if len(checkout.Commodities) == 0 && len(checkout.Lines) == 0 {
+		res := getRetString(errcode.Validation, "SalesChaincode checkout failed : empty basket")
+		return shim.Error(res)
+	}
+	if len(checkout.Coupons) > 0 && checkout.CustomerID == "" {
+		res := getRetString(errcode.Validation, "SalesChaincode checkout failed : coupons need a CustomerID")
+		return shim.Error(res)
+	}
+
+	receiptNo := stub.GetTxID()
+	_, existbl := a.getRecord(stub, Record_Prefix+receiptNo)
+	if existbl {
+		res := getRetString(errcode.AlreadyExists, "SalesChaincode checkout failed : the receipt has exist ")
+		return shim.Error(res)
+	}
+
+	// 按类别汇总
+	lines := map[string]*ReceiptLine{}
+	lineOf := func(category string) *ReceiptLine {
+		line, ok := lines[category]
+		if !ok {
+			line = &ReceiptLine{Category: category, Commodities: []string{}}
+			lines[category] = line
+		}
+		return line
+	}
+
+	// 被调用的chaincode发出的事件不随交易提交, 由本chaincode发出
+	var evs events.List
+
+	// 逐件商品: 卖出并按其类别计数
+	seen := map[string]bool{}
+	for _, commID := range checkout.Commodities {
+		if seen[commID] {
+			res := getRetString(errcode.Validation, "SalesChaincode checkout failed : duplicate commodity "+commID)
+			return shim.Error(res)
+		}
+		seen[commID] = true
+
+		resp := invoke(stub, CommodityChaincodeName, "sell", commID)
+		if resp.Status != shim.OK {
+			res := getRetError("SalesChaincode checkout retire commodity "+commID+" failed: ", errcode.FromResponse(resp.Message))
+			return shim.Error(res)
+		}
+		var comm commodityRef
+		err = json.Unmarshal(resp.Payload, &comm)
+		if err != nil {
+			res := getRetString(errcode.Internal, "SalesChaincode checkout unmarshal commodity failed")
+			return shim.Error(res)
+		}
+		if comm.StoreID != checkout.StoreID {
+			res := getRetString(errcode.BusinessRule, "SalesChaincode checkout failed : commodity "+commID+" belongs to store "+comm.StoreID)
+			return shim.Error(res)
+		}
+		err = evs.Add(events.CommoditySold, events.Commodity{
+			ID:        comm.ID,
+			Category:  comm.Category,
+			StoreID:   comm.StoreID,
+			Supplier:  comm.Supplier,
+			Reference: receiptNo,
+		})
+		if err != nil {
+			res := getRetString(errcode.Internal, "SalesChaincode checkout add event failed")
+			return shim.Error(res)
+		}
+		line := lineOf(comm.Category)
+		line.Commodities = append(line.Commodities, commID)
+		line.Quantity, err = line.Quantity.Add(decimal.FromInt(1))
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode checkout failed : "+err.Error())
+			return shim.Error(res)
+		}
+	}
+
+	// 按类别计量
+	for _, l := range checkout.Lines {
+		if l.Category == "" || l.Quantity.Sign() <= 0 {
+			res := getRetString(errcode.Validation, "SalesChaincode checkout failed : category line needs Category and a positive Quantity")
+			return shim.Error(res)
+		}
+		line := lineOf(l.Category)
+		line.Quantity, err = line.Quantity.Add(l.Quantity)
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode checkout failed : "+err.Error())
+			return shim.Error(res)
+		}
+	}
+
+	// 按类别ID排序, 保证各背书节点生成相同的小票
+	categories := make([]string, 0, len(lines))
+	for category := range lines {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	receipt := Receipt{
+		ReceiptNo:     receiptNo,
+		StoreID:       checkout.StoreID,
+		CustomerID:    checkout.CustomerID,
+		PaymentMethod: checkout.PaymentMethod,
+		Lines:         []ReceiptLine{},
+		Coupons:       []Redemption{},
+		TxID:          stub.GetTxID(),
+	}
+	for _, category := range categories {
+		line := lines[category]
+
+		// 计价: getPrice只读类别记录, 不读历史和库存流水, 避免与并发结账冲突
+		resp := invoke(stub, CategoryChaincodeName, "getPrice", category, checkout.StoreID)
+		if resp.Status != shim.OK {
+			res := getRetError("SalesChaincode checkout get category "+category+" failed: ", errcode.FromResponse(resp.Message))
+			return shim.Error(res)
+		}
+		var cate categoryRef
+		err = json.Unmarshal(resp.Payload, &cate)
+		if err != nil {
+			res := getRetString(errcode.Internal, "SalesChaincode checkout unmarshal category failed")
+			return shim.Error(res)
+		}
+		line.Name = cate.Name
+		line.UnitPrice = cate.UnitPrice
+		line.Amount, err = cate.UnitPrice.Mul(line.Quantity, decimal.HalfUp)
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode checkout failed : "+err.Error())
+			return shim.Error(res)
+		}
+		line.Amount = line.Amount.RoundCents()
+
+		// 扣减库存, 以小票号作为流水的reference
+		resp = invoke(stub, CategoryChaincodeName, "moveStock", category, checkout.StoreID, "sale", line.Quantity.String(), receiptNo)
+		if resp.Status != shim.OK {
+			res := getRetError("SalesChaincode checkout reduce stock of "+category+" failed: ", errcode.FromResponse(resp.Message))
+			return shim.Error(res)
+		}
+		err = evs.Add(events.StockMoved, events.StockMovement{
+			CateID:    category,
+			StoreID:   checkout.StoreID,
+			Type:      "sale",
+			Quantity:  line.Quantity.Neg().String(),
+			Reference: receiptNo,
+		})
+		if err != nil {
+			res := getRetString(errcode.Internal, "SalesChaincode checkout add event failed")
+			return shim.Error(res)
+		}
+
+		receipt.Lines = append(receipt.Lines, *line)
+		receipt.Subtotal, err = receipt.Subtotal.Add(line.Amount)
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode checkout failed : "+err.Error())
+			return shim.Error(res)
+		}
+	}
+	receipt.Total = receipt.Subtotal
+
+	// 会员优惠, 累计顾客消费
+	if checkout.CustomerID != "" {
+		resp := invoke(stub, UsersChaincodeName, "getBenefits", checkout.CustomerID)
+		if resp.Status != shim.OK {
+			res := getRetError("SalesChaincode checkout get customer benefits failed: ", errcode.FromResponse(resp.Message))
+			return shim.Error(res)
+		}
+		var benefits benefitsRef
+		err = json.Unmarshal(resp.Payload, &benefits)
+		if err != nil {
+			res := getRetString(errcode.Internal, "SalesChaincode checkout unmarshal benefits failed")
+			return shim.Error(res)
+		}
+		receipt.VIP = benefits.VIP
+		receipt.Discount, err = receipt.Subtotal.Percent(benefits.Discount, decimal.HalfUp)
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode checkout failed : "+err.Error())
+			return shim.Error(res)
+		}
+		receipt.Discount = receipt.Discount.RoundCents()
+		receipt.Total, err = receipt.Subtotal.Sub(receipt.Discount)
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode checkout failed : "+err.Error())
+			return shim.Error(res)
+		}
+
+		// 核销优惠券, 最低消费按优惠前的金额计算
+		basket := couponBasket{Subtotal: receipt.Subtotal, Lines: []basketLine{}}
+		for _, line := range receipt.Lines {
+			basket.Lines = append(basket.Lines, basketLine{Category: line.Category, Amount: line.Amount})
+		}
+		basketJSON, err := json.Marshal(basket)
+		if err != nil {
+			res := getRetString(errcode.Internal, "SalesChaincode checkout marshal basket failed")
+			return shim.Error(res)
+		}
+		used := map[string]bool{}
+		for _, id := range checkout.Coupons {
+			if used[id] {
+				res := getRetString(errcode.Validation, "SalesChaincode checkout failed : duplicate coupon "+id)
+				return shim.Error(res)
+			}
+			used[id] = true
+
+			resp = invoke(stub, CouponChaincodeName, "redeem", id, checkout.CustomerID, receiptNo, string(basketJSON))
+			if resp.Status != shim.OK {
+				res := getRetError("SalesChaincode checkout redeem coupon "+id+" failed: ", errcode.FromResponse(resp.Message))
+				return shim.Error(res)
+			}
+			var redemption Redemption
+			err = json.Unmarshal(resp.Payload, &redemption)
+			if err != nil {
+				res := getRetString(errcode.Internal, "SalesChaincode checkout unmarshal redemption failed")
+				return shim.Error(res)
+			}
+			receipt.Coupons = append(receipt.Coupons, redemption)
+			receipt.Total, err = receipt.Total.Sub(redemption.Discount)
+			if err != nil {
+				res := getRetString(errcode.Validation, "SalesChaincode checkout failed : "+err.Error())
+				return shim.Error(res)
+			}
+		}
+		if receipt.Total.Sign() < 0 {
+			receipt.Total = decimal.Zero
+		}
+
+		if receipt.Total.Sign() > 0 {
+			resp = invoke(stub, UsersChaincodeName, "change", checkout.CustomerID, "Cost", receipt.Total.String())
+			if resp.Status != shim.OK {
+				res := getRetError("SalesChaincode checkout add customer cost failed: ", errcode.FromResponse(resp.Message))
+				return shim.Error(res)
+			}
+			// 被调用的usercc发出的事件不随交易提交, 升级事件由这里发出
+			var changed changeRef
+			err = json.Unmarshal(resp.Payload, &changed)
+			if err != nil {
+				res := getRetString(errcode.Internal, "SalesChaincode checkout unmarshal customer change failed")
+				return shim.Error(res)
+			}
+			if changed.VIPChange != nil {
+				err = evs.Add(events.VIPChanged, events.VIPChange{
+					UserID: changed.VIPChange.UserID,
+					From:   changed.VIPChange.From,
+					To:     changed.VIPChange.To,
+					Reason: changed.VIPChange.Reason,
+					Cost:   changed.VIPChange.Cost.String(),
+				})
+				if err != nil {
+					res := getRetString(errcode.Internal, "SalesChaincode checkout add event failed")
+					return shim.Error(res)
+				}
+			}
+		}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode checkout failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	receipt.CreateTime = txtime.Format(now)
+
+	// 保存小票
+	b, bl := a.putRecord(stub, Record_Prefix+receiptNo, receipt)
+	if !bl {
+		res := getRetString(errcode.Internal, "SalesChaincode checkout put receipt failed")
+		return shim.Error(res)
+	}
+
+	// 索引
+	err = a.putIndex(stub, StoreIndexName, receipt.StoreID, now, receiptNo)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode checkout put store index failed")
+		return shim.Error(res)
+	}
+	if receipt.CustomerID != "" {
+		err = a.putIndex(stub, CustomerIndexName, receipt.CustomerID, now, receiptNo)
+		if err != nil {
+			res := getRetString(errcode.Internal, "SalesChaincode checkout put customer index failed")
+			return shim.Error(res)
+		}
+	}
+	// 编号由assignNumbers分配, 本交易不读写计数器
+	err = ledger.EnqueueNumber(stub, sequence.Receipt, receipt.StoreID, now, receiptNo)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode checkout put pending number failed")
+		return shim.Error(res)
+	}
+
+	err = evs.Emit(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode checkout set event failed")
+		return shim.Error(res)
+	}
+
+	return shim.Success(b)
+}
+
+// 写入索引, value为小票号
+func (a *SalesChaincode) putIndex(stub shim.ChaincodeStubInterface, indexName, owner string, t int64, receiptNo string) error {
+	key, err := stub.CreateCompositeKey(indexName, []string{owner, timeKey(t), receiptNo})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte(receiptNo))
+}
+
+// 根据小票号查找小票
+//
+//	0 - Receipt No
+func (a *SalesChaincode) queryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "SalesChaincode queryByID args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	receipt, bl := a.getRecord(stub, Record_Prefix+args[0])
+	if !bl {
+		res := getRetString(errcode.NotFound, "SalesChaincode queryByID get receipt error")
+		return shim.Error(res)
+	}
+
+	id, err := authz.GetIdentity(stub)
+	if err == nil {
+		if id.Role == authz.Customer {
+			err = authz.CheckSelf(stub, receipt.CustomerID)
+		} else {
+			err = authz.CheckStore(stub, receipt.StoreID)
+		}
+	}
+	if err != nil {
+		res := getRetError("SalesChaincode queryByID: ", err)
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(receipt)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode Marshal queryByID receipt error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 根据商店或顾客查找小票, 可按时间范围过滤
+//
+//	0 - Store ID or Customer ID, 1 - from (unix毫秒或秒, 可选), 2 - to (unix毫秒或秒, 可选, 不含)
+func (a *SalesChaincode) queryByIndex(stub shim.ChaincodeStubInterface, indexName string, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 3 {
+		res := getRetString(errcode.Validation, "SalesChaincode query args should be 1 or 3", errcode.Args("want 1 or 3"))
+		return shim.Error(res)
+	}
+	var err error
+	if indexName == StoreIndexName {
+		err = authz.CheckStore(stub, args[0])
+	} else {
+		err = authz.CheckSelf(stub, args[0])
+	}
+	if err != nil {
+		res := getRetError("SalesChaincode query: ", err)
+		return shim.Error(res)
+	}
+	var from, to int64
+	if len(args) == 3 {
+		var err1, err2 error
+		from, err1 = txtime.Parse(args[1])
+		to, err2 = txtime.Parse(args[2])
+		if err1 != nil || err2 != nil || from > to {
+			res := getRetString(errcode.Validation, "SalesChaincode query failed : invalid time range")
+			return shim.Error(res)
+		}
+	}
+
+	indexIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{args[0]})
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode query get index error")
+		return shim.Error(res)
+	}
+	defer indexIterator.Close()
+
+	var receiptList = []Receipt{}
+	for indexIterator.HasNext() {
+		kv, err := indexIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "SalesChaincode query iterator error")
+			return shim.Error(res)
+		}
+		if len(args) == 3 {
+			_, attrs, err := stub.SplitCompositeKey(kv.Key)
+			if err != nil || len(attrs) != 3 {
+				res := getRetString(errcode.Internal, "SalesChaincode query split index key error")
+				return shim.Error(res)
+			}
+			t, err := txtime.Parse(attrs[1])
+			if err != nil || t < from || t >= to {
+				continue
+			}
+		}
+		receipt, bl := a.getRecord(stub, Record_Prefix+string(kv.Value))
+		if !bl {
+			res := getRetString(errcode.Internal, "SalesChaincode query get receipt error")
+			return shim.Error(res)
+		}
+		receiptList = append(receiptList, receipt)
+	}
+
+	b, err := json.Marshal(receiptList)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode Marshal query receiptList error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 记录是否存在, 供其他链码(如IndexChaincode)确认引用; 不存在时返回404
+// args: 0 - ID
+func (a *SalesChaincode) exists(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "SalesChaincode exists args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	var b []byte
+	var err error
+	for _, prefix := range []string{Record_Prefix, Return_Prefix} {
+		b, err = stub.GetState(prefix + args[0])
+		if err != nil {
+			res := getRetString(errcode.Internal, "SalesChaincode exists get record error")
+			return shim.Error(res)
+		}
+		if b != nil {
+			break
+		}
+	}
+	if b == nil {
+		res := getRetString(errcode.NotFound, "SalesChaincode exists: no receipt or return "+args[0])
+		return shim.Error(res)
+	}
+	return shim.Success(getRetByte(0, args[0]+" exists"))
+}
+
+func main() {
+	err := shim.Start(new(SalesChaincode))
+	if err != nil {
+		logger.Errorf("Error starting Sales chaincode: %s", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/events"
+	"github.com/common/ledger/ledgertest"
+	"github.com/common/sequence"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 被调用的链码: 商品都属于类别Apple, 单价3.5, 已售出的SOLD不能再卖; 顾客九五折, 一张减1元的优惠券
+func salesPeers(stub *ledgertest.Stub) {
+	success := func(v interface{}) pb.Response {
+		b, _ := json.Marshal(v)
+		return shim.Success(b)
+	}
+	stub.Peers[CommodityChaincodeName] = func(args []string) pb.Response {
+		if args[1] == "SOLD" {
+			return shim.Error(`{"Code":422,"Des":"commodity has been sold"}`)
+		}
+		return success(map[string]string{"ID": args[1], "Category": "Apple", "StoreID": "S1", "Supplier": "SP1"})
+	}
+	stub.Peers[CategoryChaincodeName] = func(args []string) pb.Response {
+		if args[0] == "getPrice" {
+			return success(map[string]string{"ID": "Apple", "Name": "Apple", "StoreID": "S1", "UnitPrice": "3.5"})
+		}
+		return shim.Success(nil)
+	}
+	stub.Peers[UsersChaincodeName] = func(args []string) pb.Response {
+		if args[0] == "getBenefits" {
+			return success(map[string]string{"VIP": "gold", "Discount": "5"})
+		}
+		return success(map[string]interface{}{"Code": 0, "Des": "invoke " + args[0] + " success"})
+	}
+	stub.Peers[CouponChaincodeName] = func(args []string) pb.Response {
+		return success(map[string]string{"CouponID": args[1], "Discount": "1"})
+	}
+}
+
+// 两个节点背书同一结账提案, 写集和事件必须逐字节相同
+func TestCheckoutEndorsementsMatch(t *testing.T) {
+	p := ledgertest.Proposal{
+		TxID:    "tx1",
+		Creator: ledgertest.Creator("Org1MSP", "carol", map[string]string{"role": "clerk", "storeID": "S1"}),
+		Time:    time.Unix(1500000000, 123456789),
+		Args: []string{"checkout", `{"StoreID":"S1","CustomerID":"U1","PaymentMethod":"cash",` +
+			`"Commodities":["C1"],"Lines":[{"Category":"Apple","Quantity":"1.25"}],"Coupons":["K1"]}`},
+	}
+	endorse := func() *ledgertest.Stub {
+		stub := ledgertest.NewStub("sales", new(SalesChaincode))
+		salesPeers(stub)
+		resp := stub.Invoke(p)
+		if resp.Status != shim.OK {
+			t.Fatalf("checkout: %s", resp.Message)
+		}
+		return stub
+	}
+	a := endorse()
+	// 节点的本地时间不同
+	time.Sleep(5 * time.Millisecond)
+	b := endorse()
+
+	if len(a.Writes) == 0 || !reflect.DeepEqual(a.Writes, b.Writes) {
+		t.Errorf("write sets differ:\n%q\n%q", a.Writes, b.Writes)
+	}
+	if len(a.Events) != 1 || !reflect.DeepEqual(a.Events, b.Events) {
+		t.Errorf("events differ:\n%q\n%q", a.Events, b.Events)
+	}
+
+	var receipt Receipt
+	err := json.Unmarshal(a.Writes[Record_Prefix+"tx1"], &receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2.25件 x 3.5 = 7.88, 九五折优惠0.39, 再减优惠券1元
+	if receipt.CreateTime != "1500000000123" || receipt.Subtotal.String() != "7.88" || receipt.Total.String() != "6.49" {
+		t.Errorf("receipt = %+v", receipt)
+	}
+}
+
+// 累计消费引起的会员升级在被调用的usercc中发生, 由结账交易发出VIPChanged
+func TestCheckoutVIPChanged(t *testing.T) {
+	clerk := ledgertest.Creator("Org1MSP", "carol", map[string]string{"role": "clerk", "storeID": "S1"})
+	cases := []struct {
+		name   string
+		change string
+		types  []string
+	}{
+		{"no level change", `{"Code":0,"Des":"invoke change success"}`,
+			[]string{events.CommoditySold, events.StockMoved}},
+		{"promoted", `{"Code":0,"Des":"invoke change success","VIPChange":{"UserID":"U1","From":"level0","To":"level1","Reason":"auto","Cost":"1006.49","TxID":"tx1","Time":"1500000000000"}}`,
+			[]string{events.CommoditySold, events.StockMoved, events.VIPChanged}},
+	}
+	for _, c := range cases {
+		stub := ledgertest.NewStub("sales", new(SalesChaincode))
+		salesPeers(stub)
+		users := stub.Peers[UsersChaincodeName]
+		stub.Peers[UsersChaincodeName] = func(args []string) pb.Response {
+			if args[0] == "change" {
+				return shim.Success([]byte(c.change))
+			}
+			return users(args)
+		}
+		resp := stub.Invoke(ledgertest.Proposal{TxID: "tx1", Creator: clerk, Time: time.Unix(1500000000, 0),
+			Args: []string{"checkout", `{"StoreID":"S1","CustomerID":"U1","PaymentMethod":"cash","Commodities":["C1"]}`}})
+		if resp.Status != shim.OK {
+			t.Fatalf("%s: checkout: %s", c.name, resp.Message)
+		}
+		if len(stub.Events) != 1 {
+			t.Fatalf("%s: %d events, want one batch", c.name, len(stub.Events))
+		}
+		batch, err := events.Decode(stub.Events[0].Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var types []string
+		for _, e := range batch.Events {
+			types = append(types, e.Type)
+		}
+		if !reflect.DeepEqual(types, c.types) {
+			t.Errorf("%s: events %q, want %q", c.name, types, c.types)
+			continue
+		}
+		if len(c.types) == 3 {
+			v, err := batch.Events[2].Decode()
+			change, _ := v.(*events.VIPChange)
+			if err != nil || *change != (events.VIPChange{UserID: "U1", From: "level0", To: "level1", Reason: "auto", Cost: "1006.49"}) {
+				t.Errorf("%s: VIPChanged = %+v, %v", c.name, v, err)
+			}
+		}
+	}
+}
+
+// 并发结账的小票按交易时间连续编号, 失败的结账不占用编号
+func TestAssignNumbers(t *testing.T) {
+	stub := ledgertest.NewStub("sales", new(SalesChaincode))
+	salesPeers(stub)
+	clerk := ledgertest.Creator("Org1MSP", "carol", map[string]string{"role": "clerk", "storeID": "S1"})
+	manager := ledgertest.Creator("Org1MSP", "bob", map[string]string{"role": "manager", "storeID": "S1"})
+	t0 := time.Unix(1500000000, 0)
+
+	checkouts := []struct {
+		txID      string
+		at        time.Duration
+		commodity string
+		ok        bool
+	}{
+		{"tx1", 3 * time.Second, "C1", true},
+		{"tx2", 1 * time.Second, "C2", true},
+		{"tx3", 2 * time.Second, "SOLD", false},
+		{"tx4", 2 * time.Second, "C4", true},
+	}
+	for _, c := range checkouts {
+		resp := stub.Invoke(ledgertest.Proposal{TxID: c.txID, Creator: clerk, Time: t0.Add(c.at),
+			Args: []string{"checkout", `{"StoreID":"S1","PaymentMethod":"cash","Commodities":["` + c.commodity + `"]}`}})
+		if (resp.Status == shim.OK) != c.ok {
+			t.Fatalf("checkout %s: %s", c.txID, resp.Message)
+		}
+	}
+
+	assigns := []struct {
+		limit   string
+		docs    []string
+		pending bool
+	}{
+		{"2", []string{"tx2", "tx4"}, true},
+		{"2", []string{"tx1"}, false},
+		{"2", []string{}, false},
+	}
+	for i, c := range assigns {
+		resp := stub.Invoke(ledgertest.Proposal{TxID: "assign" + strconv.Itoa(i), Creator: manager, Time: t0.Add(time.Minute),
+			Args: []string{"assignNumbers", sequence.Receipt, "S1", c.limit}})
+		if resp.Status != shim.OK {
+			t.Fatalf("assignNumbers: %s", resp.Message)
+		}
+		var r sequence.Assignment
+		json.Unmarshal(resp.Payload, &r)
+		if !reflect.DeepEqual(r.Docs, c.docs) || r.Pending != c.pending {
+			t.Errorf("assignNumbers %d = %+v", i, r)
+		}
+	}
+
+	for i, txID := range []string{"tx2", "tx4", "tx1"} {
+		number := sequence.Format(sequence.Receipt, "S1", int64(i+1))
+		resp := stub.Invoke(ledgertest.Proposal{TxID: "query" + strconv.Itoa(i), Creator: clerk, Time: t0.Add(time.Hour),
+			Args: []string{"queryByNumber", number}})
+		var receipt Receipt
+		json.Unmarshal(resp.Payload, &receipt)
+		if resp.Status != shim.OK || receipt.ReceiptNo != txID || receipt.Number != number {
+			t.Errorf("queryByNumber(%s) = %+v: %s", number, receipt, resp.Message)
+		}
+	}
+}
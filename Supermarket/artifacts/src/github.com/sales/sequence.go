@@ -0,0 +1,104 @@
+/*
+小票与退货单编号
+小票号、退货单号为交易ID; 每个店铺的小票、退货单另有各自连续的编号(Number), 由assignNumbers在结账、退货提交后分配, 见common/sequence
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/ledger"
+	"github.com/common/sequence"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 为店铺的小票或退货单编号
+// args: 0 - kind(receipt或return), 1 - Store ID, 2 - 最多编号的数量(可选)
+func (a *SalesChaincode) assignNumbers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		res := getRetString(errcode.Validation, "SalesChaincode assignNumbers args should be 2 or 3", errcode.Args("want 2 or 3"))
+		return shim.Error(res)
+	}
+	kind := args[0]
+	if kind != sequence.Receipt && kind != sequence.Return {
+		res := getRetString(errcode.Validation, "SalesChaincode assignNumbers failed : kind should be "+sequence.Receipt+" or "+sequence.Return,
+			errcode.Field("kind", "should be "+sequence.Receipt+" or "+sequence.Return))
+		return shim.Error(res)
+	}
+	limit := sequence.DefaultBatch
+	var err error
+	if len(args) == 3 {
+		limit, err = sequence.Batch(args[2])
+		if err != nil {
+			res := getRetString(errcode.Validation, "SalesChaincode assignNumbers failed : "+err.Error())
+			return shim.Error(res)
+		}
+	}
+	err = authz.CheckStore(stub, args[1])
+	if err != nil {
+		res := getRetError("SalesChaincode assignNumbers failed : ", err)
+		return shim.Error(res)
+	}
+
+	result, err := ledger.AssignNumbers(stub, kind, args[1], limit, func(docID, number string) error {
+		if kind == sequence.Return {
+			ret, existbl := a.getReturn(stub, docID)
+			if !existbl {
+				return errcode.New(errcode.Internal, "the return "+docID+" does not exist")
+			}
+			ret.Number = number
+			_, bl := a.putReturn(stub, ret)
+			if !bl {
+				return errcode.New(errcode.Internal, "put return "+docID+" failed")
+			}
+			return nil
+		}
+		receipt, existbl := a.getRecord(stub, Record_Prefix+docID)
+		if !existbl {
+			return errcode.New(errcode.Internal, "the receipt "+docID+" does not exist")
+		}
+		receipt.Number = number
+		_, bl := a.putRecord(stub, Record_Prefix+docID, receipt)
+		if !bl {
+			return errcode.New(errcode.Internal, "put receipt "+docID+" failed")
+		}
+		return nil
+	})
+	if err != nil {
+		res := getRetError("SalesChaincode assignNumbers failed : ", err)
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode Marshal assignNumbers result error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 根据编号查找小票或退货单
+//
+//	0 - Number
+func (a *SalesChaincode) queryByNumber(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "SalesChaincode queryByNumber args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	docID, err := ledger.NumberedDocument(stub, args[0])
+	if err != nil {
+		res := getRetString(errcode.Internal, "SalesChaincode queryByNumber get index error")
+		return shim.Error(res)
+	}
+	if docID == "" {
+		res := getRetString(errcode.NotFound, "SalesChaincode queryByNumber failed : no receipt or return numbered "+args[0])
+		return shim.Error(res)
+	}
+	if _, ok := a.getReturn(stub, docID); ok {
+		return a.queryReturn(stub, []string{docID})
+	}
+	return a.queryByID(stub, []string{docID})
+}
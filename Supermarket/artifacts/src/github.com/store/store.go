@@ -0,0 +1,471 @@
+/*
+店铺
+登记店铺的地址、区域、所属组织(MSP)、营业状态和店长;
+类别与商品记录只保存StoreID, 店铺名称在查询时从这里取得, 改名后不会留下过期的副本
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/history"
+	"github.com/common/ledger"
+	"github.com/common/schema"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"unicode/utf8"
+)
+
+var logger = shim.NewLogger("Store")
+
+// 权限矩阵; 店长只能修改自己的店铺, change按字段再检查一次
+var permissions = authz.Matrix{
+	"insert":               {authz.Admin},
+	"queryByID":            authz.Everyone,
+	"queryHistory":         authz.Everyone,
+	"queryAll":             authz.Everyone,
+	"change":               authz.Managers,
+	"change.Name":          authz.Managers,
+	"change.Address":       authz.Managers,
+	"change.Region":        {authz.Admin},
+	"change.OrgMSP":        {authz.Admin},
+	"change.Managers":      {authz.Admin},
+	"setStatus":            {authz.Admin},
+	"check":                authz.Everyone,
+	"exists":               authz.Everyone,
+	"setIdempotencyWindow": {authz.Admin},
+	"purgeIdempotencyKeys": {authz.Admin},
+}
+
+// 营业状态
+const (
+	StatusPlanned = "planned" // 筹备中, 可以建立类别、进货
+	StatusOpen    = "open"    // 营业中
+	StatusClosed  = "closed"  // 已关闭, 不再接受类别与商品的写入
+)
+
+var statuses = map[string]bool{
+	StatusPlanned: true,
+	StatusOpen:    true,
+	StatusClosed:  true,
+}
+
+// 店铺
+type Record struct {
+	ID         string   `json:"ID"`
+	Name       string   `json:"Name"`
+	Address    string   `json:"Address"`
+	Region     string   `json:"Region"`
+	OrgMSP     string   `json:"OrgMSP"`   // 所属组织
+	Status     string   `json:"Status"`   // planned / open / closed
+	Managers   []string `json:"Managers"` // 店长的enrollment ID
+	CreateTime string   `json:"CreateTime"`
+}
+
+// 前缀
+const Record_Prefix = "Store_"
+
+// StoreChaincode example Store Chaincode implementation
+type StoreChaincode struct {
+}
+
+// 根据key取出记录
+func (a *StoreChaincode) getRecord(stub shim.ChaincodeStubInterface, key string) (Record, bool) {
+	var record Record
+	b, err := stub.GetState(key)
+	if b == nil {
+		return record, false
+	}
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// 保存记录
+func (a *StoreChaincode) putRecord(stub shim.ChaincodeStubInterface, key string, record Record) ([]byte, bool) {
+
+	byte, err := json.Marshal(record)
+	if err != nil {
+		return nil, false
+	}
+
+	err = stub.PutState(key, byte)
+	if err != nil {
+		return nil, false
+	}
+	// 记录提交者, 见queryHistory
+	err = history.Stamp(stub)
+	if err != nil {
+		return nil, false
+	}
+	return byte, true
+}
+
+// response message format
+func getRetByte(code int, des string, details ...errcode.Detail) []byte {
+	r := errcode.NewRet(code, des, details...)
+
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		fmt.Println("marshal Ret failed")
+		return nil
+	}
+	return b
+}
+
+// response message format
+func getRetString(code int, des string, details ...errcode.Detail) string {
+	r := errcode.NewRet(code, des, details...)
+
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		fmt.Println("marshal Ret failed")
+		return ""
+	}
+	logger.Infof("%s", string(b[:]))
+	return string(b[:])
+}
+
+// 按错误的错误码返回, 保留被调用链码的Details
+func getRetError(des string, err error) string {
+	return getRetString(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...)
+}
+
+// 交易时间(unix毫秒), 所有背书节点一致
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
+func (t *StoreChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("########### Store Chaincode Init ###########")
+	return shim.Success(nil)
+
+}
+
+// Transaction makes payment of X units from A to B
+func (t *StoreChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	resp := ledger.DispatchOnce(stub, t.dispatch)
+	if resp.Status != shim.OK {
+		// 错误返回带上交易ID
+		resp.Message = errcode.Stamp(resp.Message, stub.GetTxID())
+	}
+	return resp
+}
+
+// 按函数名分发
+func (t *StoreChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("########### chaincode Invoke ###########")
+
+	function, args := stub.GetFunctionAndParameters()
+	logger.Info("%s%s", "StoreChaincode function=", function)
+	logger.Info("%s%s", "StoreChaincode args=", args)
+	// 权限检查
+	_, err := permissions.Authorize(stub, function)
+	if err != nil {
+		res := getRetError("StoreChaincode ", err)
+		return shim.Error(res)
+	}
+	if function == "insert" {
+		// 登记店铺
+		return t.insert(stub, args)
+	} else if function == "queryHistory" {
+		// 变更历史
+		return t.queryHistory(stub, args)
+	} else if function == "queryByID" {
+		// 根据编号查询
+		return t.queryByID(stub, args)
+	} else if function == "queryAll" {
+		// 查询所有店铺, 可按区域过滤
+		return t.queryAll(stub, args)
+	} else if function == "change" {
+		// 修改信息
+		return t.change(stub, args)
+	} else if function == "setStatus" {
+		// 修改营业状态
+		return t.setStatus(stub, args)
+	} else if function == "check" {
+		// 供其他chaincode确认店铺存在且未关闭
+		return t.check(stub, args)
+	} else if function == "exists" {
+		// 记录是否存在
+		return t.exists(stub, args)
+	} else if function == "setIdempotencyWindow" {
+		// 设置幂等key的保存时间
+		return ledger.SetIdempotencyWindow(stub, args)
+	} else if function == "purgeIdempotencyKeys" {
+		// 删除已失效的幂等key
+		return ledger.PurgeIdempotencyKeys(stub, args)
+	}
+
+	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", function)
+	res := getRetString(errcode.Validation, "Unknown action: "+function, errcode.Field("function", "unknown"))
+	return shim.Error(res)
+}
+
+// 登记店铺
+// args: 0 - {Record Object}
+func (a *StoreChaincode) insert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	var record Record
+	err := schema.Strict(args[0], &record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+	if record.ID == "" || record.Name == "" || record.OrgMSP == "" {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert failed : ID, Name and OrgMSP are required")
+		return shim.Error(res)
+	}
+	if record.Status == "" {
+		record.Status = StatusPlanned
+	}
+	if !statuses[record.Status] {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert failed : unknown status "+record.Status)
+		return shim.Error(res)
+	}
+
+	//根据ID 查找是否ID已存在
+	_, existbl := a.getRecord(stub, Record_Prefix+record.ID)
+	if existbl {
+		res := getRetString(errcode.AlreadyExists, "Chaincode Invoke insert failed : the store has exist ")
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	record.CreateTime = txtime.Format(now)
+
+	// 保存记录
+	_, bl := a.putRecord(stub, Record_Prefix+record.ID, record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke insert success")
+	return shim.Success(res)
+}
+
+// 根据ID查找记录
+//
+//	0 - Store ID
+func (a *StoreChaincode) queryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "StoreChaincode queryByID args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	b, err := stub.GetState(Record_Prefix + args[0])
+	if err != nil || b == nil {
+		res := getRetString(errcode.NotFound, "StoreChaincode queryByID get record error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 查询所有店铺
+//
+//	0 - Region (可选)
+func (a *StoreChaincode) queryAll(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		res := getRetString(errcode.Validation, "StoreChaincode queryAll args should be 0 or 1", errcode.Args("want 0 or 1"))
+		return shim.Error(res)
+	}
+
+	recordsIterator, err := stub.GetStateByRange(Record_Prefix, Record_Prefix+string(utf8.MaxRune))
+	if err != nil {
+		res := getRetString(errcode.Internal, "StoreChaincode queryAll get records error")
+		return shim.Error(res)
+	}
+	defer recordsIterator.Close()
+
+	var recordList = []Record{}
+	for recordsIterator.HasNext() {
+		kv, err := recordsIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "StoreChaincode queryAll iterator error")
+			return shim.Error(res)
+		}
+		var record Record
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			res := getRetString(errcode.Internal, "StoreChaincode queryAll unmarshal failed")
+			return shim.Error(res)
+		}
+		if len(args) == 1 && record.Region != args[0] {
+			continue
+		}
+		recordList = append(recordList, record)
+	}
+
+	b, err := json.Marshal(recordList)
+	if err != nil {
+		res := getRetString(errcode.Internal, "StoreChaincode Marshal queryAll recordList error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 修改记录
+// args: 0 - ID, 1 - field (Name, Address, Region, OrgMSP, Managers), 2 - new value, Managers为JSON数组
+func (a *StoreChaincode) change(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke change args!=3", errcode.Args("want 3"))
+		return shim.Error(res)
+	}
+
+	//根据ID 查找是否ID已存在
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke change failed : change without existed record")
+		return shim.Error(res)
+	}
+
+	if args[1] == "Name" {
+		if args[2] == "" {
+			res := getRetString(errcode.Validation, "Chaincode Invoke change failed : Name is required")
+			return shim.Error(res)
+		}
+		record.Name = args[2]
+	} else if args[1] == "Address" {
+		record.Address = args[2]
+	} else if args[1] == "Region" {
+		record.Region = args[2]
+	} else if args[1] == "OrgMSP" {
+		if args[2] == "" {
+			res := getRetString(errcode.Validation, "Chaincode Invoke change failed : OrgMSP is required")
+			return shim.Error(res)
+		}
+		record.OrgMSP = args[2]
+	} else if args[1] == "Managers" {
+		var managers []string
+		err := json.Unmarshal([]byte(args[2]), &managers)
+		if err != nil {
+			res := getRetString(errcode.Validation, "Chaincode Invoke change failed : Managers should be a JSON array")
+			return shim.Error(res)
+		}
+		record.Managers = managers
+	} else {
+		res := getRetString(errcode.Validation, "wrong field: "+args[1], errcode.Field(args[1], "cannot be changed"))
+		return shim.Error(res)
+	}
+
+	// 字段级权限, 店长只能修改自己的店铺
+	_, err := permissions.Authorize(stub, "change."+args[1])
+	if err == nil {
+		err = authz.CheckStore(stub, record.ID)
+	}
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
+		return shim.Error(res)
+	}
+
+	// 保存记录
+	_, bl := a.putRecord(stub, Record_Prefix+args[0], record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke change put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke change success")
+	return shim.Success(res)
+}
+
+// 修改营业状态
+// args: 0 - ID, 1 - status (planned, open, closed)
+func (a *StoreChaincode) setStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setStatus args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	if !statuses[args[1]] {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setStatus failed : unknown status "+args[1])
+		return shim.Error(res)
+	}
+
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke setStatus failed : the store does not exist")
+		return shim.Error(res)
+	}
+	record.Status = args[1]
+
+	_, bl := a.putRecord(stub, Record_Prefix+args[0], record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke setStatus put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke setStatus success")
+	return shim.Success(res)
+}
+
+// 确认店铺存在且未关闭, 成功时返回店铺记录
+// args: 0 - Store ID
+func (a *StoreChaincode) check(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "StoreChaincode check args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "StoreChaincode check failed : unknown store "+args[0])
+		return shim.Error(res)
+	}
+	if record.Status == StatusClosed {
+		res := getRetString(errcode.BusinessRule, "StoreChaincode check failed : store "+args[0]+" is closed")
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		res := getRetString(errcode.Internal, "StoreChaincode Marshal check record error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 记录是否存在, 供其他链码(如IndexChaincode)确认引用; 不存在时返回404
+// args: 0 - ID
+func (a *StoreChaincode) exists(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "StoreChaincode exists args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	b, err := stub.GetState(Record_Prefix + args[0])
+	if err != nil {
+		res := getRetString(errcode.Internal, "StoreChaincode exists get record error")
+		return shim.Error(res)
+	}
+	if b == nil {
+		res := getRetString(errcode.NotFound, "StoreChaincode exists: no store "+args[0])
+		return shim.Error(res)
+	}
+	return shim.Success(getRetByte(0, args[0]+" exists"))
+}
+
+func main() {
+	err := shim.Start(new(StoreChaincode))
+	if err != nil {
+		logger.Errorf("Error starting Store chaincode: %s", err)
+	}
+}
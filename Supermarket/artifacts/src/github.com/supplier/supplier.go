@@ -0,0 +1,608 @@
+/*
+供应商
+登记供应商、核准供货的商品类别、证照(含有效期)与合作状态;
+进货登记商品时由CommodityChaincode调用check, 拒绝未登记、已暂停、
+未核准该类别或食品经营许可证过期的供应商
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/history"
+	"github.com/common/ledger"
+	"github.com/common/schema"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"unicode/utf8"
+)
+
+var logger = shim.NewLogger("Supplier")
+
+// 权限矩阵; 供应商只能查看、修改本公司的联系方式
+var permissions = authz.Matrix{
+	"insert":               {authz.Admin},
+	"queryByID":            {authz.Admin, authz.Manager, authz.Clerk, authz.Supplier},
+	"queryHistory":         {authz.Admin, authz.Manager, authz.Clerk, authz.Supplier},
+	"queryAll":             authz.Staff,
+	"change":               {authz.Admin, authz.Manager, authz.Supplier},
+	"change.Name":          {authz.Admin},
+	"change.Address":       {authz.Admin, authz.Manager, authz.Supplier},
+	"change.Contact":       {authz.Admin, authz.Manager, authz.Supplier},
+	"setCategories":        {authz.Admin},
+	"putLicence":           {authz.Admin},
+	"setStatus":            {authz.Admin},
+	"check":                authz.Everyone,
+	"exists":               authz.Everyone,
+	"setIdempotencyWindow": {authz.Admin},
+	"purgeIdempotencyKeys": {authz.Admin},
+}
+
+// 合作状态
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+)
+
+// 证照类型
+const (
+	LicenceFoodSafety = "food-safety" // 食品经营许可证, 进货时必须在有效期内
+	LicenceBusiness   = "business"    // 营业执照
+)
+
+// 证照或认证
+type Licence struct {
+	Type      string `json:"Type"` // food-safety, business, 或其他认证, 例如 organic
+	Number    string `json:"Number"`
+	Issuer    string `json:"Issuer"`
+	ValidFrom string `json:"ValidFrom"` // 有效期开始(unix毫秒, 兼容unix秒)
+	ValidTo   string `json:"ValidTo"`   // 有效期结束(unix毫秒, 兼容unix秒, 不含)
+}
+
+// 供应商
+type Record struct {
+	ID         string    `json:"ID"`
+	Name       string    `json:"Name"`
+	Address    string    `json:"Address"`
+	Contact    string    `json:"Contact"`
+	Status     string    `json:"Status"`     // active / suspended
+	Categories []string  `json:"Categories"` // 核准供货的类别ID
+	Licences   []Licence `json:"Licences"`
+	CreateTime string    `json:"CreateTime"`
+}
+
+// 前缀
+const Record_Prefix = "Supplier_"
+
+// SupplierChaincode example Supplier Chaincode implementation
+type SupplierChaincode struct {
+}
+
+// 根据key取出记录
+func (a *SupplierChaincode) getRecord(stub shim.ChaincodeStubInterface, key string) (Record, bool) {
+	var record Record
+	b, err := stub.GetState(key)
+	if b == nil {
+		return record, false
+	}
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// 保存记录
+func (a *SupplierChaincode) putRecord(stub shim.ChaincodeStubInterface, key string, record Record) ([]byte, bool) {
+
+	byte, err := json.Marshal(record)
+	if err != nil {
+		return nil, false
+	}
+
+	err = stub.PutState(key, byte)
+	if err != nil {
+		return nil, false
+	}
+	// 记录提交者, 见queryHistory
+	err = history.Stamp(stub)
+	if err != nil {
+		return nil, false
+	}
+	return byte, true
+}
+
+// response message format
+func getRetByte(code int, des string, details ...errcode.Detail) []byte {
+	r := errcode.NewRet(code, des, details...)
+
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		fmt.Println("marshal Ret failed")
+		return nil
+	}
+	return b
+}
+
+// response message format
+func getRetString(code int, des string, details ...errcode.Detail) string {
+	r := errcode.NewRet(code, des, details...)
+
+	b, err := json.Marshal(r)
+
+	if err != nil {
+		fmt.Println("marshal Ret failed")
+		return ""
+	}
+	logger.Infof("%s", string(b[:]))
+	return string(b[:])
+}
+
+// 按错误的错误码返回, 保留被调用链码的Details
+func getRetError(des string, err error) string {
+	return getRetString(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...)
+}
+
+// 交易时间(unix毫秒), 所有背书节点一致
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
+// 证照在now时是否有效
+func (l Licence) validAt(now int64) bool {
+	from, err1 := txtime.Parse(l.ValidFrom)
+	to, err2 := txtime.Parse(l.ValidTo)
+	return err1 == nil && err2 == nil && from <= now && now < to
+}
+
+// 是否持有now时有效的某类证照
+func (r Record) hasValidLicence(licenceType string, now int64) bool {
+	for _, l := range r.Licences {
+		if l.Type == licenceType && l.validAt(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否核准供应该类别
+func (r Record) approved(category string) bool {
+	for _, c := range r.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *SupplierChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("########### Supplier Chaincode Init ###########")
+	return shim.Success(nil)
+
+}
+
+// Transaction makes payment of X units from A to B
+func (t *SupplierChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	resp := ledger.DispatchOnce(stub, t.dispatch)
+	if resp.Status != shim.OK {
+		// 错误返回带上交易ID
+		resp.Message = errcode.Stamp(resp.Message, stub.GetTxID())
+	}
+	return resp
+}
+
+// 按函数名分发
+func (t *SupplierChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
+	logger.Info("########### chaincode Invoke ###########")
+
+	function, args := stub.GetFunctionAndParameters()
+	logger.Info("%s%s", "SupplierChaincode function=", function)
+	logger.Info("%s%s", "SupplierChaincode args=", args)
+	// 权限检查
+	_, err := permissions.Authorize(stub, function)
+	if err != nil {
+		res := getRetError("SupplierChaincode ", err)
+		return shim.Error(res)
+	}
+	if function == "insert" {
+		// 登记供应商
+		return t.insert(stub, args)
+	} else if function == "queryHistory" {
+		// 变更历史
+		return t.queryHistory(stub, args)
+	} else if function == "queryByID" {
+		// 根据编号查询
+		return t.queryByID(stub, args)
+	} else if function == "queryAll" {
+		// 查询所有供应商, 可按状态过滤
+		return t.queryAll(stub, args)
+	} else if function == "change" {
+		// 修改基本信息
+		return t.change(stub, args)
+	} else if function == "setCategories" {
+		// 设置核准供货的类别
+		return t.setCategories(stub, args)
+	} else if function == "putLicence" {
+		// 登记或更新证照
+		return t.putLicence(stub, args)
+	} else if function == "setStatus" {
+		// 启用或暂停
+		return t.setStatus(stub, args)
+	} else if function == "check" {
+		// 供CommodityChaincode在进货时校验
+		return t.check(stub, args)
+	} else if function == "exists" {
+		// 记录是否存在
+		return t.exists(stub, args)
+	} else if function == "setIdempotencyWindow" {
+		// 设置幂等key的保存时间
+		return ledger.SetIdempotencyWindow(stub, args)
+	} else if function == "purgeIdempotencyKeys" {
+		// 删除已失效的幂等key
+		return ledger.PurgeIdempotencyKeys(stub, args)
+	}
+
+	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", function)
+	res := getRetString(errcode.Validation, "Unknown action: "+function, errcode.Field("function", "unknown"))
+	return shim.Error(res)
+}
+
+// 登记供应商
+// args: 0 - {Record Object}
+func (a *SupplierChaincode) insert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	var record Record
+	err := schema.Strict(args[0], &record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+	if record.ID == "" || record.Name == "" {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert failed : ID and Name are required")
+		return shim.Error(res)
+	}
+	if record.Status == "" {
+		record.Status = StatusActive
+	}
+	if record.Status != StatusActive && record.Status != StatusSuspended {
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert failed : unknown status "+record.Status)
+		return shim.Error(res)
+	}
+	for _, l := range record.Licences {
+		if !validLicence(l) {
+			res := getRetString(errcode.Validation, "Chaincode Invoke insert failed : invalid licence "+l.Type+" "+l.Number)
+			return shim.Error(res)
+		}
+	}
+
+	//根据ID 查找是否ID已存在
+	_, existbl := a.getRecord(stub, Record_Prefix+record.ID)
+	if existbl {
+		res := getRetString(errcode.AlreadyExists, "Chaincode Invoke insert failed : the supplier has exist ")
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	record.CreateTime = txtime.Format(now)
+
+	// 保存记录
+	_, bl := a.putRecord(stub, Record_Prefix+record.ID, record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke insert success")
+	return shim.Success(res)
+}
+
+// 证照必须有类型、编号和有效期
+func validLicence(l Licence) bool {
+	if l.Type == "" || l.Number == "" {
+		return false
+	}
+	from, err1 := txtime.Parse(l.ValidFrom)
+	to, err2 := txtime.Parse(l.ValidTo)
+	return err1 == nil && err2 == nil && from < to
+}
+
+// 根据ID查找记录
+//
+//	0 - Supplier ID
+func (a *SupplierChaincode) queryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "SupplierChaincode queryByID args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	err := authz.CheckSupplier(stub, args[0])
+	if err != nil {
+		res := getRetError("SupplierChaincode queryByID: ", err)
+		return shim.Error(res)
+	}
+
+	b, err := stub.GetState(Record_Prefix + args[0])
+	if err != nil || b == nil {
+		res := getRetString(errcode.NotFound, "SupplierChaincode queryByID get record error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 查询所有供应商
+//
+//	0 - Status (可选)
+func (a *SupplierChaincode) queryAll(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		res := getRetString(errcode.Validation, "SupplierChaincode queryAll args should be 0 or 1", errcode.Args("want 0 or 1"))
+		return shim.Error(res)
+	}
+
+	recordsIterator, err := stub.GetStateByRange(Record_Prefix, Record_Prefix+string(utf8.MaxRune))
+	if err != nil {
+		res := getRetString(errcode.Internal, "SupplierChaincode queryAll get records error")
+		return shim.Error(res)
+	}
+	defer recordsIterator.Close()
+
+	var recordList = []Record{}
+	for recordsIterator.HasNext() {
+		kv, err := recordsIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "SupplierChaincode queryAll iterator error")
+			return shim.Error(res)
+		}
+		var record Record
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			res := getRetString(errcode.Internal, "SupplierChaincode queryAll unmarshal failed")
+			return shim.Error(res)
+		}
+		if len(args) == 1 && record.Status != args[0] {
+			continue
+		}
+		recordList = append(recordList, record)
+	}
+
+	b, err := json.Marshal(recordList)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SupplierChaincode Marshal queryAll recordList error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 修改基本信息
+// args: 0 - ID, 1 - field (Name, Address, Contact), 2 - new value
+func (a *SupplierChaincode) change(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke change args!=3", errcode.Args("want 3"))
+		return shim.Error(res)
+	}
+
+	//根据ID 查找是否ID已存在
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke change failed : change without existed record")
+		return shim.Error(res)
+	}
+
+	if args[1] == "Name" {
+		if args[2] == "" {
+			res := getRetString(errcode.Validation, "Chaincode Invoke change failed : Name is required")
+			return shim.Error(res)
+		}
+		record.Name = args[2]
+	} else if args[1] == "Address" {
+		record.Address = args[2]
+	} else if args[1] == "Contact" {
+		record.Contact = args[2]
+	} else {
+		res := getRetString(errcode.Validation, "wrong field: "+args[1], errcode.Field(args[1], "cannot be changed"))
+		return shim.Error(res)
+	}
+
+	// 字段级权限, 供应商只能修改本公司的信息
+	_, err := permissions.Authorize(stub, "change."+args[1])
+	if err == nil {
+		err = authz.CheckSupplier(stub, record.ID)
+	}
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
+		return shim.Error(res)
+	}
+
+	// 保存记录
+	_, bl := a.putRecord(stub, Record_Prefix+args[0], record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke change put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke change success")
+	return shim.Success(res)
+}
+
+// 设置核准供货的类别, 覆盖原有列表
+// args: 0 - ID, 1 - [Category ID, ...]
+func (a *SupplierChaincode) setCategories(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setCategories args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	var categories []string
+	err := json.Unmarshal([]byte(args[1]), &categories)
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setCategories failed : args[1] should be a JSON array")
+		return shim.Error(res)
+	}
+
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke setCategories failed : the supplier does not exist")
+		return shim.Error(res)
+	}
+	record.Categories = categories
+
+	_, bl := a.putRecord(stub, Record_Prefix+args[0], record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke setCategories put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke setCategories success")
+	return shim.Success(res)
+}
+
+// 登记证照; 类型与编号相同的证照(例如续期)被替换
+// args: 0 - ID, 1 - {Licence Object}
+func (a *SupplierChaincode) putLicence(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke putLicence args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	var licence Licence
+	err := schema.Strict(args[1], &licence)
+	if err != nil {
+		res := getRetError("Chaincode Invoke putLicence failed : ", err)
+		return shim.Error(res)
+	}
+	if !validLicence(licence) {
+		res := getRetString(errcode.Validation, "Chaincode Invoke putLicence failed : Type, Number and a valid validity window are required")
+		return shim.Error(res)
+	}
+
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke putLicence failed : the supplier does not exist")
+		return shim.Error(res)
+	}
+	replaced := false
+	for i, l := range record.Licences {
+		if l.Type == licence.Type && l.Number == licence.Number {
+			record.Licences[i] = licence
+			replaced = true
+		}
+	}
+	if !replaced {
+		record.Licences = append(record.Licences, licence)
+	}
+
+	_, bl := a.putRecord(stub, Record_Prefix+args[0], record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke putLicence put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke putLicence success")
+	return shim.Success(res)
+}
+
+// 启用或暂停供应商
+// args: 0 - ID, 1 - status (active, suspended)
+func (a *SupplierChaincode) setStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setStatus args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	if args[1] != StatusActive && args[1] != StatusSuspended {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setStatus failed : unknown status "+args[1])
+		return shim.Error(res)
+	}
+
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke setStatus failed : the supplier does not exist")
+		return shim.Error(res)
+	}
+	record.Status = args[1]
+
+	_, bl := a.putRecord(stub, Record_Prefix+args[0], record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke setStatus put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke setStatus success")
+	return shim.Success(res)
+}
+
+// 进货校验: 供应商已登记且在合作中, 核准供应该类别, 食品经营许可证在有效期内
+// args: 0 - Supplier ID, 1 - Category ID
+func (a *SupplierChaincode) check(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "SupplierChaincode check args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "SupplierChaincode check failed : unknown supplier "+args[0])
+		return shim.Error(res)
+	}
+	if record.Status != StatusActive {
+		res := getRetString(errcode.BusinessRule, "SupplierChaincode check failed : supplier "+args[0]+" is "+record.Status)
+		return shim.Error(res)
+	}
+	if !record.approved(args[1]) {
+		res := getRetString(errcode.BusinessRule, "SupplierChaincode check failed : supplier "+args[0]+" is not approved for category "+args[1])
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SupplierChaincode check failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	if !record.hasValidLicence(LicenceFoodSafety, now) {
+		res := getRetString(errcode.BusinessRule, "SupplierChaincode check failed : food-safety licence of supplier "+args[0]+" is missing or lapsed")
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		res := getRetString(errcode.Internal, "SupplierChaincode Marshal check record error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 记录是否存在, 供其他链码(如IndexChaincode)确认引用; 不存在时返回404
+// args: 0 - ID
+func (a *SupplierChaincode) exists(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "SupplierChaincode exists args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	b, err := stub.GetState(Record_Prefix + args[0])
+	if err != nil {
+		res := getRetString(errcode.Internal, "SupplierChaincode exists get record error")
+		return shim.Error(res)
+	}
+	if b == nil {
+		res := getRetString(errcode.NotFound, "SupplierChaincode exists: no supplier "+args[0])
+		return shim.Error(res)
+	}
+	return shim.Success(getRetByte(0, args[0]+" exists"))
+}
+
+func main() {
+	err := shim.Start(new(SupplierChaincode))
+	if err != nil {
+		logger.Errorf("Error starting Supplier chaincode: %s", err)
+	}
+}
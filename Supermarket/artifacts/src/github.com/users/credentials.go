@@ -0,0 +1,320 @@
+/*
+登录凭证
+密码只通过proposal的transient map传入, 不出现在交易参数和区块中;
+账本上只保存加盐、多次迭代的哈希(PBKDF2-HMAC-SHA256), 且保存在private data collection中, 区块里只有其哈希.
+盐由客户端随机生成, 与密码一起通过transient map传入, 各背书节点得到相同的盐, 不出现在区块中.
+Fabric 1.1的private data是实验特性, shim只在experimental构建下提供; 节点须以EXPERIMENTAL=true构建,
+链码实例化时带上collections_config.json. 没有private data时涉及密码的函数返回错误, 不会退回公开状态
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 保存凭证的private data collection, 定义见collections_config.json
+const CredentialsCollection = "collectionCredentials"
+
+// 凭证的key前缀; 公开状态中的 Pwd_ 为旧的明文密码, Cred_ 为曾保存在公开状态的哈希, 只在migratePasswords中读取
+const Credential_Prefix = "Cred_"
+
+// transient map中密码与盐的key
+const TransientPassword = "password"
+const TransientSalt = "salt"
+
+// 盐至少16字节, hex编码
+const minSaltLength = 16
+
+// 哈希算法与迭代次数(OWASP建议PBKDF2-HMAC-SHA256至少600000次); 凭证记录各自的迭代次数, 调整后旧凭证仍可校验
+const HashAlgorithm = "pbkdf2-sha256"
+const HashIterations = 600000
+const hashLength = 32
+
+// 没有private data时的错误
+var errNoPrivateData = errcode.New(errcode.Internal, "private data is not enabled: the peer should be built with EXPERIMENTAL=true "+
+	"and usercc instantiated with collections_config.json")
+
+// private data的读写; 只有experimental构建的shim提供, 因此在运行时检查
+type privateData interface {
+	GetPrivateData(collection, key string) ([]byte, error)
+	PutPrivateData(collection string, key string, value []byte) error
+	DelPrivateData(collection, key string) error
+}
+
+func credentialStore(stub shim.ChaincodeStubInterface) (privateData, error) {
+	store, ok := stub.(privateData)
+	if !ok {
+		return nil, errNoPrivateData
+	}
+	return store, nil
+}
+
+// 保存的凭证
+type Credential struct {
+	Algorithm  string `json:"Algorithm"`
+	Iterations int    `json:"Iterations"`
+	Salt       string `json:"Salt"` // hex
+	Hash       string `json:"Hash"` // hex
+}
+
+// PBKDF2 (RFC 8018), PRF为HMAC-SHA256
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:4])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// 生成凭证; 用户的盐由客户端的随机盐和用户ID导出, 一次迁移多个用户时各不相同
+func newCredential(clientSalt []byte, userID string, password []byte) Credential {
+	salt := sha256.Sum256(append(append(append([]byte{}, clientSalt...), 0), userID...))
+	hash := pbkdf2(password, salt[:minSaltLength], HashIterations, hashLength)
+	return Credential{
+		Algorithm:  HashAlgorithm,
+		Iterations: HashIterations,
+		Salt:       hex.EncodeToString(salt[:minSaltLength]),
+		Hash:       hex.EncodeToString(hash),
+	}
+}
+
+// 校验密码
+func (c Credential) verify(password []byte) bool {
+	if c.Algorithm != HashAlgorithm || c.Iterations <= 0 {
+		return false
+	}
+	salt, err := hex.DecodeString(c.Salt)
+	if err != nil {
+		return false
+	}
+	expected, err := hex.DecodeString(c.Hash)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(pbkdf2(password, salt, c.Iterations, len(expected)), expected)
+}
+
+// 从transient map取得密码
+func transientPassword(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	password, ok := transient[TransientPassword]
+	if !ok || len(password) == 0 {
+		return nil, errors.New("password should be passed in the transient map")
+	}
+	return password, nil
+}
+
+// 从transient map取得客户端生成的随机盐
+func transientSalt(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	salt, err := hex.DecodeString(string(transient[TransientSalt]))
+	if err != nil || len(salt) < minSaltLength {
+		return nil, errors.New("a random salt of at least " + strconv.Itoa(minSaltLength) + " bytes should be passed hex encoded in the transient map")
+	}
+	return salt, nil
+}
+
+// 保存凭证
+func (a *UsersChaincode) putCredential(stub shim.ChaincodeStubInterface, userID string, password, salt []byte) error {
+	store, err := credentialStore(stub)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(newCredential(salt, userID, password))
+	if err != nil {
+		return err
+	}
+	return store.PutPrivateData(CredentialsCollection, Credential_Prefix+userID, b)
+}
+
+// 读取凭证; 没有凭证时ok为false
+func (a *UsersChaincode) getCredential(stub shim.ChaincodeStubInterface, userID string) (credential Credential, ok bool, err error) {
+	store, err := credentialStore(stub)
+	if err != nil {
+		return credential, false, err
+	}
+	b, err := store.GetPrivateData(CredentialsCollection, Credential_Prefix+userID)
+	if err != nil || b == nil {
+		return credential, false, err
+	}
+	err = json.Unmarshal(b, &credential)
+	if err != nil {
+		return credential, false, nil
+	}
+	return credential, true, nil
+}
+
+// 删除凭证
+func (a *UsersChaincode) delCredential(stub shim.ChaincodeStubInterface, userID string) error {
+	store, err := credentialStore(stub)
+	if err != nil {
+		return err
+	}
+	return store.DelPrivateData(CredentialsCollection, Credential_Prefix+userID)
+}
+
+// 修改密码
+// transient: password - 新密码, salt - 随机盐(hex)
+// args: 0 - ID
+func (a *UsersChaincode) changePassword(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke changePassword args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	err := authz.CheckSelf(stub, args[0])
+	if err != nil {
+		res := getRetError("Chaincode Invoke changePassword failed : ", err)
+		return shim.Error(res)
+	}
+
+	_, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke changePassword failed : the ID does not exist ")
+		return shim.Error(res)
+	}
+	password, err := transientPassword(stub)
+	var salt []byte
+	if err == nil {
+		salt, err = transientSalt(stub)
+	}
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke changePassword failed : "+err.Error())
+		return shim.Error(res)
+	}
+	err = a.putCredential(stub, args[0], password, salt)
+	if err != nil {
+		res := getRetError("Chaincode Invoke changePassword put credential failed : ", err)
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke changePassword success")
+	return shim.Success(res)
+}
+
+// 一次性迁移: 将公开状态中 Pwd_<id> 的明文密码转为private data中的哈希, 删除明文,
+// 并清除用户记录中的Password字段; 曾保存在公开状态 Cred_<id> 中的哈希移入private data.
+// 已写入的历史区块无法修改, 迁移后应要求用户修改密码
+// transient: salt - 随机盐(hex)
+// args: 无
+func (a *UsersChaincode) migratePasswords(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke migratePasswords args!=0", errcode.Args("want 0"))
+		return shim.Error(res)
+	}
+	salt, err := transientSalt(stub)
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke migratePasswords failed : "+err.Error())
+		return shim.Error(res)
+	}
+	store, err := credentialStore(stub)
+	if err != nil {
+		res := getRetError("Chaincode Invoke migratePasswords failed : ", err)
+		return shim.Error(res)
+	}
+
+	pwdIterator, err := stub.GetStateByRange(Password_Prefix, Password_Prefix+string(utf8.MaxRune))
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke migratePasswords get passwords error")
+		return shim.Error(res)
+	}
+	defer pwdIterator.Close()
+
+	count := 0
+	for pwdIterator.HasNext() {
+		kv, err := pwdIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migratePasswords iterator error")
+			return shim.Error(res)
+		}
+		userID := strings.TrimPrefix(kv.Key, Password_Prefix)
+		if len(kv.Value) > 0 {
+			err = a.putCredential(stub, userID, kv.Value, salt)
+			if err != nil {
+				res := getRetError("Chaincode Invoke migratePasswords put credential failed : ", err)
+				return shim.Error(res)
+			}
+		}
+		err = stub.DelState(kv.Key)
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migratePasswords delete password failed")
+			return shim.Error(res)
+		}
+		record, existbl := a.getRecord(stub, Record_Prefix+userID)
+		if existbl && record.Password != "" {
+			record.Password = ""
+			_, bl := a.putRecord(stub, Record_Prefix+userID, record)
+			if !bl {
+				res := getRetString(errcode.Internal, "Chaincode Invoke migratePasswords put record failed")
+				return shim.Error(res)
+			}
+		}
+		count++
+	}
+
+	credIterator, err := stub.GetStateByRange(Credential_Prefix, Credential_Prefix+string(utf8.MaxRune))
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke migratePasswords get public credentials error")
+		return shim.Error(res)
+	}
+	defer credIterator.Close()
+	for credIterator.HasNext() {
+		kv, err := credIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migratePasswords iterator error")
+			return shim.Error(res)
+		}
+		err = store.PutPrivateData(CredentialsCollection, kv.Key, kv.Value)
+		if err == nil {
+			err = stub.DelState(kv.Key)
+		}
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migratePasswords move credential failed")
+			return shim.Error(res)
+		}
+		count++
+	}
+
+	res := getRetByte(0, "invoke migratePasswords success: "+strconv.Itoa(count)+" users")
+	return shim.Success(res)
+}
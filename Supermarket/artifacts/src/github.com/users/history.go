@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/common/authz"
+	"github.com/common/errcode"
+	"github.com/common/ledger"
+	"github.com/common/paging"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 查询用户的变更历史, 包括提交者和每次修改的字段; 不返回旧记录中的密码
+//
+//	0 - User ID, 1 - page size(可选), 2 - bookmark(可选, 上一页返回的交易ID)
+func (a *UsersChaincode) queryHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		res := getRetString(errcode.Validation, "UsersChaincode queryHistory args should be 1 to 3", errcode.Args("want 1 to 3"))
+		return shim.Error(res)
+	}
+	err := authz.CheckSelf(stub, args[0])
+	if err != nil {
+		res := getRetError("UsersChaincode queryHistory: ", err)
+		return shim.Error(res)
+	}
+	size, bookmark, err := paging.Args(args[1:])
+	if err != nil {
+		res := getRetString(errcode.Validation, "UsersChaincode queryHistory failed : "+err.Error())
+		return shim.Error(res)
+	}
+	b, err := ledger.KeyHistory(stub, Record_Prefix+args[0], size, bookmark, "Password")
+	if err != nil {
+		res := getRetError("UsersChaincode queryHistory error: ", err)
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
@@ -0,0 +1,42 @@
+/*
+用户记录的JSON Schema
+insert按它校验, querySchema发布同一份schema; 修改Record时同时修改这里, 否则链码无法启动.
+*/
+
+package main
+
+import (
+	"github.com/common/errcode"
+	"github.com/common/schema"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var recordSchema = schema.Schema{
+	ID:          "supermarket/user.json",
+	Title:       "User",
+	Description: "注册用户",
+	Properties: []schema.Property{
+		{Name: "ID", Type: schema.String, Required: true, Immutable: true, MaxLength: schema.IDMaxLength, Pattern: schema.IDPattern},
+		{Name: "Name", Type: schema.String, MaxLength: schema.NameMaxLength},
+		{Name: "Password", Type: schema.String, Deprecated: true, Description: "密码通过transient map传递, 不能放在记录中"},
+		{Name: "Coupon", Type: schema.String, Deprecated: true, Description: "优惠券见CouponChaincode"},
+		{Name: "VIP", Type: schema.String, ReadOnly: true, Description: "会员等级, 由消费评定"},
+		{Name: "Phone", Type: schema.String, MaxLength: 20, Pattern: `^[0-9+ -]+$`},
+		{Name: "Cost", Type: schema.Decimal, ReadOnly: true, Description: "消费总金额"},
+		{Name: "CreateTime", Type: schema.String, ReadOnly: true},
+		{Name: "PeriodCost", Type: schema.Decimal, ReadOnly: true, Description: "本评定周期内的消费"},
+		{Name: "PeriodStart", Type: schema.String, ReadOnly: true},
+		{Name: "Version", Type: schema.Integer, ReadOnly: true, NonNegative: true, Description: "版本, 每次写入加一; change时可提交查询读到的版本"},
+	},
+}
+
+// 发布用户记录的JSON Schema
+func (a *UsersChaincode) querySchema(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	b, err := recordSchema.JSON()
+	if err != nil {
+		res := getRetString(errcode.Internal, "UsersChaincode Marshal querySchema error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
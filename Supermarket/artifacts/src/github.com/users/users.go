@@ -9,25 +9,37 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/common/authz"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/events"
+	"github.com/common/history"
+	"github.com/common/ledger"
+	"github.com/common/schema"
+	"github.com/common/txtime"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"strconv"
-	"time"
+	"unicode/utf8"
 )
 
 var logger = shim.NewLogger("Users")
 
 // user
 type Record struct {
-	ID       string `json:ID`   // ID
-	Name     string `json:Name` // full name
-	Password string `json:Password`
-	Coupon   string `json:Coupon` // category id
-	//BlackList 	bool 		`json:StoreID`
-	VIP        string `json:VIP`
-	Phone      string `json:Phone`
-	Cost       string `json:Cost`       // 消费总金额
-	CreateTime string `json:CreateTime` // 创建时间
+	ID       string `json:"ID"`                 // ID
+	Name     string `json:"Name"`               // full name
+	Password string `json:"Password,omitempty"` // 已废弃, 密码哈希保存在private data collection中, 见credentials.go
+	Coupon   string `json:"Coupon"`             // 已废弃, 优惠券见CouponChaincode
+	//BlackList 	bool 		`json:"StoreID"`
+	VIP        string          `json:"VIP"`
+	Phone      string          `json:"Phone"`
+	Cost       decimal.Decimal `json:"Cost"`       // 消费总金额, 精确到分
+	CreateTime string          `json:"CreateTime"` // 创建时间
+
+	PeriodCost  decimal.Decimal `json:"PeriodCost"`  // 本评定周期内的消费
+	PeriodStart string          `json:"PeriodStart"` // 本评定周期开始时间
+	Version     int64           `json:"Version"`     // 版本, 每次写入加一
 }
 
 // VIP level
@@ -49,15 +61,36 @@ type HistoryItem struct {
 const Record_Prefix = "User_"
 const Password_Prefix = "Pwd_"
 
+// 权限矩阵; 顾客只能操作本人数据, change按字段再检查一次
+var permissions = authz.Matrix{
+	"insert":               {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"queryByID":            {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"queryHistory":         {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"change":               {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"change.Phone":         {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"change.Cost":          authz.Staff,
+	"change.VIP":           authz.Managers,
+	"refund":               authz.Staff,
+	"delete":               authz.Managers,
+	"login":                authz.Everyone,
+	"changePassword":       {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"migratePasswords":     {authz.Admin},
+	"queryByVIP":           authz.Managers,
+	"setVIPConfig":         {authz.Admin},
+	"queryVIPConfig":       authz.Everyone,
+	"getBenefits":          {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"requalify":            authz.Staff,
+	"queryVIPHistory":      {authz.Admin, authz.Manager, authz.Clerk, authz.Customer},
+	"migrate":              {authz.Admin},
+	"querySchema":          authz.Everyone,
+	"exists":               authz.Everyone,
+	"setIdempotencyWindow": {authz.Admin},
+	"purgeIdempotencyKeys": {authz.Admin},
+}
+
 // composite keys
 const IndexName = "storeID~CommID"
 
-// chaincode response结构
-type chaincodeRet struct {
-	Code int    // 0 success otherwise 1
-	Des  string //description
-}
-
 // 根据ID取出记录
 func (a *UsersChaincode) getRecord(stub shim.ChaincodeStubInterface, key string) (Record, bool) {
 	var record Record
@@ -72,9 +105,9 @@ func (a *UsersChaincode) getRecord(stub shim.ChaincodeStubInterface, key string)
 	return record, true
 }
 
-// 保存记录
+// 保存记录, 版本加一
 func (a *UsersChaincode) putRecord(stub shim.ChaincodeStubInterface, key string, record Record) ([]byte, bool) {
-
+	record.Version++
 	byte, err := json.Marshal(record)
 	if err != nil {
 		return nil, false
@@ -84,6 +117,11 @@ func (a *UsersChaincode) putRecord(stub shim.ChaincodeStubInterface, key string,
 	if err != nil {
 		return nil, false
 	}
+	// 记录提交者, 见queryHistory
+	err = history.Stamp(stub)
+	if err != nil {
+		return nil, false
+	}
 	return byte, true
 }
 
@@ -92,10 +130,8 @@ type UsersChaincode struct {
 }
 
 // response message format
-func getRetByte(code int, des string) []byte {
-	var r chaincodeRet
-	r.Code = code
-	r.Des = des
+func getRetByte(code int, des string, details ...errcode.Detail) []byte {
+	r := errcode.NewRet(code, des, details...)
 
 	b, err := json.Marshal(r)
 
@@ -107,10 +143,8 @@ func getRetByte(code int, des string) []byte {
 }
 
 // response message format
-func getRetString(code int, des string) string {
-	var r chaincodeRet
-	r.Code = code
-	r.Des = des
+func getRetString(code int, des string, details ...errcode.Detail) string {
+	r := errcode.NewRet(code, des, details...)
 
 	b, err := json.Marshal(r)
 
@@ -122,6 +156,11 @@ func getRetString(code int, des string) string {
 	return string(b[:])
 }
 
+// 按错误的错误码返回, 保留被调用链码的Details
+func getRetError(des string, err error) string {
+	return getRetString(errcode.Code(err), des+err.Error(), errcode.DetailsOf(err)...)
+}
+
 func (a *UsersChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### Users Chaincode Init ###########")
 	//val, ok, err := cid.GetAttributeValue(stub, "type")
@@ -134,69 +173,159 @@ func (a *UsersChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 
 // Transaction makes payment of X units from A to B
 func (a *UsersChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	resp := ledger.DispatchOnce(stub, a.dispatch)
+	if resp.Status != shim.OK {
+		// 错误返回带上交易ID
+		resp.Message = errcode.Stamp(resp.Message, stub.GetTxID())
+	}
+	return resp
+}
+
+// 按函数名分发
+func (a *UsersChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### chaincode Invoke ###########")
 
 	function, args := stub.GetFunctionAndParameters()
 	logger.Info("%s%s", "UsersChaincode function=", function)
 	logger.Info("%s%s", "UsersChaincode args=", args)
+	// 权限检查
+	_, err := permissions.Authorize(stub, function)
+	if err != nil {
+		res := getRetError("UsersChaincode ", err)
+		return shim.Error(res)
+	}
 	if function == "insert" {
 		// 插入信息
 		return a.insert(stub, args)
+	} else if function == "queryHistory" {
+		// 变更历史
+		return a.queryHistory(stub, args)
 	} else if function == "queryByID" {
 		// 根据编号查询
 		return a.queryByID(stub, args)
 	} else if function == "change" {
 		// 修改记录
 		return a.change(stub, args)
+	} else if function == "refund" {
+		// 退货扣减累计消费
+		return a.refund(stub, args)
 	} else if function == "delete" {
 		// 删除记录
 		return a.delete(stub, args)
 	} else if function == "login" {
 		// 登录
 		return a.login(stub, args)
+	} else if function == "changePassword" {
+		// 修改密码
+		return a.changePassword(stub, args)
+	} else if function == "migratePasswords" {
+		// 将明文密码迁移为加盐哈希
+		return a.migratePasswords(stub, args)
+	} else if function == "queryByVIP" {
+		// 查询某一等级的用户
+		return a.queryByVIP(stub, args)
+	} else if function == "setVIPConfig" {
+		// 设置会员等级配置
+		return a.setVIPConfig(stub, args)
+	} else if function == "queryVIPConfig" {
+		// 查询会员等级配置
+		return a.queryVIPConfig(stub, args)
+	} else if function == "getBenefits" {
+		// 查询会员权益
+		return a.getBenefits(stub, args)
+	} else if function == "requalify" {
+		// 周期重新评定等级
+		return a.requalify(stub, args)
+	} else if function == "queryVIPHistory" {
+		// 查询等级历史
+		return a.queryVIPHistory(stub, args)
+	} else if function == "migrate" {
+		// 将旧的浮点数值改写为规范的定点小数
+		return a.migrate(stub, args)
+	} else if function == "querySchema" {
+		// 查询记录的JSON Schema
+		return a.querySchema(stub, args)
+	} else if function == "exists" {
+		// 记录是否存在
+		return a.exists(stub, args)
+	} else if function == "setIdempotencyWindow" {
+		// 设置幂等key的保存时间
+		return ledger.SetIdempotencyWindow(stub, args)
+	} else if function == "purgeIdempotencyKeys" {
+		// 删除已失效的幂等key
+		return ledger.PurgeIdempotencyKeys(stub, args)
 	}
 
-	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", args[0])
-	res := getRetString(1, "Unknown action")
+	logger.Errorf("Unknown action, check the first argument. Wrong action: %v", function)
+	res := getRetString(errcode.Validation, "Unknown action: "+function, errcode.Field("function", "unknown"))
 	return shim.Error(res)
 }
 
 // 加入新记录, register
-// args: 0 - {Record Object}
+// transient: password - 密码, salt - 随机盐(hex)
+// args: 0 - {Record Object}, 不含Password
 func (a *UsersChaincode) insert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke insert args!=1")
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
+	// 密码通过transient map传递, 记录中的Password须为空
 	var record Record
-	err := json.Unmarshal([]byte(args[0]), &record)
+	err := recordSchema.Decode(args[0], &record)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+	err = authz.CheckSelf(stub, record.ID)
+	if err != nil {
+		res := getRetError("Chaincode Invoke insert failed : ", err)
+		return shim.Error(res)
+	}
+	password, err := transientPassword(stub)
+	var salt []byte
+	if err == nil {
+		salt, err = transientSalt(stub)
+	}
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insert unmarshal failed")
+		res := getRetString(errcode.Validation, "Chaincode Invoke insert failed : "+err.Error())
 		return shim.Error(res)
 	}
 
 	//根据ID 查找是否ID已存在
 	_, existbl := a.getRecord(stub, Record_Prefix+record.ID)
 	if existbl {
-		res := getRetString(1, "Chaincode Invoke insert failed : the recordNo has exist ")
+		res := getRetString(errcode.AlreadyExists, "Chaincode Invoke insert failed : the recordNo has exist ")
+		return shim.Error(res)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert failed :get time stamp failed ")
 		return shim.Error(res)
 	}
-	//13位时间戳
-	record.CreateTime = strconv.FormatInt(time.Now().Unix(), 10)
+	//13位时间戳(毫秒)
+	record.CreateTime = txtime.Format(now)
 
 	record.VIP = VIPLevel0
-	record.Cost = "0"
+	record.Cost = decimal.Zero
+	record.PeriodCost = decimal.Zero
+	record.PeriodStart = record.CreateTime
+	record.Version = 0
 	// 保存记录
 	_, bl := a.putRecord(stub, Record_Prefix+record.ID, record)
 	if !bl {
-		res := getRetString(1, "Chaincode Invoke insert put record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert put record failed")
 		return shim.Error(res)
 	}
 
-	err = stub.PutState(Password_Prefix+record.ID, []byte(record.Password))
+	err = a.putCredential(stub, record.ID, password, salt)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke insert put password failed")
+		res := getRetError("Chaincode Invoke insert put credential failed : ", err)
+		return shim.Error(res)
+	}
+	err = events.Emit(stub, events.UserRegistered, events.User{ID: record.ID, VIP: record.VIP})
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke insert set event failed")
 		return shim.Error(res)
 	}
 
@@ -204,100 +333,238 @@ func (a *UsersChaincode) insert(stub shim.ChaincodeStubInterface, args []string)
 	return shim.Success(res)
 }
 
-// login
-// args: 0 - ID, 1 - password (md5)
+// login, 与账本上的密码哈希比对
+// transient: password - 密码
+// args: 0 - ID
 func (a *UsersChaincode) login(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 2 {
-		res := getRetString(1, "Chaincode Invoke login args!=2")
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke login args!=1, password should be passed in the transient map", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
-	//根据ID 查找是否ID已存在
-	password, err := stub.GetState(Password_Prefix + args[0])
+	password, err := transientPassword(stub)
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke login failed : the ID does not exist ")
+		res := getRetString(errcode.Validation, "Chaincode Invoke login failed : "+err.Error())
 		return shim.Error(res)
 	}
 
-	if string(password) == args[1] {
+	//根据ID 查找凭证
+	// 登录失败也要提交交易才能发出LoginFailed事件, 因此不返回shim.Error, 而是在payload中返回错误码;
+	// 用户不存在与密码错误返回相同的结果, 不泄露ID是否存在
+	reason := ""
+	credential, existbl, err := a.getCredential(stub, args[0])
+	if err != nil {
+		res := getRetError("Chaincode Invoke login get credential failed : ", err)
+		return shim.Error(res)
+	}
+	if !existbl {
+		reason = "unknown-user"
+	} else if !credential.verify(password) {
+		reason = "bad-password"
+	}
+	if reason == "" {
 		res := getRetByte(0, "success")
 		return shim.Success(res)
-	} else {
-		res := getRetByte(0, "failed")
-		return shim.Success(res)
 	}
 
+	err = events.Emit(stub, events.LoginFailed, events.LoginFailure{ID: args[0], Reason: reason})
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke login set event failed")
+		return shim.Error(res)
+	}
+	res := errcode.Stamp(getRetString(errcode.Unauthenticated, "Chaincode Invoke login failed : wrong ID or password"), stub.GetTxID())
+	return shim.Success([]byte(res))
 }
 
 // 根据ID查找记录
-//  0 - Users ID
+//
+//	0 - Users ID
 func (a *UsersChaincode) queryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "UsersChaincode queryByRecordNo args!=1")
+		res := getRetString(errcode.Validation, "UsersChaincode queryByID args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	err := authz.CheckSelf(stub, args[0])
+	if err != nil {
+		res := getRetError("UsersChaincode queryByID: ", err)
 		return shim.Error(res)
 	}
 
 	// 取得该记录
 	record, bl := a.getRecord(stub, Record_Prefix+args[0])
 	if !bl {
-		res := getRetString(1, "UsersChaincode queryByRecordNo get record error")
+		res := getRetString(errcode.NotFound, "UsersChaincode queryByID get record error")
 		return shim.Error(res)
 	}
+	// 不返回任何凭证信息
+	record.Password = ""
 
 	b, err := json.Marshal(record)
 	if err != nil {
-		res := getRetString(1, "UsersChaincode Marshal queryByRecordNo recordList error")
+		res := getRetString(errcode.Internal, "UsersChaincode Marshal queryByID recordList error")
 		return shim.Error(res)
 	}
 	return shim.Success(b)
 }
 
-// TODO unused
+// change的返回, 等级发生变化时带上变化;
+// 结账时累计消费引起的升级由被调用的usercc发出的事件不会提交, 由SalesChaincode据此发出VIPChanged
+type ChangeResult struct {
+	errcode.Ret
+	VIPChange *VIPHistoryItem `json:"VIPChange,omitempty"`
+}
+
 // 修改记录
-// args: 0 - ID, 1 - json field, 2 - new value
+// 可选的version为查询时读到的版本, 记录已被他人修改时返回412; 结账累计消费等不需要检查版本的调用不传
+// args: 0 - ID, 1 - json field, 2 - new value, 3 - version(可选)
 func (a *UsersChaincode) change(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 3 {
-		res := getRetString(1, "Chaincode Invoke change args!=3")
+	if len(args) != 3 && len(args) != 4 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke change args should be 3 or 4", errcode.Args("want 3 or 4"))
 		return shim.Error(res)
 	}
 
 	//根据ID 查找是否ID已存在
 	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
 	if !existbl {
-		res := getRetString(1, "Chaincode Invoke change failed : change without existed record")
+		res := getRetString(errcode.NotFound, "Chaincode Invoke change failed : change without existed record")
 		return shim.Error(res)
 	}
+	if len(args) == 4 {
+		expected, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || expected < 0 {
+			res := getRetString(errcode.Validation, "Chaincode Invoke change failed : version should be a non-negative integer", errcode.Field(schema.VersionField, "should be a non-negative integer"))
+			return shim.Error(res)
+		}
+		err = schema.CheckVersion(expected, record.Version)
+		if err != nil {
+			res := getRetError("Chaincode Invoke change failed : ", err)
+			return shim.Error(res)
+		}
+	}
+	var item *VIPHistoryItem
+	var err error
 	if args[1] == "Coupon" {
-		record.Coupon = args[2]
+		res := getRetString(errcode.Validation, "Chaincode Invoke change failed : Coupon is deprecated, issue coupons with CouponChaincode", errcode.Field("Coupon", "is deprecated"))
+		return shim.Error(res)
 	} else if args[1] == "VIP" {
-		record.VIP = args[2]
+		if vipRank(args[2]) < 0 {
+			res := getRetString(errcode.Validation, "Chaincode Invoke change failed : unknown VIP level "+args[2])
+			return shim.Error(res)
+		}
+		if args[2] != record.VIP {
+			item, err = a.changeLevel(stub, &record, args[2], VIPReasonManual, record.Cost)
+			if err != nil {
+				res := getRetError("Chaincode Invoke change failed : ", err)
+				return shim.Error(res)
+			}
+		}
 	} else if args[1] == "Phone" {
 		record.Phone = args[2]
 	} else if args[1] == "Cost" {
-		cost, err := strconv.ParseFloat(record.Cost, 32)
+		add, err := decimal.Parse(args[2])
 		if err != nil {
-			res := getRetString(1, "Chaincode Invoke change failed : cannot convert record.Cost to float")
+			res := getRetString(errcode.Validation, "Chaincode Invoke change failed : cannot convert args[2] to decimal")
 			return shim.Error(res)
 		}
-		add, err := strconv.ParseFloat(args[2], 32)
+		// 累计消费只能增加, 退货经refund扣减
+		if add.Sign() <= 0 {
+			res := getRetString(errcode.Validation, "Chaincode Invoke change failed : Cost can only be increased", errcode.Field("Cost", "should be positive"))
+			return shim.Error(res)
+		}
+		record.Cost, err = record.Cost.Add(add.RoundCents())
+		if err == nil {
+			record.PeriodCost, err = record.PeriodCost.Add(add.RoundCents())
+		}
 		if err != nil {
-			res := getRetString(1, "Chaincode Invoke change failed : cannot convert record.Cost to float")
+			res := getRetString(errcode.Validation, "Chaincode Invoke change failed : "+err.Error())
+			return shim.Error(res)
+		}
+		// 消费增加后自动评定等级
+		item, err = a.promote(stub, &record)
+		if err != nil {
+			res := getRetError("Chaincode Invoke change failed : ", err)
 			return shim.Error(res)
 		}
-		record.Cost = strconv.FormatFloat(cost+add, 'f', 2, 32)
 	} else {
-		res := getRetString(1, "wrong field: "+args[1])
+		res := getRetString(errcode.Validation, "wrong field: "+args[1], errcode.Field(args[1], "cannot be changed"))
+		return shim.Error(res)
+	}
+
+	// 字段级权限
+	_, err = permissions.Authorize(stub, "change."+args[1])
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
+		return shim.Error(res)
+	}
+	err = authz.CheckSelf(stub, args[0])
+	if err != nil {
+		res := getRetError("Chaincode Invoke change failed : ", err)
 		return shim.Error(res)
 	}
 
 	// 保存记录
 	_, bl := a.putRecord(stub, Record_Prefix+args[0], record)
 	if !bl {
-		res := getRetString(1, "Chaincode Invoke change put record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke change put record failed")
+		return shim.Error(res)
+	}
+	if item != nil {
+		err = a.putVIPHistory(stub, item)
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke change put VIP history failed")
+			return shim.Error(res)
+		}
+	}
+
+	b, err := json.Marshal(ChangeResult{Ret: errcode.NewRet(0, "invoke change success"), VIPChange: item})
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke change marshal result failed")
 		return shim.Error(res)
 	}
+	return shim.Success(b)
+}
 
-	res := getRetByte(0, "invoke change success")
+// 扣减消费, 不低于0
+func reduce(cost, amount decimal.Decimal) decimal.Decimal {
+	if amount.Cmp(cost) >= 0 {
+		return decimal.Zero
+	}
+	left, _ := cost.Sub(amount) // 0 < amount < cost, 不会越界
+	return left
+}
+
+// 退货时扣减累计消费, 不低于0; 只能由SalesChaincode.returnGoods调用. 等级不随之降低, 由周期评定处理
+// args: 0 - ID, 1 - 退款金额
+func (a *UsersChaincode) refund(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke refund args!=2", errcode.Args("want 2"))
+		return shim.Error(res)
+	}
+	if ledger.TopLevel(stub) {
+		res := getRetString(errcode.Forbidden, "Chaincode Invoke refund failed : only SalesChaincode.returnGoods can refund")
+		return shim.Error(res)
+	}
+	amount, err := decimal.Parse(args[1])
+	if err != nil || amount.Sign() <= 0 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke refund failed : amount should be a positive decimal", errcode.Field("amount", "should be positive"))
+		return shim.Error(res)
+	}
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke refund failed : record does not exist")
+		return shim.Error(res)
+	}
+
+	amount = amount.RoundCents()
+	record.Cost = reduce(record.Cost, amount)
+	record.PeriodCost = reduce(record.PeriodCost, amount)
+	_, bl := a.putRecord(stub, Record_Prefix+args[0], record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke refund put record failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke refund success")
 	return shim.Success(res)
 }
 
@@ -305,20 +572,30 @@ func (a *UsersChaincode) change(stub shim.ChaincodeStubInterface, args []string)
 // args: 0 - ID
 func (a *UsersChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		res := getRetString(1, "Chaincode Invoke delete args!=1")
+		res := getRetString(errcode.Validation, "Chaincode Invoke delete args!=1", errcode.Args("want 1"))
 		return shim.Error(res)
 	}
 
 	//根据ID 查找是否ID已存在
 	_, existbl := a.getRecord(stub, Record_Prefix+args[0])
 	if !existbl {
-		res := getRetString(1, "Chaincode Invoke delete failed : delete without existed record ")
+		res := getRetString(errcode.NotFound, "Chaincode Invoke delete failed : delete without existed record ")
 		return shim.Error(res)
 	}
 
 	err := stub.DelState(Record_Prefix + args[0])
 	if err != nil {
-		res := getRetString(1, "Chaincode Invoke delete delete record failed")
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete delete record failed")
+		return shim.Error(res)
+	}
+	err = history.Stamp(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke delete stamp history failed")
+		return shim.Error(res)
+	}
+	err = a.delCredential(stub, args[0])
+	if err != nil {
+		res := getRetError("Chaincode Invoke delete delete credential failed : ", err)
 		return shim.Error(res)
 	}
 
@@ -326,8 +603,117 @@ func (a *UsersChaincode) delete(stub shim.ChaincodeStubInterface, args []string)
 	return shim.Success(res)
 }
 
+// 查询某一等级的所有用户, 只返回用户ID
+// args: 0 - VIP level
+func (a *UsersChaincode) queryByVIP(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "UsersChaincode queryByVIP args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	recordsIterator, err := stub.GetStateByRange(Record_Prefix, Record_Prefix+string(utf8.MaxRune))
+	if err != nil {
+		res := getRetString(errcode.Internal, "UsersChaincode queryByVIP get records error")
+		return shim.Error(res)
+	}
+	defer recordsIterator.Close()
+
+	var idList = []string{}
+	for recordsIterator.HasNext() {
+		kv, err := recordsIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "UsersChaincode queryByVIP iterator error")
+			return shim.Error(res)
+		}
+		var record Record
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil {
+			res := getRetString(errcode.Internal, "UsersChaincode queryByVIP unmarshal failed")
+			return shim.Error(res)
+		}
+		if record.VIP == args[0] {
+			idList = append(idList, record.ID)
+		}
+	}
+
+	b, err := json.Marshal(idList)
+	if err != nil {
+		res := getRetString(errcode.Internal, "UsersChaincode Marshal queryByVIP idList error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 迁移旧数据: 旧记录中的Cost是strconv.FormatFloat产生的字符串,
+// 这里按decimal.NormalizeLegacy兼容解析, 按分舍入后改写为规范格式; 迁移前这类记录无法按严格格式读取
+// args: 无
+func (a *UsersChaincode) migrate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke migrate args!=0", errcode.Args("want 0"))
+		return shim.Error(res)
+	}
+
+	recordsIterator, err := stub.GetStateByRange(Record_Prefix, Record_Prefix+string(utf8.MaxRune))
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke migrate get records error")
+		return shim.Error(res)
+	}
+	defer recordsIterator.Close()
+	count := 0
+	for recordsIterator.HasNext() {
+		kv, err := recordsIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate iterator error")
+			return shim.Error(res)
+		}
+		var record Record
+		b, err := decimal.NormalizeLegacy(kv.Value, "Cost", "PeriodCost")
+		if err == nil {
+			err = json.Unmarshal(b, &record)
+		}
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate unmarshal failed: "+kv.Key)
+			return shim.Error(res)
+		}
+		record.Cost = record.Cost.RoundCents()
+		_, bl := a.putRecord(stub, kv.Key, record)
+		if !bl {
+			res := getRetString(errcode.Internal, "Chaincode Invoke migrate put record failed")
+			return shim.Error(res)
+		}
+		count++
+	}
+
+	res := getRetByte(0, "invoke migrate success: "+strconv.Itoa(count)+" records")
+	return shim.Success(res)
+}
+
+// 记录是否存在, 供其他链码(如IndexChaincode)确认引用; 不存在时返回404
+// args: 0 - ID
+func (a *UsersChaincode) exists(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "UsersChaincode exists args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	b, err := stub.GetState(Record_Prefix + args[0])
+	if err != nil {
+		res := getRetString(errcode.Internal, "UsersChaincode exists get record error")
+		return shim.Error(res)
+	}
+	if b == nil {
+		res := getRetString(errcode.NotFound, "UsersChaincode exists: no user "+args[0])
+		return shim.Error(res)
+	}
+	return shim.Success(getRetByte(0, args[0]+" exists"))
+}
+
 func main() {
-	err := shim.Start(new(UsersChaincode))
+	err := recordSchema.Sync(Record{})
+	if err != nil {
+		logger.Errorf("Error starting Users chaincode: %s", err)
+		return
+	}
+	err = shim.Start(new(UsersChaincode))
 	if err != nil {
 		logger.Errorf("Error starting Users chaincode: %s", err)
 	}
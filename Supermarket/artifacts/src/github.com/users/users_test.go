@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/common/errcode"
+	"github.com/common/ledger/ledgertest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	t0       = time.Unix(1500000000, 0)
+	customer = ledgertest.Creator("Org1MSP", "u1", map[string]string{"role": "customer"})
+	manager  = ledgertest.Creator("Org1MSP", "bob", map[string]string{"role": "manager", "storeID": "S1"})
+	admin    = ledgertest.Creator("Org1MSP", "root", map[string]string{"role": "admin"})
+	salt     = "00112233445566778899aabbccddeeff"
+)
+
+func code(resp pb.Response) int {
+	if resp.Status != shim.OK {
+		return errcode.FromResponse(resp.Message).Code
+	}
+	// login失败时在payload中返回错误码, 成功时为0
+	var ret struct{ Code int }
+	json.Unmarshal(resp.Payload, &ret)
+	if ret.Code == 0 {
+		return errcode.OK
+	}
+	return ret.Code
+}
+
+// 密码与哈希都不出现在公开状态中
+func checkPublic(t *testing.T, name string, stub *ledgertest.Stub, secrets ...string) {
+	for key, value := range stub.State {
+		for _, s := range append(secrets, `"Hash"`) {
+			if bytes.Contains(value, []byte(s)) {
+				t.Errorf("%s: public key %s contains %s: %s", name, key, s, value)
+			}
+		}
+	}
+}
+
+// 按顺序执行, 后面的步骤依赖前面保存的凭证
+func TestCredentials(t *testing.T) {
+	stub := ledgertest.NewStub("usercc", new(UsersChaincode))
+	cases := []struct {
+		name      string
+		creator   []byte
+		args      []string
+		transient map[string]string
+		code      int
+	}{
+		{"register without salt", customer, []string{"insert", `{"ID":"u1","Name":"Ann"}`}, map[string]string{"password": "secret-1"}, errcode.Validation},
+		{"register with a short salt", customer, []string{"insert", `{"ID":"u1","Name":"Ann"}`}, map[string]string{"password": "secret-1", "salt": "0011"}, errcode.Validation},
+		{"register", customer, []string{"insert", `{"ID":"u1","Name":"Ann"}`}, map[string]string{"password": "secret-1", "salt": salt}, errcode.OK},
+		{"login", customer, []string{"login", "u1"}, map[string]string{"password": "secret-1"}, errcode.OK},
+		{"wrong password", customer, []string{"login", "u1"}, map[string]string{"password": "secret-2"}, errcode.Unauthenticated},
+		{"unknown user", customer, []string{"login", "u9"}, map[string]string{"password": "secret-1"}, errcode.Unauthenticated},
+		{"change password", customer, []string{"changePassword", "u1"}, map[string]string{"password": "secret-2", "salt": salt}, errcode.OK},
+		{"old password", customer, []string{"login", "u1"}, map[string]string{"password": "secret-1"}, errcode.Unauthenticated},
+		{"new password", customer, []string{"login", "u1"}, map[string]string{"password": "secret-2"}, errcode.OK},
+		{"delete", manager, []string{"delete", "u1"}, nil, errcode.OK},
+		{"deleted user", customer, []string{"login", "u1"}, map[string]string{"password": "secret-2"}, errcode.Unauthenticated},
+	}
+	for i, c := range cases {
+		transient := map[string][]byte{}
+		for k, v := range c.transient {
+			transient[k] = []byte(v)
+		}
+		resp := stub.Invoke(ledgertest.Proposal{TxID: "tx" + strconv.Itoa(i), Creator: c.creator, Time: t0, Args: c.args, Transient: transient})
+		if got := code(resp); got != c.code {
+			t.Errorf("%s: code %d, want %d: %s %s", c.name, got, c.code, resp.Message, resp.Payload)
+		}
+		checkPublic(t, c.name, stub, "secret-1", "secret-2")
+	}
+	if len(stub.Private[CredentialsCollection]) != 0 {
+		t.Errorf("credentials left after delete: %q", stub.Private[CredentialsCollection])
+	}
+}
+
+// 公开状态中的明文密码与哈希移入private data
+func TestMigratePasswords(t *testing.T) {
+	stub := ledgertest.NewStub("usercc", new(UsersChaincode))
+	record, _ := json.Marshal(Record{ID: "u1", Name: "Ann", Password: "plain-1"})
+	stub.Put(Record_Prefix+"u1", record)
+	stub.Put(Password_Prefix+"u1", []byte("plain-1"))
+	legacy, _ := json.Marshal(newCredential([]byte(salt), "u2", []byte("plain-2")))
+	stub.Put(Credential_Prefix+"u2", legacy)
+
+	migrate := ledgertest.Proposal{TxID: "migrate", Creator: admin, Time: t0, Args: []string{"migratePasswords"}}
+	if resp := stub.Invoke(migrate); code(resp) != errcode.Validation {
+		t.Errorf("migrate without salt: %s", resp.Message)
+	}
+	migrate.Transient = map[string][]byte{TransientSalt: []byte(salt)}
+	if resp := stub.Invoke(migrate); resp.Status != shim.OK {
+		t.Fatalf("migrate: %s", resp.Message)
+	}
+	checkPublic(t, "migrate", stub, "plain-1", "plain-2")
+	for _, c := range []struct{ id, password string }{{"u1", "plain-1"}, {"u2", "plain-2"}} {
+		resp := stub.Invoke(ledgertest.Proposal{TxID: "login-" + c.id, Creator: customer, Time: t0, Args: []string{"login", c.id},
+			Transient: map[string][]byte{TransientPassword: []byte(c.password)}})
+		if code(resp) != errcode.OK {
+			t.Errorf("login %s after migration: %s %s", c.id, resp.Message, resp.Payload)
+		}
+	}
+}
+
+// 没有private data的节点上不退回公开状态
+func TestNoPrivateData(t *testing.T) {
+	stub := ledgertest.NewStub("usercc", new(UsersChaincode))
+	// 只有stable接口的stub, 与非experimental构建的shim相同
+	stable := struct{ shim.ChaincodeStubInterface }{stub}
+	err := new(UsersChaincode).putCredential(stable, "u1", []byte("secret"), []byte(salt))
+	if err != errNoPrivateData {
+		t.Errorf("putCredential = %v, want %v", err, errNoPrivateData)
+	}
+	if _, _, err := new(UsersChaincode).getCredential(stable, "u1"); err != errNoPrivateData {
+		t.Errorf("getCredential = %v, want %v", err, errNoPrivateData)
+	}
+}
+
+// 等级变化随change的返回交给调用者
+func TestChangeReturnsVIPChange(t *testing.T) {
+	stub := ledgertest.NewStub("usercc", new(UsersChaincode))
+	record, _ := json.Marshal(Record{ID: "u1", Name: "Ann", VIP: VIPLevel0})
+	stub.Put(Record_Prefix+"u1", record)
+	cases := []struct {
+		name string
+		args []string
+		to   string
+	}{
+		{"phone", []string{"change", "u1", "Phone", "555"}, ""},
+		{"level", []string{"change", "u1", "VIP", VIPLevel2}, VIPLevel2},
+		{"same level", []string{"change", "u1", "VIP", VIPLevel2}, ""},
+	}
+	for i, c := range cases {
+		resp := stub.Invoke(ledgertest.Proposal{TxID: "change" + strconv.Itoa(i), Creator: manager, Time: t0, Args: c.args})
+		var ret ChangeResult
+		if err := json.Unmarshal(resp.Payload, &ret); err != nil || resp.Status != shim.OK {
+			t.Fatalf("%s: %s %s", c.name, resp.Message, resp.Payload)
+		}
+		to := ""
+		if ret.VIPChange != nil {
+			to = ret.VIPChange.To
+		}
+		if to != c.to {
+			t.Errorf("%s: VIPChange = %+v, want to %q", c.name, ret.VIPChange, c.to)
+		}
+	}
+}
+
+// 已废弃的Coupon字段不能再修改, 优惠券由CouponChaincode发放
+func TestChangeCoupon(t *testing.T) {
+	stub := ledgertest.NewStub("usercc", new(UsersChaincode))
+	record, _ := json.Marshal(Record{ID: "u1", Name: "Ann", VIP: VIPLevel0})
+	stub.Put(Record_Prefix+"u1", record)
+	resp := stub.Invoke(ledgertest.Proposal{TxID: "tx1", Creator: manager, Time: t0, Args: []string{"change", "u1", "Coupon", "K1"}})
+	if code(resp) != errcode.Validation {
+		t.Errorf("change Coupon: %s", resp.Message)
+	}
+	if b, _ := stub.GetState(Record_Prefix + "u1"); !bytes.Equal(b, record) {
+		t.Errorf("record changed: %s", b)
+	}
+}
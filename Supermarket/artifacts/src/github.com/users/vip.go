@@ -0,0 +1,417 @@
+/*
+会员等级
+门槛与权益配置保存在账本上, 累计消费增加时自动重新评定等级,
+等级变化时写入一条等级历史并发出VIPChanged事件.
+配置了重新评定周期时, 以周期内的消费评定, 周期结束后可通过requalify降级.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/common/authz"
+	"github.com/common/decimal"
+	"github.com/common/errcode"
+	"github.com/common/events"
+	"github.com/common/schema"
+	"github.com/common/txtime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 等级配置的key
+const VIPConfigKey = "VIPConfig"
+
+// composite keys
+const VIPHistoryIndexName = "userID~txID"
+
+// 等级变化原因
+const (
+	VIPReasonSpend     = "spend"     // 累计消费达到门槛
+	VIPReasonRequalify = "requalify" // 周期重新评定
+	VIPReasonManual    = "manual"    // 手工修改
+)
+
+// 等级从低到高
+var vipLevels = []string{VIPLevel0, VIPLevel1, VIPLevel2, VIPLevel3, VIPLevel4}
+
+// 一个等级的门槛与权益
+type VIPTier struct {
+	Level    string          `json:"Level"`
+	MinCost  decimal.Decimal `json:"MinCost"`  // 消费门槛
+	Discount decimal.Decimal `json:"Discount"` // 折扣百分比, 5 表示优惠5%
+}
+
+// 等级配置
+type VIPConfig struct {
+	Tiers           []VIPTier `json:"Tiers"`           // 每个等级一项, 按等级从低到高
+	RequalifyPeriod int64     `json:"RequalifyPeriod"` // 重新评定周期(秒), 0 表示只升不降
+}
+
+// 等级历史
+type VIPHistoryItem struct {
+	UserID string          `json:"UserID"`
+	From   string          `json:"From"`
+	To     string          `json:"To"`
+	Reason string          `json:"Reason"`
+	Cost   decimal.Decimal `json:"Cost"` // 评定所依据的消费
+	TxID   string          `json:"TxID"`
+	Time   string          `json:"Time"`
+}
+
+// 会员权益, 供结账时使用
+type VIPBenefits struct {
+	ID       string          `json:"ID"`
+	VIP      string          `json:"VIP"`
+	Discount decimal.Decimal `json:"Discount"`
+}
+
+// 未配置时的默认门槛
+func defaultVIPConfig() VIPConfig {
+	return VIPConfig{
+		Tiers: []VIPTier{
+			{Level: VIPLevel0, MinCost: decimal.Zero, Discount: decimal.Zero},
+			{Level: VIPLevel1, MinCost: decimal.FromInt(1000), Discount: decimal.FromInt(2)},
+			{Level: VIPLevel2, MinCost: decimal.FromInt(5000), Discount: decimal.FromInt(5)},
+			{Level: VIPLevel3, MinCost: decimal.FromInt(20000), Discount: decimal.FromInt(8)},
+			{Level: VIPLevel4, MinCost: decimal.FromInt(50000), Discount: decimal.FromInt(10)},
+		},
+	}
+}
+
+// 等级的序号, 未知等级返回-1
+func vipRank(level string) int {
+	for i, l := range vipLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// 检查配置: 每个等级恰好一项且按顺序, 门槛递增, 折扣在0到100之间
+func (c VIPConfig) validate() error {
+	if len(c.Tiers) != len(vipLevels) {
+		return errors.New("Tiers should list every VIP level")
+	}
+	for i, tier := range c.Tiers {
+		if tier.Level != vipLevels[i] {
+			return errors.New("Tiers should be ordered from " + VIPLevel0 + " to " + VIPLevel4)
+		}
+		if i == 0 && !tier.MinCost.IsZero() {
+			return errors.New("MinCost of " + VIPLevel0 + " should be 0")
+		}
+		if i > 0 && tier.MinCost.Cmp(c.Tiers[i-1].MinCost) <= 0 {
+			return errors.New("MinCost should increase with the level")
+		}
+		if tier.Discount.Sign() < 0 || tier.Discount.Cmp(decimal.FromInt(100)) > 0 {
+			return errors.New("Discount should be between 0 and 100")
+		}
+	}
+	if c.RequalifyPeriod < 0 {
+		return errors.New("RequalifyPeriod should not be negative")
+	}
+	return nil
+}
+
+// 消费对应的等级
+func (c VIPConfig) levelFor(cost decimal.Decimal) string {
+	level := VIPLevel0
+	for _, tier := range c.Tiers {
+		if cost.Cmp(tier.MinCost) >= 0 {
+			level = tier.Level
+		}
+	}
+	return level
+}
+
+func (c VIPConfig) tier(level string) (VIPTier, bool) {
+	for _, tier := range c.Tiers {
+		if tier.Level == level {
+			return tier, true
+		}
+	}
+	return VIPTier{}, false
+}
+
+// 交易时间(unix毫秒), 所有背书节点一致
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txtime.Of(ts), nil
+}
+
+// 读取等级配置, 未配置时使用默认值
+func (a *UsersChaincode) getVIPConfig(stub shim.ChaincodeStubInterface) (VIPConfig, error) {
+	b, err := stub.GetState(VIPConfigKey)
+	if err != nil {
+		return VIPConfig{}, err
+	}
+	if b == nil {
+		return defaultVIPConfig(), nil
+	}
+	var config VIPConfig
+	err = json.Unmarshal(b, &config)
+	return config, err
+}
+
+// 评定所依据的消费: 有重新评定周期时为周期内消费, 否则为累计消费
+func qualifyingCost(config VIPConfig, record Record) decimal.Decimal {
+	if config.RequalifyPeriod > 0 {
+		return record.PeriodCost
+	}
+	return record.Cost
+}
+
+// 消费增加后重新评定等级, 只升不降; 等级变化时返回历史记录
+func (a *UsersChaincode) promote(stub shim.ChaincodeStubInterface, record *Record) (*VIPHistoryItem, error) {
+	config, err := a.getVIPConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	cost := qualifyingCost(config, *record)
+	level := config.levelFor(cost)
+	if vipRank(level) <= vipRank(record.VIP) {
+		return nil, nil
+	}
+	return a.changeLevel(stub, record, level, VIPReasonSpend, cost)
+}
+
+// 修改等级并生成历史记录
+func (a *UsersChaincode) changeLevel(stub shim.ChaincodeStubInterface, record *Record, level, reason string, cost decimal.Decimal) (*VIPHistoryItem, error) {
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	item := &VIPHistoryItem{
+		UserID: record.ID,
+		From:   record.VIP,
+		To:     level,
+		Reason: reason,
+		Cost:   cost,
+		TxID:   stub.GetTxID(),
+		Time:   txtime.Format(now),
+	}
+	record.VIP = level
+	return item, nil
+}
+
+// 保存等级历史并发出事件
+func (a *UsersChaincode) putVIPHistory(stub shim.ChaincodeStubInterface, item *VIPHistoryItem) error {
+	key, err := stub.CreateCompositeKey(VIPHistoryIndexName, []string{item.UserID, item.TxID})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, b)
+	if err != nil {
+		return err
+	}
+	return events.Emit(stub, events.VIPChanged, events.VIPChange{
+		UserID: item.UserID,
+		From:   item.From,
+		To:     item.To,
+		Reason: item.Reason,
+		Cost:   item.Cost.String(),
+	})
+}
+
+// 设置等级配置
+// args: 0 - {VIPConfig Object}
+func (a *UsersChaincode) setVIPConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setVIPConfig args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	var config VIPConfig
+	err := schema.Strict(args[0], &config)
+	if err != nil {
+		res := getRetError("Chaincode Invoke setVIPConfig failed : ", err)
+		return shim.Error(res)
+	}
+	err = config.validate()
+	if err != nil {
+		res := getRetString(errcode.Validation, "Chaincode Invoke setVIPConfig failed : "+err.Error())
+		return shim.Error(res)
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke setVIPConfig marshal failed")
+		return shim.Error(res)
+	}
+	err = stub.PutState(VIPConfigKey, b)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke setVIPConfig put config failed")
+		return shim.Error(res)
+	}
+
+	res := getRetByte(0, "invoke setVIPConfig success")
+	return shim.Success(res)
+}
+
+// 查询等级配置
+// args: 无
+func (a *UsersChaincode) queryVIPConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	config, err := a.getVIPConfig(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "UsersChaincode queryVIPConfig get config error")
+		return shim.Error(res)
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		res := getRetString(errcode.Internal, "UsersChaincode Marshal queryVIPConfig error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 查询会员当前等级的权益
+// args: 0 - ID
+func (a *UsersChaincode) getBenefits(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "UsersChaincode getBenefits args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	err := authz.CheckSelf(stub, args[0])
+	if err != nil {
+		res := getRetError("UsersChaincode getBenefits: ", err)
+		return shim.Error(res)
+	}
+
+	record, bl := a.getRecord(stub, Record_Prefix+args[0])
+	if !bl {
+		res := getRetString(errcode.NotFound, "UsersChaincode getBenefits get record error")
+		return shim.Error(res)
+	}
+	config, err := a.getVIPConfig(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "UsersChaincode getBenefits get config error")
+		return shim.Error(res)
+	}
+
+	benefits := VIPBenefits{ID: record.ID, VIP: record.VIP}
+	if tier, ok := config.tier(record.VIP); ok {
+		benefits.Discount = tier.Discount
+	}
+	b, err := json.Marshal(benefits)
+	if err != nil {
+		res := getRetString(errcode.Internal, "UsersChaincode Marshal getBenefits error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
+
+// 周期重新评定: 周期结束后按周期内消费重新确定等级(可降级), 并开始新周期
+// args: 0 - ID
+func (a *UsersChaincode) requalify(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "Chaincode Invoke requalify args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+
+	record, existbl := a.getRecord(stub, Record_Prefix+args[0])
+	if !existbl {
+		res := getRetString(errcode.NotFound, "Chaincode Invoke requalify failed : record does not exist")
+		return shim.Error(res)
+	}
+	config, err := a.getVIPConfig(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke requalify get config error")
+		return shim.Error(res)
+	}
+	if config.RequalifyPeriod == 0 {
+		res := getRetString(errcode.BusinessRule, "Chaincode Invoke requalify failed : requalification is not configured")
+		return shim.Error(res)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		res := getRetString(errcode.Internal, "Chaincode Invoke requalify failed :get time stamp failed ")
+		return shim.Error(res)
+	}
+	start, _ := txtime.Parse(record.PeriodStart)
+	if now < start+config.RequalifyPeriod*txtime.Second {
+		res := getRetString(errcode.BusinessRule, "Chaincode Invoke requalify failed : the period has not ended")
+		return shim.Error(res)
+	}
+
+	var item *VIPHistoryItem
+	level := config.levelFor(record.PeriodCost)
+	if level != record.VIP {
+		item, err = a.changeLevel(stub, &record, level, VIPReasonRequalify, record.PeriodCost)
+		if err != nil {
+			res := getRetError("Chaincode Invoke requalify failed : ", err)
+			return shim.Error(res)
+		}
+	}
+	record.PeriodCost = decimal.Zero
+	record.PeriodStart = txtime.Format(now)
+
+	_, bl := a.putRecord(stub, Record_Prefix+args[0], record)
+	if !bl {
+		res := getRetString(errcode.Internal, "Chaincode Invoke requalify put record failed")
+		return shim.Error(res)
+	}
+	if item != nil {
+		err = a.putVIPHistory(stub, item)
+		if err != nil {
+			res := getRetString(errcode.Internal, "Chaincode Invoke requalify put history failed")
+			return shim.Error(res)
+		}
+	}
+
+	res := getRetByte(0, "invoke requalify success: "+record.VIP)
+	return shim.Success(res)
+}
+
+// 查询等级历史
+// args: 0 - ID
+func (a *UsersChaincode) queryVIPHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		res := getRetString(errcode.Validation, "UsersChaincode queryVIPHistory args!=1", errcode.Args("want 1"))
+		return shim.Error(res)
+	}
+	err := authz.CheckSelf(stub, args[0])
+	if err != nil {
+		res := getRetError("UsersChaincode queryVIPHistory: ", err)
+		return shim.Error(res)
+	}
+
+	historyIterator, err := stub.GetStateByPartialCompositeKey(VIPHistoryIndexName, []string{args[0]})
+	if err != nil {
+		res := getRetString(errcode.Internal, "UsersChaincode queryVIPHistory get history error")
+		return shim.Error(res)
+	}
+	defer historyIterator.Close()
+
+	var history = []VIPHistoryItem{}
+	for historyIterator.HasNext() {
+		kv, err := historyIterator.Next()
+		if err != nil {
+			res := getRetString(errcode.Internal, "UsersChaincode queryVIPHistory iterator error")
+			return shim.Error(res)
+		}
+		var item VIPHistoryItem
+		err = json.Unmarshal(kv.Value, &item)
+		if err != nil {
+			res := getRetString(errcode.Internal, "UsersChaincode queryVIPHistory unmarshal failed")
+			return shim.Error(res)
+		}
+		history = append(history, item)
+	}
+
+	b, err := json.Marshal(history)
+	if err != nil {
+		res := getRetString(errcode.Internal, "UsersChaincode Marshal queryVIPHistory error")
+		return shim.Error(res)
+	}
+	return shim.Success(b)
+}
@@ -2,6 +2,7 @@ from flask import (Blueprint, flash, g, redirect, render_template, request, sess
 import os
 import json
 import requests
+import uuid
 
 
 admin_bp = Blueprint('admin', __name__, template_folder='templates',
@@ -12,8 +13,30 @@ peers=["peer1.store1.aliyunbaas.com:31111"]
 channel_name="first-channel"
 commodity_cc="commodity"
 category_cc="category"
+goods_cc="goods"
 #channel_name="first-channel"
 
+# 幂等key: 每次渲染表单生成一个, 通过transient map传给链码; 超时后重新提交同一表单不会重复执行
+IDEMPOTENCY_FIELD = "idempotency_key"
+
+
+@admin_bp.app_context_processor
+def inject_idempotency_key():
+    return {"new_idempotency_key": lambda: uuid.uuid4().hex}
+
+
+def form_fields():
+    """表单字段, 不含幂等key"""
+    return {k: v for k, v in request.form.items() if k != IDEMPOTENCY_FIELD}
+
+
+def with_idempotency_key(data):
+    """表单带有幂等key时放入transient map"""
+    key = request.form.get(IDEMPOTENCY_FIELD, "")
+    if key:
+        data["transient"] = {"idempotency-key": key}
+    return data
+
 
 '''页面'''
 #主页
@@ -52,26 +75,27 @@ def purchase():
 
 
 '''表单处理'''
-#处理注册
+#处理注册: 由已登录的管理员(或CA注册管理员)创建员工, 证书中写入role与storeID属性
 @admin_bp.route('/register', methods=['POST'])
 def register():
-    user = request.form['name']
-    pwd = request.form['password']
-    org = orgName
-    res = requests.post("http://localhost:4000/register",
-                        "username=%s&orgName=%s&password=%s" % (user, org, pwd),
-                        headers={"content-type": "application/x-www-form-urlencoded"})
+    token = request.cookies.get('token')
+    if not token:
+        return render_template("login.html")
+    headers = {"authorization": "Bearer " + token, "content-type": "application/json"}
+    data = {
+        "username": request.form['name'],
+        "password": request.form['password'],
+        "role": request.form['role'],
+        "storeID": request.form.get('storeID', '')
+    }
+    res = requests.post("http://localhost:4000/staff", data=json.dumps(data), headers=headers)
     if res.status_code != 200:
         return render_template("error.html", message="status_code: " + str(res.status_code) + res.text)
     restext = json.loads(res.text)
     print(restext)
     if restext['success'] != True:
         return render_template("error.html", message=restext['message'])
-
-    resp = make_response(redirect("admin"))
-    resp.set_cookie('name', user, max_age=3600)
-    resp.set_cookie('token', restext['token'], max_age=3600)
-    return resp
+    return redirect(url_for("admin.info", message=restext['message']))
 
 
 #登录页面
@@ -155,6 +179,7 @@ def delete_category():
         "fcn": "delete",
         "args": [request.form['id'], request.form['store_id']]
     }
+    with_idempotency_key(data)
     #post
     res=requests.post("http://localhost:4000/channels/%s/chaincodes/%s"%(channel_name,chaincode_name),data=json.dumps(data),headers=headers)
     if res.status_code != 200:
@@ -182,8 +207,9 @@ def insert_category():
     data = {
         "peers": peers,
         "fcn": "insert",
-        "args": [json.dumps(request.form)]
+        "args": [json.dumps(form_fields())]
     }
+    with_idempotency_key(data)
     # post
     res = requests.post("http://localhost:4000/channels/%s/chaincodes/%s" % (channel_name, chaincode_name), data=json.dumps(data),
                         headers=headers)
@@ -209,11 +235,14 @@ def change_category():
     headers = {"authorization": "Bearer " + token, "content-type": "application/json"}
 
     chaincode_name = "category"
+    # merge patch: 只提交填写了的字段, 库存等由链码维护; Version为查询时读到的版本
+    patch = {k: v for k, v in form_fields().items() if v != "" and k not in ("Stock", "StoreName")}
     data = {
         "peers": peers,
         "fcn": "change",
-        "args": [json.dumps(request.form)]
+        "args": [json.dumps(patch)]
     }
+    with_idempotency_key(data)
     # post
     res = requests.post("http://localhost:4000/channels/%s/chaincodes/%s" % (channel_name, chaincode_name), data=json.dumps(data),
                         headers=headers)
@@ -238,13 +267,14 @@ def purchase_commodity():
     token = request.cookies.get('token')
     headers = {"authorization": "Bearer " + token, "content-type": "application/json"}
 
-    #登记进货
-    chaincode_name = "commodity"
+    #登记进货并增加库存, 在同一交易中完成
+    chaincode_name = goods_cc
     data = {
         "peers": peers,
-        "fcn": "insert",
-        "args": [json.dumps(request.form)]
+        "fcn": "purchase",
+        "args": [json.dumps(form_fields())]
     }
+    with_idempotency_key(data)
     # post
     try:
         res = requests.post("http://localhost:4000/channels/%s/chaincodes/%s" % (channel_name, chaincode_name), data=json.dumps(data),
@@ -254,35 +284,14 @@ def purchase_commodity():
     if res.status_code != 200:
         return render_template("error.html", message="status_code: " + str(res.status_code) + res.text)
 
-    # 增加库存
-    chaincode_name = "category"
-    data = {
-        "peers": peers,
-        "fcn": "changeStock",
-        "args": [request.form['Category'],request.form['StoreID'],"1","add"]
-    }
-    # post
-    try:
-        res2 = requests.post("http://localhost:4000/channels/%s/chaincodes/%s" % (channel_name, chaincode_name),
-                            data=json.dumps(data),
-                            headers=headers)
-    except Exception as e:
-        return render_template("error.html", message=e)
-    if res2.status_code != 200:
-        return render_template("error.html", message="status_code: " + str(res2.status_code) + res2.text)
-
     try:
         restext = json.loads(res.text)
-        res2text = json.loads(res2.text)
         print(restext)
-        print(res2text)
         if restext['success'] != True:
             return render_template("error.html", message=restext['message'])
-        if res2text['success'] != True:
-            return render_template("error.html", message=res2text['message'])
-        return redirect(url_for("admin.info", message=restext['message']+'\n'+res2text['message']))
+        return redirect(url_for("admin.info", message=restext['message']))
     except:
-        return render_template("error.html", message=res.text+'\n'+res2.text)
+        return render_template("error.html", message=res.text)
 
 
 #卖货处理
@@ -293,13 +302,14 @@ def sell():
     token = request.cookies.get('token')
     headers = {"authorization": "Bearer " + token, "content-type": "application/json"}
 
-    #删除货物
-    chaincode_name = "commodity"
+    #删除货物并减少库存, 在同一交易中完成
+    chaincode_name = goods_cc
     data = {
         "peers": peers,
-        "fcn": "delete",
+        "fcn": "sell",
         "args": [request.form['ID']]
     }
+    with_idempotency_key(data)
     # post
     try:
         res = requests.post("http://localhost:4000/channels/%s/chaincodes/%s" % (channel_name, chaincode_name), data=json.dumps(data),
@@ -309,33 +319,11 @@ def sell():
     if res.status_code != 200:
         return render_template("error.html", message="status_code: " + str(res.status_code) + res.text)
 
-    # 减少库存
-    chaincode_name = "category"
-    data = {
-        "peers": peers,
-        "fcn": "changeStock",
-        "args": [request.form['Category'],request.form['StoreID'],"1","reduce"]
-    }
-    # post
-    try:
-        res2 = requests.post("http://localhost:4000/channels/%s/chaincodes/%s" % (channel_name, chaincode_name),
-                            data=json.dumps(data),
-                            headers=headers)
-    except Exception as e:
-        return render_template("error.html", message=e)
-    if res2.status_code != 200:
-        return render_template("error.html", message="status_code: " + str(res2.status_code) + res2.text)
-
     try:
         restext = json.loads(res.text)
-        res2text = json.loads(res2.text)
         print(restext)
-        print(res2text)
         if restext['success'] != True:
             return render_template("error.html", message=restext['message'])
-        if res2text['success'] != True:
-            return render_template("error.html", message=res2text['message'])
-        return redirect(url_for("admin.info", message=restext['message']+'\n'+res2text['message']))
+        return redirect(url_for("admin.info", message=restext['message']))
     except:
-        return render_template("error.html", message=res.text+'\n'+res2.text)
-
+        return render_template("error.html", message=res.text)
@@ -79,7 +79,8 @@ def register():
     user = request.form['ID']
     pwd = request.form['Password']
     org = orgName
-    res = requests.post("http://localhost:4000/users",
+    # 注册为顾客, 证书中写入role=customer
+    res = requests.post("http://localhost:4000/register",
                         "username=%s&orgName=%s&password=%s" % (user, org, pwd),
                         headers={"content-type": "application/x-www-form-urlencoded"})
     if res.status_code != 200:
@@ -95,10 +96,14 @@ def register():
     print(token)
     headers = {"authorization": "Bearer " + token, "content-type": "application/json"}
 
+    # 密码通过transient map传入, 不写入交易参数
+    record = request.form.to_dict()
+    record.pop('Password', None)
     data = {
         "peers": peers,
         "fcn": "insert",
-        "args": [json.dumps(request.form)]
+        "args": [json.dumps(record)],
+        "transient": {"password": pwd}
     }
     # post
     try: